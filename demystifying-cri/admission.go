@@ -0,0 +1,160 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sandboxFeature is a field of a sandbox config the runtime doesn't implement and would otherwise silently ignore
+type sandboxFeature struct {
+	field string
+	used  func(config *runtime.PodSandboxConfig) bool
+}
+
+// containerFeature is a field of a container config the runtime doesn't implement and would otherwise silently ignore
+type containerFeature struct {
+	field string
+	used  func(config *runtime.ContainerConfig) bool
+}
+
+// unsupportedSandboxFeatures are checked by --reject-unsupported before a sandbox is created
+var unsupportedSandboxFeatures = []sandboxFeature{
+	{"linux.security_context.privileged", func(c *runtime.PodSandboxConfig) bool {
+		return c.GetLinux().GetSecurityContext().GetPrivileged()
+	}},
+	{"linux.security_context.readonly_rootfs", func(c *runtime.PodSandboxConfig) bool {
+		return c.GetLinux().GetSecurityContext().GetReadonlyRootfs()
+	}},
+	{"linux.security_context.seccomp_profile_path", func(c *runtime.PodSandboxConfig) bool {
+		return c.GetLinux().GetSecurityContext().GetSeccompProfilePath() != ""
+	}},
+	{"linux.security_context.namespace_options.pid", func(c *runtime.PodSandboxConfig) bool {
+		return c.GetLinux().GetSecurityContext().GetNamespaceOptions().GetPid() == runtime.NamespaceMode_NODE
+	}},
+	{"linux.security_context.namespace_options.ipc", func(c *runtime.PodSandboxConfig) bool {
+		return c.GetLinux().GetSecurityContext().GetNamespaceOptions().GetIpc() == runtime.NamespaceMode_NODE
+	}},
+	{"linux.security_context.namespace_options.userns_options", func(c *runtime.PodSandboxConfig) bool {
+		return usesUserNamespace(c.GetLinux().GetSecurityContext().GetNamespaceOptions())
+	}},
+	{"linux.sysctls", func(c *runtime.PodSandboxConfig) bool {
+		return len(c.GetLinux().GetSysctls()) > 0
+	}},
+	// Shaping needs the pod's interface, which only exists once a CNI plugin set up its network
+	{"annotations." + ingressBandwidthAnnotation, func(c *runtime.PodSandboxConfig) bool {
+		return c.GetAnnotations()[ingressBandwidthAnnotation] != ""
+	}},
+	{"annotations." + egressBandwidthAnnotation, func(c *runtime.PodSandboxConfig) bool {
+		return c.GetAnnotations()[egressBandwidthAnnotation] != ""
+	}},
+}
+
+// Annotations Kubernetes uses to limit the bandwidth of a pod through the CNI bandwidth plugin
+const (
+	ingressBandwidthAnnotation = "kubernetes.io/ingress-bandwidth"
+	egressBandwidthAnnotation  = "kubernetes.io/egress-bandwidth"
+)
+
+// unsupportedContainerFeatures are checked by --reject-unsupported before a container is created
+var unsupportedContainerFeatures = []containerFeature{
+	{"linux.security_context.privileged", func(c *runtime.ContainerConfig) bool {
+		return c.GetLinux().GetSecurityContext().GetPrivileged()
+	}},
+	{"linux.security_context.capabilities", func(c *runtime.ContainerConfig) bool {
+		capabilities := c.GetLinux().GetSecurityContext().GetCapabilities()
+		return len(capabilities.GetAddCapabilities()) > 0 || len(capabilities.GetDropCapabilities()) > 0 ||
+			len(capabilities.GetAddAmbientCapabilities()) > 0
+	}},
+	{"linux.security_context.readonly_rootfs", func(c *runtime.ContainerConfig) bool {
+		return c.GetLinux().GetSecurityContext().GetReadonlyRootfs()
+	}},
+	{"linux.security_context.apparmor_profile", func(c *runtime.ContainerConfig) bool {
+		return c.GetLinux().GetSecurityContext().GetApparmorProfile() != ""
+	}},
+	{"linux.security_context.seccomp_profile_path", func(c *runtime.ContainerConfig) bool {
+		return c.GetLinux().GetSecurityContext().GetSeccompProfilePath() != ""
+	}},
+	{"linux.security_context.namespace_options.userns_options", func(c *runtime.ContainerConfig) bool {
+		return usesUserNamespace(c.GetLinux().GetSecurityContext().GetNamespaceOptions())
+	}},
+	{"devices", func(c *runtime.ContainerConfig) bool {
+		return len(c.GetDevices()) > 0
+	}},
+	{"CDI_devices", func(c *runtime.ContainerConfig) bool {
+		return len(c.GetCDIDevices()) > 0
+	}},
+	{"mounts.selinux_relabel", func(c *runtime.ContainerConfig) bool {
+		return slices.ContainsFunc(c.GetMounts(), func(m *runtime.Mount) bool { return m.GetSelinuxRelabel() })
+	}},
+	{"mounts.recursive_read_only", func(c *runtime.ContainerConfig) bool {
+		return slices.ContainsFunc(c.GetMounts(), func(m *runtime.Mount) bool { return m.GetRecursiveReadOnly() })
+	}},
+	{"mounts.uidMappings", func(c *runtime.ContainerConfig) bool {
+		return slices.ContainsFunc(c.GetMounts(), func(m *runtime.Mount) bool { return len(m.GetUidMappings()) > 0 || len(m.GetGidMappings()) > 0 })
+	}},
+	{"mounts.image", func(c *runtime.ContainerConfig) bool {
+		return slices.ContainsFunc(c.GetMounts(), func(m *runtime.Mount) bool { return m.GetImage() != nil })
+	}},
+}
+
+// usesUserNamespace reports whether a pod asks for a user namespace of its own, NODE being the default
+func usesUserNamespace(options *runtime.NamespaceOption) bool {
+	userns := options.GetUsernsOptions()
+	return userns != nil && userns.GetMode() != runtime.NamespaceMode_NODE
+}
+
+// admitSandbox rejects a sandbox config meant for Windows, and one using unsupported features if --reject-unsupported is set
+func (s *DemystifyingCRI) admitSandbox(config *runtime.PodSandboxConfig) error {
+	if config.GetWindows() != nil {
+		return windowsError("sandbox " + config.GetMetadata().GetName())
+	}
+	if !s.rejectUnsupported {
+		return nil
+	}
+	var used, checked []string
+	for _, feature := range unsupportedSandboxFeatures {
+		checked = append(checked, feature.field)
+		if feature.used(config) {
+			used = append(used, feature.field)
+		}
+	}
+	return unsupportedError("sandbox "+config.GetMetadata().GetName(), used, checked)
+}
+
+// admitContainer rejects a container config meant for Windows, and one using unsupported features if --reject-unsupported is set
+func (s *DemystifyingCRI) admitContainer(config *runtime.ContainerConfig) error {
+	if config.GetWindows() != nil {
+		return windowsError("container " + config.GetMetadata().GetName())
+	}
+	if !s.rejectUnsupported {
+		return nil
+	}
+	var used, checked []string
+	for _, feature := range unsupportedContainerFeatures {
+		checked = append(checked, feature.field)
+		if feature.used(config) {
+			used = append(used, feature.field)
+		}
+	}
+	return unsupportedError("container "+config.GetMetadata().GetName(), used, checked)
+}
+
+// windowsError returns an Unimplemented error for a request carrying Windows specific config
+// Unlike the fields checked by --reject-unsupported this config is never silently ignored, as nothing of it could apply to a Linux container
+func windowsError(subject string) error {
+	return status.Errorf(codes.Unimplemented, "%s carries Windows config, but this runtime only runs Linux containers", subject)
+}
+
+// unsupportedError returns an Unimplemented error naming the used fields and all fields that were checked
+func unsupportedError(subject string, used, checked []string) error {
+	if len(used) == 0 {
+		return nil
+	}
+	return status.Errorf(codes.Unimplemented, "%s uses fields this runtime doesn't implement: %s (checked fields: %s)",
+		subject, strings.Join(used, ", "), strings.Join(checked, ", "))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWindowsConfigIsRejected(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+	containerID := createTestContainer(t, s, "app")
+	calls := len(oci.calls)
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"sandbox", func() error {
+			_, err := s.RunPodSandbox(ctx, &runtime.RunPodSandboxRequest{Config: &runtime.PodSandboxConfig{
+				Metadata: &runtime.PodSandboxMetadata{Name: "windows", Namespace: "default", Uid: "windows"},
+				Windows:  &runtime.WindowsPodSandboxConfig{},
+			}})
+			return err
+		}},
+		{"container", func() error {
+			_, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+				PodSandboxId: "sandbox",
+				Config: &runtime.ContainerConfig{
+					Metadata: &runtime.ContainerMetadata{Name: "windows"},
+					Image:    &runtime.ImageSpec{Image: testImage},
+					Windows:  &runtime.WindowsContainerConfig{},
+				},
+			})
+			return err
+		}},
+		{"update", func() error {
+			_, err := s.UpdateContainerResources(ctx, &runtime.UpdateContainerResourcesRequest{
+				ContainerId: containerID,
+				Windows:     &runtime.WindowsContainerResources{CpuShares: 2},
+			})
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+			if status.Code(err) != codes.Unimplemented || !strings.Contains(err.Error(), "only runs Linux containers") {
+				t.Errorf("error = %v, want Unimplemented explaining the runtime only runs Linux containers", err)
+			}
+		})
+	}
+	if len(oci.calls) != calls {
+		t.Errorf("runtime calls = %q, want none for the rejected requests", oci.calls[calls:])
+	}
+}
+
+func TestBandwidthAnnotationsAreUnsupported(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		want        codes.Code
+	}{
+		{nil, codes.OK},
+		{map[string]string{ingressBandwidthAnnotation: "10M"}, codes.Unimplemented},
+		{map[string]string{egressBandwidthAnnotation: "1G"}, codes.Unimplemented},
+		{map[string]string{ingressBandwidthAnnotation: ""}, codes.OK},
+	}
+	for _, test := range tests {
+		s := &DemystifyingCRI{rejectUnsupported: true}
+		config := &runtime.PodSandboxConfig{Metadata: &runtime.PodSandboxMetadata{Name: "pod"}, Annotations: test.annotations}
+		if err := s.admitSandbox(config); status.Code(err) != test.want {
+			t.Errorf("admitSandbox with annotations %v = %v, want code %v", test.annotations, err, test.want)
+		}
+
+		// Without --reject-unsupported the pod runs unshaped
+		s.rejectUnsupported = false
+		if err := s.admitSandbox(config); err != nil {
+			t.Errorf("admitSandbox with annotations %v without --reject-unsupported = %v, want no error", test.annotations, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// terminalSize is a resize event of an attached client's terminal
+type terminalSize struct {
+	Width  uint16
+	Height uint16
+}
+
+// attachContainer connects a client to the stdio of a container until either side closes
+// Output goes to stdout, stdin may be nil and every event on resize is applied to the terminal
+// Containers without a TTY get their output passed on from the log and their input written to the stdin pipe
+// Returning only detaches the client, the container keeps running unless it was created with StdinOnce
+func (s *DemystifyingCRI) attachContainer(containerID string, stdin io.Reader, stdout io.Writer, resize <-chan terminalSize) error {
+	stdio, containerLog, err := s.attachTarget(containerID)
+	if err != nil {
+		return err
+	}
+	if !stdio.attached.CompareAndSwap(false, true) {
+		return status.Errorf(codes.FailedPrecondition, "container %s is already attached", containerID)
+	}
+	defer stdio.attached.Store(false)
+
+	// With StdinOnce the first client owns stdin, so its end is the end of the container's input
+	if stdio.stdinOnce {
+		defer stdio.closeStdin()
+	}
+	if stdio.stdinClosed.Load() {
+		stdin = nil
+	}
+
+	if stdio.console != nil {
+		return attachTerminal(stdio.console, stdin, stdout, resize)
+	}
+
+	output, detach := containerLog.attach()
+	defer detach()
+
+	// The end of the client's input detaches it, except with StdinOnce, where it ends the container's input instead
+	// The output is passed on until the container closes it or the client goes away
+	inputDone := make(chan struct{})
+	if stdin != nil && stdio.stdin != nil {
+		go func() {
+			io.Copy(stdio.stdin, stdin)
+			close(inputDone)
+		}()
+	}
+
+	for {
+		select {
+		case data, ok := <-output:
+			if !ok {
+				return nil
+			}
+			if _, err := stdout.Write(data); err != nil {
+				return nil
+			}
+		case <-inputDone:
+			if !stdio.stdinOnce {
+				return nil
+			}
+			stdio.closeStdin()
+			inputDone = nil
+		}
+	}
+}
+
+// attachTerminal connects a client to the terminal of a container until either side closes
+func attachTerminal(console *os.File, stdin io.Reader, stdout io.Writer, resize <-chan terminalSize) error {
+	// A previous client left an expired deadline behind to detach
+	console.SetReadDeadline(time.Time{})
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(stdout, console)
+		done <- struct{}{}
+	}()
+	if stdin != nil {
+		go func() {
+			io.Copy(console, stdin)
+			done <- struct{}{}
+		}()
+	}
+
+	for {
+		select {
+		case size, ok := <-resize:
+			if !ok {
+				resize = nil
+				continue
+			}
+			if err := setTerminalSize(console, size); err != nil {
+				return err
+			}
+		case <-done:
+			// Unblock the pending read instead of closing the terminal, which would hang up the container
+			console.SetReadDeadline(time.Now())
+			return nil
+		}
+	}
+}
+
+// attachTarget returns the stdio and log of a container a client can attach to
+// Either a terminal or a log is required, as there would be nothing to read from otherwise
+func (s *DemystifyingCRI) attachTarget(containerID string) (*containerStdio, *containerLog, error) {
+	s.mu.RLock()
+	container, exists := s.containers[containerID]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, nil, status.Errorf(codes.NotFound, "container %s does not exist", containerID)
+	}
+	if container.stdio.console == nil && container.log == nil {
+		return nil, nil, status.Errorf(codes.FailedPrecondition, "container %s has neither a TTY nor a log to attach to", containerID)
+	}
+	return container.stdio, container.log, nil
+}
+
+// resizeTerminal applies a new size to the terminal of a container
+func (s *DemystifyingCRI) resizeTerminal(containerID string, size terminalSize) error {
+	stdio, err := s.containerTerminal(containerID)
+	if err != nil {
+		return err
+	}
+	return setTerminalSize(stdio.console, size)
+}
+
+// containerTerminal returns the stdio of a container which was started with a TTY
+func (s *DemystifyingCRI) containerTerminal(containerID string) (*containerStdio, error) {
+	s.mu.RLock()
+	container, exists := s.containers[containerID]
+	s.mu.RUnlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "container %s does not exist", containerID)
+	}
+	if container.stdio.console == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %s was not started with a TTY", containerID)
+	}
+	return container.stdio, nil
+}
+
+// setTerminalSize sets the window size of a terminal with TIOCSWINSZ
+// The raw fd is only borrowed, as Fd would switch the terminal to blocking mode and break read deadlines
+func setTerminalSize(console *os.File, size terminalSize) error {
+	conn, err := console.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		ioctlErr = unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, &unix.Winsize{Row: size.Height, Col: size.Width})
+	})
+	if err != nil {
+		return err
+	}
+	return ioctlErr
+}
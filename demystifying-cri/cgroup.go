@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// defaultCgroupParent is where pods are placed if Kubelet did not pass a CgroupParent
+const defaultCgroupParent = "/demystifying-cri"
+
+// containerCgroupsPath returns the cgroupsPath set in the OCI spec of a sandbox or container
+// Both are placed directly below the pod's cgroup parent, so the QoS cgroup accounts for all of them
+func containerCgroupsPath(parent, containerID string) string {
+	return filepath.Join(parent, containerID)
+}
+
+// resolveCgroupParent returns the cgroup path of the CgroupParent passed by Kubelet
+// The systemd driver passes slice names like kubepods-burstable-pod123.slice, which are expanded to their path
+func resolveCgroupParent(parent string) (string, error) {
+	if parent == "" {
+		return defaultCgroupParent, nil
+	}
+
+	if strings.HasSuffix(parent, ".slice") && !strings.Contains(parent, "/") {
+		name := strings.TrimSuffix(parent, ".slice")
+		if name == "-" {
+			return "/", nil
+		}
+		if name == "" || strings.HasPrefix(name, "-") || strings.HasSuffix(name, "-") || strings.Contains(name, "--") {
+			return "", status.Errorf(codes.InvalidArgument, "invalid cgroup parent slice %q", parent)
+		}
+		// Every dash separates a parent slice, e.g. kubepods-burstable.slice lives in kubepods.slice
+		path, prefix := "/", ""
+		for _, part := range strings.Split(name, "-") {
+			prefix += part
+			path = filepath.Join(path, prefix+".slice")
+			prefix += "-"
+		}
+		return path, nil
+	}
+
+	if !filepath.IsAbs(parent) || filepath.Clean(parent) != parent {
+		return "", status.Errorf(codes.InvalidArgument, "cgroup parent %q must be a clean absolute path or a systemd slice", parent)
+	}
+	return parent, nil
+}
+
+// ensureCgroupParent creates the cgroup parent and all cgroups above it that don't exist yet
+// On cgroup v1 the cpuset hierarchy is left to runc, as it must copy the CPUs and memory nodes into every new level
+func (s *DemystifyingCRI) ensureCgroupParent(parent string) error {
+	if s.cgroupV2 {
+		if err := os.MkdirAll(filepath.Join(cgroupRoot, parent), 0755); err != nil {
+			return fmt.Errorf("failed to create cgroup %s: %v", parent, err)
+		}
+		return nil
+	}
+
+	entries, err := os.ReadDir(cgroupRoot)
+	if err != nil {
+		return fmt.Errorf("failed to read cgroup hierarchies: %v", err)
+	}
+	for _, entry := range entries {
+		// Symlinks like cpu pointing to the combined cpu,cpuacct hierarchy are skipped, as IsDir doesn't follow them
+		if !entry.IsDir() || entry.Name() == "cpuset" || entry.Name() == "unified" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(cgroupRoot, entry.Name(), parent), 0755); err != nil {
+			return fmt.Errorf("failed to create cgroup %s in the %s hierarchy: %v", parent, entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// cgroupDir returns the directory of a cgroup on the host
+// On cgroup v1 every controller has its own hierarchy, on v2 the controller is ignored
+func (s *DemystifyingCRI) cgroupDir(cgroupsPath, controller string) string {
+	if s.cgroupV2 {
+		return filepath.Join(cgroupRoot, cgroupsPath)
+	}
+	return filepath.Join(cgroupRoot, controller, cgroupsPath)
+}
+
+// cgroupInfo describes where a cgroup is found on the host, as shown in verbose status
+type cgroupInfo struct {
+	CgroupsPath string            `json:"cgroupsPath"`           // Path below the cgroup root, as in linux.cgroupsPath of the OCI spec
+	Dir         string            `json:"dir,omitempty"`         // Directory of the cgroup on cgroup v2
+	Controllers map[string]string `json:"controllers,omitempty"` // Directory of the cgroup in every hierarchy on cgroup v1
+}
+
+// describeCgroup returns the directories of the cgroup at cgroupsPath, which may not exist anymore if its container is gone
+func (s *DemystifyingCRI) describeCgroup(cgroupsPath string) (*cgroupInfo, error) {
+	info := &cgroupInfo{CgroupsPath: cgroupsPath}
+	if s.cgroupV2 {
+		info.Dir = s.cgroupDir(cgroupsPath, "")
+		return info, nil
+	}
+
+	entries, err := os.ReadDir(cgroupRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgroup hierarchies: %v", err)
+	}
+	info.Controllers = make(map[string]string)
+	for _, entry := range entries {
+		// Symlinks like cpu pointing to the combined cpu,cpuacct hierarchy are skipped, it is listed under its own name
+		if entry.IsDir() {
+			info.Controllers[entry.Name()] = s.cgroupDir(cgroupsPath, entry.Name())
+		}
+	}
+	return info, nil
+}
+
+// setCgroupInfo stores where the cgroup of an OCI spec is found under key, nothing is stored for specs without cgroup like rootless ones
+func (s *DemystifyingCRI) setCgroupInfo(info map[string]string, key string, spec *rspec.Spec) error {
+	if spec.Linux == nil || spec.Linux.CgroupsPath == "" {
+		return nil
+	}
+	cgroup, err := s.describeCgroup(spec.Linux.CgroupsPath)
+	if err != nil {
+		return err
+	}
+	return setInfoJSON(info, key, cgroup)
+}
+
+// readCgroupUint reads a cgroup file containing a single number
+func readCgroupUint(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCgroupKeyValues reads a flat keyed cgroup file like memory.stat or cpu.stat
+func readCgroupKeyValues(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), " ")
+		if !found {
+			continue
+		}
+		if v, err := strconv.ParseUint(value, 10, 64); err == nil {
+			values[key] = v
+		}
+	}
+
+	return values, scanner.Err()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContainerCgroupsPathIsBelowCgroupParent(t *testing.T) {
+	tests := []struct {
+		cgroupParent string
+		want         string // Directory the container's cgroup must be placed in
+	}{
+		{"", defaultCgroupParent},
+		{"/kubepods/burstable/poduid", "/kubepods/burstable/poduid"},
+		{"kubepods-besteffort-poduid.slice", "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-poduid.slice"},
+	}
+	for _, test := range tests {
+		s, _ := newTestRuntime(t)
+		s.sandboxes["sandbox"].config.Linux = &runtime.LinuxPodSandboxConfig{CgroupParent: test.cgroupParent}
+
+		containerID := createTestContainer(t, s, "app")
+		if got := containerSpec(t, s, containerID).Linux.CgroupsPath; got != test.want+"/"+containerID {
+			t.Errorf("cgroupsPath with CgroupParent %q = %q, want %q", test.cgroupParent, got, test.want+"/"+containerID)
+		}
+	}
+}
+
+func TestResolveCgroupParent(t *testing.T) {
+	tests := []struct {
+		parent string
+		want   string
+	}{
+		{"", defaultCgroupParent},
+		{"/kubepods", "/kubepods"},
+		{"-.slice", "/"},
+		{"kubepods.slice", "/kubepods.slice"},
+		{"kubepods-burstable.slice", "/kubepods.slice/kubepods-burstable.slice"},
+	}
+	for _, test := range tests {
+		if got, err := resolveCgroupParent(test.parent); err != nil || got != test.want {
+			t.Errorf("resolveCgroupParent(%q) = %q, %v, want %q", test.parent, got, err, test.want)
+		}
+	}
+
+	for _, parent := range []string{"kubepods", "/kubepods/../etc", "/kubepods/", "-kubepods.slice", "kubepods--burstable.slice", "kubepods-.slice"} {
+		if _, err := resolveCgroupParent(parent); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("resolveCgroupParent(%q) = %v, want InvalidArgument", parent, err)
+		}
+	}
+}
+
+func TestStatusReportsCgroupOfSpec(t *testing.T) {
+	for _, cgroupV2 := range []bool{false, true} {
+		s, _ := newTestRuntime(t)
+		s.cgroupV2 = cgroupV2
+		ctx := context.Background()
+
+		containerID := createTestContainer(t, s, "app")
+		resp, err := s.ContainerStatus(ctx, &runtime.ContainerStatusRequest{ContainerId: containerID, Verbose: true})
+		if err != nil {
+			t.Fatalf("ContainerStatus: %v", err)
+		}
+		checkCgroupInfo(t, s, resp.Info["cgroup"], containerSpec(t, s, containerID).Linux.CgroupsPath)
+
+		// The pause process sits directly below the pod's cgroup
+		sandboxSpec := `{"ociVersion": "1.0.2", "linux": {"cgroupsPath": "/kubepods/burstable/poduid/sandbox"}}`
+		if err := os.MkdirAll(filepath.Join(s.runtimeRoot, "sandbox"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(s.runtimeRoot, "sandbox", "config.json"), []byte(sandboxSpec), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sandbox, err := s.PodSandboxStatus(ctx, &runtime.PodSandboxStatusRequest{PodSandboxId: "sandbox", Verbose: true})
+		if err != nil {
+			t.Fatalf("PodSandboxStatus: %v", err)
+		}
+		checkCgroupInfo(t, s, sandbox.Info["cgroup"], "/kubepods/burstable/poduid/sandbox")
+		checkCgroupInfo(t, s, sandbox.Info["podCgroup"], "/kubepods/burstable/poduid")
+	}
+}
+
+// checkCgroupInfo checks that reported describes the cgroup at cgroupsPath
+func checkCgroupInfo(t *testing.T, s *DemystifyingCRI, reported, cgroupsPath string) {
+	t.Helper()
+	var info cgroupInfo
+	if err := json.Unmarshal([]byte(reported), &info); err != nil {
+		t.Fatalf("cgroup in verbose info %q: %v", reported, err)
+	}
+	if info.CgroupsPath != cgroupsPath {
+		t.Errorf("reported cgroupsPath = %q, want %q of the spec", info.CgroupsPath, cgroupsPath)
+	}
+	if s.cgroupV2 {
+		if want := filepath.Join(cgroupRoot, cgroupsPath); info.Dir != want {
+			t.Errorf("reported cgroup v2 directory = %q, want %q", info.Dir, want)
+		}
+		return
+	}
+	for controller, dir := range info.Controllers {
+		if want := filepath.Join(cgroupRoot, controller, cgroupsPath); dir != want {
+			t.Errorf("reported directory of the %s controller = %q, want %q", controller, dir, want)
+		}
+	}
+}
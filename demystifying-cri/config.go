@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// fileConfig holds settings which are too structured for flags, loaded from the file given by --config
+type fileConfig struct {
+	Hooks      []hookConfig              `json:"hooks,omitempty"`      // OCI hooks added to every matching container
+	Registries map[string]registryLimits `json:"registries,omitempty"` // Pull limits per registry host, overriding the flags
+	RPCBudgets map[string]string         `json:"rpcBudgets,omitempty"` // Latency budgets per RPC method like 30s, overriding --slow-rpc-budget
+
+	rpcBudgets map[string]time.Duration // Parsed RPCBudgets
+}
+
+// hookConfig is an OCI hook together with the lifecycle stage and containers it applies to
+type hookConfig struct {
+	rspec.Hook
+
+	Stage string `json:"stage"`           // One of prestart, poststart or poststop
+	Scope string `json:"scope,omitempty"` // One of all (default), sandbox or container
+}
+
+// loadConfig reads and validates the config file, an empty path results in an empty config
+func loadConfig(path string) (*fileConfig, error) {
+	config := &fileConfig{rpcBudgets: make(map[string]time.Duration)}
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	for _, hook := range config.Hooks {
+		if hook.Path == "" {
+			return nil, fmt.Errorf("hook without path in config file %s", path)
+		}
+		switch hook.Stage {
+		case "prestart", "poststart", "poststop":
+		default:
+			return nil, fmt.Errorf("unknown stage %q of hook %s", hook.Stage, hook.Path)
+		}
+		switch hook.Scope {
+		case "", "all", "sandbox", "container":
+		default:
+			return nil, fmt.Errorf("unknown scope %q of hook %s", hook.Scope, hook.Path)
+		}
+	}
+
+	for host, limits := range config.Registries {
+		if limits.MaxConcurrentPulls < 0 || limits.PullsPerMinute < 0 {
+			return nil, fmt.Errorf("negative pull limit of registry %s in config file %s", host, path)
+		}
+	}
+
+	for method, value := range config.RPCBudgets {
+		budget, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency budget of %s in config file %s: %v", method, path, err)
+		}
+		config.rpcBudgets[method] = budget
+	}
+
+	return config, nil
+}
+
+// applyHooks adds the configured hooks to the OCI spec of a sandbox or a regular container
+func (s *DemystifyingCRI) applyHooks(g *generate.Generator, sandbox bool) error {
+	for _, hook := range s.config.Load().Hooks {
+		if (hook.Scope == "sandbox" && !sandbox) || (hook.Scope == "container" && sandbox) {
+			continue
+		}
+
+		var err error
+		switch hook.Stage {
+		case "prestart":
+			err = g.AddPreStartHook(hook.Hook)
+		case "poststart":
+			err = g.AddPostStartHook(hook.Hook)
+		case "poststop":
+			err = g.AddPostStopHook(hook.Hook)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add %s hook %s: %v", hook.Stage, hook.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// effectiveConfig describes the configuration the runtime is actually running with, as shown by crictl info
+type effectiveConfig struct {
+	RuntimeRoot         string       `json:"runtimeRoot"`
+	ImageRoot           string       `json:"imageRoot"`
+	SandboxImage        string       `json:"sandboxImage"`
+	SandboxPullPolicy   string       `json:"sandboxImagePullPolicy"`
+	RuntimeBinary       string       `json:"runtimeBinary"`
+	RuntimeStateRoot    string       `json:"runtimeStateRoot,omitempty"`
+	PullBackend         string       `json:"pullBackend"`
+	UnpackBackend       string       `json:"unpackBackend"`
+	CgroupV2            bool         `json:"cgroupV2"`
+	CgroupDriver        string       `json:"cgroupDriver"`
+	SwapAccounting      bool         `json:"swapAccounting"`
+	SELinux             bool         `json:"selinux"`
+	NetworkPlugin       string       `json:"networkPlugin"`
+	HostPortDNAT        bool         `json:"hostPortDNAT"`
+	CNIConfDir          string       `json:"cniConfDir"`
+	CNIConfigured       bool         `json:"cniConfigured"`
+	MaxPods             int          `json:"maxPods"`
+	MaxContainersPerPod int          `json:"maxContainersPerPod"`
+	DebugSocket         string       `json:"debugSocket,omitempty"`
+	TCPAddress          string       `json:"tcpAddress,omitempty"`
+	Authfile            string       `json:"authfile,omitempty"`
+	ImageSourceDir      string       `json:"imageSourceDir,omitempty"`
+	KeepBundles         int          `json:"keepBundles"`
+	SharedRootfs        bool         `json:"sharedRootfs"`
+	Rootless            bool         `json:"rootless"`
+	PullTimeout         string       `json:"imagePullTimeout"`
+	SandboxPullTimeout  string       `json:"sandboxImagePullTimeout"`
+	LogMaxSize          int64        `json:"containerLogMaxSize"`
+	LogMaxFiles         int          `json:"containerLogMaxFiles"`
+	DefaultSeccomp      string       `json:"defaultSeccompProfile,omitempty"`
+	SpecTemplate        string       `json:"specTemplate,omitempty"`
+	DefaultApparmor     string       `json:"defaultApparmorProfile,omitempty"`
+	SandboxSeccomp      string       `json:"sandboxSeccompProfile,omitempty"`
+	SandboxApparmor     string       `json:"sandboxApparmorProfile,omitempty"`
+	NoNewPrivileges     string       `json:"noNewPrivileges"`
+	RejectUnsupported   bool         `json:"rejectUnsupported"`
+	IDScheme            string       `json:"idScheme"`
+	ContainerEvents     bool         `json:"containerEvents"`
+	PostStartCheck      string       `json:"postStartCheck"`
+	SandboxOOMScoreAdj  int          `json:"sandboxOOMScoreAdj"`
+	SandboxNice         int          `json:"sandboxNice"`
+	SandboxCPUShares    uint64       `json:"sandboxCPUShares"`
+	SandboxCommand      []string     `json:"sandboxCommand,omitempty"`
+	DiskUsageTTL        string       `json:"diskUsageTTL"`
+	ReapInterval        string       `json:"reapInterval"`
+	StatsInterval       string       `json:"statsInterval"`
+	ExitEvents          bool         `json:"exitEvents"`
+	ImageGCHigh         int          `json:"imageGCHighThreshold"`
+	ImageGCLow          int          `json:"imageGCLowThreshold"`
+	ImageGCMinAge       string       `json:"imageGCMinAge"`
+	RedactedEnv         []string     `json:"redactedEnv"`
+	Ulimits             []string     `json:"defaultUlimits"`
+	Prepull             []string     `json:"prepull,omitempty"`
+	Hooks               []hookConfig `json:"hooks,omitempty"`
+
+	RegistryLimits registryLimits            `json:"registryLimits"`
+	Registries     map[string]registryLimits `json:"registries,omitempty"`
+
+	SlowRPCBudget string            `json:"slowRPCBudget"`
+	RPCBudgets    map[string]string `json:"rpcBudgets,omitempty"`
+
+	ConfigFile  string `json:"configFile,omitempty"`
+	WatchConfig string `json:"watchConfig"`
+}
+
+// effectiveConfigJSON returns the effective configuration as JSON
+// Hook environments may carry credentials, so their values are redacted
+func (s *DemystifyingCRI) effectiveConfigJSON() (string, error) {
+	config := effectiveConfig{
+		RuntimeRoot:         s.runtimeRoot,
+		ImageRoot:           s.imageRoot,
+		SandboxImage:        s.sandboxImage,
+		SandboxPullPolicy:   s.sandboxPolicy,
+		RuntimeBinary:       "runc",
+		RuntimeStateRoot:    s.runcRoot,
+		PullBackend:         s.pullBackend,
+		UnpackBackend:       s.unpackBackend,
+		CgroupV2:            s.cgroupV2,
+		CgroupDriver:        s.cgroupDriver,
+		SwapAccounting:      s.swapAccounting,
+		SELinux:             s.selinux,
+		NetworkPlugin:       s.networkPlugin,
+		HostPortDNAT:        s.hostPortDNAT,
+		CNIConfDir:          cniConfDir,
+		CNIConfigured:       s.cniConfigured,
+		MaxPods:             s.maxPods,
+		MaxContainersPerPod: s.maxContainersPerPod,
+		DebugSocket:         s.debugSocket,
+		TCPAddress:          s.tcpAddress,
+		Authfile:            s.authfile,
+		ImageSourceDir:      s.imageSource,
+		KeepBundles:         s.keepBundles,
+		SharedRootfs:        s.sharedRootfs,
+		Rootless:            s.rootless,
+		PullTimeout:         s.pullTimeout.String(),
+		SandboxPullTimeout:  s.sandboxPullTimeout.String(),
+		LogMaxSize:          s.logMaxSize,
+		LogMaxFiles:         s.logMaxFiles,
+		DefaultSeccomp:      s.defaultSeccompPath,
+		SpecTemplate:        s.specTemplatePath,
+		DefaultApparmor:     s.defaultApparmor,
+		SandboxSeccomp:      s.sandboxSeccompPath,
+		SandboxApparmor:     s.sandboxApparmor,
+		NoNewPrivileges:     s.noNewPrivileges,
+		RejectUnsupported:   s.rejectUnsupported,
+		IDScheme:            s.idScheme,
+		ContainerEvents:     s.events != nil,
+		PostStartCheck:      s.postStartCheck.String(),
+		SandboxOOMScoreAdj:  s.sandboxOOMScoreAdj,
+		SandboxNice:         s.sandboxNice,
+		SandboxCPUShares:    s.sandboxCPUShares,
+		SandboxCommand:      s.pauseCommand,
+		DiskUsageTTL:        s.diskUsage.ttl.String(),
+		ReapInterval:        s.reapInterval.String(),
+		StatsInterval:       s.statsInterval.String(),
+		ExitEvents:          s.exitEvents.Load(),
+		ImageGCHigh:         s.imageGCHigh,
+		ImageGCLow:          s.imageGCLow,
+		ImageGCMinAge:       s.imageGCMinAge.String(),
+		RedactedEnv:         s.redactedEnv,
+
+		RegistryLimits: s.pullLimiter.defaults,
+		Registries:     s.pullLimiter.hostLimits(),
+
+		SlowRPCBudget: s.slowRPCBudget.String(),
+		RPCBudgets:    s.config.Load().RPCBudgets,
+
+		ConfigFile:  s.configPath,
+		WatchConfig: s.watchInterval.String(),
+	}
+
+	config.Prepull = s.prepullImages
+	for _, limit := range s.ulimits {
+		config.Ulimits = append(config.Ulimits, limit.String())
+	}
+
+	for _, hook := range s.config.Load().Hooks {
+		redacted := hook
+		redacted.Env = nil
+		for _, env := range hook.Env {
+			name, _, _ := strings.Cut(env, "=")
+			redacted.Env = append(redacted.Env, name+"=<redacted>")
+		}
+		config.Hooks = append(config.Hooks, redacted)
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// hookPaths returns the paths of hooks
+func hookPaths(hooks []rspec.Hook) []string {
+	var paths []string
+	for _, hook := range hooks {
+		paths = append(paths, hook.Path)
+	}
+	return paths
+}
+
+func TestConfiguredHooksAreApplied(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"hooks": [
+		{"path": "/usr/bin/setup-devices", "args": ["setup-devices", "--all"], "stage": "prestart"},
+		{"path": "/usr/bin/announce-pod", "stage": "poststart", "scope": "sandbox"},
+		{"path": "/usr/bin/collect-logs", "stage": "poststop", "scope": "container", "timeout": 5}
+	]}`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	s, _ := newTestRuntime(t)
+	s.config.Store(loaded)
+	hooks := containerSpec(t, s, createTestContainer(t, s, "app")).Hooks
+	if hooks == nil {
+		t.Fatal("config.json of the container has no hooks")
+	}
+	if got := hookPaths(hooks.Prestart); !slices.Equal(got, []string{"/usr/bin/setup-devices"}) {
+		t.Errorf("prestart hooks of the container = %v, want the hook of all containers", got)
+	} else if !slices.Equal(hooks.Prestart[0].Args, []string{"setup-devices", "--all"}) {
+		t.Errorf("prestart hook args = %v, want setup-devices --all", hooks.Prestart[0].Args)
+	}
+	if got := hookPaths(hooks.Poststart); len(got) != 0 {
+		t.Errorf("poststart hooks of the container = %v, want none as they are scoped to sandboxes", got)
+	}
+	if got := hookPaths(hooks.Poststop); !slices.Equal(got, []string{"/usr/bin/collect-logs"}) || *hooks.Poststop[0].Timeout != 5 {
+		t.Errorf("poststop hooks of the container = %v, want the container hook with a timeout of 5", got)
+	}
+
+	g, err := generate.New("linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.applyHooks(&g, true); err != nil {
+		t.Fatalf("applyHooks: %v", err)
+	}
+	if got := hookPaths(g.Config.Hooks.Prestart); !slices.Equal(got, []string{"/usr/bin/setup-devices"}) {
+		t.Errorf("prestart hooks of a sandbox = %v, want the hook of all containers", got)
+	}
+	if got := hookPaths(g.Config.Hooks.Poststart); !slices.Equal(got, []string{"/usr/bin/announce-pod"}) {
+		t.Errorf("poststart hooks of a sandbox = %v, want the sandbox hook", got)
+	}
+	if got := hookPaths(g.Config.Hooks.Poststop); len(got) != 0 {
+		t.Errorf("poststop hooks of a sandbox = %v, want none as they are scoped to containers", got)
+	}
+}
+
+func TestLoadConfigRejectsInvalidHooks(t *testing.T) {
+	tests := []string{
+		`{"hooks": [{"stage": "prestart"}]}`,
+		`{"hooks": [{"path": "/bin/true", "stage": "createRuntime"}]}`,
+		`{"hooks": [{"path": "/bin/true", "stage": "prestart", "scope": "pod"}]}`,
+	}
+	for _, config := range tests {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil {
+			t.Errorf("loadConfig(%s) succeeded, want an error", config)
+		}
+	}
+}
+
+func TestWatchConfigReloadsChangedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"registries": {"docker.io": {"maxConcurrentPulls": 1}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	s, _ := newTestRuntime(t)
+	s.configPath = path
+	s.config.Store(config)
+	s.pullLimiter = newPullLimiter(registryLimits{}, config.Registries)
+	go s.watchConfig(10 * time.Millisecond)
+
+	// waitFor polls until the config of the runtime satisfies done
+	// The file is touched on every poll, so the change is seen even if the watcher took its first look after the write
+	waitFor := func(timeout time.Duration, done func(*fileConfig) bool) bool {
+		for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if done(s.config.Load()) {
+				return true
+			}
+			now := time.Now()
+			if err := os.Chtimes(path, now, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return false
+	}
+
+	updated := `{"registries": {"docker.io": {"maxConcurrentPulls": 2}, "quay.io": {"pullsPerMinute": 30}}, "rpcBudgets": {"PullImage": "5m"}}`
+	if err := os.WriteFile(path, []byte(updated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(5*time.Second, func(c *fileConfig) bool { return len(c.Registries) == 2 }) {
+		t.Fatalf("registries = %v 5s after the file changed, want the ones of the new file", s.config.Load().Registries)
+	}
+	if budget := s.config.Load().rpcBudgets["PullImage"]; budget != 5*time.Minute {
+		t.Errorf("latency budget of PullImage = %v, want 5m", budget)
+	}
+	if limits := s.pullLimiter.hostLimits()["docker.io"]; limits.MaxConcurrentPulls != 2 {
+		t.Errorf("pull limits of docker.io = %+v, want 2 concurrent pulls", limits)
+	}
+
+	// An invalid file keeps the previous config
+	if err := os.WriteFile(path, []byte(`{"registries": {"docker.io": {"maxConcurrentPulls": -1}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if waitFor(200*time.Millisecond, func(c *fileConfig) bool { return len(c.Registries) != 2 }) {
+		t.Errorf("registries = %v after the file became invalid, want the previous ones", s.config.Load().Registries)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// watchConfig reloads the config file whenever its modification time or size changed, checking every interval
+// Polling works for editors replacing the file as well as for ConfigMaps swapping a symlink, unlike watching the inode
+func (s *DemystifyingCRI) watchConfig(interval time.Duration) {
+	last, err := os.Stat(s.configPath)
+	if err != nil {
+		log.Printf("failed to watch config file: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// A missing file is usually being replaced, the next tick sees the new one
+		current, err := os.Stat(s.configPath)
+		if err != nil {
+			continue
+		}
+		if last != nil && current.ModTime().Equal(last.ModTime()) && current.Size() == last.Size() {
+			continue
+		}
+		last = current
+		s.reloadConfig()
+	}
+}
+
+// reloadConfig replaces the settings of the config file, keeping the previous ones if the file is invalid
+// Everything in the file is reloadable, as hooks, registry limits and latency budgets are looked up on every use
+// Flags like the socket path or the roots are never reloaded
+func (s *DemystifyingCRI) reloadConfig() {
+	config, err := loadConfig(s.configPath)
+	if err != nil {
+		log.Printf("keeping the previous config: %v", err)
+		return
+	}
+
+	s.config.Store(config)
+	s.pullLimiter.setHosts(config.Registries)
+	log.Printf("reloaded config file %s", s.configPath)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// serveDebug exposes operations which are not part of the CRI on a separate unix socket
+// e.g. curl --unix-socket /var/run/demystifying-cri-debug.sock -X POST localhost/pause?id=<container>
+func (s *DemystifyingCRI) serveDebug() error {
+	os.Remove(s.debugSocket)
+	lis, err := net.Listen("unix", s.debugSocket)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pause", s.debugContainerHandler(s.pauseContainer))
+	mux.HandleFunc("/unpause", s.debugContainerHandler(s.unpauseContainer))
+	mux.HandleFunc("/attach", s.debugAttach)
+	mux.HandleFunc("/resize", s.debugResize)
+	mux.HandleFunc("/drain", s.debugDrain(true))
+	mux.HandleFunc("/undrain", s.debugDrain(false))
+	mux.HandleFunc("/prune", s.debugPrune)
+	mux.HandleFunc("/exec-sandbox", s.debugExecSandbox)
+
+	go func() {
+		if err := http.Serve(lis, mux); err != nil {
+			log.Printf("debug socket stopped: %v", err)
+		}
+	}()
+
+	fmt.Printf("Debug server listening on %s\n", s.debugSocket)
+	return nil
+}
+
+// debugContainerHandler runs an operation on the container given by the id query parameter
+func (s *DemystifyingCRI) debugContainerHandler(operation func(containerID string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		containerID := r.URL.Query().Get("id")
+		if containerID == "" {
+			http.Error(w, "missing id parameter", http.StatusBadRequest)
+			return
+		}
+
+		if err := operation(containerID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// debugDrain enables or disables drain mode
+func (s *DemystifyingCRI) debugDrain(draining bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.setDraining(draining)
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// debugPrune removes unreferenced blobs from the image root and reports how much space was freed
+func (s *DemystifyingCRI) debugPrune(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := s.pruneBlobs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("pruned %d blobs, freeing %d bytes", result.RemovedBlobs, result.FreedBytes)
+	json.NewEncoder(w).Encode(result)
+}
+
+// debugAttach takes over the connection and carries the raw terminal of the container given by the id query parameter
+// Clients need a raw socket after the request, e.g. socat instead of curl
+func (s *DemystifyingCRI) debugAttach(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	containerID := r.URL.Query().Get("id")
+	if _, _, err := s.attachTarget(containerID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection does not support attaching", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("failed to attach to container %s: %v", containerID, err)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n")
+	if err := s.attachContainer(containerID, buf, conn, nil); err != nil {
+		fmt.Fprintln(conn, err)
+	}
+}
+
+// debugResize sets the terminal size of the container given by the id query parameter to width x height
+func (s *DemystifyingCRI) debugResize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	width, widthErr := strconv.ParseUint(r.URL.Query().Get("width"), 10, 16)
+	height, heightErr := strconv.ParseUint(r.URL.Query().Get("height"), 10, 16)
+	if widthErr != nil || heightErr != nil {
+		http.Error(w, "width and height must be numbers", http.StatusBadRequest)
+		return
+	}
+
+	size := terminalSize{Width: uint16(width), Height: uint16(height)}
+	if err := s.resizeTerminal(r.URL.Query().Get("id"), size); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
@@ -3,19 +3,31 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	runtime "demystifying-cri/proto"
 
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/opencontainers/runtime-tools/generate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 // DemystifyingCRI implements both the RuntimeServiceServer and ImageServiceServer
@@ -25,13 +37,140 @@ type DemystifyingCRI struct {
 	runtime.UnimplementedRuntimeServiceServer
 	runtime.UnimplementedImageServiceServer
 
-	sandboxes  map[string]*runtime.PodSandbox // Quick way to store sandbox information
-	containers map[string]*runtime.Container  // Quick way to store container information
-	images     map[string]*runtime.Image      // Quick way to store image information
+	mu         sync.RWMutex                // Guards the maps below as gRPC serves requests concurrently
+	sandboxes  map[string]*sandboxRecord   // Quick way to store sandbox information
+	containers map[string]*containerRecord // Quick way to store container information
+
+	ids          idGenerator       // Derives the IDs of new sandboxes and containers
+	idScheme     string            // Which of idSchemes ids implements
+	sandboxIDs   map[string]string // IDs of the sandboxes by sandboxKey, guarded by mu
+	containerIDs map[string]string // IDs of the containers by containerKey, guarded by mu
+
+	sandboxRuns map[string]*sandboxRun // RunPodSandbox calls in progress by sandboxKey, guarded by mu
+
+	reapInterval  time.Duration   // How often the reaper checks running containers for an exit, see reap
+	statsInterval time.Duration   // How often collectStats samples running containers
+	exitEvents    atomic.Bool     // Whether exits are detected with runc events instead of polling, see watchExit
+	exitWatches   map[string]bool // IDs of the containers and sandboxes watchExit waits for, guarded by mu
+
+	imageGCHigh   int           // Usage of the image filesystem in percent at which imageGC removes images, 0 disables it
+	imageGCLow    int           // Usage of the image filesystem in percent imageGC removes images down to
+	imageGCMinAge time.Duration // Time an image must not have been used for before imageGC removes it
+
+	statsMu sync.RWMutex                       // Guards stats
+	stats   map[string]*runtime.ContainerStats // Latest sample of every running container, see collectStats
+
+	diskUsage *diskUsageCache // Last disk usage walk of every container, see containerDiskUsage
+
+	images   *imageStore      // Downloaded images and downloads in progress, guarded by its own mutex
+	events   *containerEvents // Subscribers of GetContainerEvents, nil if --container-events is disabled
+	oci      ociRuntime       // Runs the containers, runc unless replaced
+	runcRoot string           // Directory runc keeps its state in, empty for runc's default
+	puller   imagePuller      // Downloads images into imageRoot, see pullBackend
+	unpacker imageUnpacker    // Unpacks images into bundles, see unpackBackend
+
+	runtimeRoot   string      // Path to create containers at
+	imageRoot     string      // Path to download images to
+	sandboxImage  string      // Image which is later used for sandboxes
+	sandboxPolicy string      // When the sandbox image is pulled at startup, see sandboxImagePullPolicies
+	debugSocket   string      // Path of the optional debug socket, empty disables it
+	tcpAddress    string      // Address of the optional mutual TLS listener, empty disables it
+	authfile      string      // Registry credentials of the node, used for pulls without per-request auth
+	imageSource   string      // Directory images are imported from before pulling them, see localPuller
+	keepBundles   int         // Number of removed containers' bundles kept in the graveyard, 0 deletes them
+	sharedRootfs  bool        // Whether containers of the same image share a read-only rootfs, see createOverlayBundle
+	rootless      bool        // Whether the runtime runs unprivileged, see applyUserNamespace
+	pullBackend   string      // Either skopeo or native, selects how images are downloaded
+	unpackBackend string      // Either umoci or native, selects how images are unpacked
+	metrics       *rpcMetrics // Outcome and latency of all RPCs
+	redactedEnv   []string    // Patterns of environment variables verbose status never shows the value of, see redactEnv
+	ulimits       []ulimit    // Rlimits of every container, see applyUlimits
+	prepullImages []string    // Images pulled in the background at startup, see prepull
+
+	config        atomic.Pointer[fileConfig] // Settings loaded from the config file, replaced as a whole by reloadConfig
+	configPath    string                     // Path of the config file, empty if there is none
+	watchInterval time.Duration              // How often watchConfig checks the config file for changes, 0 if it doesn't
+
+	slowRPCBudget time.Duration // Latency after which an RPC is logged as slow, 0 disables it, see latencyInterceptor
+
+	pullTimeout        time.Duration // Limit for pulling an image, 0 disables it
+	sandboxPullTimeout time.Duration // Limit for pulling the sandbox image, 0 disables it
+	pullLimiter        *pullLimiter  // Queues pulls exceeding the limits of their registry
+
+	pruneMu sync.RWMutex // Held for reading while writing or reading blobs, and for writing by pruneBlobs
+
+	defaultSeccompPath string              // Path of the seccomp profile for containers requesting the runtime default
+	defaultSeccomp     *rspec.LinuxSeccomp // Loaded from defaultSeccompPath, nil leaves containers unconfined
+	specTemplatePath   string              // Path of the OCI spec containers are based on, empty keeps the spec of the unpacked image
+	specTemplate       *rspec.Spec         // Loaded from specTemplatePath, see applySpecTemplate
+	defaultApparmor    string              // AppArmor profile for containers requesting the runtime default, empty for none
+	sandboxSeccompPath string              // Path of the seccomp profile for pause processes, empty for defaultPauseSeccomp
+	sandboxSeccomp     *rspec.LinuxSeccomp // Loaded from sandboxSeccompPath, nil leaves pause processes unconfined
+	sandboxApparmor    string              // AppArmor profile for pause processes, empty for defaultApparmor
+	noNewPrivileges    string              // Which containers get no_new_privs, see noNewPrivilegesPolicies
+	rejectUnsupported  bool                // Whether requests using fields the runtime ignores are rejected, see admitContainer
+
+	postStartCheck time.Duration // How long a started container or pause process must survive for its RPC to succeed, 0 disables the check
+
+	sandboxOOMScoreAdj int    // OOM score adjustment of pause processes, see applySandboxScheduling
+	sandboxNice        int    // Nice value of pause processes, 0 leaves it unchanged
+	sandboxCPUShares   uint64 // CPU shares of pause processes, 0 leaves the default
+
+	pauseCommand []string // Command of pause processes replacing the sandbox image's entrypoint, empty keeps it
+
+	logMaxSize       int64 // Size at which container logs are rotated, 0 disables rotation
+	logMaxFiles      int   // Number of rotated logs kept per container
+	podAggregateLogs bool  // Whether container output is additionally combined into a log per pod, see podLog
+
+	ready          atomic.Bool    // Set once prepare succeeded, CRI calls are rejected before
+	draining       atomic.Bool    // Set in drain mode, see setDraining
+	health         *health.Server // Reports NOT_SERVING until ready and while draining
+	cgroupV2       bool           // Whether the node uses the unified cgroup v2 hierarchy
+	swapAccounting bool           // Whether swap is enabled and the memory cgroup accounts it, see detectSwap
+	selinux        bool           // Whether SELinux is enabled on the node, see applySELinux
+	subreaper      bool           // Whether container processes are reparented to the runtime, see enableSubreaper
+	cgroupDriver   string         // Either systemd or cgroupfs
+	cniConfigured  bool           // Whether a CNI network configuration was found
+	networkPlugin  string         // Either cni or none, where none keeps pods in the host network
+	hostPortDNAT   bool           // Whether host ports of port mappings are forwarded to pods, see addHostPorts
+
+	maxPods             int            // Maximum number of sandboxes, 0 disables the limit
+	maxContainersPerPod int            // Maximum number of containers in a single sandbox, 0 disables the limit
+	pendingPods         int            // Sandboxes reserved by reservePod which aren't recorded yet, guarded by mu
+	pendingContainers   map[string]int // Containers reserved by reserveContainer which aren't recorded yet by sandbox, guarded by mu
+}
+
+// sandboxRecord wraps the CRI PodSandbox with state that is only relevant to the runtime itself
+type sandboxRecord struct {
+	*runtime.PodSandbox
+
+	config *runtime.PodSandboxConfig // Config the sandbox was created with, never modified afterwards
 
-	runtimeRoot  string // Path to create containers at
-	imageRoot    string // Path to download images to
-	sandboxImage string // Image which is later used for sandboxes
+	mu     sync.Mutex    // Serializes the initialization of pod-level resources
+	pid    int           // PID of the pause process, resolved once by podResources, 0 once it was reaped
+	files  *podResources // Files shared by all containers, set up once by podResources
+	podLog *podLog       // Combined log of all containers, opened once by sandboxPodLog
+}
+
+// containerRecord wraps the CRI Container with state that is only relevant to the runtime itself
+type containerRecord struct {
+	*runtime.Container
+
+	resources   *runtime.LinuxContainerResources // Resources applied to the container, updated by UpdateContainerResources
+	stdio       *containerStdio                  // Host side of the container's stdin and terminal
+	paused      bool                             // CRI has no paused state, so it is tracked next to the running state
+	pausing     bool                             // Whether runc pause or resume is running for the container, see reservePauseChange
+	cgroupsPath string                           // cgroupsPath of the container's OCI spec
+	log         *containerLog                    // Writer of the container's log file, nil if it has none
+	logPath     string                           // Absolute path of the container's log file
+	stopSignal  syscall.Signal                   // Signal StopContainer sends first, the StopSignal of the image or SIGTERM
+	startDelay  time.Duration                    // Time StartContainer waits before starting the container, see annotationDelayStart
+
+	pid        int    // PID of the container process, 0 if it is unknown or was reaped, see collectExitStatus
+	startedAt  int64  // Time the container process was started at, 0 if it never started
+	finishedAt int64  // Time the reaper observed the container exit at, 0 while running
+	exitCode   int32  // Exit code of the container process, unknownExitCode if it couldn't be collected
+	exitReason string // Reason of the exit, see exitReason
 }
 
 // Implement RuntimeService methods
@@ -46,46 +185,134 @@ func (s *DemystifyingCRI) Version(ctx context.Context, req *runtime.VersionReque
 }
 
 // Status is telling Kubelet that everything is alright to avoid node NotReady
+// Without a network plugin pods use the host network, so the network is always ready
 func (s *DemystifyingCRI) Status(ctx context.Context, req *runtime.StatusRequest) (*runtime.StatusResponse, error) {
 	runtimeReady := &runtime.RuntimeCondition{
 		Type:   "RuntimeReady",
 		Status: true,
 	}
 
+	// Kubelet's evented PLEG relies on GetContainerEvents, which only works if the events are enabled
+	eventsReady := &runtime.RuntimeCondition{
+		Type:   "ContainerEventsReady",
+		Status: s.events != nil,
+	}
+	if s.events == nil {
+		eventsReady.Reason = "ContainerEventsDisabled"
+		eventsReady.Message = "container events are disabled with --container-events=false"
+	}
+
 	networkReady := &runtime.RuntimeCondition{
 		Type:   "NetworkReady",
 		Status: true,
 	}
+	if s.networkPlugin == "cni" && !s.cniConfigured {
+		networkReady.Status = false
+		networkReady.Reason = "NetworkPluginNotReady"
+		networkReady.Message = "no CNI configuration found in " + cniConfDir
+	}
+
+	// crictl info asks for the runtime configuration with verbose
+	var info map[string]string
+	if req.Verbose {
+		config, err := s.effectiveConfigJSON()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode runtime config: %v", err)
+		}
+		info = map[string]string{"config": config}
+	}
 
 	return &runtime.StatusResponse{
 		Status: &runtime.RuntimeStatus{
 			Conditions: []*runtime.RuntimeCondition{
 				runtimeReady,
 				networkReady,
+				eventsReady,
 			},
 		},
+		Info: info,
 	}, nil
 }
 
+// ListPodSandbox returns a snapshot of all sandboxes taken under the lock
+// The records keep changing after the lock is released, e.g. when a sandbox stops, so they are copied rather than serialized in place
 func (s *DemystifyingCRI) ListPodSandbox(ctx context.Context, req *runtime.ListPodSandboxRequest) (*runtime.ListPodSandboxResponse, error) {
-	var sandboxes []*runtime.PodSandbox
+	s.mu.RLock()
+	sandboxes := make([]*runtime.PodSandbox, 0, len(s.sandboxes))
 	for _, sandbox := range s.sandboxes {
-		sandboxes = append(sandboxes, sandbox)
+		sandboxes = append(sandboxes, proto.Clone(sandbox.PodSandbox).(*runtime.PodSandbox))
 	}
+	s.mu.RUnlock()
 
 	return &runtime.ListPodSandboxResponse{Items: sandboxes}, nil
 }
 
+// RunPodSandbox creates and starts a pod-level sandbox
+// Concurrent calls for the same pod wait for the first one and return its result, as only one of them can create the pause container
+// The call is bound to the first caller's context, so cancelling it fails the waiting calls as well and Kubelet retries
 func (s *DemystifyingCRI) RunPodSandbox(ctx context.Context, req *runtime.RunPodSandboxRequest) (*runtime.RunPodSandboxResponse, error) {
-	sandboxID := fmt.Sprintf("%s-%s-sandbox", req.Config.Metadata.Namespace, req.Config.Metadata.Name)
+	key := sandboxKey(req.GetConfig().GetMetadata())
+	run, first := s.joinSandboxRun(key)
+	if !first {
+		select {
+		case <-run.done:
+			if run.err != nil {
+				return nil, run.err
+			}
+			return &runtime.RunPodSandboxResponse{PodSandboxId: run.sandboxID}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 
+	resp, err := s.runPodSandbox(ctx, req)
+	s.finishSandboxRun(key, run, resp.GetPodSandboxId(), err)
+	return resp, err
+}
+
+// runPodSandbox unpacks the sandbox image and runs its pause process, unless the pod's sandbox is ready already
+func (s *DemystifyingCRI) runPodSandbox(ctx context.Context, req *runtime.RunPodSandboxRequest) (*runtime.RunPodSandboxResponse, error) {
 	// Check if the sandbox already exists
-	if sandbox, exists := s.sandboxes[sandboxID]; exists {
+	s.mu.RLock()
+	sandbox, exists := s.sandboxes[s.sandboxIDs[sandboxKey(req.Config.Metadata)]]
+	ready := exists && sandbox.State == runtime.PodSandboxState_SANDBOX_READY
+	s.mu.RUnlock()
+	if ready {
 		return &runtime.RunPodSandboxResponse{PodSandboxId: sandbox.Id}, nil
 	}
+	if err := s.checkDraining(); err != nil {
+		return nil, err
+	}
+	if err := s.admitSandbox(req.Config); err != nil {
+		return nil, err
+	}
+	behavior, err := parseTeachingAnnotations(req.Config.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pause container of an existing sandbox died, so it is recreated from scratch
+	if exists {
+		if err := s.removeDeadSandbox(sandbox.Id); err != nil {
+			return nil, err
+		}
+	}
+	sandboxID := s.newID(func() string { return s.ids.sandboxID(req.Config.Metadata) })
+	if err := behavior.simulatedCreateFailure("sandbox " + sandboxID); err != nil {
+		return nil, err
+	}
+
+	// Refuse to create more sandboxes than the node is configured for
+	release, err := s.reservePod()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	// Unpack image
+	done := timePhase(ctx, "unpack")
 	unpackedPath, err := s.unpackImage(s.sandboxImage, sandboxID)
+	done()
 	if err != nil {
 		return nil, err
 	}
@@ -100,87 +327,260 @@ func (s *DemystifyingCRI) RunPodSandbox(ctx context.Context, req *runtime.RunPod
 	// Set terminal to false in order to run container detached
 	g.Config.Process.Terminal = false
 
+	// Without a network plugin the sandbox stays in the host network, as nothing would configure its own
+	if s.networkPlugin == "none" {
+		if err := g.RemoveLinuxNamespace("network"); err != nil {
+			return nil, fmt.Errorf("failed to remove network namespace: %v", err)
+		}
+	}
+
+	// Place the pause process into the pod's cgroup below the QoS cgroup chosen by Kubelet
+	cgroupParent, err := resolveCgroupParent(req.Config.GetLinux().GetCgroupParent())
+	if err != nil {
+		return nil, err
+	}
+	if !s.rootless {
+		if err := s.ensureCgroupParent(cgroupParent); err != nil {
+			return nil, err
+		}
+		g.SetLinuxCgroupsPath(containerCgroupsPath(cgroupParent, sandboxID))
+	}
+
+	// Run the configured pause command instead of the image's entrypoint, e.g. for sandbox images without a pause binary
+	s.applyPauseCommand(&g)
+
+	// Keep the pause process from being OOM killed or starved before the pod's containers
+	s.applySandboxScheduling(&g)
+
+	// Map the pod's root to the unprivileged user, its containers join this user namespace
+	if s.rootless {
+		if err := applyUserNamespace(&g, ""); err != nil {
+			return nil, err
+		}
+		dropPrivilegedSettings(&g)
+	}
+
+	// Confine the pause process like any other container of the pod, by default with the profiles of pause processes
+	securityContext := req.Config.GetLinux().GetSecurityContext()
+	if err := s.applySandboxSecurityProfiles(&g, securityContext.GetSeccomp(), securityContext.GetApparmor()); err != nil {
+		return nil, err
+	}
+	s.applySELinux(&g, securityContext.GetSelinuxOptions())
+
+	// Add the hooks configured for sandboxes
+	if err := s.applyHooks(&g, true); err != nil {
+		return nil, err
+	}
+
 	// Save the updated config.json
 	if err := g.SaveToFile(configFilePath, generate.ExportOptions{}); err != nil {
 		return nil, fmt.Errorf("failed to save updated OCI spec: %v", err)
 	}
+	behavior.logGeneratedSpec("sandbox "+sandboxID, g.Config)
+
+	// Optionally hold back the pause process, e.g. to watch Kubelet wait for the sandbox
+	if err := waitStartDelay(ctx, behavior.delayStart); err != nil {
+		return nil, err
+	}
 
 	// Use runc to create the PodSandbox
-	cmd := exec.Command("runc", "run", "-d", "--bundle", unpackedPath, sandboxID)
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("failed to create sandbox with runc: %v", err)
+	done = timePhase(ctx, "runc")
+	err = s.oci.Run(sandboxID, unpackedPath, runtimeIO{})
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sandbox with runc: %w", err)
+	}
+
+	// The pause process is reparented to the runtime, which reaps it once it exited
+	var sandboxPid int
+	if state, err := s.oci.State(sandboxID); err == nil {
+		sandboxPid = state.Pid
+	}
+
+	// A pause process which exits right away would leave the pod without namespaces
+	done = timePhase(ctx, "start check")
+	err = s.checkSandboxStarted(ctx, sandboxID)
+	done()
+	if err != nil {
+		return nil, err
+	}
+
+	// Forward the host ports to the pod, which can't be reached through them otherwise
+	if err := s.addHostPorts(ctx, sandboxID, sandboxPid, req.Config.GetPortMappings()); err != nil {
+		if err := s.oci.Delete(sandboxID, true); err != nil && !containerGone(err) {
+			log.Printf("failed to delete sandbox %s whose host ports couldn't be forwarded: %v", sandboxID, err)
+		}
+		s.collectExitStatus(sandboxPid)
+		return nil, err
 	}
 
 	// Store sandbox info
-	s.sandboxes[sandboxID] = &runtime.PodSandbox{
-		Id: sandboxID,
-		Metadata: &runtime.PodSandboxMetadata{
-			Name:      req.Config.Metadata.Name,
-			Namespace: req.Config.Metadata.Namespace,
-			Uid:       req.Config.Metadata.Uid,
+	s.mu.Lock()
+	s.sandboxIDs[sandboxKey(req.Config.Metadata)] = sandboxID
+	s.sandboxes[sandboxID] = &sandboxRecord{
+		PodSandbox: &runtime.PodSandbox{
+			Id: sandboxID,
+			Metadata: &runtime.PodSandboxMetadata{
+				Name:      req.Config.Metadata.Name,
+				Namespace: req.Config.Metadata.Namespace,
+				Uid:       req.Config.Metadata.Uid,
+			},
+			State:     runtime.PodSandboxState_SANDBOX_READY,
+			CreatedAt: time.Now().UnixNano(),
 		},
-		State:     runtime.PodSandboxState_SANDBOX_READY,
-		CreatedAt: time.Now().UnixNano(),
+		config: req.Config,
+		pid:    sandboxPid,
 	}
+	s.mu.Unlock()
+	go s.watchExit(sandboxID, true)
 
 	return &runtime.RunPodSandboxResponse{PodSandboxId: sandboxID}, nil
 }
 
 func (s *DemystifyingCRI) PodSandboxStatus(ctx context.Context, req *runtime.PodSandboxStatusRequest) (*runtime.PodSandboxStatusResponse, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	sandbox, exists := s.sandboxes[req.PodSandboxId]
 	if !exists {
 		return nil, fmt.Errorf("sandbox %s does not exist", req.PodSandboxId)
 	}
 
-	return &runtime.PodSandboxStatusResponse{
-		Status: &runtime.PodSandboxStatus{
-			Id:        sandbox.Id,
-			State:     runtime.PodSandboxState_SANDBOX_READY,
-			Metadata:  sandbox.Metadata,
-			CreatedAt: sandbox.CreatedAt,
-		},
-	}, nil
+	// Report runtime details which have no dedicated field in the status
+	var info map[string]string
+	if req.Verbose {
+		portMappings, err := portMappingsJSON(sandbox.config.GetPortMappings())
+		if err != nil {
+			return nil, err
+		}
+		info = map[string]string{"portMappings": portMappings}
+
+		// The pause process is placed directly below the pod's cgroup, which contains the cgroups of all its containers
+		var spec rspec.Spec
+		if err := readLayoutJSON(filepath.Join(s.runtimeRoot, sandbox.Id, "config.json"), &spec); err == nil {
+			if err := s.setCgroupInfo(info, "cgroup", &spec); err != nil {
+				return nil, err
+			}
+			if spec.Linux != nil && spec.Linux.CgroupsPath != "" {
+				podCgroup, err := s.describeCgroup(filepath.Dir(spec.Linux.CgroupsPath))
+				if err != nil {
+					return nil, err
+				}
+				if err := setInfoJSON(info, "podCgroup", podCgroup); err != nil {
+					return nil, err
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read OCI spec of sandbox %s: %v", sandbox.Id, err)
+		}
+	}
+
+	return &runtime.PodSandboxStatusResponse{Status: sandbox.status(), Info: info}, nil
+}
+
+// status returns the status of a sandbox as recorded, the caller must hold s.mu
+func (sandbox *sandboxRecord) status() *runtime.PodSandboxStatus {
+	return &runtime.PodSandboxStatus{
+		Id:        sandbox.Id,
+		State:     sandbox.State,
+		Metadata:  sandbox.Metadata,
+		CreatedAt: sandbox.CreatedAt,
+	}
 }
 
+// ListContainers only returns containers created by this instance, which are exactly the ones in s.containers
+// Other runc containers on the node are never looked at, so unrelated workloads can't leak into Kubelet
+// Like ListPodSandbox it returns copies taken under the lock, as the state of a container changes when it exits
 func (s *DemystifyingCRI) ListContainers(ctx context.Context, req *runtime.ListContainersRequest) (*runtime.ListContainersResponse, error) {
-	var containers []*runtime.Container
+	s.mu.RLock()
+	containers := make([]*runtime.Container, 0, len(s.containers))
 	for _, container := range s.containers {
-		containers = append(containers, container)
+		containers = append(containers, proto.Clone(container.Container).(*runtime.Container))
 	}
+	s.mu.RUnlock()
 
 	return &runtime.ListContainersResponse{Containers: containers}, nil
 }
 
 func (s *DemystifyingCRI) CreateContainer(ctx context.Context, req *runtime.CreateContainerRequest) (*runtime.CreateContainerResponse, error) {
-	containerID := fmt.Sprintf("%s-%s", req.PodSandboxId, req.Config.Metadata.Name)
-
 	// Check if the container already exists
-	if container, exists := s.containers[containerID]; exists {
+	s.mu.RLock()
+	container, exists := s.containers[s.containerIDs[containerKey(req.PodSandboxId, req.Config.Metadata)]]
+	exited := exists && container.State == runtime.ContainerState_CONTAINER_EXITED
+	sandbox, sandboxExists := s.sandboxes[req.PodSandboxId]
+	sandboxReady := sandboxExists && sandbox.State == runtime.PodSandboxState_SANDBOX_READY
+	s.mu.RUnlock()
+	if exists && !exited {
 		return &runtime.CreateContainerResponse{ContainerId: container.Id}, nil
 	}
+	if err := s.admitContainer(req.Config); err != nil {
+		return nil, err
+	}
+	behavior, err := parseTeachingAnnotations(req.Config.Annotations)
+	if err != nil {
+		return nil, err
+	}
 
-	// Unpack the image
-	unpackedPath, err := s.unpackImage(req.Config.Image.Image, containerID)
+	// The metadata matches, so a restart of an exited container has to replace it
+	// Its log file is kept, as Kubelet gives every attempt a log path of its own
+	if exited {
+		if _, err := s.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: container.Id}); err != nil {
+			return nil, fmt.Errorf("failed to remove exited container %s before recreating it: %w", container.Id, err)
+		}
+	}
+	containerID := s.newID(func() string { return s.ids.containerID(req.PodSandboxId, req.Config.Metadata) })
+	if !sandboxExists {
+		return nil, fmt.Errorf("sandbox %s does not exist", req.PodSandboxId)
+	}
+	if !sandboxReady {
+		return nil, status.Errorf(codes.FailedPrecondition, "sandbox %s is not ready", req.PodSandboxId)
+	}
+	if err := s.checkDraining(); err != nil {
+		return nil, err
+	}
+
+	// Refuse to create more containers in this sandbox than configured
+	release, err := s.reserveContainer(req.PodSandboxId)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := behavior.simulatedCreateFailure("container " + containerID); err != nil {
+		return nil, err
+	}
+
+	// Resolve the log path first, so a bad one is rejected before anything was created
+	logPath, err := containerLogPath(sandbox.config, req.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ephemeral containers share the PID namespace of the container they debug
+	pidNsPath, err := s.targetPidNamespace(req.PodSandboxId, req.Config.GetLinux().GetSecurityContext().GetNamespaceOptions())
 	if err != nil {
 		return nil, err
 	}
 
-	// Get a JSON containing the PID of the sandbox
-	stateCmd := exec.Command("runc", "state", req.PodSandboxId)
-	stateOut, err := stateCmd.Output()
+	// Kubelet pulls images before creating containers, so a missing one is reported instead of failing to unpack it
+	image, err := s.presentImage(req.Config.GetImage().GetImage())
 	if err != nil {
-		return nil, fmt.Errorf("failed to get sandbox state: %v", err)
+		return nil, err
 	}
+	s.recordImageUse(image)
 
-	// Extract the PID from the JSON
-	type RuncState struct {
-		Pid int `json:"pid"`
+	// Unpack the image
+	done := timePhase(ctx, "unpack")
+	unpackedPath, err := s.unpackImage(image, containerID)
+	done()
+	if err != nil {
+		return nil, err
 	}
-	var state RuncState
-	if err := json.Unmarshal(stateOut, &state); err != nil {
-		return nil, fmt.Errorf("failed to parse runc state output: %v", err)
+
+	// Initialize pod-level resources once, concurrent calls for the same sandbox wait for it
+	pod, err := s.podResources(sandbox)
+	if err != nil {
+		return nil, err
 	}
-	sandboxPid := state.Pid
 
 	// Load the existing config.json
 	configFilePath := filepath.Join(unpackedPath, "config.json")
@@ -188,97 +588,422 @@ func (s *DemystifyingCRI) CreateContainer(ctx context.Context, req *runtime.Crea
 	if err != nil {
 		return nil, fmt.Errorf("failed to load OCI spec from file: %v", err)
 	}
+	stages := s.newSpecStages(g.Config)
 
-	// Set terminal to false in order to run container detached
-	g.Config.Process.Terminal = false
+	// Run the image's entrypoint, env, working dir and user unless the CRI config overrides them
+	imageConfig, err := s.imageConfig(image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config of image %s: %v", image, err)
+	}
+	stages.recordImageDefaults(g.Config, filepath.Join(unpackedPath, "rootfs"), imageConfig)
+	if err := applyProcessConfig(&g, filepath.Join(unpackedPath, "rootfs"), imageConfig, req.Config); err != nil {
+		return nil, fmt.Errorf("failed to configure container process: %v", err)
+	}
+	stopSignal, err := parseStopSignal(imageConfig.Config.StopSignal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config of image %s: %v", image, err)
+	}
+
+	// Only allocate a terminal if requested, otherwise the container runs detached
+	g.Config.Process.Terminal = req.Config.Tty
+	stages.record("cri", g.Config)
 
-	// Use sandbox's network namespace
-	netNsPath := fmt.Sprintf("/proc/%d/ns/net", sandboxPid)
+	// Base everything but the image's rootfs and process on the operator's template
+	if err := s.applySpecTemplate(&g); err != nil {
+		return nil, err
+	}
+	stages.record("template", g.Config)
+
+	// Apply the requested resource limits
+	resources := req.Config.GetLinux().GetResources()
+	if err := s.applyResources(&g, resources); err != nil {
+		return nil, err
+	}
+	if err := s.applyUlimits(&g, req.Config.Annotations); err != nil {
+		return nil, err
+	}
+	if err := applyUmask(&g, req.Config.Annotations); err != nil {
+		return nil, err
+	}
+	stages.record("resources", g.Config)
+
+	// Apply the seccomp and AppArmor profiles, falling back to the node's defaults
+	securityContext := req.Config.GetLinux().GetSecurityContext()
+	if err := s.applySecurityProfiles(&g, securityContext.GetSeccomp(), securityContext.GetApparmor()); err != nil {
+		return nil, err
+	}
+	s.applySELinux(&g, securityContext.GetSelinuxOptions())
+	s.applyNoNewPrivileges(&g, securityContext)
+
+	// Add the hooks configured for containers
+	if err := s.applyHooks(&g, false); err != nil {
+		return nil, err
+	}
+	stages.record("security", g.Config)
+
+	// Place the container in its own cgroup next to the sandbox's, which is where its stats are read from
+	// The parent was validated and created when the sandbox was run
+	cgroupParent, err := resolveCgroupParent(sandbox.config.GetLinux().GetCgroupParent())
+	if err != nil {
+		return nil, err
+	}
+	cgroupsPath := containerCgroupsPath(cgroupParent, containerID)
+	g.SetLinuxCgroupsPath(cgroupsPath)
+
+	// Use sandbox's network and IPC namespace, and with the latter its /dev/shm
+	netNsPath := fmt.Sprintf("/proc/%d/ns/net", pod.pid)
 	if err := g.AddOrReplaceLinuxNamespace("network", netNsPath); err != nil {
 		return nil, fmt.Errorf("failed to set network namespace: %v", err)
 	}
+	ipcNsPath := fmt.Sprintf("/proc/%d/ns/ipc", pod.pid)
+	if err := g.AddOrReplaceLinuxNamespace("ipc", ipcNsPath); err != nil {
+		return nil, fmt.Errorf("failed to set IPC namespace: %v", err)
+	}
 
-	// Save the updated config.json
+	if pidNsPath != "" {
+		if err := g.AddOrReplaceLinuxNamespace("pid", pidNsPath); err != nil {
+			return nil, fmt.Errorf("failed to set PID namespace: %v", err)
+		}
+	}
+
+	// Share memory and resolve names like the rest of the pod
+	applyPodResources(&g, pod)
+
+	// Mount the volumes, which may replace the pod's hosts and resolv.conf
+	if err := applyImageVolumes(&g, unpackedPath, imageConfig, req.Config); err != nil {
+		return nil, err
+	}
+	if err := applyMounts(&g, req.Config); err != nil {
+		return nil, err
+	}
+
+	// The sandbox's namespaces are owned by its user namespace, so it must be joined as well
+	if s.rootless {
+		if err := applyUserNamespace(&g, fmt.Sprintf("/proc/%d/ns/user", pod.pid)); err != nil {
+			return nil, err
+		}
+		dropPrivilegedSettings(&g)
+		cgroupsPath = ""
+	}
+	stages.record("namespaces", g.Config)
+
+	// Save the updated config.json and how it came about
 	if err := g.SaveToFile(configFilePath, generate.ExportOptions{}); err != nil {
 		return nil, fmt.Errorf("failed to save updated OCI spec: %v", err)
 	}
+	if err := stages.save(unpackedPath); err != nil {
+		return nil, err
+	}
+	behavior.logGeneratedSpec("container "+containerID, g.Config)
+
+	// Prepare the terminal or stdin pipe if the container is interactive
+	stdio, err := newContainerStdio(unpackedPath, req.Config)
+	if err != nil {
+		return nil, err
+	}
 
-	// Use runc to create the container
-	cmd := exec.Command("runc", "run", "-d", "--bundle", unpackedPath, containerID)
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("failed to create sandbox with runc: %v", err)
+	// Write the output to the log file Kubelet expects, TTY output is only available by attaching
+	var containerLog *containerLog
+	if logPath != "" && !req.Config.Tty {
+		maxSize, maxFiles := s.logLimits(req.Config.Annotations)
+		containerLog, err = newContainerLog(logPath, maxSize, maxFiles)
+		if err != nil {
+			stdio.close()
+			return nil, err
+		}
+
+		// Additionally tee the output into the pod log, which never affects the CRI log
+		if containerLog.pod, err = s.sandboxPodLog(sandbox); err != nil {
+			log.Printf("failed to open pod log of sandbox %s: %v", sandbox.Id, err)
+		}
+		containerLog.name = req.Config.Metadata.Name
+	}
+
+	// Use runc to create the container, its process is only started by StartContainer
+	createdAt := time.Now().UnixNano()
+	containerIO := runtimeIO{Stdin: stdio.containerStdin(), ConsoleSocket: stdio.consoleSocketPath()}
+	if containerLog != nil {
+		containerIO.Stdout = containerLog.stdout
+		containerIO.Stderr = containerLog.stderr
+	}
+	done = timePhase(ctx, "runc")
+	err = stdio.finish(s.oci.Create(containerID, unpackedPath, containerIO))
+	done()
+	if err != nil {
+		if containerLog != nil {
+			containerLog.close()
+		}
+		return nil, fmt.Errorf("failed to create container with runc: %w", err)
+	}
+
+	// The process runc created is reparented to the runtime, which collects its exit status, see markExited
+	var pid int
+	if state, err := s.oci.State(containerID); err == nil {
+		pid = state.Pid
 	}
 
 	// Store container info
-	s.containers[containerID] = &runtime.Container{
-		Id:           containerID,
-		PodSandboxId: req.PodSandboxId,
-		Metadata:     req.Config.Metadata,
-		Image:        req.Config.Image,
-		ImageRef:     req.Config.Image.Image,
-		State:        runtime.ContainerState_CONTAINER_RUNNING,
-		CreatedAt:    time.Now().UnixNano(),
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containerIDs[containerKey(req.PodSandboxId, req.Config.Metadata)] = containerID
+	s.containers[containerID] = &containerRecord{
+		Container: &runtime.Container{
+			Id:           containerID,
+			PodSandboxId: req.PodSandboxId,
+			Metadata:     req.Config.Metadata,
+			Image:        req.Config.Image,
+			ImageRef:     req.Config.Image.Image,
+			State:        runtime.ContainerState_CONTAINER_CREATED,
+			CreatedAt:    createdAt,
+			Labels:       req.Config.Labels,
+			Annotations:  req.Config.Annotations,
+		},
+		resources:   resources,
+		stdio:       stdio,
+		log:         containerLog,
+		logPath:     logPath,
+		cgroupsPath: cgroupsPath,
+		stopSignal:  stopSignal,
+		startDelay:  behavior.delayStart,
+		pid:         pid,
 	}
+	s.emitContainerEvent(req.PodSandboxId, containerID, runtime.ContainerEventType_CONTAINER_CREATED_EVENT)
 
 	return &runtime.CreateContainerResponse{ContainerId: containerID}, nil
 }
 
-// StartContainer must be implemented as Kubelet requires it after CreateContainer was executed
+// StartContainer runs the process of a container created by CreateContainer with runc start
 func (s *DemystifyingCRI) StartContainer(ctx context.Context, req *runtime.StartContainerRequest) (*runtime.StartContainerResponse, error) {
+	// Optionally hold back the process, e.g. to watch Kubelet wait for the container
+	var delay time.Duration
+	s.mu.RLock()
+	if container, exists := s.containers[req.ContainerId]; exists && container.State == runtime.ContainerState_CONTAINER_CREATED {
+		delay = container.startDelay
+	}
+	s.mu.RUnlock()
+	if err := waitStartDelay(ctx, delay); err != nil {
+		return nil, err
+	}
+
+	done := timePhase(ctx, "runc")
+	err := s.startContainer(req.ContainerId)
+	done()
+	if err != nil {
+		return nil, err
+	}
+
+	// Optionally report a process which died right away, instead of leaving it to a crashloop
+	if s.postStartCheck > 0 {
+		done := timePhase(ctx, "post-start check")
+		err := s.checkStarted(ctx, req.ContainerId)
+		done()
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &runtime.StartContainerResponse{}, nil
 }
 
+// startContainer starts a created container and begins capturing its output
+// The lock is held throughout, so concurrent calls can't start the container or its log capture twice
+func (s *DemystifyingCRI) startContainer(containerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	container, exists := s.containers[containerID]
+	if !exists {
+		return status.Errorf(codes.NotFound, "container %s does not exist", containerID)
+	}
+	if container.State != runtime.ContainerState_CONTAINER_CREATED {
+		return status.Errorf(codes.FailedPrecondition, "container %s is not in created state", containerID)
+	}
+
+	if err := s.oci.Start(containerID); err != nil {
+		return fmt.Errorf("failed to start container %s: %w", containerID, err)
+	}
+
+	// Copy the output into the log file from now on
+	if container.log != nil {
+		container.log.start()
+	}
+
+	// Keep the timestamps monotonic even if the wall clock jumped backwards
+	startedAt := time.Now().UnixNano()
+	if startedAt < container.CreatedAt {
+		startedAt = container.CreatedAt
+	}
+	container.State = runtime.ContainerState_CONTAINER_RUNNING
+	container.startedAt = startedAt
+	s.emitContainerEvent(container.PodSandboxId, containerID, runtime.ContainerEventType_CONTAINER_STARTED_EVENT)
+	go s.watchExit(containerID, false)
+
+	return nil
+}
+
+// RemoveContainer deletes a container with runc, a running container is killed first
+// Removing a container which does not exist is not an error, as required by the CRI
+func (s *DemystifyingCRI) RemoveContainer(ctx context.Context, req *runtime.RemoveContainerRequest) (*runtime.RemoveContainerResponse, error) {
+	containerID := req.ContainerId
+
+	s.mu.RLock()
+	container, exists := s.containers[containerID]
+	neverStarted := exists && container.State == runtime.ContainerState_CONTAINER_CREATED
+	s.mu.RUnlock()
+	if !exists {
+		return &runtime.RemoveContainerResponse{}, nil
+	}
+
+	if err := s.oci.Delete(containerID, true); err != nil && !containerGone(err) && s.processAlive(containerID) {
+		return nil, fmt.Errorf("failed to delete container %s: %w", containerID, err)
+	}
+	s.reapContainer(containerID)
+	container.stdio.close()
+	// Started logs close themselves once the output ends, otherwise the pipes are still held
+	if neverStarted && container.log != nil {
+		container.log.close()
+	}
+
+	if err := s.unmountRootfs(containerID); err != nil {
+		return nil, err
+	}
+	if err := s.removeImageVolumes(containerID); err != nil {
+		return nil, err
+	}
+	if err := s.removeBundle(containerID); err != nil {
+		return nil, err
+	}
+	s.removeUnusedSharedRootfs()
+
+	s.mu.Lock()
+	if container, exists := s.containers[containerID]; exists {
+		delete(s.containerIDs, containerKey(container.PodSandboxId, container.Metadata))
+		delete(s.containers, containerID)
+		s.emitContainerEvent(container.PodSandboxId, containerID, runtime.ContainerEventType_CONTAINER_DELETED_EVENT)
+	}
+	s.mu.Unlock()
+
+	s.statsMu.Lock()
+	delete(s.stats, containerID)
+	s.statsMu.Unlock()
+	s.forgetDiskUsage(containerID)
+
+	return &runtime.RemoveContainerResponse{}, nil
+}
+
 func (s *DemystifyingCRI) ContainerStatus(ctx context.Context, req *runtime.ContainerStatusRequest) (*runtime.ContainerStatusResponse, error) {
-	container, exists := s.containers[req.ContainerId]
+	current, err := s.containerStatus(req.ContainerId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Report what the runtime actually did with the container, which has no fields in the status
+	// The bundle is walked without holding the lock, as a walk may take a while
+	var info map[string]string
+	if req.Verbose {
+		info, err = s.containerInfo(ctx, req.ContainerId, current.LogPath, current.GetImage().GetImage())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &runtime.ContainerStatusResponse{Status: current, Info: info}, nil
+}
+
+// containerStatus returns the status of a container as recorded
+func (s *DemystifyingCRI) containerStatus(containerID string) (*runtime.ContainerStatus, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	container, exists := s.containers[containerID]
+	if !exists {
+		return nil, fmt.Errorf("container %s does not exist", containerID)
+	}
+	return container.status(), nil
+}
+
+// status returns the status of a container as recorded, the caller must hold s.mu
+func (container *containerRecord) status() *runtime.ContainerStatus {
+	var reason string
+	if container.paused {
+		reason = "Paused"
+	} else if container.State == runtime.ContainerState_CONTAINER_EXITED {
+		reason = container.exitReason
+	}
+
+	return &runtime.ContainerStatus{
+		Id:         container.Id,
+		State:      container.State,
+		Metadata:   container.Metadata,
+		Image:      container.Image,
+		ImageRef:   container.ImageRef,
+		CreatedAt:  container.CreatedAt,
+		StartedAt:  container.startedAt,
+		FinishedAt: container.finishedAt,
+		ExitCode:   container.exitCode,
+		Resources:  &runtime.ContainerResources{Linux: container.resources},
+		Reason:     reason,
+		LogPath:    container.logPath,
+	}
+}
+
+// UpdateContainerResources applies new resource limits to a running container and records them
+func (s *DemystifyingCRI) UpdateContainerResources(ctx context.Context, req *runtime.UpdateContainerResourcesRequest) (*runtime.UpdateContainerResourcesResponse, error) {
+	s.mu.RLock()
+	_, exists := s.containers[req.ContainerId]
+	s.mu.RUnlock()
 	if !exists {
 		return nil, fmt.Errorf("container %s does not exist", req.ContainerId)
 	}
+	if req.Windows != nil {
+		return nil, windowsError("update of container " + req.ContainerId)
+	}
 
-	return &runtime.ContainerStatusResponse{
-		Status: &runtime.ContainerStatus{
-			Id:        container.Id,
-			State:     container.State,
-			Metadata:  container.Metadata,
-			Image:     container.Image,
-			ImageRef:  container.ImageRef,
-			CreatedAt: container.CreatedAt,
-		},
-	}, nil
+	if err := s.updateResources(req.ContainerId, req.Linux); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if container, exists := s.containers[req.ContainerId]; exists {
+		container.resources = req.Linux
+	}
+
+	return &runtime.UpdateContainerResourcesResponse{}, nil
 }
 
 // Implement ImageService methods
 
 func (s *DemystifyingCRI) ListImages(ctx context.Context, req *runtime.ListImagesRequest) (*runtime.ListImagesResponse, error) {
-	var images []*runtime.Image
-	for _, image := range s.images {
-		images = append(images, image)
-	}
-
-	return &runtime.ListImagesResponse{Images: images}, nil
+	return &runtime.ListImagesResponse{Images: s.images.list()}, nil
 }
 
 // ImageStatus must be implemented as Kubelet expects a proper response
 func (s *DemystifyingCRI) ImageStatus(ctx context.Context, req *runtime.ImageStatusRequest) (*runtime.ImageStatusResponse, error) {
-	imageID := req.Image.Image
-
-	image, exists := s.images[imageID]
+	image, exists := s.images.get(req.Image.Image)
 	if !exists {
 		return &runtime.ImageStatusResponse{
 			Image: nil, // This indicates that the image was not found
 		}, nil
 	}
 
-	return &runtime.ImageStatusResponse{
-		Image: &runtime.Image{
-			Id:   image.Id,
-			Spec: image.Spec,
-			Size: image.Size,
-		},
-	}, nil
+	// Report details which have no dedicated field in the image, crictl inspecti shows them
+	var info map[string]string
+	if req.Verbose {
+		labels, err := json.Marshal(image.labels)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode image labels: %v", err)
+		}
+		info = map[string]string{"labels": string(labels)}
+	}
+
+	return &runtime.ImageStatusResponse{Image: image.Image, Info: info}, nil
 }
 
 func (s *DemystifyingCRI) PullImage(ctx context.Context, req *runtime.PullImageRequest) (*runtime.PullImageResponse, error) {
-	err := s.downloadImage(req.Image.Image)
+	done := timePhase(ctx, "pull")
+	err := s.downloadImage(ctx, req.Image.Image, req.Auth)
+	done()
 	if err != nil {
 		return nil, err
 	}
@@ -286,35 +1011,229 @@ func (s *DemystifyingCRI) PullImage(ctx context.Context, req *runtime.PullImageR
 	return &runtime.PullImageResponse{ImageRef: req.Image.Image}, nil
 }
 
+// RemoveImage deletes a reference of an image from the store, and its OCI layout from imageRoot once no other reference uses it
+// Removing an image which does not exist is not an error, as required by the CRI
+func (s *DemystifyingCRI) RemoveImage(ctx context.Context, req *runtime.RemoveImageRequest) (*runtime.RemoveImageResponse, error) {
+	removed, exists := s.images.remove(req.Image.Image)
+	if !exists {
+		return &runtime.RemoveImageResponse{}, nil
+	}
+	if err := s.removeImageRecords(removed); err != nil {
+		return nil, err
+	}
+
+	return &runtime.RemoveImageResponse{}, nil
+}
+
+// removeImageRecords deletes what references removed from the image store leave unused, their shared rootfs and layouts
+func (s *DemystifyingCRI) removeImageRecords(removed []*imageRecord) error {
+	s.removeUnusedSharedRootfs()
+
+	for _, image := range removed {
+		if err := s.removeImageLayout(image.ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeImageLayout deletes the layout a removed reference was stored in
+// References of the same repository share a layout, which must be kept until the last one is removed
+func (s *DemystifyingCRI) removeImageLayout(ref string) error {
+	layoutPath, _ := splitLayoutReference(filepath.Join(s.imageRoot, getImage(ref)))
+	for _, other := range s.images.refs() {
+		if otherPath, _ := splitLayoutReference(filepath.Join(s.imageRoot, getImage(other))); otherPath == layoutPath {
+			s.forgetImageRef(ref)
+			return nil
+		}
+	}
+	if err := os.RemoveAll(layoutPath); err != nil {
+		return fmt.Errorf("failed to remove image %s: %v", ref, err)
+	}
+	return nil
+}
+
 func (s *DemystifyingCRI) ImageFsInfo(ctx context.Context, req *runtime.ImageFsInfoRequest) (*runtime.ImageFsInfoResponse, error) {
 	return &runtime.ImageFsInfoResponse{}, nil
 }
 
 // downloadImage downloads an image and stores it at imageRoot
-func (s *DemystifyingCRI) downloadImage(image string) error {
-	_, exists := s.images[image]
-	if exists {
-		return nil
+// Concurrent calls for the same image share a single download, see imageStore.pull
+func (s *DemystifyingCRI) downloadImage(ctx context.Context, image string, auth *runtime.AuthConfig) error {
+	if _, exists := s.images.get(image); exists {
+		// An image whose layout lost blobs, e.g. to a full disk, is forgotten and pulled again
+		err := checkLayoutComplete(splitLayoutReference(filepath.Join(s.imageRoot, getImage(image))))
+		if err == nil {
+			return nil
+		}
+		log.Printf("pulling incomplete image %s again: %v", image, err)
+		s.images.remove(image)
+	}
+
+	return s.images.pull(ctx, image, func(ctx context.Context) (*imageRecord, error) {
+		// Time spent queueing for the registry doesn't count towards the pull timeout
+		release, err := s.pullLimiter.acquire(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		// The new blobs aren't referenced by a stored image until the pull finished
+		s.pruneMu.RLock()
+		defer s.pruneMu.RUnlock()
+
+		// The tiny sandbox image gets a short timeout, so a bad registry fails startup instead of hanging it
+		timeout := s.pullTimeout
+		if image == s.sandboxImage {
+			timeout = s.sandboxPullTimeout
+		}
+		if timeout <= 0 {
+			return s.copyImage(ctx, image, auth)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		pulled, err := s.copyImage(ctx, image, auth)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, status.Errorf(codes.DeadlineExceeded, "pull of image %s timed out after %s", image, timeout)
+		}
+		return pulled, err
+	})
+}
+
+// copyImage copies an image from its registry to imageRoot with the configured backend
+func (s *DemystifyingCRI) copyImage(ctx context.Context, image string, auth *runtime.AuthConfig) (*imageRecord, error) {
+	if err := s.puller.Pull(ctx, image, auth); err != nil {
+		return nil, err
+	}
+	if err := s.recordImageRef(image); err != nil {
+		return nil, err
 	}
+	return s.readImageRecord(image)
+}
 
-	// Download image
-	dst := filepath.Join(s.imageRoot, getImage(image))
-	cmd := exec.Command("skopeo", "copy", "docker://"+image, "oci:"+dst)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to download image %s: %v", image, err)
+// readImageRecord describes an image stored in imageRoot
+func (s *DemystifyingCRI) readImageRecord(image string) (*imageRecord, error) {
+	layoutPath, tag := splitLayoutReference(filepath.Join(s.imageRoot, getImage(image)))
+	size, err := layoutSize(layoutPath, tag)
+	if err != nil {
+		return nil, err
 	}
 
-	// Store image info
-	s.images[image] = &runtime.Image{
-		Id:   image,
-		Spec: &runtime.ImageSpec{Image: image},
-		Size: 123456, // Mock size
+	// The digests tell which references are the same image and what they resolved to
+	descriptor, err := readLayoutDescriptor(layoutPath, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve image %s: %v", image, err)
+	}
+	manifest, err := readLayoutManifest(layoutPath, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest of image %s: %v", image, err)
 	}
 
-	return nil
+	// Keep the labels and user, so ImageStatus doesn't read the layout on every call
+	config, err := s.imageConfig(image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config of image %s: %v", image, err)
+	}
+
+	record := &imageRecord{
+		Image: &runtime.Image{
+			Id:   manifest.Config.Digest,
+			Spec: &runtime.ImageSpec{Image: image},
+			Size: size,
+		},
+		ref:            image,
+		labels:         config.Config.Labels,
+		configDigest:   manifest.Config.Digest,
+		manifestDigest: registryDigest(descriptor),
+		lastUsedAt:     s.imageLastUsed(image),
+	}
+	setImageUser(record.Image, config.Config.User)
+	return record, nil
+}
+
+// reservePod returns ResourceExhausted if creating another sandbox would exceed maxPods
+// Otherwise the sandbox counts against the limit until the returned release is called, which must happen after it was recorded,
+// so concurrent calls can't all pass the check before any of them recorded its sandbox
+func (s *DemystifyingCRI) reservePod() (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxPods > 0 && len(s.sandboxes)+s.pendingPods >= s.maxPods {
+		return nil, status.Errorf(codes.ResourceExhausted, "maximum number of pods (%d) reached", s.maxPods)
+	}
+	s.pendingPods++
+
+	return func() {
+		s.mu.Lock()
+		s.pendingPods--
+		s.mu.Unlock()
+	}, nil
+}
+
+// reserveContainer returns ResourceExhausted if creating another container in the sandbox would exceed maxContainersPerPod
+// Like reservePod the container counts against the limit until the returned release is called
+func (s *DemystifyingCRI) reserveContainer(sandboxID string) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := s.pendingContainers[sandboxID]
+	for _, container := range s.containers {
+		if container.PodSandboxId == sandboxID {
+			count++
+		}
+	}
+	if s.maxContainersPerPod > 0 && count >= s.maxContainersPerPod {
+		return nil, status.Errorf(codes.ResourceExhausted, "maximum number of containers (%d) reached for sandbox %s", s.maxContainersPerPod, sandboxID)
+	}
+	s.pendingContainers[sandboxID]++
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.pendingContainers[sandboxID]--; s.pendingContainers[sandboxID] == 0 {
+			delete(s.pendingContainers, sandboxID)
+		}
+	}, nil
+}
+
+// targetPidNamespace returns the PID namespace of the target container if the namespace options request one
+// An empty path means the container keeps its own PID namespace
+func (s *DemystifyingCRI) targetPidNamespace(sandboxID string, options *runtime.NamespaceOption) (string, error) {
+	if options.GetPid() != runtime.NamespaceMode_TARGET {
+		return "", nil
+	}
+
+	s.mu.RLock()
+	target, exists := s.containers[options.TargetId]
+	s.mu.RUnlock()
+	if !exists || target.PodSandboxId != sandboxID {
+		return "", status.Errorf(codes.NotFound, "target container %s does not exist in sandbox %s", options.TargetId, sandboxID)
+	}
+
+	state, err := s.oci.State(options.TargetId)
+	if err != nil || state.Status != "running" {
+		return "", status.Errorf(codes.FailedPrecondition, "target container %s is not running", options.TargetId)
+	}
+
+	return fmt.Sprintf("/proc/%d/ns/pid", state.Pid), nil
+}
+
+// presentImage returns the reference an image given by reference or ID is stored as, as Kubelet may pass either
+// It returns NotFound if the image was never pulled or its layout is gone from imageRoot
+func (s *DemystifyingCRI) presentImage(image string) (string, error) {
+	ref, exists := s.images.resolve(image)
+	if !exists {
+		return "", status.Errorf(codes.NotFound, "image %s is not present, pull it first", image)
+	}
+	if err := checkLayoutComplete(splitLayoutReference(filepath.Join(s.imageRoot, getImage(ref)))); err != nil {
+		return "", status.Errorf(codes.NotFound, "image %s is not present in %s, pull it again: %v", image, s.imageRoot, err)
+	}
+	return ref, nil
 }
 
 // unpackImage unpacks an image and returns the path where it was unpacked
+// With sharedRootfs the bundle only holds the writable layer on top of a rootfs shared by all containers of the image
 func (s *DemystifyingCRI) unpackImage(image, containerID string) (string, error) {
 	snapshotPath := filepath.Join(s.runtimeRoot, containerID)
 
@@ -324,58 +1243,407 @@ func (s *DemystifyingCRI) unpackImage(image, containerID string) (string, error)
 		return snapshotPath, nil
 	}
 
+	s.pruneMu.RLock()
+	defer s.pruneMu.RUnlock()
+
 	imagePath := filepath.Join(s.imageRoot, getImage(image))
+	if s.sharedRootfs {
+		return snapshotPath, s.createOverlayBundle(imagePath, snapshotPath)
+	}
 
-	// Unpack image
-	cmd := exec.Command("umoci", "unpack", "--image", imagePath, snapshotPath)
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to unpack image %s to %s: %v", imagePath, snapshotPath, err)
+	return snapshotPath, s.unpackBundle(imagePath, snapshotPath)
+}
+
+// unpackBundle unpacks the image at imagePath into a bundle at snapshotPath
+func (s *DemystifyingCRI) unpackBundle(imagePath, snapshotPath string) error {
+	// Unpack into a temporary sibling directory, so a failed unpack never leaves a partial snapshot behind
+	tmpPath, err := os.MkdirTemp(s.runtimeRoot, "."+filepath.Base(snapshotPath)+"-unpack-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary unpack directory: %v", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	// umoci refuses to unpack into an existing directory
+	bundlePath := filepath.Join(tmpPath, "bundle")
+
+	if err := s.unpacker.Unpack(imagePath, bundlePath); err != nil {
+		return fmt.Errorf("failed to unpack image %s to %s: %w", imagePath, snapshotPath, err)
+	}
+
+	// Move the complete bundle into place
+	if err := os.Rename(bundlePath, snapshotPath); err != nil {
+		return fmt.Errorf("failed to move unpacked image to %s: %v", snapshotPath, err)
 	}
 
-	return snapshotPath, nil
+	return nil
 }
 
 // Start the CRI gRPC server
 func main() {
-	lis, err := net.Listen("unix", "/var/run/demystifying-cri.sock")
+	maxPods := flag.Int("max-pods", 110, "Maximum number of pods, 0 disables the limit")
+	maxContainersPerPod := flag.Int("max-containers-per-pod", 0, "Maximum number of containers per pod, 0 disables the limit")
+	sandboxOOMScoreAdj := flag.Int("sandbox-oom-score-adj", defaultSandboxOOMScoreAdj, "OOM score adjustment of pause containers, between -1000 and 1000")
+	sandboxNice := flag.Int("sandbox-nice", 0, "Nice value of pause containers, between -20 and 19, 0 leaves it unchanged")
+	sandboxCPUShares := flag.Uint64("sandbox-cpu-shares", 0, "CPU shares of pause containers, 0 leaves the default")
+	sandboxCommand := flag.String("sandbox-command", "", "Command of pause containers like /pause or 'sleep infinity', defaults to the entrypoint of the sandbox image")
+	statsInterval := flag.Duration("stats-interval", 10*time.Second, "How often container stats are sampled")
+	reapInterval := flag.Duration("reap-interval", defaultReapInterval, "How often running containers are checked for an exit")
+	imageGCHigh := flag.Int("image-gc-high-threshold", 0, "Usage of the image filesystem in percent at which unused images are removed, 0 leaves image garbage collection to Kubelet")
+	imageGCLow := flag.Int("image-gc-low-threshold", 80, "Usage of the image filesystem in percent unused images are removed down to")
+	imageGCMinAge := flag.Duration("image-gc-min-age", 2*time.Minute, "Time an image must not have been used for before it may be removed")
+	imageGCInterval := flag.Duration("image-gc-interval", 5*time.Minute, "How often the usage of the image filesystem is checked")
+	exitEvents := flag.Bool("exit-events", false, "Detect container exits with runc events instead of polling, falls back to polling without cgroup v2")
+	diskUsageTTL := flag.Duration("disk-usage-ttl", time.Minute, "How long the measured disk usage of a container is reused, 0 measures on every stats call")
+	debugSocket := flag.String("debug-socket", "", "Path of a unix socket exposing debug operations, disabled if empty")
+	sandboxPolicy := flag.String("sandbox-image-pull-policy", "Always", "When the sandbox image is pulled at startup, one of Always, IfNotPresent or Never")
+	slowRPCBudget := flag.Duration("slow-rpc-budget", 10*time.Second, "Log RPCs taking longer than this with a breakdown of their time, 0 disables it")
+	ulimits := flag.String("default-ulimits", defaultUlimits, "Comma separated rlimits of all containers like nofile=1024:1024, overridable per container with the "+annotationUlimits+" annotation")
+	prepullImages := flag.String("prepull", "", "Comma separated images to pull in the background once the sandbox image is present")
+	redactEnv := flag.String("redact-env", defaultRedactEnv, "Comma separated patterns of environment variables whose values are redacted in verbose container status")
+	tcpAddress := flag.String("tcp-addr", "", "Address to additionally serve the CRI on over TCP with mutual TLS, disabled if empty")
+	tlsCert := flag.String("tls-cert", "", "Server certificate of the TCP listener")
+	tlsKey := flag.String("tls-key", "", "Private key of the server certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "CA certificates clients of the TCP listener must be signed by")
+	pullBackend := flag.String("pull-backend", "skopeo", "How images are downloaded, either skopeo or native")
+	unpackBackend := flag.String("unpack-backend", "umoci", "How images are unpacked, either umoci or native")
+	metricsAddress := flag.String("metrics-address", "", "Address to serve Prometheus metrics on, disabled if empty")
+	metricsNamespaceLabels := flag.Bool("metrics-namespace-labels", false, "Split metrics by pod namespace, only meant for debugging")
+	networkPlugin := flag.String("network-plugin", "", "Either cni or none, defaults to cni if a CNI configuration is present and none otherwise")
+	imageSourceDir := flag.String("image-source-dir", "", "Directory of OCI layouts and archives images are imported from before pulling them from their registry")
+	authfile := flag.String("authfile", defaultAuthfile(), "Path of a registry auth file used when a pull has no credentials of its own")
+	rootless := flag.Bool("rootless", os.Geteuid() != 0, "Run containers without privileges, defaults to true when not running as root")
+	runtimeRoot := flag.String("runtime-root", "", "Absolute path container bundles are created at, defaults to /var/lib/demystifying-cri or $XDG_DATA_HOME/demystifying-cri when rootless")
+	imageRoot := flag.String("image-root", "", "Absolute path images are downloaded to, defaults to images below the runtime root")
+	configFile := flag.String("config", "", "Path of an optional JSON config file")
+	watchConfig := flag.Duration("watch-config", 0, "Reload the config file at this interval whenever it changed, 0 disables reloading")
+	keepBundles := flag.Int("keep-bundles", 0, "Number of removed containers' bundles kept for debugging, 0 deletes them right away")
+	sharedRootfs := flag.Bool("shared-rootfs", true, "Unpack every image once and give containers an overlay on top of it instead of a full copy, not supported in rootless mode")
+	pullTimeout := flag.Duration("image-pull-timeout", 30*time.Minute, "Maximum duration of an image pull, 0 disables the limit")
+	sandboxPullTimeout := flag.Duration("sandbox-image-pull-timeout", time.Minute, "Maximum duration of the sandbox image pull, 0 disables the limit")
+	maxConcurrentPulls := flag.Int("max-concurrent-pulls-per-registry", 0, "Maximum number of concurrent pulls from a registry host, 0 disables the limit")
+	pullsPerMinute := flag.Int("registry-pulls-per-minute", 0, "Maximum rate of pulls from a registry host, 0 disables the limit")
+	reconcileInterval := flag.Duration("reconcile-interval", time.Minute, "How often records are compared with runc list, 0 disables it")
+	logMaxSize := flag.Int64("container-log-max-size", 10*1024*1024, "Size in bytes at which a container log is rotated, 0 disables rotation")
+	logMaxFiles := flag.Int("container-log-max-files", 5, "Number of rotated logs kept per container")
+	podAggregateLogs := flag.Bool("pod-aggregate-logs", false, "Additionally write the output of all containers of a pod to pod.log in its log directory")
+	runcRoot := flag.String("runc-root", "", "Directory runc keeps its state in, defaults to runc's own default")
+	specTemplate := flag.String("spec-template", "", "Path of an OCI spec with the default mounts, env, rlimits and masked paths every container's spec is based on")
+	defaultSeccomp := flag.String("default-seccomp-profile", "", "Path of an OCI seccomp profile applied to containers without a profile of their own")
+	defaultApparmor := flag.String("default-apparmor-profile", "", "AppArmor profile applied to containers without a profile of their own")
+	sandboxSeccomp := flag.String("sandbox-seccomp-profile", "", "Path of an OCI seccomp profile applied to pause containers without a profile of their own, unconfined disables it, defaults to a built-in profile")
+	sandboxApparmor := flag.String("sandbox-apparmor-profile", "", "AppArmor profile applied to pause containers without a profile of their own, unconfined disables it, defaults to --default-apparmor-profile")
+	noNewPrivileges := flag.String("no-new-privileges", "requested", "Which containers can't gain privileges, one of requested, non-root or always")
+	rejectUnsupported := flag.Bool("reject-unsupported", false, "Reject sandboxes and containers using security fields this runtime doesn't implement instead of ignoring them")
+	idScheme := flag.String("id-scheme", "name", "How IDs of sandboxes and containers are generated, one of name or random")
+	containerEvents := flag.Bool("container-events", true, "Serve GetContainerEvents, which Kubelet's evented PLEG relies on")
+	hostPortDNAT := flag.Bool("host-port-dnat", false, "Forward the host ports of pods to their IP with iptables DNAT rules, which needs a network plugin giving pods an IP")
+	postStartCheck := flag.Duration("post-start-check", 0, "Fail StartContainer or RunPodSandbox if the container or pause process exits within this duration, 0 disables the check")
+	preflight := flag.Bool("preflight", false, "Check the environment of the node, print a report and exit")
+	flag.Parse()
+
+	config, err := loadConfig(*configFile)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		log.Fatalf("failed to load config: %v", err)
+	}
+
+	if *pullBackend != "skopeo" && *pullBackend != "native" {
+		log.Fatalf("unknown pull backend %q", *pullBackend)
+	}
+	if *unpackBackend != "umoci" && *unpackBackend != "native" {
+		log.Fatalf("unknown unpack backend %q", *unpackBackend)
+	}
+	if *networkPlugin != "" && *networkPlugin != "cni" && *networkPlugin != "none" {
+		log.Fatalf("unknown network plugin %q", *networkPlugin)
+	}
+	if *hostPortDNAT && *rootless {
+		log.Fatalf("--host-port-dnat is not supported in rootless mode")
+	}
+	if !slices.Contains(noNewPrivilegesPolicies, *noNewPrivileges) {
+		log.Fatalf("unknown no-new-privileges policy %q", *noNewPrivileges)
+	}
+	containerUlimits, err := parseUlimits(*ulimits)
+	if err != nil {
+		log.Fatalf("invalid default ulimits: %v", err)
+	}
+	if !slices.Contains(sandboxImagePullPolicies, *sandboxPolicy) {
+		log.Fatalf("unknown sandbox image pull policy %q", *sandboxPolicy)
+	}
+	if !slices.Contains(idSchemes, *idScheme) {
+		log.Fatalf("unknown ID scheme %q", *idScheme)
+	}
+	var ids idGenerator = nameIDs{}
+	if *idScheme == "random" {
+		ids = randomIDs{}
+	}
+	if *sandboxOOMScoreAdj < -1000 || *sandboxOOMScoreAdj > 1000 {
+		log.Fatalf("sandbox OOM score adjustment %d is out of range", *sandboxOOMScoreAdj)
+	}
+	if *sandboxNice < -20 || *sandboxNice > 19 {
+		log.Fatalf("sandbox nice value %d is out of range", *sandboxNice)
+	}
+	if *maxConcurrentPulls < 0 || *pullsPerMinute < 0 {
+		log.Fatalf("registry pull limits must not be negative")
+	}
+	if *reapInterval <= 0 || *statsInterval <= 0 {
+		log.Fatalf("reap and stats intervals must be positive")
+	}
+	if *imageGCHigh != 0 && (*imageGCLow < 0 || *imageGCLow >= *imageGCHigh || *imageGCHigh > 100 || *imageGCInterval <= 0) {
+		log.Fatalf("image garbage collection needs 0 <= low < high <= 100 and a positive interval")
+	}
+	pullLimiter := newPullLimiter(registryLimits{MaxConcurrentPulls: *maxConcurrentPulls, PullsPerMinute: *pullsPerMinute}, config.Registries)
+	if *runtimeRoot == "" {
+		*runtimeRoot = "/var/lib/demystifying-cri"
+		if *rootless {
+			*runtimeRoot = rootlessRuntimeRoot()
+		}
+	}
+	if *imageRoot == "" {
+		*imageRoot = filepath.Join(*runtimeRoot, "images")
+	}
+	// Mounting the overlay requires privileges, so rootless containers always get a full copy of their image
+	if *rootless {
+		explicit := false
+		flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "shared-rootfs" })
+		if explicit && *sharedRootfs {
+			log.Fatalf("--shared-rootfs is not supported in rootless mode")
+		}
+		*sharedRootfs = false
+	}
+	socketPath := "/var/run/demystifying-cri.sock"
+	if *rootless {
+		socketPath = rootlessSocketPath()
 	}
-	defer lis.Close()
 
 	// Create DemystifyingCRI and initialize maps for storing data about sandboxes, containers, and images
 	s := &DemystifyingCRI{
-		sandboxes:    make(map[string]*runtime.PodSandbox),
-		containers:   make(map[string]*runtime.Container),
-		images:       make(map[string]*runtime.Image),
-		runtimeRoot:  "/var/lib/demystifying-cri",
-		imageRoot:    "/var/lib/demystifying-cri/images",
-		sandboxImage: "registry.k8s.io/pause:3.9",
+		sandboxes:     make(map[string]*sandboxRecord),
+		containers:    make(map[string]*containerRecord),
+		ids:           ids,
+		idScheme:      *idScheme,
+		sandboxIDs:    make(map[string]string),
+		containerIDs:  make(map[string]string),
+		sandboxRuns:   make(map[string]*sandboxRun),
+		exitWatches:   make(map[string]bool),
+		reapInterval:  *reapInterval,
+		statsInterval: *statsInterval,
+		images:        newImageStore(),
+		oci:           &runcBinary{path: "runc", root: *runcRoot, rootless: *rootless},
+		runcRoot:      *runcRoot,
+		stats:         make(map[string]*runtime.ContainerStats),
+		diskUsage:     newDiskUsageCache(*diskUsageTTL),
+		runtimeRoot:   filepath.Clean(*runtimeRoot),
+		imageRoot:     filepath.Clean(*imageRoot),
+		sandboxImage:  "registry.k8s.io/pause:3.9",
+		sandboxPolicy: *sandboxPolicy,
+		slowRPCBudget: *slowRPCBudget,
+		redactedEnv:   strings.Split(strings.ToUpper(*redactEnv), ","),
+		ulimits:       containerUlimits,
+		prepullImages: parseImageList(*prepullImages),
+		debugSocket:   *debugSocket,
+		tcpAddress:    *tcpAddress,
+		authfile:      *authfile,
+		imageSource:   *imageSourceDir,
+		keepBundles:   *keepBundles,
+		sharedRootfs:  *sharedRootfs,
+		rootless:      *rootless,
+		pullBackend:   *pullBackend,
+		unpackBackend: *unpackBackend,
+		metrics:       newRPCMetrics(*metricsNamespaceLabels),
+		networkPlugin: *networkPlugin,
+		hostPortDNAT:  *hostPortDNAT,
+
+		configPath:    *configFile,
+		watchInterval: *watchConfig,
+
+		pullTimeout:        *pullTimeout,
+		sandboxPullTimeout: *sandboxPullTimeout,
+		pullLimiter:        pullLimiter,
+
+		defaultSeccompPath: *defaultSeccomp,
+		specTemplatePath:   *specTemplate,
+		defaultApparmor:    *defaultApparmor,
+		sandboxSeccompPath: *sandboxSeccomp,
+		sandboxApparmor:    *sandboxApparmor,
+		noNewPrivileges:    *noNewPrivileges,
+		rejectUnsupported:  *rejectUnsupported,
+
+		postStartCheck: *postStartCheck,
+
+		sandboxOOMScoreAdj: *sandboxOOMScoreAdj,
+		sandboxNice:        *sandboxNice,
+		sandboxCPUShares:   *sandboxCPUShares,
+
+		pauseCommand: strings.Fields(*sandboxCommand),
+
+		imageGCHigh:   *imageGCHigh,
+		imageGCLow:    *imageGCLow,
+		imageGCMinAge: *imageGCMinAge,
+
+		logMaxSize:       *logMaxSize,
+		logMaxFiles:      *logMaxFiles,
+		podAggregateLogs: *podAggregateLogs,
+
+		maxPods:             *maxPods,
+		maxContainersPerPod: *maxContainersPerPod,
+		pendingContainers:   make(map[string]int),
+	}
+	s.config.Store(config)
+	if *containerEvents {
+		s.events = newContainerEvents()
 	}
 
-	// Create directory for images
-	err = os.MkdirAll(s.imageRoot, 0755)
-	if err != nil {
-		log.Fatalf("failed to create images directory: %v", err)
+	if s.defaultSeccompPath != "" {
+		if s.defaultSeccomp, err = loadSeccompProfile(s.defaultSeccompPath); err != nil {
+			log.Fatalf("failed to load default seccomp profile: %v", err)
+		}
+	}
+	switch s.sandboxSeccompPath {
+	case "":
+		s.sandboxSeccomp = defaultPauseSeccomp()
+	case unconfinedProfile:
+	default:
+		if s.sandboxSeccomp, err = loadSeccompProfile(s.sandboxSeccompPath); err != nil {
+			log.Fatalf("failed to load sandbox seccomp profile: %v", err)
+		}
+	}
+	if s.specTemplatePath != "" {
+		if s.specTemplate, err = loadSpecTemplate(s.specTemplatePath); err != nil {
+			log.Fatalf("failed to load spec template: %v", err)
+		}
 	}
 
-	// Download Sandbox image
-	err = s.downloadImage(s.sandboxImage)
+	s.puller = &skopeoPuller{imageRoot: s.imageRoot, authfile: s.authfile}
+	if s.pullBackend == "native" {
+		s.puller = &nativePuller{imageRoot: s.imageRoot, authfile: s.authfile}
+	}
+	if s.imageSource != "" {
+		s.puller = &localPuller{dir: s.imageSource, imageRoot: s.imageRoot, next: s.puller}
+	}
+	s.unpacker = umociUnpacker{rootless: s.rootless}
+	if s.unpackBackend == "native" {
+		s.unpacker = nativeUnpacker{}
+	}
+
+	// Only report whether the node is able to run the runtime
+	if *preflight {
+		if !s.preflight() {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := validateRoots(*runtimeRoot, *imageRoot); err != nil {
+		log.Fatalf("invalid roots: %v", err)
+	}
+
+	// Collect the exit status of containers, before any of them is started
+	s.enableSubreaper()
+
+	// Never serve the CRI over TCP without authenticating clients
+	var tcpCreds credentials.TransportCredentials
+	if s.tcpAddress != "" {
+		tcpCreds, err = tcpCredentials(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatalf("refusing to listen on %s: %v", s.tcpAddress, err)
+		}
+	}
+
+	lis, err := net.Listen("unix", socketPath)
 	if err != nil {
-		log.Fatalf("failed to download sandbox image: %v", err)
+		log.Fatalf("failed to listen: %v", err)
+	}
+	defer lis.Close()
+
+	// Watch for exited containers
+	go s.reap(s.reapInterval)
+
+	// Pick up changes of the config file without a restart
+	if s.configPath != "" && s.watchInterval > 0 {
+		go s.watchConfig(s.watchInterval)
 	}
 
-	grpcServer := grpc.NewServer()
+	// Repair drift between the records and runc
+	if *reconcileInterval > 0 {
+		go s.reconcile(*reconcileInterval)
+	}
 
-	// Register both RuntimeService and ImageService
-	runtime.RegisterRuntimeServiceServer(grpcServer, s)
-	runtime.RegisterImageServiceServer(grpcServer, s)
+	// Serve debug operations next to the CRI if requested
+	if s.debugSocket != "" {
+		if err := s.serveDebug(); err != nil {
+			log.Fatalf("failed to serve debug socket: %v", err)
+		}
+	}
 
-	fmt.Println("CRI server listening on /var/run/demystifying-cri.sock")
-	if err := grpcServer.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+	// Serve metrics if requested
+	if *metricsAddress != "" {
+		s.serveMetrics(*metricsAddress)
 	}
+
+	// Report NOT_SERVING until the readiness sequence completed
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	s.health = healthServer
+
+	// Record metrics for every call and reject CRI calls until the runtime is ready
+	// Both listeners serve the same services, the TCP one additionally requires TLS
+	newServer := func(opts ...grpc.ServerOption) *grpc.Server {
+		server := grpc.NewServer(append(opts, grpc.ChainUnaryInterceptor(s.metricsInterceptor, s.latencyInterceptor, s.readinessInterceptor))...)
+		runtime.RegisterRuntimeServiceServer(server, s)
+		runtime.RegisterImageServiceServer(server, s)
+		healthpb.RegisterHealthServer(server, healthServer)
+		return server
+	}
+	grpcServer := newServer()
+
+	// Toggle drain mode on SIGUSR1
+	go s.toggleDrainOnSignal()
+
+	serveErr := make(chan error, 2)
+	go func() {
+		serveErr <- grpcServer.Serve(lis)
+	}()
 	defer grpcServer.Stop()
+
+	if s.tcpAddress != "" {
+		tcpLis, err := net.Listen("tcp", s.tcpAddress)
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %v", s.tcpAddress, err)
+		}
+		tcpServer := newServer(grpc.Creds(tcpCreds))
+		go func() {
+			serveErr <- tcpServer.Serve(tcpLis)
+		}()
+		defer tcpServer.Stop()
+		fmt.Printf("CRI server listening on %s with mutual TLS\n", tcpLis.Addr())
+	}
+
+	// Check dependencies and download the sandbox image before accepting CRI calls
+	if err := s.prepare(context.Background()); err != nil {
+		log.Fatalf("failed to start runtime: %v", err)
+	}
+	if *exitEvents {
+		s.enableExitEvents()
+	}
+	s.ready.Store(true)
+
+	// Warm up the image store without delaying readiness
+	go s.prepull(s.prepullImages)
+
+	// Remove unused images once the image filesystem fills up, the images are restored by now
+	if s.imageGCHigh > 0 {
+		go s.imageGC(*imageGCInterval)
+	}
+
+	// Sample container stats in the background, the cgroup version is known by now
+	go s.collectStats(s.statsInterval)
+	if !s.draining.Load() {
+		healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	}
+
+	fmt.Printf("CRI server listening on %s\n", socketPath)
+	if err := <-serveErr; err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
 }
 
 // getImage takes an image and returns the name of the image without the registry
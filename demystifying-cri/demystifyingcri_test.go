@@ -0,0 +1,561 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// testImage is the image newTestRuntime pulls into its image store
+const testImage = "docker.io/library/test:1"
+
+// newTestRuntime returns a runtime running containers with a fakeOCI in a ready sandbox with the ID sandbox
+func newTestRuntime(t *testing.T) (*DemystifyingCRI, *fakeOCI) {
+	t.Helper()
+	oci := newFakeOCI(t)
+	s := &DemystifyingCRI{
+		sandboxes:         make(map[string]*sandboxRecord),
+		containers:        make(map[string]*containerRecord),
+		ids:               nameIDs{},
+		sandboxIDs:        make(map[string]string),
+		containerIDs:      make(map[string]string),
+		sandboxRuns:       make(map[string]*sandboxRun),
+		exitWatches:       make(map[string]bool),
+		images:            newImageStore(),
+		oci:               oci,
+		stats:             make(map[string]*runtime.ContainerStats),
+		diskUsage:         newDiskUsageCache(time.Minute),
+		unpacker:          nativeUnpacker{},
+		runtimeRoot:       t.TempDir(),
+		imageRoot:         t.TempDir(),
+		metrics:           newRPCMetrics(false),
+		subreaper:         true,
+		pendingContainers: make(map[string]int),
+	}
+	s.config.Store(&fileConfig{})
+
+	writeTestImage(t, s.imageRoot, testImage)
+	record, err := s.readImageRecord(testImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.images.add(record)
+
+	// The pause process only has to provide namespaces, which the fake never enters
+	s.sandboxes["sandbox"] = &sandboxRecord{
+		PodSandbox: &runtime.PodSandbox{
+			Id:       "sandbox",
+			Metadata: &runtime.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"},
+			State:    runtime.PodSandboxState_SANDBOX_READY,
+		},
+		config: &runtime.PodSandboxConfig{Metadata: &runtime.PodSandboxMetadata{Name: "pod", Namespace: "default", Uid: "uid"}},
+		pid:    os.Getpid(),
+	}
+	return s, oci
+}
+
+// writeTestImage writes an OCI layout of an image with a single empty layer into imageRoot, where pulls put it
+func writeTestImage(t *testing.T, imageRoot, image string) {
+	t.Helper()
+	var config ociImageConfig
+	config.Config.Cmd = []string{"sleep", "1000"}
+	writeTestImageConfig(t, imageRoot, image, config)
+}
+
+// writeTestImageConfig writes an image like writeTestImage with the given image config
+func writeTestImageConfig(t *testing.T, imageRoot, image string, config ociImageConfig) {
+	t.Helper()
+	layoutPath, tag := splitLayoutReference(filepath.Join(imageRoot, getImage(image)))
+
+	writeBlob := func(mediaType string, data []byte) ociDescriptor {
+		sum := sha256.Sum256(data)
+		descriptor := ociDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		path := layoutBlobPath(layoutPath, descriptor.Digest)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return descriptor
+	}
+	marshal := func(v any) []byte {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	if err := tw.WriteHeader(&tar.Header{Name: "bin/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	configDescriptor := writeBlob("application/vnd.oci.image.config.v1+json", marshal(config))
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeOCIManifest,
+		Config:        &configDescriptor,
+		Layers:        []ociDescriptor{writeBlob("application/vnd.oci.image.layer.v1.tar", layer.Bytes())},
+	}
+	descriptor := writeBlob(mediaTypeOCIManifest, marshal(manifest))
+	descriptor.Annotations = map[string]string{"org.opencontainers.image.ref.name": tag}
+	if err := writeLayoutIndex(layoutPath, tag, descriptor); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestContainer creates a container with the given name from testImage in the sandbox of newTestRuntime
+func createTestContainer(t *testing.T, s *DemystifyingCRI, name string) string {
+	t.Helper()
+	resp, err := s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+		PodSandboxId: "sandbox",
+		Config: &runtime.ContainerConfig{
+			Metadata: &runtime.ContainerMetadata{Name: name},
+			Image:    &runtime.ImageSpec{Image: testImage},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	return resp.ContainerId
+}
+
+// containerSpec returns the config.json runc reads for a container
+func containerSpec(t *testing.T, s *DemystifyingCRI, containerID string) *rspec.Spec {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(s.runtimeRoot, containerID, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return &spec
+}
+
+// containerState returns the status of a container, failing the test if it doesn't exist
+func containerState(t *testing.T, s *DemystifyingCRI, containerID string) *runtime.ContainerStatus {
+	t.Helper()
+	resp, err := s.ContainerStatus(context.Background(), &runtime.ContainerStatusRequest{ContainerId: containerID})
+	if err != nil {
+		t.Fatalf("ContainerStatus: %v", err)
+	}
+	return resp.Status
+}
+
+func TestContainerLifecycle(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+
+	containerID := createTestContainer(t, s, "app")
+	if state := containerState(t, s, containerID).State; state != runtime.ContainerState_CONTAINER_CREATED {
+		t.Fatalf("state after create = %v, want CONTAINER_CREATED", state)
+	}
+	if _, err := os.Stat(filepath.Join(s.runtimeRoot, containerID, "config.json")); err != nil {
+		t.Fatalf("bundle was not created: %v", err)
+	}
+
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+	started := containerState(t, s, containerID)
+	if started.State != runtime.ContainerState_CONTAINER_RUNNING || started.StartedAt == 0 {
+		t.Fatalf("status after start = %v started at %d, want CONTAINER_RUNNING with a start time", started.State, started.StartedAt)
+	}
+
+	if _, err := s.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: containerID, Timeout: 10}); err != nil {
+		t.Fatalf("StopContainer: %v", err)
+	}
+	stopped := containerState(t, s, containerID)
+	if stopped.State != runtime.ContainerState_CONTAINER_EXITED || stopped.ExitCode != 143 || stopped.Reason != "Error" {
+		t.Fatalf("status after stop = %v exit code %d reason %q, want CONTAINER_EXITED with 143 and Error", stopped.State, stopped.ExitCode, stopped.Reason)
+	}
+
+	if _, err := s.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("RemoveContainer: %v", err)
+	}
+	list, err := s.ListContainers(ctx, &runtime.ListContainersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Containers) != 0 {
+		t.Errorf("ListContainers after remove = %v, want none", list.Containers)
+	}
+	if _, err := os.Stat(filepath.Join(s.runtimeRoot, containerID)); !os.IsNotExist(err) {
+		t.Errorf("bundle still exists after remove: %v", err)
+	}
+
+	want := []string{"create " + containerID, "start " + containerID, "kill " + containerID + " 15", "delete " + containerID}
+	if !slices.Equal(oci.calls, want) {
+		t.Errorf("runtime calls = %q, want %q", oci.calls, want)
+	}
+}
+
+func TestContainerTimestampsAreMonotonic(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	containerID := createTestContainer(t, s, "app")
+	if created := containerState(t, s, containerID); created.CreatedAt == 0 || created.StartedAt != 0 || created.FinishedAt != 0 {
+		t.Fatalf("timestamps after create = %d, %d, %d, want only CreatedAt", created.CreatedAt, created.StartedAt, created.FinishedAt)
+	}
+	if _, err := s.StartContainer(context.Background(), &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+
+	// The container exits on its own, so the reaper is what observes the exit
+	if err := oci.Kill(containerID, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.processAlive(containerID); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("container process didn't exit")
+		}
+	}
+	s.markExited(containerID)
+
+	exited := containerState(t, s, containerID)
+	if exited.State != runtime.ContainerState_CONTAINER_EXITED || exited.ExitCode != 137 {
+		t.Fatalf("status after exit = %v exit code %d, want CONTAINER_EXITED with 137", exited.State, exited.ExitCode)
+	}
+	if exited.CreatedAt == 0 || exited.StartedAt < exited.CreatedAt || exited.FinishedAt < exited.StartedAt {
+		t.Errorf("CreatedAt %d, StartedAt %d, FinishedAt %d, want them set in this order", exited.CreatedAt, exited.StartedAt, exited.FinishedAt)
+	}
+}
+
+func TestCreateEphemeralContainerJoinsTarget(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+	createdID := createTestContainer(t, s, "created")
+	targetID := createTestContainer(t, s, "app")
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: targetID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+
+	createDebug := func(name, target string) (*runtime.CreateContainerResponse, error) {
+		return s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+			PodSandboxId: "sandbox",
+			Config: &runtime.ContainerConfig{
+				Metadata: &runtime.ContainerMetadata{Name: name},
+				Image:    &runtime.ImageSpec{Image: testImage},
+				Linux: &runtime.LinuxContainerConfig{SecurityContext: &runtime.LinuxContainerSecurityContext{
+					NamespaceOptions: &runtime.NamespaceOption{Pid: runtime.NamespaceMode_TARGET, TargetId: target},
+				}},
+			},
+		})
+	}
+
+	resp, err := createDebug("debugger", targetID)
+	if err != nil {
+		t.Fatalf("CreateContainer targeting %s: %v", targetID, err)
+	}
+	want := fmt.Sprintf("/proc/%d/ns/pid", oci.containers[targetID].process.Pid)
+	var joined string
+	for _, namespace := range containerSpec(t, s, resp.ContainerId).Linux.Namespaces {
+		if namespace.Type == rspec.PIDNamespace {
+			joined = namespace.Path
+		}
+	}
+	if joined != want {
+		t.Errorf("PID namespace of the ephemeral container = %q, want %q of the target", joined, want)
+	}
+
+	if _, err := createDebug("missing", "missing"); status.Code(err) != codes.NotFound {
+		t.Errorf("CreateContainer targeting a missing container = %v, want NotFound", err)
+	}
+	if _, err := createDebug("early", createdID); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CreateContainer targeting a created container = %v, want FailedPrecondition", err)
+	}
+}
+
+func TestRemoveRunningContainer(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+
+	containerID := createTestContainer(t, s, "app")
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+	if _, err := s.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("RemoveContainer: %v", err)
+	}
+	if _, exists := oci.containers[containerID]; exists {
+		t.Errorf("container %s still exists in the runtime", containerID)
+	}
+	if _, err := s.ContainerStatus(ctx, &runtime.ContainerStatusRequest{ContainerId: containerID}); err == nil {
+		t.Errorf("ContainerStatus after remove succeeded, want an error")
+	}
+}
+
+func TestContainerHandlerErrors(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	ctx := context.Background()
+
+	containerID := createTestContainer(t, s, "app")
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"start twice", func() error {
+			_, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID})
+			return err
+		}, codes.FailedPrecondition},
+		{"start unknown", func() error {
+			_, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: "unknown"})
+			return err
+		}, codes.NotFound},
+		{"create from unpulled image", func() error {
+			_, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+				PodSandboxId: "sandbox",
+				Config: &runtime.ContainerConfig{
+					Metadata: &runtime.ContainerMetadata{Name: "other"},
+					Image:    &runtime.ImageSpec{Image: "docker.io/library/missing:1"},
+				},
+			})
+			return err
+		}, codes.NotFound},
+		{"stop unknown", func() error {
+			_, err := s.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: "unknown"})
+			return err
+		}, codes.NotFound},
+		{"remove unknown", func() error {
+			_, err := s.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: "unknown"})
+			return err
+		}, codes.OK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.call(); status.Code(err) != test.want {
+				t.Errorf("error = %v, want code %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestCreateContainerIsIdempotent(t *testing.T) {
+	s, oci := newTestRuntime(t)
+
+	first := createTestContainer(t, s, "app")
+	second := createTestContainer(t, s, "app")
+	if first != second {
+		t.Errorf("second create returned %s, want the existing container %s", second, first)
+	}
+	if creates := strings.Count(strings.Join(oci.calls, "\n"), "create "); creates != 1 {
+		t.Errorf("runtime created %d containers, want 1", creates)
+	}
+}
+
+func TestCreateContainerReplacesExitedContainer(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+
+	first := startTestContainers(t, s, "app")[0]
+	if _, err := s.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: first, Timeout: 10}); err != nil {
+		t.Fatalf("StopContainer: %v", err)
+	}
+	exited := containerState(t, s, first)
+
+	second := createTestContainer(t, s, "app")
+	if second != first {
+		t.Errorf("recreate returned %s, want the name based ID %s", second, first)
+	}
+	recreated := containerState(t, s, second)
+	if recreated.State != runtime.ContainerState_CONTAINER_CREATED || recreated.StartedAt != 0 {
+		t.Errorf("recreated container is %v started at %d, want a fresh created container", recreated.State, recreated.StartedAt)
+	}
+	if recreated.CreatedAt <= exited.CreatedAt {
+		t.Errorf("recreated container created at %d, want after %d", recreated.CreatedAt, exited.CreatedAt)
+	}
+
+	calls := strings.Join(oci.calls, "\n")
+	if want := "delete " + first + "\ncreate " + first; !strings.Contains(calls, want) {
+		t.Errorf("runtime calls = %q, want the exited container deleted before it is created again", oci.calls)
+	}
+
+	// Only exited containers are replaced, a created one is still returned as is
+	creates := strings.Count(calls, "create ")
+	if again := createTestContainer(t, s, "app"); again != second {
+		t.Errorf("create of a created container returned %s, want %s", again, second)
+	}
+	if after := strings.Count(strings.Join(oci.calls, "\n"), "create "); after != creates {
+		t.Errorf("runtime created %d containers, want %d", after, creates)
+	}
+}
+
+func TestContainerStatusReportsResources(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+
+	requested := &runtime.LinuxContainerResources{CpuPeriod: 100000, CpuQuota: 50000, CpuShares: 512, MemoryLimitInBytes: 64 << 20, CpusetCpus: "0"}
+	resp, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+		PodSandboxId: "sandbox",
+		Config: &runtime.ContainerConfig{
+			Metadata: &runtime.ContainerMetadata{Name: "app"},
+			Image:    &runtime.ImageSpec{Image: testImage},
+			Linux:    &runtime.LinuxContainerConfig{Resources: requested},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	if reported := containerState(t, s, resp.ContainerId).GetResources().GetLinux(); !proto.Equal(reported, requested) {
+		t.Errorf("resources after create = %v, want %v", reported, requested)
+	}
+
+	updated := &runtime.LinuxContainerResources{CpuPeriod: 100000, CpuQuota: 20000, MemoryLimitInBytes: 128 << 20}
+	if _, err := s.UpdateContainerResources(ctx, &runtime.UpdateContainerResourcesRequest{ContainerId: resp.ContainerId, Linux: updated}); err != nil {
+		t.Fatalf("UpdateContainerResources: %v", err)
+	}
+	if reported := containerState(t, s, resp.ContainerId).GetResources().GetLinux(); !proto.Equal(reported, updated) {
+		t.Errorf("resources after update = %v, want %v", reported, updated)
+	}
+	if len(oci.updates) != 1 || *oci.updates[0].CPU.Quota != 20000 || *oci.updates[0].Memory.Limit != 128<<20 {
+		t.Errorf("runtime updates = %+v, want quota 20000 and memory limit %d", oci.updates, 128<<20)
+	}
+
+	// Invalid limits are rejected without reaching the runtime or replacing the reported ones
+	invalid := &runtime.LinuxContainerResources{CpusetCpus: "3-1"}
+	if _, err := s.UpdateContainerResources(ctx, &runtime.UpdateContainerResourcesRequest{ContainerId: resp.ContainerId, Linux: invalid}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("UpdateContainerResources with cpuset 3-1 = %v, want InvalidArgument", err)
+	}
+	if reported := containerState(t, s, resp.ContainerId).GetResources().GetLinux(); !proto.Equal(reported, updated) {
+		t.Errorf("resources after rejected update = %v, want %v", reported, updated)
+	}
+	if len(oci.updates) != 1 {
+		t.Errorf("runtime got %d updates, want 1", len(oci.updates))
+	}
+}
+
+func TestListContainersSkipsExternalContainers(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+
+	// Containers of other tools and ones without a record, e.g. left behind by a crash, both show up in runc list
+	if err := oci.Run("external", t.TempDir(), runtimeIO{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := oci.Run("orphan", filepath.Join(s.runtimeRoot, "orphan"), runtimeIO{}); err != nil {
+		t.Fatal(err)
+	}
+	containerID := createTestContainer(t, s, "app")
+	s.reconcileOnce(make(map[string]bool))
+
+	resp, err := s.ListContainers(ctx, &runtime.ListContainersRequest{})
+	if err != nil {
+		t.Fatalf("ListContainers: %v", err)
+	}
+	var ids []string
+	for _, container := range resp.Containers {
+		ids = append(ids, container.Id)
+	}
+	if !slices.Equal(ids, []string{containerID}) {
+		t.Errorf("ListContainers = %q, want only %q", ids, containerID)
+	}
+}
+
+func TestListDuringChurn(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	ctx := context.Background()
+	stable := createTestContainer(t, s, "stable")
+
+	// Containers are created, started and removed while others list them
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				resp, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+					PodSandboxId: "sandbox",
+					Config: &runtime.ContainerConfig{
+						Metadata: &runtime.ContainerMetadata{Name: fmt.Sprintf("churn-%d-%d", worker, i)},
+						Image:    &runtime.ImageSpec{Image: testImage},
+					},
+				})
+				if err != nil {
+					t.Errorf("CreateContainer: %v", err)
+					return
+				}
+				if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: resp.ContainerId}); err != nil {
+					t.Errorf("StartContainer: %v", err)
+				}
+				if _, err := s.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: resp.ContainerId}); err != nil {
+					t.Errorf("RemoveContainer: %v", err)
+				}
+			}
+		}(worker)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var snapshot *runtime.Container
+	for listing := true; listing; {
+		select {
+		case <-done:
+			listing = false
+		default:
+		}
+		containers, err := s.ListContainers(ctx, &runtime.ListContainersRequest{})
+		if err != nil {
+			t.Fatalf("ListContainers: %v", err)
+		}
+		for _, container := range containers.Containers {
+			if container.Id == "" || container.Metadata == nil || container.PodSandboxId != "sandbox" {
+				t.Fatalf("ListContainers returned the partial container %v", container)
+			}
+			if container.Id == stable {
+				snapshot = container
+			}
+		}
+		if !slices.ContainsFunc(containers.Containers, func(c *runtime.Container) bool { return c.Id == stable }) {
+			t.Fatalf("ListContainers during churn lacks the container %s which exists throughout", stable)
+		}
+		sandboxes, err := s.ListPodSandbox(ctx, &runtime.ListPodSandboxRequest{})
+		if err != nil {
+			t.Fatalf("ListPodSandbox: %v", err)
+		}
+		if len(sandboxes.Items) != 1 || sandboxes.Items[0].Id != "sandbox" {
+			t.Fatalf("ListPodSandbox during churn = %v, want only the sandbox", sandboxes.Items)
+		}
+	}
+
+	// Listed containers are copies, which don't change along with the container
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: stable}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+	if snapshot.State != runtime.ContainerState_CONTAINER_CREATED {
+		t.Errorf("listed container changed to %v after it was started, want the state at the time of the listing", snapshot.State)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+// diskUsage is what a container occupies on disk, measured like du in allocated blocks
+type diskUsage struct {
+	writableBytes  uint64 // Blocks of the container's writable layer
+	writableInodes uint64 // Files and directories of the container's writable layer
+	logBytes       uint64 // Blocks of the container's log including its rotated files
+	sampledAt      time.Time
+}
+
+// diskUsageCache keeps the last walk of every container, as walking a large rootfs on every stats call is expensive
+type diskUsageCache struct {
+	ttl time.Duration // How long a walk is reused, 0 walks on every call
+
+	mu      sync.Mutex
+	entries map[string]diskUsage
+}
+
+// newDiskUsageCache returns an empty cache reusing walks for ttl
+func newDiskUsageCache(ttl time.Duration) *diskUsageCache {
+	return &diskUsageCache{
+		ttl:     ttl,
+		entries: make(map[string]diskUsage),
+	}
+}
+
+// containerDiskUsage returns the disk usage of a container, walking its bundle only if the cached walk expired
+func (s *DemystifyingCRI) containerDiskUsage(ctx context.Context, containerID, logPath string) (diskUsage, error) {
+	s.diskUsage.mu.Lock()
+	cached, exists := s.diskUsage.entries[containerID]
+	s.diskUsage.mu.Unlock()
+	if exists && time.Since(cached.sampledAt) < s.diskUsage.ttl {
+		return cached, nil
+	}
+
+	// With an overlay rootfs only upper is the container's own, otherwise the whole rootfs is a private copy
+	bundlePath := filepath.Join(s.runtimeRoot, containerID)
+	writablePath := filepath.Join(bundlePath, "upper")
+	if _, err := os.Stat(writablePath); err != nil {
+		writablePath = filepath.Join(bundlePath, "rootfs")
+	}
+
+	usage := diskUsage{sampledAt: time.Now()}
+	var err error
+	usage.writableBytes, usage.writableInodes, err = walkDiskUsage(ctx, writablePath)
+	if err != nil {
+		return diskUsage{}, fmt.Errorf("failed to measure writable layer of container %s: %w", containerID, err)
+	}
+	if logPath != "" {
+		usage.logBytes = logDiskUsage(logPath)
+	}
+
+	s.diskUsage.mu.Lock()
+	s.diskUsage.entries[containerID] = usage
+	s.diskUsage.mu.Unlock()
+	return usage, nil
+}
+
+// forgetDiskUsage drops the cached walk of a removed container
+func (s *DemystifyingCRI) forgetDiskUsage(containerID string) {
+	s.diskUsage.mu.Lock()
+	delete(s.diskUsage.entries, containerID)
+	s.diskUsage.mu.Unlock()
+}
+
+// walkDiskUsage sums up the allocated bytes and inodes below root without crossing into other filesystems
+// Hard links are counted once, and files vanishing during the walk are skipped, as the container keeps writing
+func walkDiskUsage(ctx context.Context, root string) (bytes, inodes uint64, err error) {
+	var rootStat syscall.Stat_t
+	if err := syscall.Lstat(root, &rootStat); err != nil {
+		return 0, 0, err
+	}
+
+	type inode struct{ dev, ino uint64 }
+	seen := make(map[inode]struct{})
+
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		var stat syscall.Stat_t
+		if err := syscall.Lstat(path, &stat); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if uint64(stat.Dev) != uint64(rootStat.Dev) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if stat.Nlink > 1 && !entry.IsDir() {
+			key := inode{uint64(stat.Dev), stat.Ino}
+			if _, counted := seen[key]; counted {
+				return nil
+			}
+			seen[key] = struct{}{}
+		}
+
+		bytes += uint64(stat.Blocks) * 512
+		inodes++
+		return nil
+	})
+	return bytes, inodes, err
+}
+
+// logDiskUsage returns the allocated bytes of a log file and the files it was rotated to
+func logDiskUsage(logPath string) uint64 {
+	var bytes uint64
+	for i := 0; ; i++ {
+		path := logPath
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", logPath, i)
+		}
+		var stat syscall.Stat_t
+		if err := syscall.Stat(path, &stat); err != nil {
+			// The current file may be missing while rotating, the rotated ones end at the first gap
+			if i > 0 {
+				return bytes
+			}
+			continue
+		}
+		bytes += uint64(stat.Blocks) * 512
+	}
+}
+
+// withWritableLayer returns a copy of cached stats with the container's writable layer usage added
+// The cached stats are shared with other callers, so they are never modified
+func (s *DemystifyingCRI) withWritableLayer(ctx context.Context, stats *runtime.ContainerStats, containerID, logPath string) (*runtime.ContainerStats, error) {
+	usage, err := s.containerDiskUsage(ctx, containerID, logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &runtime.ContainerStats{
+		Attributes: stats.GetAttributes(),
+		Cpu:        stats.GetCpu(),
+		Memory:     stats.GetMemory(),
+		Swap:       stats.GetSwap(),
+		WritableLayer: &runtime.FilesystemUsage{
+			Timestamp:  statsTimestamp(usage.sampledAt),
+			FsId:       &runtime.FilesystemIdentifier{Mountpoint: s.runtimeRoot},
+			UsedBytes:  &runtime.UInt64Value{Value: usage.writableBytes},
+			InodesUsed: &runtime.UInt64Value{Value: usage.writableInodes},
+		},
+	}, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+)
+
+// hostResolvConf is where the nameservers of the node are read from if the DNS config of a pod names none
+const hostResolvConf = "/etc/resolv.conf"
+
+// clusterNdots is what Kubelet sets for pods resolving through the cluster DNS, so short service names are tried with the search domains first
+const clusterNdots = "ndots:5"
+
+// maxNameservers is how many nameservers the resolver of glibc and musl uses, more are ignored
+const maxNameservers = 3
+
+// writeResolvConf writes the resolv.conf of a pod into the bundle of its sandbox and returns its path
+// Pods without DNS config keep whatever resolv.conf their images contain, so nothing is written for them
+func writeResolvConf(bundlePath string, config *runtime.DNSConfig) (string, error) {
+	if len(config.GetServers()) == 0 && len(config.GetSearches()) == 0 && len(config.GetOptions()) == 0 {
+		return "", nil
+	}
+
+	var host []byte
+	if len(config.GetServers()) == 0 {
+		var err error
+		if host, err = os.ReadFile(hostResolvConf); err != nil {
+			log.Printf("failed to read nameservers of the node from %s: %v", hostResolvConf, err)
+		}
+	}
+
+	path := filepath.Join(bundlePath, "resolv.conf")
+	if err := os.WriteFile(path, buildResolvConf(config, host), 0644); err != nil {
+		return "", fmt.Errorf("failed to write resolv.conf: %v", err)
+	}
+	return path, nil
+}
+
+// buildResolvConf renders the DNS config of a pod, taking the nameservers from the node's resolv.conf if the config names none
+// Duplicates are dropped and of options with the same name, like ndots, the last one wins
+func buildResolvConf(config *runtime.DNSConfig, host []byte) []byte {
+	servers := config.GetServers()
+	if len(servers) == 0 {
+		scanner := bufio.NewScanner(bytes.NewReader(host))
+		for scanner.Scan() {
+			if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, fields[1])
+			}
+		}
+	}
+	servers = uniqueStrings(servers)
+	if len(servers) > maxNameservers {
+		log.Printf("only the first %d of the nameservers %v are used", maxNameservers, servers)
+	}
+
+	searches := uniqueStrings(config.GetSearches())
+	options := config.GetOptions()
+	// Kubelet always passes ndots for pods using the cluster DNS, whose search domains are below svc
+	if !hasOption(options, "ndots") && hasClusterSearch(searches) {
+		options = append([]string{clusterNdots}, options...)
+	}
+
+	var b strings.Builder
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(searches) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(searches, " "))
+	}
+	if options = uniqueOptions(options); len(options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	}
+	return []byte(b.String())
+}
+
+// uniqueStrings returns values without duplicates, keeping the first occurrence of each
+func uniqueStrings(values []string) []string {
+	var unique []string
+	for _, value := range values {
+		if !slices.Contains(unique, value) {
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// uniqueOptions returns resolver options with a single occurrence per name, taking the value of the last one
+func uniqueOptions(options []string) []string {
+	var unique []string
+	for i, option := range options {
+		name, _, _ := strings.Cut(option, ":")
+		if !hasOption(options[i+1:], name) {
+			unique = append(unique, option)
+		}
+	}
+	return unique
+}
+
+// hasOption reports whether options contain an option with the given name, with or without value
+func hasOption(options []string, name string) bool {
+	for _, option := range options {
+		if optionName, _, _ := strings.Cut(option, ":"); optionName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasClusterSearch reports whether the search domains are the ones Kubelet sets for the cluster DNS, e.g. default.svc.cluster.local
+func hasClusterSearch(searches []string) bool {
+	for _, search := range searches {
+		if strings.Contains(search, ".svc.") || strings.HasPrefix(search, "svc.") {
+			return true
+		}
+	}
+	return false
+}
+
+// buildHosts renders the hosts file of a pod, which resolves localhost and the pod's hostname to the loopback interface
+// Kubelet mounts a hosts file of its own into pods outside the host network, which replaces it
+func buildHosts(hostname string) []byte {
+	var hosts bytes.Buffer
+	hosts.WriteString("127.0.0.1\tlocalhost\n")
+	hosts.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	if hostname != "" {
+		fmt.Fprintf(&hosts, "127.0.1.1\t%s\n", hostname)
+	}
+	return hosts.Bytes()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestBuildResolvConf(t *testing.T) {
+	host := []byte("# generated by the node\nnameserver 192.168.0.1\nnameserver 192.168.0.2\nsearch lan\noptions edns0\n")
+	tests := []struct {
+		name   string
+		config *runtime.DNSConfig
+		want   string
+	}{
+		{
+			"cluster DNS gets ndots 5",
+			&runtime.DNSConfig{Servers: []string{"10.96.0.10"}, Searches: []string{"default.svc.cluster.local", "svc.cluster.local", "cluster.local"}},
+			"nameserver 10.96.0.10\nsearch default.svc.cluster.local svc.cluster.local cluster.local\noptions ndots:5\n",
+		},
+		{
+			"options are kept",
+			&runtime.DNSConfig{Servers: []string{"10.96.0.10"}, Searches: []string{"default.svc.cluster.local"}, Options: []string{"ndots:2", "edns0"}},
+			"nameserver 10.96.0.10\nsearch default.svc.cluster.local\noptions ndots:2 edns0\n",
+		},
+		{
+			"no ndots outside the cluster DNS",
+			&runtime.DNSConfig{Servers: []string{"8.8.8.8"}, Searches: []string{"example.com"}},
+			"nameserver 8.8.8.8\nsearch example.com\n",
+		},
+		{
+			"duplicates are dropped and the last option wins",
+			&runtime.DNSConfig{Servers: []string{"8.8.8.8", "8.8.8.8"}, Searches: []string{"a.com", "a.com"}, Options: []string{"ndots:1", "edns0", "ndots:3"}},
+			"nameserver 8.8.8.8\nsearch a.com\noptions edns0 ndots:3\n",
+		},
+		{
+			"nameservers of the node without servers",
+			&runtime.DNSConfig{Searches: []string{"example.com"}},
+			"nameserver 192.168.0.1\nnameserver 192.168.0.2\nsearch example.com\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(buildResolvConf(test.config, host)); got != test.want {
+				t.Errorf("buildResolvConf(%v) = %q, want %q", test.config, got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteResolvConfSkipsPodsWithoutDNSConfig(t *testing.T) {
+	for _, config := range []*runtime.DNSConfig{nil, {}} {
+		path, err := writeResolvConf(t.TempDir(), config)
+		if err != nil || path != "" {
+			t.Errorf("writeResolvConf(%v) = %q, %v, want no resolv.conf", config, path, err)
+		}
+	}
+}
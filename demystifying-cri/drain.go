@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// setDraining toggles drain mode, in which no new pods or containers are accepted while existing ones keep running
+// The health endpoint reports NOT_SERVING while draining, so node tooling can see that the runtime takes no new work
+func (s *DemystifyingCRI) setDraining(draining bool) {
+	if s.draining.Swap(draining) == draining {
+		return
+	}
+
+	servingStatus := healthpb.HealthCheckResponse_SERVING
+	if draining || !s.ready.Load() {
+		servingStatus = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	if s.health != nil {
+		s.health.SetServingStatus("", servingStatus)
+	}
+	if draining {
+		log.Printf("drain mode enabled, no new pods or containers are accepted")
+	} else {
+		log.Printf("drain mode disabled")
+	}
+}
+
+// checkDraining rejects creating new pods and containers in drain mode
+func (s *DemystifyingCRI) checkDraining() error {
+	if s.draining.Load() {
+		return status.Error(codes.Unavailable, "runtime is draining and accepts no new pods or containers")
+	}
+	return nil
+}
+
+// toggleDrainOnSignal flips drain mode on every SIGUSR1
+func (s *DemystifyingCRI) toggleDrainOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		s.setDraining(!s.draining.Load())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// eventBuffer is how many events a subscriber may lag behind before its stream is ended
+const eventBuffer = 128
+
+// containerEvents fans out container lifecycle events to all GetContainerEvents streams
+type containerEvents struct {
+	mu          sync.Mutex
+	subscribers map[chan *runtime.ContainerEventResponse]struct{}
+}
+
+// newContainerEvents returns a broker without subscribers
+func newContainerEvents() *containerEvents {
+	return &containerEvents{subscribers: make(map[chan *runtime.ContainerEventResponse]struct{})}
+}
+
+// subscribe returns a channel receiving all future events and a function to unsubscribe
+// The channel is closed once the subscriber fell behind by more than eventBuffer events
+func (e *containerEvents) subscribe() (<-chan *runtime.ContainerEventResponse, func()) {
+	events := make(chan *runtime.ContainerEventResponse, eventBuffer)
+
+	e.mu.Lock()
+	e.subscribers[events] = struct{}{}
+	e.mu.Unlock()
+
+	return events, func() {
+		e.mu.Lock()
+		delete(e.subscribers, events)
+		e.mu.Unlock()
+	}
+}
+
+// publish hands an event to all subscribers without blocking the caller
+// A subscriber which is too slow would silently miss the event, so it is unsubscribed and its channel closed instead,
+// which ends its stream and makes Kubelet subscribe again, starting over with a snapshot
+func (e *containerEvents) publish(event *runtime.ContainerEventResponse) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for events := range e.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Printf("ending the event stream of a subscriber lagging more than %d events behind at %s event of container %s", eventBuffer, event.ContainerEventType, event.ContainerId)
+			delete(e.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// emitContainerEvent publishes a lifecycle event of a container in a sandbox, the caller must hold s.mu
+func (s *DemystifyingCRI) emitContainerEvent(sandboxID, containerID string, eventType runtime.ContainerEventType) {
+	if s.events == nil {
+		return
+	}
+	s.events.publish(s.containerEvent(sandboxID, containerID, eventType, time.Now().UnixNano()))
+}
+
+// containerEvent returns an event of a container in a sandbox, the caller must hold s.mu
+// It carries the status of the sandbox and of all containers in it, which Kubelet reconciles the pod with,
+// so a deleted container is missing from the statuses of its own event
+func (s *DemystifyingCRI) containerEvent(sandboxID, containerID string, eventType runtime.ContainerEventType, createdAt int64) *runtime.ContainerEventResponse {
+	event := &runtime.ContainerEventResponse{
+		ContainerId:        containerID,
+		ContainerEventType: eventType,
+		CreatedAt:          createdAt,
+	}
+	for _, container := range s.containers {
+		if container.PodSandboxId == sandboxID {
+			event.ContainersStatuses = append(event.ContainersStatuses, container.status())
+		}
+	}
+	if sandbox, exists := s.sandboxes[sandboxID]; exists {
+		event.PodSandboxStatus = sandbox.status()
+	}
+	return event
+}
+
+// stateEvents maps container states to the event a subscriber would have seen when the container entered it
+var stateEvents = map[runtime.ContainerState]runtime.ContainerEventType{
+	runtime.ContainerState_CONTAINER_CREATED: runtime.ContainerEventType_CONTAINER_CREATED_EVENT,
+	runtime.ContainerState_CONTAINER_RUNNING: runtime.ContainerEventType_CONTAINER_STARTED_EVENT,
+	runtime.ContainerState_CONTAINER_EXITED:  runtime.ContainerEventType_CONTAINER_STOPPED_EVENT,
+}
+
+// containerEventSnapshot returns an event for every known container reporting its current state
+func (s *DemystifyingCRI) containerEventSnapshot() []*runtime.ContainerEventResponse {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	var snapshot []*runtime.ContainerEventResponse
+	for _, container := range s.containers {
+		if eventType, known := stateEvents[container.State]; known {
+			snapshot = append(snapshot, s.containerEvent(container.PodSandboxId, container.Id, eventType, now))
+		}
+	}
+	return snapshot
+}
+
+// GetContainerEvents streams container lifecycle events until the client goes away
+// A new subscriber first receives the current state of all containers, so it doesn't depend on having seen earlier events
+func (s *DemystifyingCRI) GetContainerEvents(req *runtime.GetEventsRequest, stream grpc.ServerStreamingServer[runtime.ContainerEventResponse]) error {
+	if s.events == nil {
+		return status.Error(codes.Unimplemented, "container events are disabled")
+	}
+
+	// Subscribe before taking the snapshot, so no change falls in between
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	for _, event := range s.containerEventSnapshot() {
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-events:
+			if !ok {
+				return status.Errorf(codes.ResourceExhausted, "subscriber fell more than %d events behind, subscribe again", eventBuffer)
+			}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
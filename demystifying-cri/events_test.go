@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeEventStream is a GetContainerEvents stream handing the sent events to the test
+type fakeEventStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *runtime.ContainerEventResponse
+}
+
+func (f *fakeEventStream) Context() context.Context {
+	return f.ctx
+}
+
+func (f *fakeEventStream) Send(event *runtime.ContainerEventResponse) error {
+	f.events <- event
+	return nil
+}
+
+// nextEvent returns the next event sent on the stream, failing the test if none arrives
+func (f *fakeEventStream) nextEvent(t *testing.T) *runtime.ContainerEventResponse {
+	t.Helper()
+	select {
+	case event := <-f.events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event was sent")
+		return nil
+	}
+}
+
+func TestGetContainerEventsSendsSnapshotFirst(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	s.events = newContainerEvents()
+
+	containerID := createTestContainer(t, s, "app")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeEventStream{ctx: ctx, events: make(chan *runtime.ContainerEventResponse)}
+	done := make(chan error)
+	go func() {
+		done <- s.GetContainerEvents(&runtime.GetEventsRequest{}, stream)
+	}()
+
+	snapshot := stream.nextEvent(t)
+	if snapshot.ContainerId != containerID || snapshot.ContainerEventType != runtime.ContainerEventType_CONTAINER_CREATED_EVENT {
+		t.Fatalf("first event = %s of %s, want the CONTAINER_CREATED_EVENT of %s", snapshot.ContainerEventType, snapshot.ContainerId, containerID)
+	}
+	if snapshot.PodSandboxStatus.GetId() != "sandbox" || len(snapshot.ContainersStatuses) != 1 {
+		t.Errorf("snapshot event carries sandbox %q and %d container statuses, want sandbox and 1", snapshot.PodSandboxStatus.GetId(), len(snapshot.ContainersStatuses))
+	}
+
+	if _, err := s.StartContainer(context.Background(), &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+	if started := stream.nextEvent(t); started.ContainerId != containerID || started.ContainerEventType != runtime.ContainerEventType_CONTAINER_STARTED_EVENT {
+		t.Errorf("event after start = %s of %s, want the CONTAINER_STARTED_EVENT of %s", started.ContainerEventType, started.ContainerId, containerID)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("GetContainerEvents after the client went away = %v, want nil", err)
+	}
+}
+
+func TestContainerEventsCarryPodStatus(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	s.events = newContainerEvents()
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+	ctx := context.Background()
+
+	sidecarID := createTestContainer(t, s, "sidecar")
+	containerID := createTestContainer(t, s, "app")
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+	if _, err := s.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: containerID, Timeout: 10}); err != nil {
+		t.Fatalf("StopContainer: %v", err)
+	}
+	if _, err := s.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("RemoveContainer: %v", err)
+	}
+
+	tests := []struct {
+		containerID string
+		eventType   runtime.ContainerEventType
+		state       runtime.ContainerState // State of the container reported by the event itself
+		statuses    int
+	}{
+		{sidecarID, runtime.ContainerEventType_CONTAINER_CREATED_EVENT, runtime.ContainerState_CONTAINER_CREATED, 1},
+		{containerID, runtime.ContainerEventType_CONTAINER_CREATED_EVENT, runtime.ContainerState_CONTAINER_CREATED, 2},
+		{containerID, runtime.ContainerEventType_CONTAINER_STARTED_EVENT, runtime.ContainerState_CONTAINER_RUNNING, 2},
+		{containerID, runtime.ContainerEventType_CONTAINER_STOPPED_EVENT, runtime.ContainerState_CONTAINER_EXITED, 2},
+		{containerID, runtime.ContainerEventType_CONTAINER_DELETED_EVENT, runtime.ContainerState_CONTAINER_UNKNOWN, 1},
+	}
+	for _, test := range tests {
+		var event *runtime.ContainerEventResponse
+		select {
+		case event = <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s of %s was published", test.eventType, test.containerID)
+		}
+		if event.ContainerId != test.containerID || event.ContainerEventType != test.eventType {
+			t.Fatalf("event = %s of %s, want %s of %s", event.ContainerEventType, event.ContainerId, test.eventType, test.containerID)
+		}
+		if event.PodSandboxStatus.GetId() != "sandbox" || len(event.ContainersStatuses) != test.statuses {
+			t.Errorf("%s carries sandbox %q and %d container statuses, want sandbox and %d", test.eventType, event.PodSandboxStatus.GetId(), len(event.ContainersStatuses), test.statuses)
+		}
+		state := runtime.ContainerState_CONTAINER_UNKNOWN
+		for _, status := range event.ContainersStatuses {
+			if status.Id == test.containerID {
+				state = status.State
+			}
+		}
+		if state != test.state {
+			t.Errorf("%s reports the container as %s, want %s", test.eventType, state, test.state)
+		}
+	}
+}
+
+func TestGetContainerEventsEndsLaggingStream(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	s.events = newContainerEvents()
+
+	// The stream blocks on its first send, so everything published afterwards queues up
+	stream := &fakeEventStream{ctx: context.Background(), events: make(chan *runtime.ContainerEventResponse)}
+	done := make(chan error)
+	go func() {
+		done <- s.GetContainerEvents(&runtime.GetEventsRequest{}, stream)
+	}()
+	for !subscribed(s.events) {
+		time.Sleep(time.Millisecond)
+	}
+	_, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	s.mu.RLock()
+	for i := 0; i <= eventBuffer+1; i++ {
+		s.emitContainerEvent("sandbox", "app", runtime.ContainerEventType_CONTAINER_CREATED_EVENT)
+	}
+	s.mu.RUnlock()
+
+	// Events which were queued before the subscriber fell behind are still delivered
+	for i := 0; i <= eventBuffer; i++ {
+		stream.nextEvent(t)
+	}
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("GetContainerEvents of a lagging subscriber = %v, want ResourceExhausted", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream of a lagging subscriber wasn't ended")
+	}
+
+	// The subscriber which never received anything lagged behind as well
+	if subscribed(s.events) {
+		t.Errorf("lagging subscribers are still subscribed")
+	}
+}
+
+// subscribed reports whether events has any subscriber
+func subscribed(events *containerEvents) bool {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	return len(events.subscribers) > 0
+}
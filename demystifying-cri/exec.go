@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// execTimeoutExitCode is reported for commands killed at their timeout, which have no exit code of their own
+const execTimeoutExitCode = -1
+
+// maxExecOutput bounds the output kept per stream, so a chatty probe running every second can't exhaust memory
+const maxExecOutput = 16 * 1024 * 1024
+
+// execOutput is a buffer silently dropping everything beyond maxExecOutput
+// Writes never fail, as failing would make runc see a broken pipe and the command exit early
+type execOutput struct {
+	bytes.Buffer
+}
+
+func (o *execOutput) Write(p []byte) (int, error) {
+	if remaining := maxExecOutput - o.Len(); remaining < len(p) {
+		o.Buffer.Write(p[:max(remaining, 0)])
+		return len(p), nil
+	}
+	return o.Buffer.Write(p)
+}
+
+// ExecSync runs a command in a running container and returns its output once it exited, e.g. for exec probes
+// On timeout the command is killed and the output it produced so far is returned with a non-zero exit code
+func (s *DemystifyingCRI) ExecSync(ctx context.Context, req *runtime.ExecSyncRequest) (*runtime.ExecSyncResponse, error) {
+	if len(req.Cmd) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "command must be set")
+	}
+
+	s.mu.RLock()
+	container, exists := s.containers[req.ContainerId]
+	running := exists && container.State == runtime.ContainerState_CONTAINER_RUNNING
+	s.mu.RUnlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "container %s does not exist", req.ContainerId)
+	}
+	if !running {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %s is not running", req.ContainerId)
+	}
+
+	execCtx := ctx
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	var stdout, stderr execOutput
+	exitCode, err := s.oci.Exec(execCtx, req.ContainerId, req.Cmd, runtimeIO{Stdout: &stdout, Stderr: &stderr})
+
+	// Only the exec timeout is reported in the response, a cancelled call is not answered anyway
+	if ctx.Err() == nil && errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+		fmt.Fprintf(&stderr, "timeout %ds exceeded: command was killed", req.Timeout)
+		return &runtime.ExecSyncResponse{Stdout: stdout.Bytes(), Stderr: stderr.Bytes(), ExitCode: execTimeoutExitCode}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to exec in container %s: %w", req.ContainerId, err)
+	}
+
+	return &runtime.ExecSyncResponse{Stdout: stdout.Bytes(), Stderr: stderr.Bytes(), ExitCode: int32(exitCode)}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestExecSync(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	containerID := startTestContainers(t, s, "app")[0]
+
+	resp, err := s.ExecSync(context.Background(), &runtime.ExecSyncRequest{
+		ContainerId: containerID,
+		Cmd:         []string{"sh", "-c", "echo out; echo err >&2; exit 3"},
+	})
+	if err != nil {
+		t.Fatalf("ExecSync: %v", err)
+	}
+	if string(resp.Stdout) != "out\n" || string(resp.Stderr) != "err\n" || resp.ExitCode != 3 {
+		t.Errorf("ExecSync = %q, %q, exit code %d, want out, err and 3", resp.Stdout, resp.Stderr, resp.ExitCode)
+	}
+}
+
+func TestExecSyncTimeoutReturnsPartialOutput(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	containerID := startTestContainers(t, s, "app")[0]
+
+	start := time.Now()
+	resp, err := s.ExecSync(context.Background(), &runtime.ExecSyncRequest{
+		ContainerId: containerID,
+		Cmd:         []string{"sh", "-c", "echo started; echo warming up >&2; exec sleep 30"},
+		Timeout:     1,
+	})
+	if err != nil {
+		t.Fatalf("ExecSync: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("ExecSync with a timeout of 1s took %s, the command wasn't killed", elapsed)
+	}
+	if string(resp.Stdout) != "started\n" {
+		t.Errorf("stdout of a timed out exec = %q, want the output before the timeout", resp.Stdout)
+	}
+	if stderr := string(resp.Stderr); !strings.HasPrefix(stderr, "warming up\n") || !strings.Contains(stderr, "timeout 1s exceeded") {
+		t.Errorf("stderr of a timed out exec = %q, want the output before the timeout and the timeout", stderr)
+	}
+	if resp.ExitCode == 0 {
+		t.Errorf("exit code of a timed out exec = 0, want non-zero")
+	}
+}
+
+// openFDs returns the number of open file descriptors of the test
+func openFDs(t *testing.T) int {
+	t.Helper()
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// zombieChildren returns the PIDs of children of the test which exited without being reaped
+func zombieChildren(t *testing.T) []string {
+	t.Helper()
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var zombies []string
+	for _, stat := range stats {
+		data, err := os.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// The fields after the command are the state and the parent PID
+		fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+		if len(fields) > 1 && fields[0] == "Z" && fields[1] == strconv.Itoa(os.Getpid()) {
+			zombies = append(zombies, filepath.Base(filepath.Dir(stat)))
+		}
+	}
+	return zombies
+}
+
+func TestExecSyncDoesNotLeak(t *testing.T) {
+	// The fake runc runs the command on the host like runc exec runs it in the container
+	dir := t.TempDir()
+	script := `#!/bin/sh
+[ "$1" = exec ] && [ "$2" = --pid-file ] || exit 1
+echo $$ > "$3"
+shift 4
+exec "$@"
+`
+	if err := os.WriteFile(filepath.Join(dir, "runc"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TMPDIR", t.TempDir())
+
+	s, _ := newTestRuntime(t)
+	containerID := startTestContainers(t, s, "app")[0]
+	s.oci = &runcBinary{path: filepath.Join(dir, "runc")}
+	probe := func() {
+		resp, err := s.ExecSync(context.Background(), &runtime.ExecSyncRequest{ContainerId: containerID, Cmd: []string{"echo", "ok"}, Timeout: 10})
+		if err != nil {
+			t.Fatalf("ExecSync: %v", err)
+		}
+		if string(resp.Stdout) != "ok\n" || resp.ExitCode != 0 {
+			t.Fatalf("ExecSync = %q exit code %d, want ok and 0", resp.Stdout, resp.ExitCode)
+		}
+	}
+
+	// The first exec may open descriptors which are kept for good, like the one of /dev/null,
+	// and other tests may have left processes of their own unreaped
+	probe()
+	before, zombiesBefore := openFDs(t), zombieChildren(t)
+	for i := 0; i < 200; i++ {
+		probe()
+	}
+	if after := openFDs(t); after > before+5 {
+		t.Errorf("open file descriptors grew from %d to %d over 200 execs", before, after)
+	}
+	if zombies := zombieChildren(t); len(zombies) > len(zombiesBefore) {
+		t.Errorf("execs left unreaped processes, %v instead of %v", zombies, zombiesBefore)
+	}
+	if entries, _ := filepath.Glob(filepath.Join(os.TempDir(), "exec-*")); len(entries) > 0 {
+		t.Errorf("execs left pid file directories %v", entries)
+	}
+}
+
+func TestExecOutputIsBounded(t *testing.T) {
+	var output execOutput
+	chunk := bytes.Repeat([]byte("x"), 1024*1024)
+	for i := 0; i < maxExecOutput/len(chunk)+4; i++ {
+		if n, err := output.Write(chunk); n != len(chunk) || err != nil {
+			t.Fatalf("Write = %d, %v, want %d and no error", n, err, len(chunk))
+		}
+	}
+	if output.Len() != maxExecOutput {
+		t.Errorf("kept %d bytes of output, want %d", output.Len(), maxExecOutput)
+	}
+}
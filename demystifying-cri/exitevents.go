@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	runtime "demystifying-cri/proto"
+)
+
+// enableExitEvents switches the reaper from polling to runc events if the node supports it
+// runc events only returns once a container's processes exited when it can watch cgroup.events, which requires cgroup v2,
+// on cgroup v1 it would keep running for stopped containers until they are deleted
+func (s *DemystifyingCRI) enableExitEvents() {
+	if !s.cgroupV2 {
+		log.Printf("runc events can't detect container exits without cgroup v2, polling every %v instead", s.reapInterval)
+		return
+	}
+	s.exitEvents.Store(true)
+}
+
+// watchExits starts watchExit for running containers and ready sandboxes which aren't watched yet, e.g. after a restart
+func (s *DemystifyingCRI) watchExits() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for id, container := range s.containers {
+		if container.State == runtime.ContainerState_CONTAINER_RUNNING && !s.exitWatches[id] {
+			go s.watchExit(id, false)
+		}
+	}
+	for id, sandbox := range s.sandboxes {
+		if sandbox.State == runtime.PodSandboxState_SANDBOX_READY && !s.exitWatches[id] {
+			go s.watchExit(id, true)
+		}
+	}
+}
+
+// watchExit waits for runc events of a running container or ready sandbox to end and then marks it like the reaper does
+// If runc events ended although the process is still there it can't be relied on, so the reaper falls back to polling
+func (s *DemystifyingCRI) watchExit(id string, sandbox bool) {
+	if !s.exitEvents.Load() {
+		return
+	}
+	s.mu.Lock()
+	if s.exitWatches[id] {
+		s.mu.Unlock()
+		return
+	}
+	s.exitWatches[id] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.exitWatches, id)
+		s.mu.Unlock()
+	}()
+
+	err := s.oci.Events(context.Background(), id)
+	if s.processAlive(id) {
+		if err == nil {
+			err = errors.New("runc events exited")
+		}
+		if s.exitEvents.CompareAndSwap(true, false) {
+			log.Printf("runc events stopped reporting %s while it is still running, polling every %v instead: %v", id, s.reapInterval, err)
+		}
+		return
+	}
+	if sandbox {
+		s.markSandboxNotReady(id)
+	} else {
+		s.markExited(id)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+
+	"golang.org/x/sys/unix"
+)
+
+// unknownExitCode is reported for containers whose exit status couldn't be collected, like containerd does
+const unknownExitCode = 255
+
+// enableSubreaper makes the runtime the parent of the container processes runc starts
+// runc create and runc run -d exit once the container runs, so its process is reparented to the closest subreaper,
+// otherwise to init, which reaps it and throws away the exit status.
+func (s *DemystifyingCRI) enableSubreaper() {
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		log.Printf("failed to become a child subreaper, exit codes of containers are reported as %d: %v", unknownExitCode, err)
+		return
+	}
+	s.subreaper = true
+}
+
+// collectExitStatus reaps the exited process with the given PID and returns its exit code, 128 plus the signal if it was killed
+// Only processes reparented to the runtime can be reaped, for any other process false is returned.
+// The PID must not be passed again once it was reaped, as it may belong to another child of the runtime by then.
+func (s *DemystifyingCRI) collectExitStatus(pid int) (int32, bool) {
+	if !s.subreaper || pid <= 0 {
+		return unknownExitCode, false
+	}
+
+	var status unix.WaitStatus
+	if reaped, err := unix.Wait4(pid, &status, unix.WNOHANG, nil); err != nil || reaped != pid {
+		return unknownExitCode, false
+	}
+	if status.Signaled() {
+		return 128 + int32(status.Signal()), true
+	}
+	return int32(status.ExitStatus()), true
+}
+
+// exitReason returns the reason reported for an exited container, matching the ones of containerd
+func exitReason(exitCode int32, known bool) string {
+	switch {
+	case !known:
+		return "Unknown"
+	case exitCode == 0:
+		return "Completed"
+	}
+	return "Error"
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// graveyardDir is where bundles of removed containers are kept for post-mortem debugging, relative to runtimeRoot
+const graveyardDir = "graveyard"
+
+// removeBundle deletes the bundle of a removed container
+// With keepBundles set the bundle is moved to the graveyard instead, which only retains the newest keepBundles ones
+func (s *DemystifyingCRI) removeBundle(containerID string) error {
+	bundlePath := filepath.Join(s.runtimeRoot, containerID)
+	if s.keepBundles <= 0 {
+		if err := os.RemoveAll(bundlePath); err != nil {
+			return fmt.Errorf("failed to remove bundle of container %s: %v", containerID, err)
+		}
+		return nil
+	}
+
+	graveyard := filepath.Join(s.runtimeRoot, graveyardDir)
+	if err := os.MkdirAll(graveyard, 0700); err != nil {
+		return fmt.Errorf("failed to create graveyard: %v", err)
+	}
+
+	// Prefix with the removal time, so names sort from oldest to newest and a recreated container never collides
+	retainedPath := filepath.Join(graveyard, fmt.Sprintf("%d-%s", time.Now().UnixNano(), containerID))
+	if err := os.Rename(bundlePath, retainedPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to move bundle of container %s to the graveyard: %v", containerID, err)
+	}
+	log.Printf("kept bundle of removed container %s at %s", containerID, retainedPath)
+
+	s.evictGraveyard(graveyard)
+	return nil
+}
+
+// evictGraveyard deletes the oldest bundles until at most keepBundles are left
+func (s *DemystifyingCRI) evictGraveyard(graveyard string) {
+	entries, err := os.ReadDir(graveyard)
+	if err != nil {
+		log.Printf("failed to read graveyard: %v", err)
+		return
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	for len(names) > s.keepBundles {
+		if err := os.RemoveAll(filepath.Join(graveyard, names[0])); err != nil {
+			log.Printf("failed to evict %s from graveyard: %v", names[0], err)
+		}
+		names = names[1:]
+	}
+}
+
+// sweepOrphanBundles removes bundles left behind by a crash, i.e. bundles without a runc container
+// Removal follows keepBundles like RemoveContainer, leftover temporary unpack directories are always deleted
+func (s *DemystifyingCRI) sweepOrphanBundles() error {
+	states, err := s.oci.List()
+	if err != nil {
+		return fmt.Errorf("failed to list runc containers: %v", err)
+	}
+	inUse := make(map[string]bool)
+	for _, state := range states {
+		inUse[filepath.Clean(state.Bundle)] = true
+	}
+
+	entries, err := os.ReadDir(s.runtimeRoot)
+	if err != nil {
+		return fmt.Errorf("failed to read runtime root: %v", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(s.runtimeRoot, name)
+		if !entry.IsDir() || name == graveyardDir || name == sharedRootfsDir || inUse[path] {
+			continue
+		}
+		// imageRoot may be nested below runtimeRoot
+		if rel, err := filepath.Rel(path, s.imageRoot); err == nil && !strings.HasPrefix(rel, "..") {
+			continue
+		}
+
+		if strings.HasPrefix(name, ".") {
+			err = os.RemoveAll(path)
+		} else if err = s.unmountRootfs(name); err == nil {
+			err = s.removeBundle(name)
+		}
+		if err != nil {
+			log.Printf("failed to clean up orphaned bundle %s: %v", path, err)
+			continue
+		}
+		log.Printf("cleaned up orphaned bundle %s", path)
+	}
+
+	return nil
+}
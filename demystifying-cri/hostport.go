@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// hostPortChain is the nat chain holding the DNAT rules of all host ports, jumped to for traffic to local addresses
+const hostPortChain = "DEMYSTIFYING-HOSTPORTS"
+
+// portMappingsJSON encodes port mappings like Kubelet and crictl expect them, with camel case names and protocols by name
+func portMappingsJSON(mappings []*runtime.PortMapping) (string, error) {
+	entries := make([]json.RawMessage, 0, len(mappings))
+	for _, mapping := range mappings {
+		entry, err := protojson.Marshal(mapping)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode port mapping: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode port mappings: %v", err)
+	}
+	return string(data), nil
+}
+
+// hostPortComment tags the rules of a sandbox, so they can be found and removed again
+func hostPortComment(sandboxID string) string {
+	return "demystifying-cri:" + sandboxID
+}
+
+// hostPortRules returns the rules forwarding the host ports of a sandbox's port mappings to its pod IP
+// Mappings without a host port only describe the pod and get no rule
+func hostPortRules(sandboxID, podIP string, mappings []*runtime.PortMapping) [][]string {
+	var rules [][]string
+	for _, mapping := range mappings {
+		if mapping.HostPort <= 0 {
+			continue
+		}
+		rule := []string{"-p", strings.ToLower(mapping.Protocol.String()), "--dport", strconv.Itoa(int(mapping.HostPort))}
+		if mapping.HostIp != "" {
+			rule = append(rule, "-d", mapping.HostIp)
+		}
+		rule = append(rule,
+			"-m", "comment", "--comment", hostPortComment(sandboxID),
+			"-j", "DNAT", "--to-destination", net.JoinHostPort(podIP, strconv.Itoa(int(mapping.ContainerPort))),
+		)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// addHostPorts forwards the host ports of a sandbox to the IP of its network namespace with iptables DNAT rules
+// Pods in the host network receive traffic to their host ports anyway, and without --host-port-dnat ports are only reported
+func (s *DemystifyingCRI) addHostPorts(ctx context.Context, sandboxID string, pid int, mappings []*runtime.PortMapping) error {
+	if !s.hostPortDNAT || s.networkPlugin == "none" {
+		return nil
+	}
+	if len(hostPortRules(sandboxID, "", mappings)) == 0 {
+		return nil
+	}
+
+	podIP, err := podIPv4(ctx, pid)
+	if err != nil {
+		return err
+	}
+	if err := ensureHostPortChain(ctx); err != nil {
+		return err
+	}
+	for _, rule := range hostPortRules(sandboxID, podIP, mappings) {
+		if err := iptablesNat(ctx, append([]string{"-A", hostPortChain}, rule...)...); err != nil {
+			if err := s.removeHostPorts(ctx, sandboxID); err != nil {
+				log.Printf("failed to remove host ports of sandbox %s after failing to add them: %v", sandboxID, err)
+			}
+			return fmt.Errorf("failed to forward host ports of sandbox %s: %v", sandboxID, err)
+		}
+	}
+	return nil
+}
+
+// removeHostPorts deletes the DNAT rules of a sandbox, which may have none
+func (s *DemystifyingCRI) removeHostPorts(ctx context.Context, sandboxID string) error {
+	if !s.hostPortDNAT {
+		return nil
+	}
+	out, err := exec.CommandContext(ctx, "iptables", "-w", "-t", "nat", "-S", hostPortChain).Output()
+	if err != nil {
+		// The chain only exists once a sandbox had host ports
+		return nil
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" || !slices.ContainsFunc(fields, func(field string) bool {
+			return strings.Trim(field, `"`) == hostPortComment(sandboxID)
+		}) {
+			continue
+		}
+		fields[0] = "-D"
+		if err := iptablesNat(ctx, fields...); err != nil {
+			return fmt.Errorf("failed to remove host ports of sandbox %s: %v", sandboxID, err)
+		}
+	}
+	return nil
+}
+
+// ensureHostPortChain creates hostPortChain and the jumps to it for traffic from outside and from the node itself
+func ensureHostPortChain(ctx context.Context) error {
+	if err := iptablesNat(ctx, "-L", hostPortChain, "-n"); err != nil {
+		if err := iptablesNat(ctx, "-N", hostPortChain); err != nil {
+			return fmt.Errorf("failed to create chain %s: %v", hostPortChain, err)
+		}
+	}
+	for _, parent := range []string{"PREROUTING", "OUTPUT"} {
+		jump := []string{parent, "-m", "addrtype", "--dst-type", "LOCAL", "-j", hostPortChain}
+		if iptablesNat(ctx, append([]string{"-C"}, jump...)...) == nil {
+			continue
+		}
+		if err := iptablesNat(ctx, append([]string{"-A"}, jump...)...); err != nil {
+			return fmt.Errorf("failed to jump from %s to %s: %v", parent, hostPortChain, err)
+		}
+	}
+	return nil
+}
+
+// iptablesNat runs iptables on the nat table, waiting for the lock other tools like kube-proxy may hold
+// With iptables-nft the rules end up in nftables
+func iptablesNat(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "iptables", append([]string{"-w", "-t", "nat"}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", binaryError("iptables", err), bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// podIPv4 returns the IPv4 address of the network namespace of a pause process, as set up by the network plugin
+func podIPv4(ctx context.Context, pid int) (string, error) {
+	cmd := exec.CommandContext(ctx, "nsenter", "--target", strconv.Itoa(pid), "--net", "--", "ip", "-o", "-4", "addr", "show", "scope", "global")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read pod IP: %w", binaryError("nsenter", err))
+	}
+	// Lines look like: 2: eth0    inet 10.88.0.5/16 brd 10.88.255.255 scope global eth0
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[2] == "inet" {
+			ip, _, _ := strings.Cut(fields[3], "/")
+			return ip, nil
+		}
+	}
+	return "", status.Error(codes.FailedPrecondition, "pod has no IPv4 address to forward host ports to, the network plugin set up none")
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPodSandboxStatusReportsPortMappings(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	mappings := []*runtime.PortMapping{
+		{Protocol: runtime.Protocol_TCP, ContainerPort: 8080, HostPort: 80, HostIp: "192.0.2.1"},
+		{Protocol: runtime.Protocol_UDP, ContainerPort: 53},
+		{Protocol: runtime.Protocol_SCTP, ContainerPort: 9, HostPort: 9},
+	}
+	s.sandboxes["sandbox"].config.PortMappings = mappings
+
+	resp, err := s.PodSandboxStatus(context.Background(), &runtime.PodSandboxStatusRequest{PodSandboxId: "sandbox", Verbose: true})
+	if err != nil {
+		t.Fatalf("PodSandboxStatus: %v", err)
+	}
+	reported := resp.Info["portMappings"]
+	if !strings.Contains(reported, `"containerPort":8080`) || !strings.Contains(reported, `"protocol":"UDP"`) {
+		t.Errorf("port mappings %s don't use the names of the CRI", reported)
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal([]byte(reported), &entries); err != nil {
+		t.Fatalf("port mappings %s: %v", reported, err)
+	}
+	if len(entries) != len(mappings) {
+		t.Fatalf("reported %d port mappings, want %d", len(entries), len(mappings))
+	}
+	for i, entry := range entries {
+		var mapping runtime.PortMapping
+		if err := protojson.Unmarshal(entry, &mapping); err != nil {
+			t.Fatalf("port mapping %s: %v", entry, err)
+		}
+		if !proto.Equal(&mapping, mappings[i]) {
+			t.Errorf("port mapping %d = %v, want %v", i, &mapping, mappings[i])
+		}
+	}
+}
+
+func TestHostPortRules(t *testing.T) {
+	rules := hostPortRules("web", "10.88.0.5", []*runtime.PortMapping{
+		{Protocol: runtime.Protocol_TCP, ContainerPort: 8080, HostPort: 80},
+		{Protocol: runtime.Protocol_UDP, ContainerPort: 53},
+		{Protocol: runtime.Protocol_SCTP, ContainerPort: 9, HostPort: 9, HostIp: "192.0.2.1"},
+	})
+	want := [][]string{
+		{"-p", "tcp", "--dport", "80", "-m", "comment", "--comment", "demystifying-cri:web", "-j", "DNAT", "--to-destination", "10.88.0.5:8080"},
+		{"-p", "sctp", "--dport", "9", "-d", "192.0.2.1", "-m", "comment", "--comment", "demystifying-cri:web", "-j", "DNAT", "--to-destination", "10.88.0.5:9"},
+	}
+	if !slices.EqualFunc(rules, want, slices.Equal[[]string]) {
+		t.Errorf("hostPortRules = %q, want %q", rules, want)
+	}
+}
+
+func TestStopPodSandboxRemovesHostPorts(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	s.hostPortDNAT = true
+
+	// The fake iptables lists rules of two sandboxes and records all other calls
+	dir := t.TempDir()
+	script := `#!/bin/sh
+case "$*" in
+*" -S "*)
+	echo "-N DEMYSTIFYING-HOSTPORTS"
+	echo "-A DEMYSTIFYING-HOSTPORTS -p tcp -m tcp --dport 80 -m comment --comment demystifying-cri:sandbox -j DNAT --to-destination 10.88.0.5:8080"
+	echo "-A DEMYSTIFYING-HOSTPORTS -p tcp -m tcp --dport 81 -m comment --comment demystifying-cri:sandbox-2 -j DNAT --to-destination 10.88.0.6:8080"
+	;;
+*)
+	echo "$*" >> ` + dir + `/calls
+	;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(dir, "iptables"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	if _, err := s.StopPodSandbox(context.Background(), &runtime.StopPodSandboxRequest{PodSandboxId: "sandbox"}); err != nil {
+		t.Fatalf("StopPodSandbox: %v", err)
+	}
+	calls, _ := os.ReadFile(filepath.Join(dir, "calls"))
+	want := "-w -t nat -D DEMYSTIFYING-HOSTPORTS -p tcp -m tcp --dport 80 -m comment --comment demystifying-cri:sandbox -j DNAT --to-destination 10.88.0.5:8080\n"
+	if string(calls) != want {
+		t.Errorf("iptables calls = %q, want only %q", calls, want)
+	}
+}
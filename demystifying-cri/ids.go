@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	runtime "demystifying-cri/proto"
+)
+
+// idSchemes are the values of --id-scheme, selecting an idGenerator
+var idSchemes = []string{"name", "random"}
+
+// idGenerator derives the IDs of new sandboxes and containers
+// Every ID must be usable as runc container ID and as directory name, and contain a dash, see validateRoots
+type idGenerator interface {
+	sandboxID(metadata *runtime.PodSandboxMetadata) string
+	containerID(sandboxID string, metadata *runtime.ContainerMetadata) string
+}
+
+// nameIDs implements idGenerator with readable IDs derived from the names, e.g. default-nginx-sandbox-app
+type nameIDs struct{}
+
+func (nameIDs) sandboxID(metadata *runtime.PodSandboxMetadata) string {
+	return fmt.Sprintf("%s-%s-sandbox", metadata.Namespace, metadata.Name)
+}
+
+func (nameIDs) containerID(sandboxID string, metadata *runtime.ContainerMetadata) string {
+	return fmt.Sprintf("%s-%s", sandboxID, metadata.Name)
+}
+
+// randomIDs implements idGenerator with random UUIDs, which never repeat for a recreated sandbox or container
+type randomIDs struct{}
+
+func (randomIDs) sandboxID(*runtime.PodSandboxMetadata) string {
+	return randomID()
+}
+
+func (randomIDs) containerID(string, *runtime.ContainerMetadata) string {
+	return randomID()
+}
+
+// randomID returns a random version 4 UUID
+func randomID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("failed to read random ID: %v", err))
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	encoded := hex.EncodeToString(id)
+	return encoded[:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:]
+}
+
+// sandboxKey identifies a sandbox by its metadata, so RunPodSandbox stays idempotent whatever the IDs look like
+func sandboxKey(metadata *runtime.PodSandboxMetadata) string {
+	return metadata.GetNamespace() + "/" + metadata.GetName()
+}
+
+// containerKey identifies a container by its sandbox and metadata, so CreateContainer stays idempotent whatever the IDs look like
+func containerKey(sandboxID string, metadata *runtime.ContainerMetadata) string {
+	return sandboxID + "/" + metadata.GetName()
+}
+
+// idTaken reports whether an ID is used by a sandbox, a container or a leftover bundle, the caller must hold s.mu
+func (s *DemystifyingCRI) idTaken(id string) bool {
+	_, sandbox := s.sandboxes[id]
+	_, container := s.containers[id]
+	_, err := os.Stat(filepath.Join(s.runtimeRoot, id))
+	return sandbox || container || err == nil
+}
+
+// newID returns an ID of generate which is not taken yet, drawing again should a random ID collide
+// Name based IDs are returned as they are, as a recreated sandbox or container is meant to get the same ID
+func (s *DemystifyingCRI) newID(generate func() string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id := generate()
+	if _, random := s.ids.(randomIDs); random {
+		for s.idTaken(id) {
+			id = generate()
+		}
+	}
+	return id
+}
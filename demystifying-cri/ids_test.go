@@ -0,0 +1,79 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestNameIDs(t *testing.T) {
+	ids := nameIDs{}
+	sandboxID := ids.sandboxID(&runtime.PodSandboxMetadata{Name: "nginx", Namespace: "default"})
+	if sandboxID != "default-nginx-sandbox" {
+		t.Errorf("sandboxID = %q, want %q", sandboxID, "default-nginx-sandbox")
+	}
+	if id := ids.containerID(sandboxID, &runtime.ContainerMetadata{Name: "app"}); id != "default-nginx-sandbox-app" {
+		t.Errorf("containerID = %q, want %q", id, "default-nginx-sandbox-app")
+	}
+}
+
+func TestRandomIDs(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ids := randomIDs{}
+	metadata := &runtime.PodSandboxMetadata{Name: "nginx", Namespace: "default"}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id := ids.sandboxID(metadata)
+		if !uuid.MatchString(id) {
+			t.Fatalf("sandboxID = %q, want a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("sandboxID returned %q twice for the same metadata", id)
+		}
+		seen[id] = true
+	}
+	if id := ids.containerID("sandbox", &runtime.ContainerMetadata{Name: "app"}); !uuid.MatchString(id) || seen[id] {
+		t.Errorf("containerID = %q, want a new version 4 UUID", id)
+	}
+}
+
+func TestNewIDDrawsAgainOnCollision(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	takenID := createTestContainer(t, s, "app")
+
+	// The generator first returns IDs of an existing sandbox and container
+	draws := func() func() string {
+		ids := []string{"sandbox", takenID, "fresh-id"}
+		return func() string {
+			id := ids[0]
+			ids = ids[1:]
+			return id
+		}
+	}
+
+	s.ids = randomIDs{}
+	if id := s.newID(draws()); id != "fresh-id" {
+		t.Errorf("newID with random IDs = %q, want the first ID which isn't taken", id)
+	}
+
+	// Name based IDs are meant to repeat for a recreated sandbox or container
+	s.ids = nameIDs{}
+	if id := s.newID(draws()); id != "sandbox" {
+		t.Errorf("newID with name based IDs = %q, want the generated ID", id)
+	}
+}
+
+func TestCreateContainerIsIdempotentWithRandomIDs(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	s.ids = randomIDs{}
+
+	first := createTestContainer(t, s, "app")
+	if second := createTestContainer(t, s, "app"); second != first {
+		t.Errorf("second create returned %s, want the existing container %s", second, first)
+	}
+	if other := createTestContainer(t, s, "sidecar"); other == first {
+		t.Errorf("container of another name got the ID %s too", other)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	runtime "demystifying-cri/proto"
+)
+
+// imagePuller downloads an image from its registry into an OCI layout below imageRoot
+type imagePuller interface {
+	Pull(ctx context.Context, image string, auth *runtime.AuthConfig) error
+}
+
+// imageUnpacker unpacks an image from the OCI layout at imagePath (layout:tag) into a new bundle at bundlePath
+type imageUnpacker interface {
+	Unpack(imagePath, bundlePath string) error
+}
+
+// umociUnpacker implements imageUnpacker by running umoci unpack
+type umociUnpacker struct {
+	rootless bool // Unpack without privileges, which skips device nodes and file ownership
+}
+
+func (u umociUnpacker) Unpack(imagePath, bundlePath string) error {
+	args := []string{"unpack"}
+	if u.rootless {
+		args = append(args, "--rootless")
+	}
+	args = append(args, "--image", imagePath, bundlePath)
+	if out, err := exec.Command("umoci", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", binaryError("umoci", err), out)
+	}
+	return nil
+}
+
+// nativeUnpacker implements imageUnpacker in-process, see unpackImageNative
+type nativeUnpacker struct{}
+
+func (nativeUnpacker) Unpack(imagePath, bundlePath string) error {
+	return unpackImageNative(imagePath, bundlePath)
+}
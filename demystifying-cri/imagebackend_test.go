@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestFailedUnpackLeavesNoSnapshot(t *testing.T) {
+	// The fake umoci extracts part of the rootfs before it fails, like one running out of disk space
+	dir := t.TempDir()
+	script := `#!/bin/sh
+for arg; do bundle=$arg; done
+mkdir -p "$bundle/rootfs/bin" && touch "$bundle/rootfs/bin/sh"
+echo "no space left on device" >&2
+exit 1
+`
+	if err := os.WriteFile(filepath.Join(dir, "umoci"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	s, _ := newTestRuntime(t)
+	s.unpacker = umociUnpacker{}
+	if _, err := s.unpackImage(testImage, "app"); err == nil {
+		t.Fatal("unpackImage with a failing umoci succeeded")
+	}
+	entries, err := os.ReadDir(s.runtimeRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("failed unpack left %s behind", entry.Name())
+	}
+
+	// A retry must unpack again instead of reusing a partial snapshot
+	s.unpacker = nativeUnpacker{}
+	snapshotPath, err := s.unpackImage(testImage, "app")
+	if err != nil {
+		t.Fatalf("unpackImage after a failed unpack: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(snapshotPath, "config.json")); err != nil {
+		t.Errorf("snapshot unpacked after a failed unpack is incomplete: %v", err)
+	}
+}
+
+// fakePuller is an imagePuller whose pulls block until released, while the test writes the image layout
+type fakePuller struct {
+	mu      sync.Mutex
+	pulls   []string      // Images Pull was called for
+	release chan struct{} // Closed to let pulls finish
+}
+
+func (p *fakePuller) Pull(ctx context.Context, image string, auth *runtime.AuthConfig) error {
+	p.mu.Lock()
+	p.pulls = append(p.pulls, image)
+	p.mu.Unlock()
+	select {
+	case <-p.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *fakePuller) calls() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.pulls)
+}
+
+func TestPullImageDeduplicatesPulls(t *testing.T) {
+	const image = "docker.io/library/app:1"
+	s, _ := newTestRuntime(t)
+	puller := &fakePuller{release: make(chan struct{})}
+	s.puller = puller
+	s.pullLimiter = newPullLimiter(registryLimits{}, nil)
+
+	const callers = 3
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err := s.PullImage(context.Background(), &runtime.PullImageRequest{Image: &runtime.ImageSpec{Image: image}})
+			errs <- err
+		}()
+	}
+
+	// Only release the pull once every caller joined it
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.images.mu.RLock()
+		pull := s.images.pulls[image]
+		joined := pull != nil && pull.waiters == callers
+		s.images.mu.RUnlock()
+		if joined {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("callers didn't join the pull")
+		}
+	}
+	writeTestImage(t, s.imageRoot, image)
+	close(puller.release)
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("PullImage: %v", err)
+		}
+	}
+	if calls := puller.calls(); !slices.Equal(calls, []string{image}) {
+		t.Errorf("concurrent pulls called the backend for %q, want a single pull", calls)
+	}
+
+	// Present images are not pulled again
+	for _, present := range []string{image, testImage} {
+		if _, err := s.PullImage(context.Background(), &runtime.PullImageRequest{Image: &runtime.ImageSpec{Image: present}}); err != nil {
+			t.Errorf("PullImage(%s): %v", present, err)
+		}
+	}
+	if calls := puller.calls(); !slices.Equal(calls, []string{image}) {
+		t.Errorf("pulls of present images called the backend for %q, want no further pulls", calls)
+	}
+}
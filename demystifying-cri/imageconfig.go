@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// imageConfig reads the OCI image config of a downloaded image from its layout
+func (s *DemystifyingCRI) imageConfig(image string) (*ociImageConfig, error) {
+	layoutPath, tag := splitLayoutReference(filepath.Join(s.imageRoot, getImage(image)))
+	manifest, err := readLayoutManifest(layoutPath, tag)
+	if err != nil {
+		return nil, err
+	}
+	return readLayoutConfig(layoutPath, manifest)
+}
+
+// setImageUser reports the user an image runs as in its CRI Image, which is what Kubelet enforces runAsNonRoot with
+// The CRI doesn't pass runAsNonRoot to the runtime, Kubelet refuses to create the container itself if the image's uid is 0
+// or the image names a user, as it can't tell whether the name is root, unless runAsUser replaces the image's user.
+// An image without a user runs as root, which Kubelet assumes if neither uid nor username is reported.
+func setImageUser(image *runtime.Image, user string) {
+	name, _, _ := strings.Cut(user, ":")
+	if name == "" {
+		return
+	}
+	if uid, err := strconv.ParseInt(name, 10, 64); err == nil {
+		image.Uid = &runtime.Int64Value{Value: uid}
+		return
+	}
+	image.Username = name
+}
+
+// applyProcessConfig sets the container process from the image defaults with the CRI config layered on top
+// The precedence matches Kubernetes: command replaces the entrypoint, args replace the image's cmd,
+// envs override image envs with the same name and working dir and user replace the image's ones
+func applyProcessConfig(g *generate.Generator, rootfs string, image *ociImageConfig, config *runtime.ContainerConfig) error {
+	// Command and arguments
+	entrypoint, cmd := image.Config.Entrypoint, image.Config.Cmd
+	if len(config.Command) > 0 {
+		entrypoint, cmd = config.Command, config.Args
+	} else if len(config.Args) > 0 {
+		cmd = config.Args
+	}
+	g.SetProcessArgs(append(append([]string{}, entrypoint...), cmd...))
+
+	// Environment, CRI values win over image values with the same name
+	env := map[string]string{}
+	var names []string
+	setEnv := func(name, value string) {
+		if _, exists := env[name]; !exists {
+			names = append(names, name)
+		}
+		env[name] = value
+	}
+	for _, kv := range image.Config.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		setEnv(name, value)
+	}
+	for _, kv := range config.Envs {
+		setEnv(kv.Key, kv.Value)
+	}
+	g.ClearProcessEnv()
+	for _, name := range names {
+		g.AddProcessEnv(name, env[name])
+	}
+
+	// Working directory
+	if config.WorkingDir != "" {
+		g.SetProcessCwd(config.WorkingDir)
+	} else if image.Config.WorkingDir != "" {
+		g.SetProcessCwd(image.Config.WorkingDir)
+	}
+
+	// User and group
+	user := image.Config.User
+	securityContext := config.GetLinux().GetSecurityContext()
+	if securityContext.GetRunAsUser() != nil {
+		user = strconv.FormatInt(securityContext.GetRunAsUser().GetValue(), 10)
+	} else if securityContext.GetRunAsUsername() != "" {
+		user = securityContext.GetRunAsUsername()
+	}
+	if securityContext.GetRunAsGroup() != nil {
+		name, _, _ := strings.Cut(user, ":")
+		if name == "" {
+			name = "0"
+		}
+		user = name + ":" + strconv.FormatInt(securityContext.GetRunAsGroup().GetValue(), 10)
+	}
+	uid, gid, err := resolveUser(rootfs, user)
+	if err != nil {
+		return err
+	}
+	g.SetProcessUID(uid)
+	g.SetProcessGID(gid)
+
+	// Supplemental groups, merged with the user's memberships in the image unless the policy is strict
+	g.ClearProcessAdditionalGids()
+	if securityContext.GetSupplementalGroupsPolicy() != runtime.SupplementalGroupsPolicy_Strict {
+		members, err := memberGroups(rootfs, uid)
+		if err != nil {
+			return fmt.Errorf("failed to look up groups of user %d: %v", uid, err)
+		}
+		for _, group := range members {
+			g.AddProcessAdditionalGid(group)
+		}
+	}
+	for _, group := range securityContext.GetSupplementalGroups() {
+		g.AddProcessAdditionalGid(uint32(group))
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestApplyProcessConfig(t *testing.T) {
+	rootfs := writeIDFiles(t,
+		"root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000:app:/home/app:/bin/sh\n",
+		"root:x:0:\napp:x:1000:\nstaff:x:50:app\n")
+
+	var image ociImageConfig
+	image.Config.Entrypoint = []string{"/entrypoint"}
+	image.Config.Cmd = []string{"serve"}
+	image.Config.Env = []string{"PATH=/bin", "MODE=image"}
+	image.Config.WorkingDir = "/srv"
+	image.Config.User = "app"
+
+	tests := []struct {
+		name     string
+		config   *runtime.ContainerConfig
+		args     []string
+		env      []string
+		cwd      string
+		uid, gid uint32
+	}{
+		{
+			name:   "image defaults",
+			config: &runtime.ContainerConfig{},
+			args:   []string{"/entrypoint", "serve"},
+			env:    []string{"PATH=/bin", "MODE=image"},
+			cwd:    "/srv",
+			uid:    1000,
+			gid:    1000,
+		},
+		{
+			name:   "args replace cmd",
+			config: &runtime.ContainerConfig{Args: []string{"migrate"}},
+			args:   []string{"/entrypoint", "migrate"},
+			env:    []string{"PATH=/bin", "MODE=image"},
+			cwd:    "/srv",
+			uid:    1000,
+			gid:    1000,
+		},
+		{
+			name:   "command replaces entrypoint and cmd",
+			config: &runtime.ContainerConfig{Command: []string{"/bin/sh"}},
+			args:   []string{"/bin/sh"},
+			env:    []string{"PATH=/bin", "MODE=image"},
+			cwd:    "/srv",
+			uid:    1000,
+			gid:    1000,
+		},
+		{
+			name: "config overrides image",
+			config: &runtime.ContainerConfig{
+				Command:    []string{"/bin/sh"},
+				Args:       []string{"-c", "true"},
+				Envs:       []*runtime.KeyValue{{Key: "MODE", Value: "cri"}, {Key: "EXTRA", Value: "1"}},
+				WorkingDir: "/tmp",
+				Linux: &runtime.LinuxContainerConfig{SecurityContext: &runtime.LinuxContainerSecurityContext{
+					RunAsUser:  &runtime.Int64Value{Value: 2000},
+					RunAsGroup: &runtime.Int64Value{Value: 3000},
+				}},
+			},
+			args: []string{"/bin/sh", "-c", "true"},
+			env:  []string{"PATH=/bin", "MODE=cri", "EXTRA=1"},
+			cwd:  "/tmp",
+			uid:  2000,
+			gid:  3000,
+		},
+		{
+			name: "username replaces the image's user",
+			config: &runtime.ContainerConfig{Linux: &runtime.LinuxContainerConfig{SecurityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsUsername: "root",
+			}}},
+			args: []string{"/entrypoint", "serve"},
+			env:  []string{"PATH=/bin", "MODE=image"},
+			cwd:  "/srv",
+			uid:  0,
+			gid:  0,
+		},
+		{
+			name: "group without user keeps the image's user",
+			config: &runtime.ContainerConfig{Linux: &runtime.LinuxContainerConfig{SecurityContext: &runtime.LinuxContainerSecurityContext{
+				RunAsGroup: &runtime.Int64Value{Value: 50},
+			}}},
+			args: []string{"/entrypoint", "serve"},
+			env:  []string{"PATH=/bin", "MODE=image"},
+			cwd:  "/srv",
+			uid:  1000,
+			gid:  50,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g, err := generate.New("linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := applyProcessConfig(&g, rootfs, &image, test.config); err != nil {
+				t.Fatalf("applyProcessConfig: %v", err)
+			}
+
+			process := g.Config.Process
+			if !slices.Equal(process.Args, test.args) {
+				t.Errorf("args = %q, want %q", process.Args, test.args)
+			}
+			if !slices.Equal(process.Env, test.env) {
+				t.Errorf("env = %q, want %q", process.Env, test.env)
+			}
+			if process.Cwd != test.cwd {
+				t.Errorf("cwd = %q, want %q", process.Cwd, test.cwd)
+			}
+			if process.User.UID != test.uid || process.User.GID != test.gid {
+				t.Errorf("user = %d:%d, want %d:%d", process.User.UID, process.User.GID, test.uid, test.gid)
+			}
+		})
+	}
+}
+
+func TestApplyProcessConfigSupplementalGroups(t *testing.T) {
+	rootfs := writeIDFiles(t,
+		"root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000:app:/home/app:/bin/sh\n",
+		"root:x:0:\napp:x:1000:\nstaff:x:50:app\nwheel:x:10:root,app\naudio:x:63:root\n")
+	var image ociImageConfig
+	image.Config.User = "app"
+
+	tests := []struct {
+		name            string
+		securityContext *runtime.LinuxContainerSecurityContext
+		groups          []uint32
+	}{
+		{"memberships of the image's user", nil, []uint32{50, 10}},
+		{"requested groups are added", &runtime.LinuxContainerSecurityContext{SupplementalGroups: []int64{4000}}, []uint32{50, 10, 4000}},
+		{"strict policy only keeps requested groups", &runtime.LinuxContainerSecurityContext{
+			SupplementalGroups:       []int64{4000},
+			SupplementalGroupsPolicy: runtime.SupplementalGroupsPolicy_Strict,
+		}, []uint32{4000}},
+		{"memberships of runAsUser", &runtime.LinuxContainerSecurityContext{RunAsUser: &runtime.Int64Value{Value: 0}}, []uint32{10, 63}},
+		{"user without passwd entry", &runtime.LinuxContainerSecurityContext{RunAsUser: &runtime.Int64Value{Value: 2000}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g, err := generate.New("linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &runtime.ContainerConfig{Linux: &runtime.LinuxContainerConfig{SecurityContext: test.securityContext}}
+			if err := applyProcessConfig(&g, rootfs, &image, config); err != nil {
+				t.Fatalf("applyProcessConfig: %v", err)
+			}
+			if groups := g.Config.Process.User.AdditionalGids; !slices.Equal(groups, test.groups) {
+				t.Errorf("additional groups = %v, want %v", groups, test.groups)
+			}
+		})
+	}
+}
+
+func TestImageStatusReportsUser(t *testing.T) {
+	tests := []struct {
+		user     string
+		uid      *runtime.Int64Value // Kubelet refuses uid 0 for runAsNonRoot and allows others
+		username string              // Kubelet refuses names for runAsNonRoot, as it can't tell whether they are root
+	}{
+		{"", nil, ""},
+		{"0", &runtime.Int64Value{Value: 0}, ""},
+		{"0:0", &runtime.Int64Value{Value: 0}, ""},
+		{"1000", &runtime.Int64Value{Value: 1000}, ""},
+		{"1000:1000", &runtime.Int64Value{Value: 1000}, ""},
+		{"app", nil, "app"},
+		{"app:staff", nil, "app"},
+	}
+	for _, test := range tests {
+		s, _ := newTestRuntime(t)
+		const image = "docker.io/library/user:1"
+		var config ociImageConfig
+		config.Config.User = test.user
+		writeTestImageConfig(t, s.imageRoot, image, config)
+		record, err := s.readImageRecord(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.images.add(record)
+
+		resp, err := s.ImageStatus(context.Background(), &runtime.ImageStatusRequest{Image: &runtime.ImageSpec{Image: image}})
+		if err != nil {
+			t.Fatalf("ImageStatus: %v", err)
+		}
+		if !proto.Equal(resp.Image.Uid, test.uid) || resp.Image.Username != test.username {
+			t.Errorf("image with user %q reports uid %v and username %q, want %v and %q", test.user, resp.Image.Uid, resp.Image.Username, test.uid, test.username)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// recordImageUse marks an image as used by a new container, so imageGC keeps it for at least imageGCMinAge
+// The time is also kept as modification time of the image's recorded reference, where readImageRecord picks it up after a restart
+func (s *DemystifyingCRI) recordImageUse(image string) {
+	now := time.Now()
+	s.images.touch(image, now)
+	refPath, _ := s.imageRefPath(image)
+	if err := os.Chtimes(refPath, now, now); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to record use of image %s: %v", image, err)
+	}
+}
+
+// imageLastUsed returns when an image stored in imageRoot was last used, the time its reference was recorded or last touched
+// Images without a recorded reference, like a pre-loaded sandbox image, count as used just now
+func (s *DemystifyingCRI) imageLastUsed(image string) time.Time {
+	refPath, _ := s.imageRefPath(image)
+	info, err := os.Stat(refPath)
+	if err != nil {
+		return time.Now()
+	}
+	return info.ModTime()
+}
+
+// imageGC periodically removes the least recently used images once the filesystem of imageRoot is fuller than imageGCHigh
+// Kubelet garbage collects images on its own by default, this is meant for nodes where it is disabled or the runtime is used without it
+func (s *DemystifyingCRI) imageGC(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := s.collectImages(time.Now()); err != nil {
+			log.Printf("image garbage collection failed: %v", err)
+		}
+	}
+}
+
+// collectImages removes images until the usage of the image filesystem is estimated to be below imageGCLow
+// Only images no container was created from and which weren't used within imageGCMinAge are removed, oldest first.
+// The sizes of removed images only estimate the freed space, as images may share layers, the next run sees the actual usage.
+func (s *DemystifyingCRI) collectImages(now time.Time) error {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(s.imageRoot, &fs); err != nil {
+		return fmt.Errorf("failed to read usage of %s: %v", s.imageRoot, err)
+	}
+	capacity, available := fs.Blocks*uint64(fs.Bsize), fs.Bavail*uint64(fs.Bsize)
+	if capacity == 0 || (capacity-available)*100 < uint64(s.imageGCHigh)*capacity {
+		return nil
+	}
+	targetAvailable := capacity * uint64(100-s.imageGCLow) / 100
+	if available >= targetAvailable {
+		return nil
+	}
+	toFree := targetAvailable - available
+	log.Printf("image filesystem is %d%% full, removing unused images to free %d bytes", (capacity-available)*100/capacity, toFree)
+
+	var removed []*imageRecord
+	var freed uint64
+	cutoff := now.Add(-s.imageGCMinAge)
+	for _, image := range imageGCCandidates(s.images.records(), s.imagesInUse(), cutoff) {
+		if freed >= toFree {
+			break
+		}
+		// A container may have been created from the image since the candidates were chosen
+		if current, exists := s.images.get(image.Id); !exists || current.lastUsedAt.After(cutoff) {
+			continue
+		}
+		records, _ := s.images.remove(image.Id)
+		// A concurrent RemoveImage may have got to the image first, then its space is already accounted for
+		if len(records) == 0 {
+			continue
+		}
+		removed = append(removed, records...)
+		freed += image.Size
+		log.Printf("removing image %s, last used at %s", image.Id, image.lastUsedAt.Format(time.RFC3339))
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	if err := s.removeImageRecords(removed); err != nil {
+		return err
+	}
+	// Removed tags of a layout other tags still use leave their blobs behind
+	result, err := s.pruneBlobs()
+	if err != nil {
+		return err
+	}
+	log.Printf("image garbage collection removed %d references and pruned %d blobs, freeing %d bytes", len(removed), result.RemovedBlobs, result.FreedBytes)
+	return nil
+}
+
+// imageGCCandidates returns the images which may be removed, least recently used first
+// Images in use are identified by their config digest, and so is the sandbox image, which is in inUse as well
+func imageGCCandidates(images []*imageRecord, inUse map[string]bool, cutoff time.Time) []*imageRecord {
+	var candidates []*imageRecord
+	for _, image := range images {
+		if inUse[image.configDigest] || image.lastUsedAt.After(cutoff) {
+			continue
+		}
+		candidates = append(candidates, image)
+	}
+	slices.SortFunc(candidates, func(a, b *imageRecord) int { return a.lastUsedAt.Compare(b.lastUsedAt) })
+	return candidates
+}
+
+// imagesInUse returns the config digests of the sandbox image and of the images of all containers
+func (s *DemystifyingCRI) imagesInUse() map[string]bool {
+	refs := []string{s.sandboxImage}
+	s.mu.RLock()
+	for _, container := range s.containers {
+		refs = append(refs, container.GetImage().GetImage())
+	}
+	s.mu.RUnlock()
+
+	inUse := make(map[string]bool)
+	for _, ref := range refs {
+		if image, exists := s.images.get(ref); exists {
+			inUse[image.configDigest] = true
+		}
+	}
+	return inUse
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestImageGCCandidates(t *testing.T) {
+	now := time.Now()
+	image := func(id, configDigest string, unusedFor time.Duration) *imageRecord {
+		return &imageRecord{Image: &runtime.Image{Id: id}, configDigest: configDigest, lastUsedAt: now.Add(-unusedFor)}
+	}
+	images := []*imageRecord{
+		image("recent", "sha256:1", time.Minute),
+		image("old", "sha256:2", 2*time.Hour),
+		image("oldest", "sha256:3", 3*time.Hour),
+		image("pause", "sha256:4", 4*time.Hour),
+		image("in-use", "sha256:5", 5*time.Hour),
+		image("in-use-tag", "sha256:5", time.Hour),
+		image("older", "sha256:6", 150*time.Minute),
+	}
+	inUse := map[string]bool{"sha256:4": true, "sha256:5": true}
+
+	tests := []struct {
+		name   string
+		minAge time.Duration
+		want   []string
+	}{
+		{"least recently used first", 30 * time.Minute, []string{"oldest", "older", "old"}},
+		{"recently used are kept", 150 * time.Minute, []string{"oldest", "older"}},
+		{"nothing is old enough", 24 * time.Hour, nil},
+		{"no minimum age", 0, []string{"oldest", "older", "old", "recent"}},
+	}
+	for _, test := range tests {
+		var ids []string
+		for _, candidate := range imageGCCandidates(images, inUse, now.Add(-test.minAge)) {
+			ids = append(ids, candidate.Id)
+		}
+		if !slices.Equal(ids, test.want) {
+			t.Errorf("%s: candidates = %q, want %q", test.name, ids, test.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// imageRefsDir is the directory of an OCI layout recording the full reference of each of its tags
+// The layout path lacks the registry, so the reference can't be recovered from the layout alone
+const imageRefsDir = "refs"
+
+// imageRefPath returns the file recording the reference of an image and the layout the image is stored in
+func (s *DemystifyingCRI) imageRefPath(image string) (string, string) {
+	layoutPath, tag := splitLayoutReference(filepath.Join(s.imageRoot, getImage(image)))
+	return filepath.Join(layoutPath, imageRefsDir, tag), layoutPath
+}
+
+// recordImageRef remembers the reference an image was pulled as, so restoreImages finds it after a restart
+func (s *DemystifyingCRI) recordImageRef(image string) error {
+	refPath, _ := s.imageRefPath(image)
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return fmt.Errorf("failed to record reference of image %s: %v", image, err)
+	}
+	if err := os.WriteFile(refPath, []byte(image), 0644); err != nil {
+		return fmt.Errorf("failed to record reference of image %s: %v", image, err)
+	}
+	return nil
+}
+
+// forgetImageRef removes the recorded reference of an image whose layout is kept for other tags
+func (s *DemystifyingCRI) forgetImageRef(image string) {
+	refPath, _ := s.imageRefPath(image)
+	if err := os.Remove(refPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to forget reference of image %s: %v", image, err)
+	}
+}
+
+// restoreImages adds the images of all layouts below imageRoot to the image store, so they aren't pulled again after a restart
+// Layouts and references which can't be read are logged and skipped, the image is then pulled again when it is needed
+func (s *DemystifyingCRI) restoreImages() {
+	restored := 0
+	err := filepath.WalkDir(s.imageRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("skipping %s while restoring images: %v", path, err)
+			return nil
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		// Temporary layouts of pulls which were interrupted by a restart are never complete
+		if isLayoutStaging(entry.Name()) {
+			if err := os.RemoveAll(path); err != nil {
+				log.Printf("failed to remove temporary layout %s: %v", path, err)
+			}
+			return filepath.SkipDir
+		}
+		// The blobs and references of a layout contain no further layouts
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), "index.json")); err == nil && (entry.Name() == "blobs" || entry.Name() == imageRefsDir) {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "index.json")); err != nil {
+			return nil
+		}
+		restored += s.restoreLayout(path)
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to restore images from %s: %v", s.imageRoot, err)
+	}
+	if restored > 0 {
+		fmt.Printf("Restored %d images from %s\n", restored, s.imageRoot)
+	}
+}
+
+// restoreLayout adds the images recorded for a single layout to the image store and returns how many there were
+func (s *DemystifyingCRI) restoreLayout(layoutPath string) int {
+	entries, err := os.ReadDir(filepath.Join(layoutPath, imageRefsDir))
+	if os.IsNotExist(err) {
+		log.Printf("skipping image layout %s without recorded references, its images are pulled again", layoutPath)
+		return 0
+	}
+	if err != nil {
+		log.Printf("skipping image layout %s: %v", layoutPath, err)
+		return 0
+	}
+
+	restored := 0
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(layoutPath, imageRefsDir, entry.Name()))
+		if err != nil {
+			log.Printf("skipping image reference %s of layout %s: %v", entry.Name(), layoutPath, err)
+			continue
+		}
+		image := strings.TrimSpace(string(data))
+		if _, exists := s.images.get(image); exists {
+			continue
+		}
+
+		// A reference which doesn't map back to this layout and tag was not written by recordImageRef
+		if refPath, _ := s.imageRefPath(image); refPath != filepath.Join(layoutPath, imageRefsDir, entry.Name()) {
+			log.Printf("skipping image reference %q recorded in the wrong place in layout %s", image, layoutPath)
+			continue
+		}
+		if err := checkLayoutComplete(layoutPath, entry.Name()); err != nil {
+			log.Printf("skipping incomplete image %s, it is pulled again: %v", image, err)
+			continue
+		}
+		record, err := s.readImageRecord(image)
+		if err != nil {
+			log.Printf("skipping image %s: %v", image, err)
+			continue
+		}
+		s.images.add(record)
+		restored++
+	}
+	return restored
+}
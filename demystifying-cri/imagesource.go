@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+)
+
+// localPuller implements imagePuller by importing images from a directory of OCI layouts and archives with skopeo
+// Images missing there are pulled by the next puller, so the directory only needs to hold what can't come from a registry
+type localPuller struct {
+	dir       string
+	imageRoot string
+	next      imagePuller
+}
+
+func (p *localPuller) Pull(ctx context.Context, image string, auth *runtime.AuthConfig) error {
+	src := p.source(image)
+	if src == "" {
+		return p.next.Pull(ctx, image, auth)
+	}
+
+	log.Printf("importing image %s from %s", image, src)
+	dst := filepath.Join(p.imageRoot, getImage(image))
+	layoutPath, tag := splitLayoutReference(dst)
+	return stagedLayoutPull(layoutPath, tag, func(layout string) error {
+		if out, err := exec.CommandContext(ctx, "skopeo", "copy", src, "oci:"+layout+strings.TrimPrefix(dst, layoutPath)).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to import image %s from %s: %w: %s", image, src, binaryError("skopeo", err), out)
+		}
+		return nil
+	})
+}
+
+// source returns the skopeo reference of an image in the source directory, empty if it isn't there
+// docker.io/library/busybox:latest is looked up as the OCI layout library/busybox holding the tag latest,
+// then as the OCI archive library/busybox.tar holding a single image. Digest references are never found.
+func (p *localPuller) source(image string) string {
+	name := getImage(image)
+	if strings.Contains(name, "@") {
+		return ""
+	}
+	repository, tag := name, "latest"
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		repository, tag = name[:i], name[i+1:]
+	}
+
+	layout := filepath.Join(p.dir, repository)
+	if _, err := readLayoutDescriptor(layout, tag); err == nil {
+		return "oci:" + layout + ":" + tag
+	}
+	if _, err := os.Stat(layout + ".tar"); err == nil {
+		return "oci-archive:" + layout + ".tar"
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestLocalPullerSource(t *testing.T) {
+	dir := t.TempDir()
+	writeTestImage(t, dir, "docker.io/library/layout:v1")
+	if err := os.WriteFile(filepath.Join(dir, "library", "archive.tar"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image string
+		want  string // Empty if the image is not in the directory
+	}{
+		{"docker.io/library/layout:v1", "oci:" + filepath.Join(dir, "library", "layout") + ":v1"},
+		{"docker.io/library/layout:v2", ""},
+		{"docker.io/library/archive:v1", "oci-archive:" + filepath.Join(dir, "library", "archive.tar")},
+		{"docker.io/library/missing:v1", ""},
+		{"docker.io/library/layout@sha256:0000000000000000000000000000000000000000000000000000000000000000", ""},
+	}
+	puller := &localPuller{dir: dir}
+	for _, test := range tests {
+		if got := puller.source(test.image); got != test.want {
+			t.Errorf("source(%q) = %q, want %q", test.image, got, test.want)
+		}
+	}
+}
+
+func TestLocalPullerImportsLayout(t *testing.T) {
+	// The fake copies the source layout like skopeo copy oci:<layout>:<tag> oci:<layout>:<tag> of the same tag would
+	bin := t.TempDir()
+	script := `#!/bin/sh
+src=${2#oci:}
+dst=${3#oci:}
+mkdir -p "${dst%:*}" && cp -r "${src%:*}"/. "${dst%:*}"
+`
+	if err := os.WriteFile(filepath.Join(bin, "skopeo"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	const image = "docker.io/library/app:v1"
+	source := t.TempDir()
+	writeTestImage(t, source, image)
+
+	s, _ := newTestRuntime(t)
+	next := &fakePuller{release: make(chan struct{})}
+	close(next.release)
+	s.puller = &localPuller{dir: source, imageRoot: s.imageRoot, next: next}
+	s.pullLimiter = newPullLimiter(registryLimits{}, nil)
+
+	ctx := context.Background()
+	if _, err := s.PullImage(ctx, &runtime.PullImageRequest{Image: &runtime.ImageSpec{Image: image}}); err != nil {
+		t.Fatalf("PullImage: %v", err)
+	}
+	resp, err := s.ImageStatus(ctx, &runtime.ImageStatusRequest{Image: &runtime.ImageSpec{Image: image}})
+	if err != nil {
+		t.Fatalf("ImageStatus: %v", err)
+	}
+	if resp.Image == nil || !slices.Contains(resp.Image.RepoTags, image) {
+		t.Errorf("ImageStatus after import = %v, want %s in the image store", resp.Image, image)
+	}
+	if calls := next.calls(); len(calls) != 0 {
+		t.Errorf("next puller was called for %q, want the image imported from the directory", calls)
+	}
+
+	// Images missing in the directory are left to the next puller
+	if err := s.puller.Pull(ctx, "docker.io/library/other:v1", nil); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	if calls := next.calls(); !slices.Equal(calls, []string{"docker.io/library/other:v1"}) {
+		t.Errorf("next puller calls = %q, want the missing image", calls)
+	}
+}
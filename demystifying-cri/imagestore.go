@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// imageStore keeps track of downloaded images and of the downloads in progress
+// Every reference an image was pulled as is stored on its own, as each has its own layout below imageRoot,
+// but references of the same image are handed out as a single image with all of them as RepoTags and RepoDigests,
+// whose ID is the digest of its config like with other runtimes
+// Images are handed out as copies, so callers never share state with the store
+type imageStore struct {
+	mu     sync.RWMutex
+	images map[string]*imageRecord // Downloaded images by reference
+	pulls  map[string]*imagePull   // Downloads in progress by reference
+}
+
+// imageRecord wraps the CRI Image with details of the image which the CRI Image has no field for
+type imageRecord struct {
+	*runtime.Image
+
+	ref            string            // Reference the record is stored as, whose layout below imageRoot holds the image
+	labels         map[string]string // Labels of the image config, e.g. org.opencontainers.image.version
+	configDigest   string            // Digest of the image config, the ID of the image shared by all its references
+	manifestDigest string            // Registry digest of what the reference resolved to, reported in RepoDigests
+	lastUsedAt     time.Time         // Time the reference was pulled or last used by CreateContainer, see imageGC
+}
+
+// copy returns a deep copy of the record
+func (record *imageRecord) copy() *imageRecord {
+	return &imageRecord{
+		Image:          proto.Clone(record.Image).(*runtime.Image),
+		ref:            record.ref,
+		labels:         maps.Clone(record.labels),
+		configDigest:   record.configDigest,
+		manifestDigest: record.manifestDigest,
+		lastUsedAt:     record.lastUsedAt,
+	}
+}
+
+// imageRepository returns the repository of an image reference, e.g. docker.io/library/busybox for docker.io/library/busybox:latest
+func imageRepository(ref string) string {
+	if repository, _, found := strings.Cut(ref, "@"); found {
+		return repository
+	}
+	if index := strings.LastIndex(ref, ":"); index > strings.LastIndex(ref, "/") {
+		return ref[:index]
+	}
+	return ref
+}
+
+// lookup returns the record stored as ref, or one of the image with ID ref, the caller must hold store.mu
+func (store *imageStore) lookup(ref string) (*imageRecord, bool) {
+	if record, exists := store.images[ref]; exists {
+		return record, true
+	}
+	for _, record := range store.images {
+		if record.configDigest != "" && record.configDigest == ref {
+			return record, true
+		}
+	}
+	return nil, false
+}
+
+// sameImage returns the records of all references of the image stored as or with ID ref, the caller must hold store.mu
+func (store *imageStore) sameImage(ref string) []*imageRecord {
+	record, exists := store.lookup(ref)
+	if !exists {
+		return nil
+	}
+	if record.configDigest == "" {
+		return []*imageRecord{record}
+	}
+	var records []*imageRecord
+	for _, other := range store.images {
+		if other.configDigest == record.configDigest {
+			records = append(records, other)
+		}
+	}
+	return records
+}
+
+// merge returns a copy of the image made up of records, all being references of the same image
+// The first reference in sort order is the one the image is read from, so a tag wins over a digest reference of the same repository
+// The image was last used when any of its references was
+func merge(records []*imageRecord) *imageRecord {
+	slices.SortFunc(records, func(a, b *imageRecord) int { return strings.Compare(a.ref, b.ref) })
+	merged := records[0].copy()
+	merged.RepoTags, merged.RepoDigests = nil, nil
+	for _, record := range records {
+		if record.lastUsedAt.After(merged.lastUsedAt) {
+			merged.lastUsedAt = record.lastUsedAt
+		}
+		if !strings.Contains(record.ref, "@") && !slices.Contains(merged.RepoTags, record.ref) {
+			merged.RepoTags = append(merged.RepoTags, record.ref)
+		}
+		if record.manifestDigest == "" {
+			continue
+		}
+		if repoDigest := imageRepository(record.ref) + "@" + record.manifestDigest; !slices.Contains(merged.RepoDigests, repoDigest) {
+			merged.RepoDigests = append(merged.RepoDigests, repoDigest)
+		}
+	}
+	slices.Sort(merged.RepoDigests)
+	return merged
+}
+
+// imagePull is a download in progress which is shared by all callers pulling the same image
+type imagePull struct {
+	done    chan struct{}      // Closed once the download finished
+	err     error              // Result of the download, only valid after done was closed
+	waiters int                // Number of callers still waiting for the download
+	cancel  context.CancelFunc // Cancels the underlying skopeo process
+}
+
+// newImageStore returns an empty image store
+func newImageStore() *imageStore {
+	return &imageStore{
+		images: make(map[string]*imageRecord),
+		pulls:  make(map[string]*imagePull),
+	}
+}
+
+// add stores an image under its reference, replacing a previous one
+func (store *imageStore) add(record *imageRecord) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.images[record.ref] = record.copy()
+}
+
+// get returns a copy of the image stored as or with ID ref, merged with all other references of it
+func (store *imageStore) get(ref string) (*imageRecord, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	records := store.sameImage(ref)
+	if len(records) == 0 {
+		return nil, false
+	}
+	return merge(records), true
+}
+
+// remove deletes the references an image is removed by and returns their records
+// A tag or a reference pulled by digest removes just that reference, while a digest of the image's RepoDigests
+// removes all references of the repository which resolved to that manifest, so the image is gone with its last reference
+// The ID of an image, which image garbage collection of Kubelet removes images by, removes all its references
+func (store *imageStore) remove(ref string) ([]*imageRecord, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var records []*imageRecord
+	if record, exists := store.images[ref]; exists {
+		records = append(records, record)
+	} else if repository, digest, found := strings.Cut(ref, "@"); found {
+		for _, record := range store.images {
+			if record.manifestDigest == digest && imageRepository(record.ref) == repository {
+				records = append(records, record)
+			}
+		}
+	} else {
+		records = store.sameImage(ref)
+	}
+	for _, record := range records {
+		delete(store.images, record.ref)
+	}
+	return records, len(records) > 0
+}
+
+// resolve returns the reference the image stored as or with ID ref is stored as
+func (store *imageStore) resolve(ref string) (string, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	record, exists := store.lookup(ref)
+	if !exists {
+		return "", false
+	}
+	return record.ref, true
+}
+
+// list returns copies of all images, each with all its references merged into one
+func (store *imageStore) list() []*runtime.Image {
+	var images []*runtime.Image
+	for _, record := range store.records() {
+		images = append(images, record.Image)
+	}
+	return images
+}
+
+// records returns copies of the records of all images, each with all its references merged into one
+func (store *imageStore) records() []*imageRecord {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	var records []*imageRecord
+	listed := make(map[string]bool)
+	for ref := range store.images {
+		if listed[ref] {
+			continue
+		}
+		same := store.sameImage(ref)
+		for _, record := range same {
+			listed[record.ref] = true
+		}
+		records = append(records, merge(same))
+	}
+	return records
+}
+
+// touch records that the image stored as or with ID ref was used at the given time
+func (store *imageStore) touch(ref string, at time.Time) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if record, exists := store.lookup(ref); exists && at.After(record.lastUsedAt) {
+		record.lastUsedAt = at
+	}
+}
+
+// refs returns all references images are stored as, each of which has its own layout below imageRoot
+func (store *imageStore) refs() []string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	refs := make([]string, 0, len(store.images))
+	for ref := range store.images {
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// pull joins the in-flight download of an image or starts a new one with fetch and waits for it
+// If ctx is cancelled the caller stops waiting, and if it was the last waiter the download is cancelled as well
+// The fetch of the caller starting the download is used, so are its credentials
+func (store *imageStore) pull(ctx context.Context, ref string, fetch func(context.Context) (*imageRecord, error)) error {
+	store.mu.Lock()
+	pull, inFlight := store.pulls[ref]
+	if !inFlight {
+		// The download must not be bound to the caller's context, as other callers may join it
+		pullCtx, cancel := context.WithCancel(context.Background())
+		pull = &imagePull{
+			done:   make(chan struct{}),
+			cancel: cancel,
+		}
+		store.pulls[ref] = pull
+		go store.runPull(pullCtx, ref, fetch, pull)
+	}
+	pull.waiters++
+	store.mu.Unlock()
+
+	select {
+	case <-pull.done:
+		return pull.err
+	case <-ctx.Done():
+		store.mu.Lock()
+		pull.waiters--
+		if pull.waiters == 0 {
+			pull.cancel()
+			// Later callers must start a fresh download instead of joining the cancelled one
+			if store.pulls[ref] == pull {
+				delete(store.pulls, ref)
+			}
+		}
+		store.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// runPull performs the download, stores the image and hands the result to all waiters
+func (store *imageStore) runPull(ctx context.Context, ref string, fetch func(context.Context) (*imageRecord, error), pull *imagePull) {
+	record, err := fetch(ctx)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if err == nil {
+		store.images[record.ref] = record
+	}
+	pull.err = err
+	pull.cancel()
+	close(pull.done)
+	if store.pulls[ref] == pull {
+		delete(store.pulls, ref)
+	}
+}
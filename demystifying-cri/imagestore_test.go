@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"os"
+	"slices"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestImageReferencesAreOneImage(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	ctx := context.Background()
+	const otherTag = "docker.io/library/test:2"
+	writeTestImage(t, s.imageRoot, otherTag)
+	record, err := s.readImageRecord(otherTag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.images.add(record)
+
+	layoutPath, descriptor := pulledDescriptor(t, s.imageRoot, testImage)
+	manifest, err := readLayoutManifest(layoutPath, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := s.ListImages(ctx, &runtime.ListImagesRequest{})
+	if err != nil {
+		t.Fatalf("ListImages: %v", err)
+	}
+	if len(images.Images) != 1 {
+		t.Fatalf("ListImages = %d images, want the 2 tags as 1", len(images.Images))
+	}
+	image := images.Images[0]
+	if image.Id != manifest.Config.Digest {
+		t.Errorf("image ID = %q, want the config digest %q", image.Id, manifest.Config.Digest)
+	}
+	if want := []string{testImage, otherTag}; !slices.Equal(image.RepoTags, want) {
+		t.Errorf("RepoTags = %q, want %q", image.RepoTags, want)
+	}
+	if want := []string{"docker.io/library/test@" + descriptor.Digest}; !slices.Equal(image.RepoDigests, want) {
+		t.Errorf("RepoDigests = %q, want %q", image.RepoDigests, want)
+	}
+
+	// Kubelet refers to images by the ID ImageStatus reported
+	status, err := s.ImageStatus(ctx, &runtime.ImageStatusRequest{Image: &runtime.ImageSpec{Image: image.Id}})
+	if err != nil || status.Image.GetId() != image.Id {
+		t.Errorf("ImageStatus by ID = %v, %v, want the image", status.GetImage(), err)
+	}
+	if _, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+		PodSandboxId: "sandbox",
+		Config: &runtime.ContainerConfig{
+			Metadata: &runtime.ContainerMetadata{Name: "app"},
+			Image:    &runtime.ImageSpec{Image: image.Id},
+		},
+	}); err != nil {
+		t.Errorf("CreateContainer from the image ID: %v", err)
+	}
+
+	// Both tags share a layout, which must survive removing one of them
+	if _, err := s.RemoveImage(ctx, &runtime.RemoveImageRequest{Image: &runtime.ImageSpec{Image: otherTag}}); err != nil {
+		t.Fatalf("RemoveImage(%s): %v", otherTag, err)
+	}
+	if err := checkLayoutComplete(layoutPath, "1"); err != nil {
+		t.Errorf("layout after removing %s: %v", otherTag, err)
+	}
+	status, err = s.ImageStatus(ctx, &runtime.ImageStatusRequest{Image: &runtime.ImageSpec{Image: testImage}})
+	if err != nil || !slices.Equal(status.Image.GetRepoTags(), []string{testImage}) {
+		t.Errorf("ImageStatus(%s) after removing %s = %v, %v, want only its own tag", testImage, otherTag, status.GetImage(), err)
+	}
+
+	// Removing by ID removes all references, and with them the layout
+	if _, err := s.RemoveImage(ctx, &runtime.RemoveImageRequest{Image: &runtime.ImageSpec{Image: image.Id}}); err != nil {
+		t.Fatalf("RemoveImage by ID: %v", err)
+	}
+	if images, _ := s.ListImages(ctx, &runtime.ListImagesRequest{}); len(images.GetImages()) != 0 {
+		t.Errorf("ListImages after removing by ID = %v, want none", images.GetImages())
+	}
+	if _, err := os.Stat(layoutPath); !os.IsNotExist(err) {
+		t.Errorf("layout %s is left behind after removing the image by ID", layoutPath)
+	}
+}
+
+func TestMergeReportsRegistryDigests(t *testing.T) {
+	record := func(ref, manifestDigest string) *imageRecord {
+		return &imageRecord{Image: &runtime.Image{Id: "sha256:config"}, ref: ref, configDigest: "sha256:config", manifestDigest: manifestDigest}
+	}
+	// The tag resolved to an index, whose digest differs from the stored manifest the digest reference was pulled by
+	merged := merge([]*imageRecord{
+		record("quay.io/app@sha256:manifest", "sha256:manifest"),
+		record("quay.io/app:v1", "sha256:index"),
+	})
+	if merged.Id != "sha256:config" {
+		t.Errorf("merged ID = %q, want the config digest", merged.Id)
+	}
+	if want := []string{"quay.io/app:v1"}; !slices.Equal(merged.RepoTags, want) {
+		t.Errorf("merged RepoTags = %q, want %q", merged.RepoTags, want)
+	}
+	if want := []string{"quay.io/app@sha256:index", "quay.io/app@sha256:manifest"}; !slices.Equal(merged.RepoDigests, want) {
+		t.Errorf("merged RepoDigests = %q, want %q", merged.RepoDigests, want)
+	}
+}
+
+func TestImageStatusReportsLabels(t *testing.T) {
+	registry := newTestRegistry(t, "team/app")
+	labels := map[string]string{"org.opencontainers.image.version": "1.2.3", "org.opencontainers.image.source": "https://example.com/app"}
+	config, err := json.Marshal(map[string]any{"config": map[string]any{"Cmd": []string{"sh"}, "Labels": labels}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.addManifest(t, "v1", mediaTypeOCIManifest, map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIManifest,
+		"config":        registry.addBlob(mediaTypeOCIConfig, config),
+		"layers":        []ociDescriptor{registry.addBlob(mediaTypeOCILayerGzip, []byte("layer"))},
+	})
+
+	s, _ := newTestRuntime(t)
+	s.puller = &nativePuller{imageRoot: s.imageRoot, client: registry.Client()}
+	s.pullLimiter = newPullLimiter(registryLimits{}, nil)
+	image := registry.host + "/team/app:v1"
+	ctx := context.Background()
+	if _, err := s.PullImage(ctx, &runtime.PullImageRequest{Image: &runtime.ImageSpec{Image: image}}); err != nil {
+		t.Fatalf("PullImage: %v", err)
+	}
+
+	resp, err := s.ImageStatus(ctx, &runtime.ImageStatusRequest{Image: &runtime.ImageSpec{Image: image}, Verbose: true})
+	if err != nil {
+		t.Fatalf("ImageStatus: %v", err)
+	}
+	var reported map[string]string
+	if err := json.Unmarshal([]byte(resp.Info["labels"]), &reported); err != nil {
+		t.Fatalf("labels in verbose info %q: %v", resp.Info["labels"], err)
+	}
+	if !maps.Equal(reported, labels) {
+		t.Errorf("labels in verbose info = %v, want %v", reported, labels)
+	}
+
+	resp, err = s.ImageStatus(ctx, &runtime.ImageStatusRequest{Image: &runtime.ImageSpec{Image: image}})
+	if err != nil {
+		t.Fatalf("ImageStatus: %v", err)
+	}
+	if len(resp.Info) != 0 {
+		t.Errorf("info without verbose = %v, want none", resp.Info)
+	}
+}
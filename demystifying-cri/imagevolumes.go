@@ -0,0 +1,103 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// imageVolumesDir is where the anonymous volumes of a container are created, relative to its bundle
+const imageVolumesDir = "volumes"
+
+// applyImageVolumes mounts an empty writable directory at every volume the image config declares, unless a CRI mount covers it
+// Kubelet only passes the volumes of the pod, so writes to the image's volumes would otherwise end up in the writable layer.
+// Each directory takes over owner and mode of the image's directory at the same path, so a non-root process can still write to it.
+// It must be called before applyMounts, so CRI mounts below a volume of the image are mounted on top of it.
+func applyImageVolumes(g *generate.Generator, bundlePath string, image *ociImageConfig, config *runtime.ContainerConfig) error {
+	var volumes []string
+	for volume := range image.Config.Volumes {
+		volume = filepath.Clean(volume)
+		if !filepath.IsAbs(volume) || volumeCovered(volume, config.GetMounts()) {
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+	slices.SortFunc(volumes, func(a, b string) int {
+		if depth := cmp.Compare(strings.Count(a, "/"), strings.Count(b, "/")); depth != 0 {
+			return depth
+		}
+		return strings.Compare(a, b)
+	})
+
+	rootfs := filepath.Join(bundlePath, "rootfs")
+	for i, volume := range volumes {
+		source := filepath.Join(bundlePath, imageVolumesDir, strconv.Itoa(i))
+		if err := createImageVolume(source, rootfs, volume, g.Config.Process.User); err != nil {
+			return err
+		}
+		g.RemoveMount(volume)
+		g.AddMount(rspec.Mount{
+			Destination: volume,
+			Type:        "bind",
+			Source:      source,
+			Options:     []string{"rbind", "rprivate", "rw"},
+		})
+	}
+	return nil
+}
+
+// volumeCovered reports whether a CRI mount is mounted at a volume of the image or one of its parents
+func volumeCovered(volume string, mounts []*runtime.Mount) bool {
+	return slices.ContainsFunc(mounts, func(mount *runtime.Mount) bool {
+		path := filepath.Clean(mount.ContainerPath)
+		return volume == path || strings.HasPrefix(volume, strings.TrimSuffix(path, "/")+"/")
+	})
+}
+
+// createImageVolume creates the directory of a volume at source with owner and mode of the volume's path in the rootfs
+// If the rootfs has no directory there, it is owned by the container's user with mode 0755
+func createImageVolume(source, rootfs, volume string, user rspec.User) error {
+	if err := os.MkdirAll(source, 0755); err != nil {
+		return fmt.Errorf("failed to create volume %s: %v", volume, err)
+	}
+
+	mode, uid, gid := os.FileMode(0755), int(user.UID), int(user.GID)
+	if path, err := secureJoin(rootfs, volume); err == nil {
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			mode = info.Mode().Perm() | info.Mode()&(os.ModeSetgid|os.ModeSticky)
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				uid, gid = int(stat.Uid), int(stat.Gid)
+			}
+		}
+	}
+
+	// Unprivileged runtimes can't chown, their files belong to root of the container anyway
+	if os.Geteuid() == 0 {
+		if err := os.Chown(source, uid, gid); err != nil {
+			return fmt.Errorf("failed to change owner of volume %s: %v", volume, err)
+		}
+	}
+	if err := os.Chmod(source, mode); err != nil {
+		return fmt.Errorf("failed to change mode of volume %s: %v", volume, err)
+	}
+	return nil
+}
+
+// removeImageVolumes deletes the anonymous volumes of a removed container
+// They are deleted even if the bundle is kept in the graveyard, as they may hold a lot of data
+func (s *DemystifyingCRI) removeImageVolumes(containerID string) error {
+	if err := os.RemoveAll(filepath.Join(s.runtimeRoot, containerID, imageVolumesDir)); err != nil {
+		return fmt.Errorf("failed to remove volumes of container %s: %v", containerID, err)
+	}
+	return nil
+}
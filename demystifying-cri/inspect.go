@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// defaultRedactEnv are the patterns of --redact-env, matching environment variables commonly holding credentials
+const defaultRedactEnv = "*PASSWORD*,*PASSWD*,*SECRET*,*TOKEN*,*KEY*,*CREDENTIAL*"
+
+// redactEnv replaces the values of all variables whose name matches a pattern of s.redactedEnv
+// Patterns are shell globs matched against the upper-cased name
+func (s *DemystifyingCRI) redactEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, variable := range env {
+		name, _, _ := strings.Cut(variable, "=")
+		for _, pattern := range s.redactedEnv {
+			if matched, _ := path.Match(pattern, strings.ToUpper(name)); matched {
+				variable = name + "=<redacted>"
+				break
+			}
+		}
+		redacted = append(redacted, variable)
+	}
+	return redacted
+}
+
+// redactSpec redacts the env of the process and the hooks of an OCI spec
+func (s *DemystifyingCRI) redactSpec(spec *rspec.Spec) {
+	if spec.Process != nil {
+		spec.Process.Env = s.redactEnv(spec.Process.Env)
+	}
+	if spec.Hooks != nil {
+		for _, hooks := range [][]rspec.Hook{spec.Hooks.Prestart, spec.Hooks.CreateRuntime, spec.Hooks.CreateContainer, spec.Hooks.StartContainer, spec.Hooks.Poststart, spec.Hooks.Poststop} {
+			for i := range hooks {
+				hooks[i].Env = s.redactEnv(hooks[i].Env)
+			}
+		}
+	}
+}
+
+// containerInfo returns the implementation details crictl inspect shows for a container
+// Besides the disk usage these are the OCI spec the container was created with and how it came about, its cgroup, its runc state and its image config
+// Details which can't be read, e.g. the runc state of a container runc already forgot, are left out
+func (s *DemystifyingCRI) containerInfo(ctx context.Context, containerID, logPath, image string) (map[string]string, error) {
+	info := make(map[string]string)
+
+	usage, err := s.containerDiskUsage(ctx, containerID, logPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := setInfoJSON(info, "diskUsage", map[string]uint64{
+		"writableLayerBytes":  usage.writableBytes,
+		"writableLayerInodes": usage.writableInodes,
+		"logBytes":            usage.logBytes,
+	}); err != nil {
+		return nil, err
+	}
+
+	var spec rspec.Spec
+	if err := readLayoutJSON(filepath.Join(s.runtimeRoot, containerID, "config.json"), &spec); err == nil {
+		s.redactSpec(&spec)
+		if err := setInfoJSON(info, "config", spec); err != nil {
+			return nil, err
+		}
+		if err := s.setCgroupInfo(info, "cgroup", &spec); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read OCI spec of container %s: %v", containerID, err)
+	}
+
+	// How the spec came about, containers created by older versions have no stages
+	var stages []specStage
+	if err := readLayoutJSON(filepath.Join(s.runtimeRoot, containerID, specStagesFile), &stages); err == nil {
+		if err := setInfoJSON(info, "specStages", stages); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read OCI spec stages of container %s: %v", containerID, err)
+	}
+
+	if state, err := s.oci.State(containerID); err == nil {
+		if err := setInfoJSON(info, "runtimeState", state); err != nil {
+			return nil, err
+		}
+	}
+
+	if config, err := s.imageConfig(image); err == nil {
+		config.Config.Env = s.redactEnv(config.Config.Env)
+		if err := setInfoJSON(info, "imageConfig", config); err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// setInfoJSON stores v encoded as JSON under key, the format crictl inspect expects verbose info in
+// HTML escaping is disabled, as it would turn <redacted> into unreadable escapes
+func setInfoJSON(info map[string]string, key string, v interface{}) error {
+	var data strings.Builder
+	encoder := json.NewEncoder(&data)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("failed to encode %s: %v", key, err)
+	}
+	info[key] = strings.TrimSuffix(data.String(), "\n")
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// rpcTimings collects how long the phases of a single RPC took, e.g. unpacking the image or calling runc
+type rpcTimings struct {
+	mu     sync.Mutex
+	phases []rpcPhase
+}
+
+// rpcPhase is a single timed phase of an RPC
+type rpcPhase struct {
+	name     string
+	duration time.Duration
+}
+
+// rpcTimingsKey is the context key of the rpcTimings of the current RPC
+type rpcTimingsKey struct{}
+
+// timePhase starts timing a phase of the RPC ctx belongs to and returns a function which ends it
+// Outside of an RPC or without a budget for it nothing is recorded
+func timePhase(ctx context.Context, name string) func() {
+	timings, ok := ctx.Value(rpcTimingsKey{}).(*rpcTimings)
+	if !ok {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		timings.mu.Lock()
+		timings.phases = append(timings.phases, rpcPhase{name: name, duration: time.Since(start)})
+		timings.mu.Unlock()
+	}
+}
+
+// breakdown describes where the time of an RPC went, everything not covered by a phase is reported as other
+func (timings *rpcTimings) breakdown(total time.Duration) string {
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+
+	parts := make([]string, 0, len(timings.phases)+1)
+	other := total
+	for _, phase := range timings.phases {
+		parts = append(parts, fmt.Sprintf("%s %s", phase.name, phase.duration.Round(time.Millisecond)))
+		other -= phase.duration
+	}
+	parts = append(parts, fmt.Sprintf("other %s", max(other, 0).Round(time.Millisecond)))
+	return strings.Join(parts, ", ")
+}
+
+// rpcBudget returns the latency budget of a method, 0 if slow calls of it aren't logged
+func (s *DemystifyingCRI) rpcBudget(method string) time.Duration {
+	if budget, exists := s.config.Load().rpcBudgets[method]; exists {
+		return budget
+	}
+	return s.slowRPCBudget
+}
+
+// latencyInterceptor logs a warning with a breakdown of the time spent whenever an RPC exceeds its budget
+func (s *DemystifyingCRI) latencyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := path.Base(info.FullMethod)
+	budget := s.rpcBudget(method)
+	if budget <= 0 {
+		return handler(ctx, req)
+	}
+
+	timings := &rpcTimings{}
+	start := time.Now()
+	resp, err := handler(context.WithValue(ctx, rpcTimingsKey{}, timings), req)
+
+	if elapsed := time.Since(start); elapsed > budget {
+		log.Printf("slow %s took %s, exceeding its budget of %s (%s)", method, elapsed.Round(time.Millisecond), budget, timings.breakdown(elapsed))
+	}
+	return resp, err
+}
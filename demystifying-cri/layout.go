@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ociImageConfig is the subset of an OCI image config which is relevant to running containers
+type ociImageConfig struct {
+	Config struct {
+		User       string              `json:"User,omitempty"`
+		Env        []string            `json:"Env,omitempty"`
+		Entrypoint []string            `json:"Entrypoint,omitempty"`
+		Cmd        []string            `json:"Cmd,omitempty"`
+		WorkingDir string              `json:"WorkingDir,omitempty"`
+		Labels     map[string]string   `json:"Labels,omitempty"`
+		StopSignal string              `json:"StopSignal,omitempty"`
+		Volumes    map[string]struct{} `json:"Volumes,omitempty"`
+	} `json:"config"`
+}
+
+// annotationRegistryDigest is set on a manifest in index.json if the registry knows the image by a different digest,
+// as the manifest was converted from a Docker one or picked from a multi-platform index
+const annotationRegistryDigest = "demystifying-cri/registry-digest"
+
+// registryDigest returns the digest the registry knows the image of a manifest in index.json by
+func registryDigest(descriptor *ociDescriptor) string {
+	if digest := descriptor.Annotations[annotationRegistryDigest]; digest != "" {
+		return digest
+	}
+	return descriptor.Digest
+}
+
+// readLayoutManifest returns the image manifest tagged with tag in the OCI layout at layoutPath
+func readLayoutManifest(layoutPath, tag string) (*ociManifest, error) {
+	descriptor, err := readLayoutDescriptor(layoutPath, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest ociManifest
+	if err := readLayoutJSON(layoutBlobPath(layoutPath, descriptor.Digest), &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Config == nil {
+		return nil, fmt.Errorf("manifest %s has no config", descriptor.Digest)
+	}
+	return &manifest, nil
+}
+
+// readLayoutDescriptor returns the descriptor of the manifest tagged with tag in the OCI layout at layoutPath
+func readLayoutDescriptor(layoutPath, tag string) (*ociDescriptor, error) {
+	var index ociManifest
+	if err := readLayoutJSON(filepath.Join(layoutPath, "index.json"), &index); err != nil {
+		return nil, err
+	}
+
+	for _, descriptor := range index.Manifests {
+		if descriptor.Annotations["org.opencontainers.image.ref.name"] == tag {
+			return &descriptor, nil
+		}
+	}
+
+	return nil, fmt.Errorf("tag %s not found in %s", tag, layoutPath)
+}
+
+// readLayoutConfig returns the image config referenced by a manifest of the OCI layout at layoutPath
+func readLayoutConfig(layoutPath string, manifest *ociManifest) (*ociImageConfig, error) {
+	var config ociImageConfig
+	if err := readLayoutJSON(layoutBlobPath(layoutPath, manifest.Config.Digest), &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// layoutBlobPath returns where a blob with the given digest is stored in an OCI layout
+func layoutBlobPath(layoutPath, digest string) string {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return filepath.Join(layoutPath, "blobs", algorithm, hex)
+}
+
+func readLayoutJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return nil
+}
+
+// layoutSize returns the size of an image in an OCI layout as the sum of its config and layers
+func layoutSize(layoutPath, tag string) (uint64, error) {
+	manifest, err := readLayoutManifest(layoutPath, tag)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+	if manifest.Config != nil {
+		size += manifest.Config.Size
+	}
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return uint64(size), nil
+}
+
+// checkLayoutComplete verifies that the OCI layout at layoutPath holds every blob of the image tagged with tag
+// A blob whose size differs from its descriptor was truncated, e.g. by a full disk, its content isn't hashed as that would read every layer
+func checkLayoutComplete(layoutPath, tag string) error {
+	descriptor, err := readLayoutDescriptor(layoutPath, tag)
+	if err != nil {
+		return err
+	}
+	if err := checkLayoutBlob(layoutPath, *descriptor); err != nil {
+		return err
+	}
+	manifest, err := readLayoutManifest(layoutPath, tag)
+	if err != nil {
+		return err
+	}
+	for _, blob := range append([]ociDescriptor{*manifest.Config}, manifest.Layers...) {
+		if err := checkLayoutBlob(layoutPath, blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLayoutBlob verifies that a blob of an OCI layout exists with the size of its descriptor
+func checkLayoutBlob(layoutPath string, blob ociDescriptor) error {
+	info, err := os.Stat(layoutBlobPath(layoutPath, blob.Digest))
+	if err != nil {
+		return fmt.Errorf("blob %s is missing: %v", blob.Digest, err)
+	}
+	if info.Size() != blob.Size {
+		return fmt.Errorf("blob %s has %d of %d bytes", blob.Digest, info.Size(), blob.Size)
+	}
+	return nil
+}
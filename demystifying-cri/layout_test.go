@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckLayoutComplete(t *testing.T) {
+	tests := []struct {
+		name     string
+		damage   func(layoutPath string, manifest *ociManifest) error
+		complete bool
+	}{
+		{"complete", func(string, *ociManifest) error { return nil }, true},
+		{"missing layer", func(layoutPath string, manifest *ociManifest) error {
+			return os.Remove(layoutBlobPath(layoutPath, manifest.Layers[0].Digest))
+		}, false},
+		{"missing config", func(layoutPath string, manifest *ociManifest) error {
+			return os.Remove(layoutBlobPath(layoutPath, manifest.Config.Digest))
+		}, false},
+		{"truncated layer", func(layoutPath string, manifest *ociManifest) error {
+			return os.Truncate(layoutBlobPath(layoutPath, manifest.Layers[0].Digest), manifest.Layers[0].Size-1)
+		}, false},
+		{"missing index", func(layoutPath string, manifest *ociManifest) error {
+			return os.Remove(filepath.Join(layoutPath, "index.json"))
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			imageRoot := t.TempDir()
+			writeTestImage(t, imageRoot, testImage)
+			layoutPath, tag := splitLayoutReference(filepath.Join(imageRoot, getImage(testImage)))
+			manifest, err := readLayoutManifest(layoutPath, tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.damage(layoutPath, manifest); err != nil {
+				t.Fatal(err)
+			}
+
+			err = checkLayoutComplete(layoutPath, tag)
+			if test.complete && err != nil {
+				t.Errorf("checkLayoutComplete = %v, want nil", err)
+			}
+			if !test.complete && err == nil {
+				t.Errorf("checkLayoutComplete = nil, want an error")
+			}
+		})
+	}
+
+	if err := checkLayoutComplete(t.TempDir(), "latest"); err == nil {
+		t.Errorf("checkLayoutComplete of an empty directory = nil, want an error")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// layoutStagingMarker is part of the name of a temporary layout a pull over an incomplete layout is staged in
+const layoutStagingMarker = "-pull-"
+
+// isLayoutStaging reports whether a directory below imageRoot is a temporary layout of stagedLayoutPull
+func isLayoutStaging(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, layoutStagingMarker)
+}
+
+// stagedLayoutPull runs pull with the layout the image tagged with tag is to be copied into
+// If the layout at layoutPath exists but misses blobs of the tag, e.g. after an interrupted or failed copy,
+// copying into it could reuse the broken blobs, so the image is copied into an empty temporary layout next to it instead
+// and merged into layoutPath once complete, see mergeStagedLayout.
+func stagedLayoutPull(layoutPath, tag string, pull func(dst string) error) error {
+	if _, err := os.Stat(filepath.Join(layoutPath, "index.json")); err != nil || checkLayoutComplete(layoutPath, tag) == nil {
+		return pull(layoutPath)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(layoutPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory of %s: %v", layoutPath, err)
+	}
+	stagingPath, err := os.MkdirTemp(filepath.Dir(layoutPath), "."+filepath.Base(layoutPath)+layoutStagingMarker)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary layout for %s: %v", layoutPath, err)
+	}
+	defer os.RemoveAll(stagingPath)
+
+	if err := pull(stagingPath); err != nil {
+		return err
+	}
+	return mergeStagedLayout(stagingPath, layoutPath, tag)
+}
+
+// mergeStagedLayout moves the blobs of a complete temporary layout into layoutPath and tags its image there
+// The blobs replace broken ones of the same digest, and index.json is replaced last,
+// so readers of the layout never see the tag before all of its blobs are in place
+func mergeStagedLayout(stagingPath, layoutPath, tag string) error {
+	if err := checkLayoutComplete(stagingPath, tag); err != nil {
+		return fmt.Errorf("copied image is incomplete: %v", err)
+	}
+	descriptor, err := readLayoutDescriptor(stagingPath, tag)
+	if err != nil {
+		return err
+	}
+
+	blobsPath := filepath.Join(stagingPath, "blobs")
+	err = filepath.WalkDir(blobsPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		relative, err := filepath.Rel(stagingPath, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(layoutPath, relative)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		return os.Rename(path, dst)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to move blobs into %s: %v", layoutPath, err)
+	}
+
+	if err := writeLayoutIndex(layoutPath, tag, *descriptor); err != nil {
+		return fmt.Errorf("failed to tag %s in %s: %v", tag, layoutPath, err)
+	}
+	return nil
+}
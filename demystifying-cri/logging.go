@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Annotations overriding the global log rotation limits for a single container
+const (
+	annotationLogMaxSize  = "demystifying-cri/log-max-size"
+	annotationLogMaxFiles = "demystifying-cri/log-max-files"
+)
+
+// attachOutputBuffer is how many lines an attached client may lag behind before output is dropped for it
+const attachOutputBuffer = 256
+
+// containerLog writes the output of a container to its log file in the CRI logging format
+// Once the file exceeds maxSize it is rotated to path.1, path.2, ... keeping at most maxFiles rotated files
+type containerLog struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	maxSize  int64 // 0 disables rotation
+	maxFiles int
+
+	pod  *podLog // Combined log of the pod the output is also written to, nil if disabled
+	name string  // Name of the container in the pod log
+
+	attached chan []byte // Output for an attached client, nil if none is attached
+	finished bool        // Whether the container closed its output, after which attached clients get nothing more
+
+	stdout, stderr *os.File // Container side of the output pipes, handed to runc
+	readers        []*os.File
+}
+
+// newContainerLog opens the log file at path and creates the pipes for the container's stdout and stderr
+func newContainerLog(path string, maxSize int64, maxFiles int) (*containerLog, error) {
+	l := &containerLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	for _, target := range []**os.File{&l.stdout, &l.stderr} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			l.close()
+			return nil, fmt.Errorf("failed to create output pipe: %v", err)
+		}
+		*target = w
+		l.readers = append(l.readers, r)
+	}
+
+	return l, nil
+}
+
+// start copies the container's output into the log file once runc handed the pipes to the container
+// The log file is closed when the container closed both streams, i.e. when it exited
+func (l *containerLog) start() {
+	l.stdout.Close()
+	l.stderr.Close()
+
+	var wg sync.WaitGroup
+	for i, stream := range []string{"stdout", "stderr"} {
+		wg.Add(1)
+		go func(stream string, r *os.File) {
+			defer wg.Done()
+			defer r.Close()
+			l.copy(stream, r)
+		}(stream, l.readers[i])
+	}
+
+	go func() {
+		wg.Wait()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.file.Close()
+		l.detachAll()
+	}()
+}
+
+// copy writes every line of r as log entry, lines longer than the buffer are split into partial entries
+func (l *containerLog) copy(stream string, r io.Reader) {
+	reader := bufio.NewReaderSize(r, 16*1024)
+	for {
+		line, isPrefix, err := reader.ReadLine()
+		if len(line) > 0 || (err == nil && !isPrefix) {
+			tag := "F"
+			if isPrefix {
+				tag = "P"
+			}
+			l.write(stream, tag, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write appends a single entry and rotates the log file if it grew too large
+func (l *containerLog) write(stream, tag string, line []byte) {
+	entry := fmt.Sprintf("%s %s %s %s\n", time.Now().UTC().Format(time.RFC3339Nano), stream, tag, line)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(entry)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("failed to rotate log %s: %v", l.path, err)
+		}
+	}
+
+	n, err := l.file.WriteString(entry)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("failed to write log %s: %v", l.path, err)
+	}
+
+	if l.pod != nil {
+		l.pod.write(l.name, line)
+	}
+
+	// A slow client misses output rather than stalling the container
+	if l.attached != nil {
+		output := append([]byte(nil), line...)
+		if tag == "F" {
+			output = append(output, '\n')
+		}
+		select {
+		case l.attached <- output:
+		default:
+		}
+	}
+}
+
+// attach passes all output from now on to the returned channel until detach is called
+// The channel is closed once the container closed its output
+func (l *containerLog) attach() (<-chan []byte, func()) {
+	output := make(chan []byte, attachOutputBuffer)
+
+	l.mu.Lock()
+	if l.finished {
+		close(output)
+	} else {
+		l.attached = output
+	}
+	l.mu.Unlock()
+
+	return output, func() {
+		l.mu.Lock()
+		if l.attached == output {
+			l.attached = nil
+		}
+		l.mu.Unlock()
+	}
+}
+
+// rotate shifts the rotated files by one, drops the oldest and starts a new log file
+// A new file is opened even if rotating failed, so the container's output is never lost
+func (l *containerLog) rotate() error {
+	l.file.Close()
+
+	var err error
+	if l.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+		for i := l.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		err = os.Rename(l.path, l.path+".1")
+	} else {
+		err = os.Remove(l.path)
+	}
+
+	if openErr := l.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// reopen starts writing to a new file at path, after an external tool moved the old one away
+func (l *containerLog) reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.file.Close()
+	return l.open()
+}
+
+func (l *containerLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %v", l.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file %s: %v", l.path, err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// close releases everything if the container never started
+func (l *containerLog) close() {
+	for _, f := range append([]*os.File{l.file, l.stdout, l.stderr}, l.readers...) {
+		if f != nil {
+			f.Close()
+		}
+	}
+
+	l.mu.Lock()
+	l.detachAll()
+	l.mu.Unlock()
+}
+
+// detachAll ends the output of an attached client for good, l.mu must be held
+func (l *containerLog) detachAll() {
+	l.finished = true
+	if l.attached != nil {
+		close(l.attached)
+		l.attached = nil
+	}
+}
+
+// logLimits returns the rotation limits of a container, annotations take precedence over the global flags
+func (s *DemystifyingCRI) logLimits(annotations map[string]string) (int64, int) {
+	maxSize, maxFiles := s.logMaxSize, s.logMaxFiles
+	if value, ok := annotations[annotationLogMaxSize]; ok {
+		if size, err := strconv.ParseInt(value, 10, 64); err == nil && size >= 0 {
+			maxSize = size
+		} else {
+			log.Printf("ignoring invalid %s annotation %q", annotationLogMaxSize, value)
+		}
+	}
+	if value, ok := annotations[annotationLogMaxFiles]; ok {
+		if files, err := strconv.Atoi(value); err == nil && files >= 0 {
+			maxFiles = files
+		} else {
+			log.Printf("ignoring invalid %s annotation %q", annotationLogMaxFiles, value)
+		}
+	}
+	return maxSize, maxFiles
+}
+
+// containerLogPath returns the absolute log path Kubelet expects, empty if either part is missing
+// The container's log path is relative to the sandbox's log directory and must not point outside of it
+func containerLogPath(sandboxConfig *runtime.PodSandboxConfig, config *runtime.ContainerConfig) (string, error) {
+	if sandboxConfig.GetLogDirectory() == "" || config.GetLogPath() == "" {
+		return "", nil
+	}
+
+	relPath := filepath.Clean(config.GetLogPath())
+	if filepath.IsAbs(relPath) || relPath == ".." || strings.HasPrefix(relPath, "../") {
+		return "", status.Errorf(codes.InvalidArgument, "log path %q escapes the log directory of the sandbox", config.GetLogPath())
+	}
+	return filepath.Join(sandboxConfig.GetLogDirectory(), relPath), nil
+}
+
+// ReopenContainerLog makes a container write to a new log file, e.g. after Kubelet rotated the old one
+func (s *DemystifyingCRI) ReopenContainerLog(ctx context.Context, req *runtime.ReopenContainerLogRequest) (*runtime.ReopenContainerLogResponse, error) {
+	s.mu.RLock()
+	container, exists := s.containers[req.ContainerId]
+	running := exists && container.State == runtime.ContainerState_CONTAINER_RUNNING
+	s.mu.RUnlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "container %s does not exist", req.ContainerId)
+	}
+	if !running {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %s is not running", req.ContainerId)
+	}
+	if container.log == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %s has no log file", req.ContainerId)
+	}
+
+	if err := container.log.reopen(); err != nil {
+		return nil, err
+	}
+	return &runtime.ReopenContainerLogResponse{}, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestContainerLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app", "0.log")
+	l, err := newContainerLog(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	// Every entry is about 60 bytes, so each file holds three of them
+	for i := 0; i < 20; i++ {
+		l.write("stdout", "F", []byte(fmt.Sprintf("line %02d", i)))
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("log file %s is missing: %v", name, err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("log file %s has %d bytes, want at most 200", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("log file %s.3 exists beyond the 2 rotated files to keep", path)
+	}
+
+	// The current file holds the newest lines, the rotated ones the lines before them
+	current, _ := os.ReadFile(path)
+	if !strings.Contains(string(current), " stdout F line 19\n") {
+		t.Errorf("current log file = %q, want the last line", current)
+	}
+	rotated, _ := os.ReadFile(path + ".1")
+	if strings.Contains(string(rotated), "line 19") || !strings.Contains(string(rotated), "line 1") {
+		t.Errorf("rotated log file = %q, want the lines preceding the current file", rotated)
+	}
+}
+
+func TestContainerLogWithoutRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "0.log")
+	l, err := newContainerLog(path, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	for i := 0; i < 10; i++ {
+		l.write("stderr", "F", []byte(fmt.Sprintf("line %02d", i)))
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("rotated log file exists without any to keep")
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 100 {
+		t.Errorf("log file = %v, %v, want at most 100 bytes", info, err)
+	}
+}
+
+func TestLogLimits(t *testing.T) {
+	s := &DemystifyingCRI{logMaxSize: 10 << 20, logMaxFiles: 5}
+	tests := []struct {
+		annotations map[string]string
+		maxSize     int64
+		maxFiles    int
+	}{
+		{nil, 10 << 20, 5},
+		{map[string]string{annotationLogMaxSize: "1024", annotationLogMaxFiles: "1"}, 1024, 1},
+		{map[string]string{annotationLogMaxSize: "0"}, 0, 5},
+		{map[string]string{annotationLogMaxSize: "-1", annotationLogMaxFiles: "many"}, 10 << 20, 5},
+	}
+	for _, test := range tests {
+		if maxSize, maxFiles := s.logLimits(test.annotations); maxSize != test.maxSize || maxFiles != test.maxFiles {
+			t.Errorf("logLimits(%v) = %d, %d, want %d, %d", test.annotations, maxSize, maxFiles, test.maxSize, test.maxFiles)
+		}
+	}
+}
+
+func TestContainerLogPath(t *testing.T) {
+	sandboxConfig := &runtime.PodSandboxConfig{LogDirectory: "/var/log/pods/default_app_uid"}
+	tests := []struct {
+		logDirectory, logPath string
+		want                  string
+	}{
+		{"/var/log/pods/default_app_uid", "app/0.log", "/var/log/pods/default_app_uid/app/0.log"},
+		{"/var/log/pods/default_app_uid", "app/../sidecar/0.log", "/var/log/pods/default_app_uid/sidecar/0.log"},
+		{"/var/log/pods/default_app_uid", "", ""},
+		{"", "app/0.log", ""},
+	}
+	for _, test := range tests {
+		sandboxConfig.LogDirectory = test.logDirectory
+		got, err := containerLogPath(sandboxConfig, &runtime.ContainerConfig{LogPath: test.logPath})
+		if err != nil || got != test.want {
+			t.Errorf("containerLogPath(%q, %q) = %q, %v, want %q", test.logDirectory, test.logPath, got, err, test.want)
+		}
+	}
+
+	sandboxConfig.LogDirectory = "/var/log/pods/default_app_uid"
+	for _, logPath := range []string{"../other/0.log", "app/../../0.log", "..", "/etc/passwd"} {
+		if _, err := containerLogPath(sandboxConfig, &runtime.ContainerConfig{LogPath: logPath}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("containerLogPath of %q = %v, want InvalidArgument", logPath, err)
+		}
+	}
+}
+
+func TestCreateContainerWritesLogBelowLogDirectory(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	logDirectory := filepath.Join(t.TempDir(), "default_pod_uid")
+	s.sandboxes["sandbox"].config.LogDirectory = logDirectory
+
+	create := func(name, logPath string) (*runtime.CreateContainerResponse, error) {
+		return s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+			PodSandboxId: "sandbox",
+			Config: &runtime.ContainerConfig{
+				Metadata: &runtime.ContainerMetadata{Name: name},
+				Image:    &runtime.ImageSpec{Image: testImage},
+				LogPath:  logPath,
+			},
+		})
+	}
+
+	resp, err := create("app", "app/0.log")
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	want := filepath.Join(logDirectory, "app", "0.log")
+	if _, err := os.Stat(want); err != nil {
+		t.Errorf("log file was not created below the log directory: %v", err)
+	}
+	if logPath := containerState(t, s, resp.ContainerId).LogPath; logPath != want {
+		t.Errorf("reported log path = %q, want %q", logPath, want)
+	}
+
+	if _, err := create("escape", "../escape.log"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateContainer with a log path escaping the log directory = %v, want InvalidArgument", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(logDirectory), "escape.log")); !os.IsNotExist(err) {
+		t.Errorf("log file outside the log directory was created")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics are exported in the Prometheus text format with the following label schema:
+//
+//	demystifying_cri_requests_total{method, code[, namespace]}                  counter
+//	demystifying_cri_request_duration_seconds_sum{method, code[, namespace]}    counter
+//	demystifying_cri_request_duration_seconds_count{method, code[, namespace]}  counter
+//
+// method is the short RPC name (e.g. RunPodSandbox) and code the gRPC status code (e.g. OK, NotFound).
+// Pod, container and image names are never used as labels, as they would create a series per object.
+// The namespace label is only added with --metrics-namespace-labels, which is meant for debugging.
+
+// metricKey identifies a single series
+type metricKey struct {
+	method    string
+	code      string
+	namespace string
+}
+
+// rpcMetrics aggregates the outcome and latency of all RPCs
+type rpcMetrics struct {
+	mu              sync.Mutex
+	namespaceLabels bool // Whether series are additionally split by pod namespace
+	requests        map[metricKey]uint64
+	durations       map[metricKey]float64 // Total seconds spent per series
+}
+
+func newRPCMetrics(namespaceLabels bool) *rpcMetrics {
+	return &rpcMetrics{
+		namespaceLabels: namespaceLabels,
+		requests:        make(map[metricKey]uint64),
+		durations:       make(map[metricKey]float64),
+	}
+}
+
+// metricsInterceptor records every RPC in s.metrics
+func (s *DemystifyingCRI) metricsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	key := metricKey{
+		method: path.Base(info.FullMethod),
+		code:   status.Code(err).String(),
+	}
+	if s.metrics.namespaceLabels {
+		key.namespace = s.requestNamespace(req)
+	}
+
+	s.metrics.mu.Lock()
+	s.metrics.requests[key]++
+	s.metrics.durations[key] += time.Since(start).Seconds()
+	s.metrics.mu.Unlock()
+
+	return resp, err
+}
+
+// requestNamespace returns the pod namespace a request refers to, or an empty string if there is none
+func (s *DemystifyingCRI) requestNamespace(req interface{}) string {
+	if r, ok := req.(interface {
+		GetConfig() *runtime.PodSandboxConfig
+	}); ok {
+		return r.GetConfig().GetMetadata().GetNamespace()
+	}
+	if r, ok := req.(interface {
+		GetSandboxConfig() *runtime.PodSandboxConfig
+	}); ok {
+		return r.GetSandboxConfig().GetMetadata().GetNamespace()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sandboxID := ""
+	if r, ok := req.(interface{ GetPodSandboxId() string }); ok {
+		sandboxID = r.GetPodSandboxId()
+	} else if r, ok := req.(interface{ GetContainerId() string }); ok {
+		if container, exists := s.containers[r.GetContainerId()]; exists {
+			sandboxID = container.PodSandboxId
+		}
+	}
+	if sandbox, exists := s.sandboxes[sandboxID]; exists {
+		return sandbox.Metadata.GetNamespace()
+	}
+
+	return ""
+}
+
+// ServeHTTP writes all series in the Prometheus text format
+func (m *rpcMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]metricKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP demystifying_cri_requests_total Number of CRI requests by method and status code.")
+	fmt.Fprintln(w, "# TYPE demystifying_cri_requests_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "demystifying_cri_requests_total{%s} %d\n", m.labels(key), m.requests[key])
+	}
+	fmt.Fprintln(w, "# HELP demystifying_cri_request_duration_seconds Time spent handling CRI requests.")
+	fmt.Fprintln(w, "# TYPE demystifying_cri_request_duration_seconds summary")
+	for _, key := range keys {
+		fmt.Fprintf(w, "demystifying_cri_request_duration_seconds_sum{%s} %g\n", m.labels(key), m.durations[key])
+		fmt.Fprintf(w, "demystifying_cri_request_duration_seconds_count{%s} %d\n", m.labels(key), m.requests[key])
+	}
+}
+
+func (m *rpcMetrics) labels(key metricKey) string {
+	labels := []string{
+		fmt.Sprintf("method=%q", key.method),
+		fmt.Sprintf("code=%q", key.code),
+	}
+	if m.namespaceLabels {
+		labels = append(labels, fmt.Sprintf("namespace=%q", key.namespace))
+	}
+	return strings.Join(labels, ",")
+}
+
+// serveMetrics exposes the metrics over HTTP at /metrics
+func (s *DemystifyingCRI) serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics)
+
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Printf("metrics server stopped: %v", err)
+		}
+	}()
+
+	fmt.Printf("Metrics server listening on %s\n", address)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// annotationTerminationMessagePath is set by Kubelet on every container to the path its termination message is read from
+const annotationTerminationMessagePath = "io.kubernetes.container.terminationMessagePath"
+
+// mountPropagations are the mount options of the CRI propagation modes
+var mountPropagations = map[runtime.MountPropagation]string{
+	runtime.MountPropagation_PROPAGATION_PRIVATE:           "rprivate",
+	runtime.MountPropagation_PROPAGATION_HOST_TO_CONTAINER: "rslave",
+	runtime.MountPropagation_PROPAGATION_BIDIRECTIONAL:     "rshared",
+}
+
+// applyMounts bind mounts the volumes of the CRI config into a container, replacing mounts of the spec at the same path
+// Mounts are sorted by depth, so a volume inside another volume is mounted after it
+// Missing host paths are created as directories like containerd does, except the termination log, see ensureTerminationLog
+func applyMounts(g *generate.Generator, config *runtime.ContainerConfig) error {
+	mounts := slices.Clone(config.GetMounts())
+	slices.SortStableFunc(mounts, func(a, b *runtime.Mount) int {
+		return cmp.Compare(strings.Count(filepath.Clean(a.ContainerPath), "/"), strings.Count(filepath.Clean(b.ContainerPath), "/"))
+	})
+
+	terminationLog := config.GetAnnotations()[annotationTerminationMessagePath]
+	for _, mount := range mounts {
+		if !filepath.IsAbs(mount.ContainerPath) || !filepath.IsAbs(mount.HostPath) {
+			return status.Errorf(codes.InvalidArgument, "mount of %q to %q must use absolute paths", mount.HostPath, mount.ContainerPath)
+		}
+		propagation, ok := mountPropagations[mount.Propagation]
+		if !ok {
+			return status.Errorf(codes.InvalidArgument, "unknown propagation %v of mount %s", mount.Propagation, mount.ContainerPath)
+		}
+
+		if terminationLog != "" && filepath.Clean(mount.ContainerPath) == filepath.Clean(terminationLog) {
+			if err := ensureTerminationLog(mount.HostPath); err != nil {
+				return err
+			}
+		} else if _, err := os.Stat(mount.HostPath); os.IsNotExist(err) {
+			if err := os.MkdirAll(mount.HostPath, 0755); err != nil {
+				return fmt.Errorf("failed to create host path %s of mount %s: %v", mount.HostPath, mount.ContainerPath, err)
+			}
+		} else if err != nil {
+			return fmt.Errorf("failed to check host path %s of mount %s: %v", mount.HostPath, mount.ContainerPath, err)
+		}
+
+		options := []string{"rbind", propagation, "rw"}
+		if mount.Readonly {
+			options[2] = "ro"
+		}
+		g.RemoveMount(mount.ContainerPath)
+		g.AddMount(rspec.Mount{
+			Destination: mount.ContainerPath,
+			Type:        "bind",
+			Source:      mount.HostPath,
+			Options:     options,
+		})
+
+		// Propagation into or out of the container requires the rootfs to propagate as well
+		switch mount.Propagation {
+		case runtime.MountPropagation_PROPAGATION_BIDIRECTIONAL:
+			if err := g.SetLinuxRootPropagation("rshared"); err != nil {
+				return fmt.Errorf("failed to set rootfs propagation: %v", err)
+			}
+		case runtime.MountPropagation_PROPAGATION_HOST_TO_CONTAINER:
+			if g.Config.Linux == nil || g.Config.Linux.RootfsPropagation != "rshared" {
+				if err := g.SetLinuxRootPropagation("rslave"); err != nil {
+					return fmt.Errorf("failed to set rootfs propagation: %v", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ensureTerminationLog creates the host file of a container's termination log if Kubelet didn't, writable by any user of the container
+// Kubelet reads the termination message from it after the container exited, so it must be a file and not a directory
+func ensureTerminationLog(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory of termination log %s: %v", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to create termination log %s: %v", path, err)
+	}
+	file.Close()
+	// The mode passed to open is reduced by the umask of the runtime
+	if err := os.Chmod(path, 0666); err != nil {
+		return fmt.Errorf("failed to make termination log %s writable: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestTerminationLogMountIsWritable(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	podDir := t.TempDir()
+	terminationLog := filepath.Join(podDir, "containers", "app", "termination-log")
+	volume := filepath.Join(podDir, "volumes", "data")
+
+	resp, err := s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+		PodSandboxId: "sandbox",
+		Config: &runtime.ContainerConfig{
+			Metadata:    &runtime.ContainerMetadata{Name: "app"},
+			Image:       &runtime.ImageSpec{Image: testImage},
+			Annotations: map[string]string{annotationTerminationMessagePath: "/dev/termination-log"},
+			Mounts: []*runtime.Mount{
+				{ContainerPath: "/dev/termination-log", HostPath: terminationLog},
+				{ContainerPath: "/data", HostPath: volume},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+
+	info, err := os.Stat(terminationLog)
+	if err != nil {
+		t.Fatalf("termination log was not created: %v", err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm() != 0666 {
+		t.Errorf("termination log has mode %v, want a regular file writable by any user", info.Mode())
+	}
+	if info, err := os.Stat(volume); err != nil || !info.IsDir() {
+		t.Errorf("missing host path of a volume was not created as directory: %v", err)
+	}
+
+	mounts := containerSpec(t, s, resp.ContainerId).Mounts
+	i := slices.IndexFunc(mounts, func(m rspec.Mount) bool { return m.Destination == "/dev/termination-log" })
+	if i < 0 {
+		t.Fatalf("mounts = %+v, want the termination log", mounts)
+	}
+	if mount := mounts[i]; mount.Source != terminationLog || mount.Type != "bind" || !slices.Contains(mount.Options, "rw") {
+		t.Errorf("termination log mount = %+v, want a writable bind mount of %s", mount, terminationLog)
+	}
+
+	// A file Kubelet created already is kept, including what was written to it
+	if err := os.WriteFile(terminationLog, []byte("previous"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureTerminationLog(terminationLog); err != nil {
+		t.Fatalf("ensureTerminationLog: %v", err)
+	}
+	if data, err := os.ReadFile(terminationLog); err != nil || string(data) != "previous" {
+		t.Errorf("termination log = %q, %v after ensureTerminationLog, want its content kept", data, err)
+	}
+}
+
+func TestImageVolumesAreMounted(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	ctx := context.Background()
+
+	const image = "docker.io/library/volumes:1"
+	var config ociImageConfig
+	config.Config.Cmd = []string{"sleep", "1000"}
+	config.Config.Volumes = map[string]struct{}{"/data": {}, "/var/cache/": {}}
+	writeTestImageConfig(t, s.imageRoot, image, config)
+	record, err := s.readImageRecord(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.images.add(record)
+
+	// The pod's volume covers the image's one at /var
+	hostCache := t.TempDir()
+	resp, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+		PodSandboxId: "sandbox",
+		Config: &runtime.ContainerConfig{
+			Metadata: &runtime.ContainerMetadata{Name: "app"},
+			Image:    &runtime.ImageSpec{Image: image},
+			Mounts:   []*runtime.Mount{{ContainerPath: "/var", HostPath: hostCache}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	containerID := resp.ContainerId
+
+	sources := make(map[string]string)
+	for _, mount := range containerSpec(t, s, containerID).Mounts {
+		sources[mount.Destination] = mount.Source
+	}
+	volume := sources["/data"]
+	if filepath.Dir(volume) != filepath.Join(s.runtimeRoot, containerID, imageVolumesDir) {
+		t.Fatalf("/data is mounted from %q, want an anonymous volume in the bundle", volume)
+	}
+	if info, err := os.Stat(volume); err != nil || !info.IsDir() || info.Mode().Perm() != 0755 {
+		t.Errorf("anonymous volume = %v, %v, want a directory with mode 0755", info, err)
+	}
+	if _, exists := sources["/var/cache"]; exists {
+		t.Errorf("mounts = %v, want no anonymous volume below the pod's volume at /var", sources)
+	}
+	if sources["/var"] != hostCache {
+		t.Errorf("/var is mounted from %q, want the pod's volume %s", sources["/var"], hostCache)
+	}
+
+	if _, err := s.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("RemoveContainer: %v", err)
+	}
+	if _, err := os.Stat(volume); !os.IsNotExist(err) {
+		t.Errorf("anonymous volume still exists after RemoveContainer: %v", err)
+	}
+}
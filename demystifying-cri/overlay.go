@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// sharedRootfsDir is where images are unpacked once by manifest digest with sharedRootfs, relative to runtimeRoot
+const sharedRootfsDir = "rootfs"
+
+// createOverlayBundle creates a bundle whose rootfs is an overlay on top of the image's shared rootfs
+// The bundle keeps the container's writable layer in upper, so removing it never touches the shared rootfs
+func (s *DemystifyingCRI) createOverlayBundle(imagePath, snapshotPath string) error {
+	sharedPath, err := s.sharedBundle(imagePath)
+	if err != nil {
+		return err
+	}
+
+	// Build the bundle in a temporary sibling directory, so a failure never leaves a partial bundle behind
+	tmpPath, err := os.MkdirTemp(s.runtimeRoot, "."+filepath.Base(snapshotPath)+"-bundle-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary bundle directory: %v", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	config, err := os.ReadFile(filepath.Join(sharedPath, "config.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read config of shared rootfs: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpPath, "config.json"), config, 0644); err != nil {
+		return fmt.Errorf("failed to write bundle config: %v", err)
+	}
+	for _, dir := range []string{"upper", "work", "rootfs"} {
+		if err := os.Mkdir(filepath.Join(tmpPath, dir), 0755); err != nil {
+			return fmt.Errorf("failed to create bundle directory %s: %v", dir, err)
+		}
+	}
+
+	if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		return fmt.Errorf("failed to move bundle to %s: %v", snapshotPath, err)
+	}
+
+	// Mount after the rename, as the overlay remembers the paths of its upper and work directories
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		filepath.Join(sharedPath, "rootfs"), filepath.Join(snapshotPath, "upper"), filepath.Join(snapshotPath, "work"))
+	if err := syscall.Mount("overlay", filepath.Join(snapshotPath, "rootfs"), "overlay", 0, options); err != nil {
+		os.RemoveAll(snapshotPath)
+		return fmt.Errorf("failed to mount overlay rootfs at %s: %v", snapshotPath, err)
+	}
+
+	return nil
+}
+
+// sharedBundle returns the bundle the image at imagePath was unpacked to once, unpacking it if necessary
+// Bundles are keyed by manifest digest, so tags pointing to the same image share one rootfs
+func (s *DemystifyingCRI) sharedBundle(imagePath string) (string, error) {
+	descriptor, err := readLayoutDescriptor(splitLayoutReference(imagePath))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve digest of image %s: %v", imagePath, err)
+	}
+	_, hex, _ := strings.Cut(descriptor.Digest, ":")
+
+	parent := filepath.Join(s.runtimeRoot, sharedRootfsDir)
+	if err := os.MkdirAll(parent, 0700); err != nil {
+		return "", fmt.Errorf("failed to create shared rootfs directory: %v", err)
+	}
+
+	sharedPath := filepath.Join(parent, hex)
+	if _, err := os.Stat(sharedPath); err == nil {
+		return sharedPath, nil
+	}
+
+	// A concurrent unpack of the same image may win the rename, in which case its result is used
+	err = s.unpackBundle(imagePath, sharedPath)
+	if _, statErr := os.Stat(sharedPath); statErr == nil {
+		return sharedPath, nil
+	}
+	return "", err
+}
+
+// probeOverlay mounts and unmounts a throwaway overlay below runtimeRoot
+// The kernel may support overlayfs while the filesystem of runtimeRoot can't serve as its upper layer, e.g. when it is an overlay itself
+func (s *DemystifyingCRI) probeOverlay() error {
+	if err := os.MkdirAll(s.runtimeRoot, 0755); err != nil {
+		return fmt.Errorf("failed to create runtime root: %v", err)
+	}
+	probePath, err := os.MkdirTemp(s.runtimeRoot, ".overlay-probe-")
+	if err != nil {
+		return fmt.Errorf("failed to create overlay probe directory: %v", err)
+	}
+	defer os.RemoveAll(probePath)
+
+	for _, dir := range []string{"lower", "upper", "work", "merged"} {
+		if err := os.Mkdir(filepath.Join(probePath, dir), 0755); err != nil {
+			return fmt.Errorf("failed to create overlay probe directory %s: %v", dir, err)
+		}
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		filepath.Join(probePath, "lower"), filepath.Join(probePath, "upper"), filepath.Join(probePath, "work"))
+	merged := filepath.Join(probePath, "merged")
+	if err := syscall.Mount("overlay", merged, "overlay", 0, options); err != nil {
+		return fmt.Errorf("failed to mount overlay in %s: %v", s.runtimeRoot, err)
+	}
+	return syscall.Unmount(merged, 0)
+}
+
+// removeUnusedSharedRootfs deletes the shared rootfs of images which are no longer stored
+// A rootfs still serving as lower layer of a container is kept until the container is removed, which calls this again
+func (s *DemystifyingCRI) removeUnusedSharedRootfs() {
+	parent := filepath.Join(s.runtimeRoot, sharedRootfsDir)
+	entries, err := os.ReadDir(parent)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("failed to list shared rootfs: %v", err)
+		}
+		return
+	}
+
+	// Unpacking holds the read lock until the overlay is mounted, so every rootfs in use shows up in the mount table
+	s.pruneMu.Lock()
+	defer s.pruneMu.Unlock()
+
+	referenced := make(map[string]bool)
+	for _, image := range s.images.refs() {
+		descriptor, err := readLayoutDescriptor(splitLayoutReference(filepath.Join(s.imageRoot, getImage(image))))
+		if err != nil {
+			log.Printf("not removing shared rootfs, failed to resolve image %s: %v", image, err)
+			return
+		}
+		_, hex, _ := strings.Cut(descriptor.Digest, ":")
+		referenced[hex] = true
+	}
+	mounts, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		log.Printf("not removing shared rootfs, failed to read mounts: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		sharedPath := filepath.Join(parent, entry.Name())
+		if referenced[entry.Name()] || strings.Contains(string(mounts), "lowerdir="+filepath.Join(sharedPath, "rootfs")+",") {
+			continue
+		}
+		if err := os.RemoveAll(sharedPath); err != nil {
+			log.Printf("failed to remove shared rootfs %s: %v", sharedPath, err)
+		}
+	}
+}
+
+// unmountRootfs unmounts the overlay rootfs of a container's bundle, if it has one
+// It doesn't depend on sharedRootfs, as the bundle may have been created by a run with a different setting
+func (s *DemystifyingCRI) unmountRootfs(containerID string) error {
+	rootfs := filepath.Join(s.runtimeRoot, containerID, "rootfs")
+	err := syscall.Unmount(rootfs, syscall.MNT_DETACH)
+	if err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("failed to unmount rootfs of container %s: %v", containerID, err)
+	}
+	return nil
+}
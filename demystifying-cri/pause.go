@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CheckpointContainer freezes the container while runc checkpoints it, exports the checkpoint to req.Location and leaves the container stopped
+// The process ends with the checkpoint, which holds its complete state, so it can be restored elsewhere without running twice
+func (s *DemystifyingCRI) CheckpointContainer(ctx context.Context, req *runtime.CheckpointContainerRequest) (*runtime.CheckpointContainerResponse, error) {
+	if req.Location == "" {
+		return nil, status.Error(codes.InvalidArgument, "checkpoint location must be set")
+	}
+
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	// Freeze the container so it does not change while being checkpointed
+	if err := s.pauseContainer(req.ContainerId); err != nil {
+		return nil, err
+	}
+
+	imagePath, err := os.MkdirTemp("", "checkpoint-"+req.ContainerId)
+	if err != nil {
+		s.resumeAfterCheckpoint(req.ContainerId)
+		return nil, fmt.Errorf("failed to create checkpoint directory: %v", err)
+	}
+	defer os.RemoveAll(imagePath)
+
+	if err := s.oci.Checkpoint(ctx, req.ContainerId, imagePath); err != nil {
+		s.resumeAfterCheckpoint(req.ContainerId)
+		return nil, fmt.Errorf("failed to checkpoint container %s: %w", req.ContainerId, err)
+	}
+	if s.waitForExit(ctx, req.ContainerId, time.Now().Add(stopKillTimeout)) {
+		s.markExited(req.ContainerId)
+	}
+
+	// Export the checkpoint as an archive
+	cmd := exec.CommandContext(ctx, "tar", "-cf", req.Location, "-C", imagePath, ".")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to export checkpoint to %s: %w: %s", req.Location, binaryError("tar", err), out)
+	}
+
+	return &runtime.CheckpointContainerResponse{}, nil
+}
+
+// resumeAfterCheckpoint thaws a container whose checkpoint failed, so it keeps running as before
+func (s *DemystifyingCRI) resumeAfterCheckpoint(containerID string) {
+	if err := s.unpauseContainer(containerID); err != nil {
+		log.Printf("failed to resume container %s after failed checkpoint: %v", containerID, err)
+	}
+}
+
+// pauseContainer freezes all processes of a running container with runc pause
+func (s *DemystifyingCRI) pauseContainer(containerID string) error {
+	container, err := s.reservePauseChange(containerID, true)
+	if err != nil {
+		return err
+	}
+	err = s.oci.Pause(containerID)
+	s.finishPauseChange(container, true, err)
+	if err != nil {
+		return fmt.Errorf("failed to pause container %s: %w", containerID, err)
+	}
+	return nil
+}
+
+// unpauseContainer thaws a container previously frozen by pauseContainer with runc resume
+func (s *DemystifyingCRI) unpauseContainer(containerID string) error {
+	container, err := s.reservePauseChange(containerID, false)
+	if err != nil {
+		return err
+	}
+	err = s.oci.Resume(containerID)
+	s.finishPauseChange(container, false, err)
+	if err != nil {
+		return fmt.Errorf("failed to resume container %s: %w", containerID, err)
+	}
+	return nil
+}
+
+// reservePauseChange checks that a container can be paused or resumed and marks the change as in progress
+// runc runs without s.mu held, the reservation keeps concurrent pause and resume calls from interleaving meanwhile
+func (s *DemystifyingCRI) reservePauseChange(containerID string, pause bool) (*containerRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	container, exists := s.containers[containerID]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "container %s does not exist", containerID)
+	}
+	if container.State != runtime.ContainerState_CONTAINER_RUNNING {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %s is not running", containerID)
+	}
+	if container.pausing {
+		return nil, status.Errorf(codes.Aborted, "container %s is being paused or resumed", containerID)
+	}
+	if pause && container.paused {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %s is already paused", containerID)
+	}
+	if !pause && !container.paused {
+		return nil, status.Errorf(codes.FailedPrecondition, "container %s is not paused", containerID)
+	}
+	container.pausing = true
+	return container, nil
+}
+
+// finishPauseChange releases the reservation of reservePauseChange and records the outcome of runc
+// A container which exited meanwhile stays unpaused, as markExited left it
+func (s *DemystifyingCRI) finishPauseChange(container *containerRecord, pause bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	container.pausing = false
+	if err == nil && container.State == runtime.ContainerState_CONTAINER_RUNNING {
+		container.paused = pause
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPauseContainerGuards(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+
+	createdID := createTestContainer(t, s, "created")
+	exitedID := createTestContainer(t, s, "exited")
+	containerID := createTestContainer(t, s, "app")
+	for _, id := range []string{exitedID, containerID} {
+		if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: id}); err != nil {
+			t.Fatalf("StartContainer: %v", err)
+		}
+	}
+	if _, err := s.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: exitedID}); err != nil {
+		t.Fatalf("StopContainer: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(string) error
+		id     string
+		code   codes.Code
+	}{
+		{"pause unknown", s.pauseContainer, "unknown", codes.NotFound},
+		{"pause created", s.pauseContainer, createdID, codes.FailedPrecondition},
+		{"pause exited", s.pauseContainer, exitedID, codes.FailedPrecondition},
+		{"unpause running", s.unpauseContainer, containerID, codes.FailedPrecondition},
+		{"pause running", s.pauseContainer, containerID, codes.OK},
+		{"pause paused", s.pauseContainer, containerID, codes.FailedPrecondition},
+		{"unpause paused", s.unpauseContainer, containerID, codes.OK},
+		{"unpause exited", s.unpauseContainer, exitedID, codes.FailedPrecondition},
+	}
+	for _, test := range tests {
+		if code := status.Code(test.change(test.id)); code != test.code {
+			t.Errorf("%s = %v, want %v", test.name, code, test.code)
+		}
+	}
+	if want := []string{"pause " + containerID, "resume " + containerID}; !slices.Equal(pauseCalls(oci), want) {
+		t.Errorf("runc calls = %q, want %q", pauseCalls(oci), want)
+	}
+
+	// A change in progress holds off others until runc returned
+	s.mu.Lock()
+	s.containers[containerID].pausing = true
+	s.mu.Unlock()
+	if code := status.Code(s.pauseContainer(containerID)); code != codes.Aborted {
+		t.Errorf("pause during another change = %v, want Aborted", code)
+	}
+}
+
+// pauseCalls returns the pause and resume calls of the fake runtime
+func pauseCalls(oci *fakeOCI) []string {
+	oci.mu.Lock()
+	defer oci.mu.Unlock()
+	var calls []string
+	for _, call := range oci.calls {
+		if command, _, _ := strings.Cut(call, " "); command == "pause" || command == "resume" {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func TestCheckpointContainerStopsContainer(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+	containerID := createTestContainer(t, s, "app")
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+
+	// A failed checkpoint leaves the container running as before
+	oci.checkpoint = errors.New("criu failed")
+	location := filepath.Join(t.TempDir(), "checkpoint.tar")
+	if _, err := s.CheckpointContainer(ctx, &runtime.CheckpointContainerRequest{ContainerId: containerID, Location: location}); err == nil {
+		t.Fatal("CheckpointContainer succeeded although runc failed")
+	}
+	if status := containerState(t, s, containerID); status.State != runtime.ContainerState_CONTAINER_RUNNING || status.Reason == "Paused" {
+		t.Errorf("container after failed checkpoint is %s (%s), want running", status.State, status.Reason)
+	}
+
+	oci.checkpoint = nil
+	if _, err := s.CheckpointContainer(ctx, &runtime.CheckpointContainerRequest{ContainerId: containerID, Location: location}); err != nil {
+		t.Fatalf("CheckpointContainer: %v", err)
+	}
+	if _, err := os.Stat(location); err != nil {
+		t.Errorf("checkpoint was not exported: %v", err)
+	}
+	if status := containerState(t, s, containerID); status.State != runtime.ContainerState_CONTAINER_EXITED {
+		t.Errorf("container after checkpoint is %s, want exited", status.State)
+	}
+	want := []string{"pause " + containerID, "resume " + containerID, "pause " + containerID}
+	if calls := pauseCalls(oci); !slices.Equal(calls, want) {
+		t.Errorf("runc calls = %q, want %q", calls, want)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// applyPauseCommand replaces the entrypoint of the sandbox image with --sandbox-command, if set
+// The command must keep running for the lifetime of the pod, as the pod's namespaces die with it
+func (s *DemystifyingCRI) applyPauseCommand(g *generate.Generator) {
+	if len(s.pauseCommand) > 0 {
+		g.SetProcessArgs(append([]string{}, s.pauseCommand...))
+	}
+}
+
+// checkSandboxStarted fails if the pause process of a sandbox exited right after runc started it
+// It waits for --post-start-check if set, otherwise it only catches processes which exited before runc returned
+// A dead pause process is deleted, so the next RunPodSandbox can run the sandbox again
+func (s *DemystifyingCRI) checkSandboxStarted(ctx context.Context, sandboxID string) error {
+	if s.postStartCheck > 0 {
+		timer := time.NewTimer(s.postStartCheck)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	state, err := s.oci.State(sandboxID)
+	if err == nil && state.Status != "stopped" {
+		return nil
+	}
+	if err := s.oci.Delete(sandboxID, true); err != nil && !containerGone(err) {
+		return status.Errorf(codes.Internal, "pause process of sandbox %s exited right after starting and could not be deleted: %v", sandboxID, err)
+	}
+	if state != nil {
+		s.collectExitStatus(state.Pid)
+	}
+	return status.Errorf(codes.FailedPrecondition, "pause process of sandbox %s exited right after starting, the sandbox image %s may lack a long-running process, see --sandbox-command", sandboxID, s.sandboxImage)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sandboxConfig returns the config of a pod with the given name in the default namespace
+func sandboxConfig(name string) *runtime.PodSandboxConfig {
+	return &runtime.PodSandboxConfig{Metadata: &runtime.PodSandboxMetadata{Name: name, Namespace: "default", Uid: name + "-uid"}}
+}
+
+// enableTestSandboxes lets RunPodSandbox of a newTestRuntime run pause processes of the fake from testImage
+// Rootless mode keeps the runtime from creating cgroups on the node, and without a network plugin no netns is set up
+func enableTestSandboxes(s *DemystifyingCRI) {
+	s.sandboxImage = testImage
+	s.rootless = true
+	s.networkPlugin = "none"
+}
+
+func TestSandboxCommand(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	enableTestSandboxes(s)
+	s.pauseCommand = []string{"sleep", "infinity"}
+
+	resp, err := s.RunPodSandbox(context.Background(), &runtime.RunPodSandboxRequest{Config: sandboxConfig("pod-a")})
+	if err != nil {
+		t.Fatalf("RunPodSandbox: %v", err)
+	}
+	if args := containerSpec(t, s, resp.PodSandboxId).Process.Args; !slices.Equal(args, s.pauseCommand) {
+		t.Errorf("args of the pause process = %q, want the sandbox command %q", args, s.pauseCommand)
+	}
+	if !s.processAlive(resp.PodSandboxId) {
+		t.Errorf("pause process is not running after RunPodSandbox")
+	}
+}
+
+func TestRunPodSandboxFailsIfPauseExits(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	enableTestSandboxes(s)
+	// The pause process of an image without a long-running process exits right away, which the check waits for
+	oci.command = "true"
+	s.postStartCheck = 100 * time.Millisecond
+
+	_, err := s.RunPodSandbox(context.Background(), &runtime.RunPodSandboxRequest{Config: sandboxConfig("pod-a")})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("RunPodSandbox with an exiting pause process = %v, want FailedPrecondition", err)
+	}
+	if len(s.sandboxes) != 1 {
+		t.Errorf("sandboxes = %v, want the failed sandbox not recorded", s.sandboxes)
+	}
+	if states, _ := oci.List(); len(states) != 0 {
+		t.Errorf("runtime containers = %v, want the dead pause process deleted", states)
+	}
+}
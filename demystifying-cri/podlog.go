@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// podLog is the combined log of all containers of a sandbox, written next to their CRI logs with podAggregateLogs
+// Every line is prefixed with the name of the container it came from
+type podLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// write appends a line of a container to the pod log
+func (p *podLog) write(container string, line []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := fmt.Fprintf(p.file, "[%s] %s\n", container, line); err != nil {
+		log.Printf("failed to write pod log %s: %v", p.file.Name(), err)
+	}
+}
+
+// sandboxPodLog returns the pod log of a sandbox, opening it on first use
+// It returns nil if aggregation is disabled or the sandbox has no log directory
+func (s *DemystifyingCRI) sandboxPodLog(sandbox *sandboxRecord) (*podLog, error) {
+	if !s.podAggregateLogs || sandbox.config.GetLogDirectory() == "" {
+		return nil, nil
+	}
+
+	sandbox.mu.Lock()
+	defer sandbox.mu.Unlock()
+
+	if sandbox.podLog != nil {
+		return sandbox.podLog, nil
+	}
+
+	path := filepath.Join(sandbox.config.GetLogDirectory(), "pod.log")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pod log %s: %v", path, err)
+	}
+	sandbox.podLog = &podLog{file: file}
+
+	return sandbox.podLog, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// podResources are what all containers of a sandbox share
+type podResources struct {
+	pid        int    // PID of the pause process, whose namespaces the containers join
+	shm        string // /dev/shm of the pause container, so shared memory is shared like the IPC namespace it belongs to
+	hosts      string // hosts file of the pod
+	resolvConf string // resolv.conf of the pod, empty if its containers keep the one of their image
+}
+
+// podResources initializes the resources shared by all containers of a sandbox exactly once
+// The sandbox lock is only held for the initialization, so the caller can run the container without it
+func (s *DemystifyingCRI) podResources(sandbox *sandboxRecord) (podResources, error) {
+	sandbox.mu.Lock()
+	defer sandbox.mu.Unlock()
+
+	if sandbox.pid == 0 {
+		state, err := s.oci.State(sandbox.Id)
+		if err != nil {
+			return podResources{}, fmt.Errorf("failed to get sandbox state: %w", err)
+		}
+		sandbox.pid = state.Pid
+	}
+
+	// The files live in the bundle of the sandbox, which is removed together with the pod,
+	// and /dev/shm is the tmpfs runc mounted for the pause container
+	if sandbox.files == nil {
+		bundlePath := filepath.Join(s.runtimeRoot, sandbox.Id)
+		if err := os.MkdirAll(bundlePath, 0755); err != nil {
+			return podResources{}, fmt.Errorf("failed to create sandbox directory: %v", err)
+		}
+		hosts := filepath.Join(bundlePath, "hosts")
+		if err := os.WriteFile(hosts, buildHosts(sandbox.config.GetHostname()), 0644); err != nil {
+			return podResources{}, fmt.Errorf("failed to write hosts file: %v", err)
+		}
+		resolvConf, err := writeResolvConf(bundlePath, sandbox.config.GetDnsConfig())
+		if err != nil {
+			return podResources{}, err
+		}
+		sandbox.files = &podResources{
+			shm:        fmt.Sprintf("/proc/%d/root/dev/shm", sandbox.pid),
+			hosts:      hosts,
+			resolvConf: resolvConf,
+		}
+	}
+
+	pod := *sandbox.files
+	pod.pid = sandbox.pid
+	return pod, nil
+}
+
+// applyPodResources mounts the /dev/shm, hosts file and resolv.conf of the pod into a container
+func applyPodResources(g *generate.Generator, pod podResources) {
+	g.RemoveMount("/dev/shm")
+	g.AddMount(rspec.Mount{
+		Destination: "/dev/shm",
+		Type:        "bind",
+		Source:      pod.shm,
+		Options:     []string{"rbind", "nosuid", "nodev", "noexec"},
+	})
+	g.AddMount(rspec.Mount{
+		Destination: "/etc/hosts",
+		Type:        "bind",
+		Source:      pod.hosts,
+		Options:     []string{"rbind", "ro", "nosuid", "nodev", "noexec"},
+	})
+	if pod.resolvConf != "" {
+		g.AddMount(rspec.Mount{
+			Destination: "/etc/resolv.conf",
+			Type:        "bind",
+			Source:      pod.resolvConf,
+			Options:     []string{"rbind", "ro", "nosuid", "nodev", "noexec"},
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+func TestPodResourcesAreSharedByContainers(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	if err := oci.Run("sandbox", filepath.Join(s.runtimeRoot, "sandbox"), runtimeIO{}); err != nil {
+		t.Fatal(err)
+	}
+	sandbox := s.sandboxes["sandbox"]
+	sandbox.pid = 0
+	sandbox.config.Hostname = "web-0"
+	sandbox.config.DnsConfig = &runtime.DNSConfig{Servers: []string{"10.96.0.10"}}
+
+	// Containers created concurrently must find the pod resources set up once
+	const containers = 5
+	ids := make([]string, containers)
+	errs := make([]error, containers)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+				PodSandboxId: "sandbox",
+				Config: &runtime.ContainerConfig{
+					Metadata: &runtime.ContainerMetadata{Name: fmt.Sprintf("app-%d", i)},
+					Image:    &runtime.ImageSpec{Image: testImage},
+				},
+			})
+			ids[i], errs[i] = resp.GetContainerId(), err
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("CreateContainer: %v", err)
+		}
+	}
+
+	state, err := oci.State("sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundlePath := filepath.Join(s.runtimeRoot, "sandbox")
+	want := map[string]string{
+		"/dev/shm":         fmt.Sprintf("/proc/%d/root/dev/shm", state.Pid),
+		"/etc/hosts":       filepath.Join(bundlePath, "hosts"),
+		"/etc/resolv.conf": filepath.Join(bundlePath, "resolv.conf"),
+	}
+	for _, id := range ids {
+		g, err := generate.NewFromFile(filepath.Join(s.runtimeRoot, id, "config.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources := make(map[string][]string)
+		for _, mount := range g.Config.Mounts {
+			sources[mount.Destination] = append(sources[mount.Destination], mount.Source)
+		}
+		for destination, source := range want {
+			if len(sources[destination]) != 1 || sources[destination][0] != source {
+				t.Errorf("container %s mounts %q at %s, want only %s", id, sources[destination], destination, source)
+			}
+		}
+		var ipc string
+		for _, namespace := range g.Config.Linux.Namespaces {
+			if namespace.Type == rspec.IPCNamespace {
+				ipc = namespace.Path
+			}
+		}
+		if want := fmt.Sprintf("/proc/%d/ns/ipc", state.Pid); ipc != want {
+			t.Errorf("container %s joins IPC namespace %q, want %q", id, ipc, want)
+		}
+	}
+	if hosts, _ := os.ReadFile(want["/etc/hosts"]); string(hosts) != string(buildHosts("web-0")) {
+		t.Errorf("hosts file = %q, want %q", hosts, buildHosts("web-0"))
+	}
+
+	// Later containers neither ask runc again nor rewrite the files
+	if err := os.WriteFile(want["/etc/hosts"], []byte("edited"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := oci.Delete("sandbox", true); err != nil {
+		t.Fatal(err)
+	}
+	createTestContainer(t, s, "late")
+	if hosts, _ := os.ReadFile(want["/etc/hosts"]); string(hosts) != "edited" {
+		t.Errorf("hosts file was written again for a later container: %q", hosts)
+	}
+}
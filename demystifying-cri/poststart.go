@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// postStartLogTail is how much of the log is included when a container exited right after starting
+const postStartLogTail = 4096
+
+// checkStarted waits for postStartCheck and fails if the container's process already exited by then
+// The error includes the end of the container's log, which usually explains why a broken image died
+func (s *DemystifyingCRI) checkStarted(ctx context.Context, containerID string) error {
+	timer := time.NewTimer(s.postStartCheck)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+
+	if s.processAlive(containerID) {
+		return nil
+	}
+	s.markExited(containerID)
+
+	s.mu.RLock()
+	var logPath string
+	if container, exists := s.containers[containerID]; exists {
+		logPath = container.logPath
+	}
+	s.mu.RUnlock()
+
+	output := "no log available"
+	if logPath != "" {
+		if tail, err := readTail(logPath, postStartLogTail); err == nil {
+			output = tail
+		}
+	}
+	return fmt.Errorf("container %s exited within %s of starting, last output:\n%s", containerID, s.postStartCheck, output)
+}
+
+// readTail returns at most the last size bytes of a file
+func readTail(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := max(info.Size()-size, 0)
+	data, err := io.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
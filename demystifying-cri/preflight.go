@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// cniBinDir is where CNI plugin binaries are looked up
+const cniBinDir = "/opt/cni/bin"
+
+// preflightCheck is a single environment check of the preflight report
+// Failing mandatory checks prevent the runtime from working, optional ones only limit features
+type preflightCheck struct {
+	name      string
+	mandatory bool
+	run       func() (string, error)
+}
+
+// preflight checks the environment of the node and prints a pass/fail report
+// It returns false if any mandatory check failed
+func (s *DemystifyingCRI) preflight() bool {
+	s.detectCgroups()
+
+	checks := []preflightCheck{
+		{"runc", true, func() (string, error) { return binaryVersion("runc", "--version") }},
+	}
+	if s.pullBackend == "skopeo" {
+		checks = append(checks, preflightCheck{"skopeo", true, func() (string, error) { return binaryVersion("skopeo", "--version") }})
+	}
+	if s.unpackBackend == "umoci" {
+		checks = append(checks, preflightCheck{"umoci", true, func() (string, error) { return binaryVersion("umoci", "--version") }})
+	}
+	checks = append(checks,
+		preflightCheck{"cgroups", true, func() (string, error) {
+			if s.cgroupV2 {
+				return "v2, driver " + s.cgroupDriver, nil
+			}
+			if _, err := os.Stat("/sys/fs/cgroup/cpu"); err != nil {
+				return "", fmt.Errorf("neither cgroup v2 nor the v1 cpu hierarchy is mounted at /sys/fs/cgroup")
+			}
+			return "v1, driver " + s.cgroupDriver, nil
+		}},
+		preflightCheck{"roots", true, func() (string, error) {
+			return s.runtimeRoot + ", " + s.imageRoot, validateRoots(s.runtimeRoot, s.imageRoot)
+		}},
+		preflightCheck{"seccomp", false, checkSeccomp},
+		preflightCheck{"overlayfs", false, checkOverlayfs},
+	)
+	if s.networkPlugin != "none" {
+		checks = append(checks,
+			preflightCheck{"CNI configuration", s.networkPlugin == "cni", func() (string, error) {
+				if !probeCNI() {
+					return "", fmt.Errorf("no configuration found in %s", cniConfDir)
+				}
+				return cniConfDir, nil
+			}},
+			preflightCheck{"CNI plugins", s.networkPlugin == "cni", func() (string, error) {
+				entries, err := os.ReadDir(cniBinDir)
+				if err != nil || len(entries) == 0 {
+					return "", fmt.Errorf("no plugins found in %s", cniBinDir)
+				}
+				return fmt.Sprintf("%d plugins in %s", len(entries), cniBinDir), nil
+			}},
+		)
+	}
+
+	passed := true
+	for _, check := range checks {
+		detail, err := check.run()
+		result := "PASS"
+		if err != nil {
+			detail = err.Error()
+			result = "WARN"
+			if check.mandatory {
+				result = "FAIL"
+				passed = false
+			}
+		}
+		fmt.Printf("[%s] %s: %s\n", result, check.name, detail)
+	}
+
+	return passed
+}
+
+// binaryVersion returns the first line of the version output of an installed binary
+func binaryVersion(binary string, args ...string) (string, error) {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return "", fmt.Errorf("not found in PATH")
+	}
+	output, err := exec.Command(path, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get version: %v: %s", err, output)
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return version, nil
+}
+
+// checkWritable verifies that a directory can be created and written to
+func checkWritable(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	file, err := os.CreateTemp(dir, ".preflight-")
+	if err != nil {
+		return "", fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return dir, nil
+}
+
+// checkSeccomp verifies that the kernel supports seccomp filters
+func checkSeccomp() (string, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /proc/self/status: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "Seccomp:") {
+			return "supported", nil
+		}
+	}
+	return "", fmt.Errorf("kernel was built without seccomp")
+}
+
+// checkOverlayfs verifies that the kernel supports overlay filesystems
+func checkOverlayfs() (string, error) {
+	data, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /proc/filesystems: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(strings.TrimPrefix(line, "nodev")) == "overlay" {
+			return "supported", nil
+		}
+	}
+	if _, err := os.Stat(filepath.Join("/sys/module", "overlay")); err == nil {
+		return "supported", nil
+	}
+	return "", fmt.Errorf("overlay is not listed in /proc/filesystems, the module may need to be loaded")
+}
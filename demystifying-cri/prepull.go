@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseImageList splits a comma separated list of images, ignoring empty entries
+func parseImageList(value string) []string {
+	var images []string
+	for _, image := range strings.Split(value, ",") {
+		if image = strings.TrimSpace(image); image != "" {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// prepull pulls the warm set of images in parallel after the sandbox image, so the first pods using them don't wait for a pull
+// Failures are only logged, as the images will still be pulled on demand
+func (s *DemystifyingCRI) prepull(images []string) {
+	if len(images) == 0 {
+		return
+	}
+	log.Printf("prepulling %d images", len(images))
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for _, image := range images {
+		wg.Add(1)
+		go func(image string) {
+			defer wg.Done()
+			imageStart := time.Now()
+			if err := s.downloadImage(context.Background(), image, nil); err != nil {
+				log.Printf("failed to prepull image %s: %v", image, err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			log.Printf("prepulled image %s in %s", image, time.Since(imageStart).Round(time.Millisecond))
+		}(image)
+	}
+	wg.Wait()
+
+	log.Printf("prepulled %d of %d images in %s", len(images)-failed, len(images), time.Since(start).Round(time.Millisecond))
+}
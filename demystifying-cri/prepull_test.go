@@ -0,0 +1,40 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseImageList(t *testing.T) {
+	want := []string{"docker.io/library/nginx:1.25", "registry.k8s.io/pause:3.9"}
+	if got := parseImageList(" docker.io/library/nginx:1.25,,registry.k8s.io/pause:3.9 ,"); !slices.Equal(got, want) {
+		t.Errorf("parseImageList = %q, want %q", got, want)
+	}
+	if got := parseImageList(""); got != nil {
+		t.Errorf("parseImageList of an empty list = %q, want none", got)
+	}
+}
+
+func TestPrepullPopulatesImageStore(t *testing.T) {
+	registry := newTestRegistry(t, "team/app")
+	for _, tag := range []string{"v1", "v2"} {
+		manifest := registry.addImage(mediaTypeOCIConfig, mediaTypeOCILayerGzip)
+		manifest["mediaType"] = mediaTypeOCIManifest
+		registry.addManifest(t, tag, mediaTypeOCIManifest, manifest)
+	}
+
+	s, _ := newTestRuntime(t)
+	s.puller = &nativePuller{imageRoot: s.imageRoot, client: registry.Client()}
+	s.pullLimiter = newPullLimiter(registryLimits{}, nil)
+	images := []string{registry.host + "/team/app:v1", registry.host + "/team/app:v2", registry.host + "/team/app:missing"}
+	s.prepull(images)
+
+	for _, image := range images[:2] {
+		if _, exists := s.images.get(image); !exists {
+			t.Errorf("prepulled image %s is not in the image store", image)
+		}
+	}
+	if _, exists := s.images.get(images[2]); exists {
+		t.Errorf("image %s which failed to prepull is in the image store", images[2])
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// pruneResult reports what pruneBlobs reclaimed
+type pruneResult struct {
+	RemovedBlobs int    `json:"removedBlobs"`
+	FreedBytes   uint64 `json:"freedBytes"`
+}
+
+// pruneBlobs removes all blobs from imageRoot which no stored image's manifest references
+// Old tags of a repository leave their blobs behind in the shared layout, and so do images the store forgot on restart
+// Pulls and unpacks are held off meanwhile, so a blob can't be removed while it is written or read
+func (s *DemystifyingCRI) pruneBlobs() (pruneResult, error) {
+	s.pruneMu.Lock()
+	defer s.pruneMu.Unlock()
+
+	// Refuse to prune if any stored image can't be resolved, as its blobs would be considered unreferenced
+	referenced := make(map[string]struct{})
+	for _, image := range s.images.refs() {
+		layoutPath, tag := splitLayoutReference(filepath.Join(s.imageRoot, getImage(image)))
+		descriptor, err := readLayoutDescriptor(layoutPath, tag)
+		if err != nil {
+			return pruneResult{}, fmt.Errorf("failed to resolve image %s: %v", image, err)
+		}
+		manifest, err := readLayoutManifest(layoutPath, tag)
+		if err != nil {
+			return pruneResult{}, fmt.Errorf("failed to read manifest of image %s: %v", image, err)
+		}
+
+		referenced[layoutBlobPath(layoutPath, descriptor.Digest)] = struct{}{}
+		referenced[layoutBlobPath(layoutPath, manifest.Config.Digest)] = struct{}{}
+		for _, layer := range manifest.Layers {
+			referenced[layoutBlobPath(layoutPath, layer.Digest)] = struct{}{}
+		}
+	}
+
+	var result pruneResult
+	err := filepath.WalkDir(s.imageRoot, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Blobs are stored as <layout>/blobs/<algorithm>/<hex>
+		if !entry.Type().IsRegular() || filepath.Base(filepath.Dir(filepath.Dir(path))) != "blobs" {
+			return nil
+		}
+		if _, exists := referenced[path]; exists {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		result.RemovedBlobs++
+		result.FreedBytes += uint64(info.Size())
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("failed to prune blobs: %v", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPruneBlobsRemovesOrphans(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	layoutPath, tag := splitLayoutReference(filepath.Join(s.imageRoot, getImage(testImage)))
+
+	// An old tag's layer next to the stored image's blobs, and a layout of an image the store forgot
+	orphans := map[string]int{
+		layoutBlobPath(layoutPath, "sha256:"+strings.Repeat("a", 64)):                              100,
+		layoutBlobPath(filepath.Join(s.imageRoot, "forgotten"), "sha256:"+strings.Repeat("b", 64)): 50,
+	}
+	for path, size := range orphans {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := s.pruneBlobs()
+	if err != nil {
+		t.Fatalf("pruneBlobs: %v", err)
+	}
+	if result.RemovedBlobs != 2 || result.FreedBytes != 150 {
+		t.Errorf("pruneBlobs = %+v, want 2 blobs and 150 bytes removed", result)
+	}
+	for path := range orphans {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("orphaned blob %s was kept", path)
+		}
+	}
+	if err := checkLayoutComplete(layoutPath, tag); err != nil {
+		t.Errorf("stored image lost blobs: %v", err)
+	}
+
+	// Nothing is left to prune
+	if result, err := s.pruneBlobs(); err != nil || result.RemovedBlobs != 0 {
+		t.Errorf("second pruneBlobs = %+v, %v, want nothing removed", result, err)
+	}
+}
+
+func TestPruneBlobsRefusesUnresolvableImages(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	layoutPath, _ := splitLayoutReference(filepath.Join(s.imageRoot, getImage(testImage)))
+	if err := os.Remove(filepath.Join(layoutPath, "index.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.pruneBlobs(); err == nil {
+		t.Fatal("pruneBlobs with an unresolvable image succeeded")
+	}
+	blobs, err := filepath.Glob(filepath.Join(layoutPath, "blobs", "sha256", "*"))
+	if err != nil || len(blobs) != 3 {
+		t.Errorf("blobs after refused prune = %v, %v, want all 3 kept", blobs, err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+)
+
+// skopeoPuller implements imagePuller by running skopeo copy into an OCI layout
+type skopeoPuller struct {
+	imageRoot string
+	authfile  string // Registry credentials of the node, used for pulls without per-request auth
+}
+
+func (p *skopeoPuller) Pull(ctx context.Context, image string, auth *runtime.AuthConfig) error {
+	dst := filepath.Join(p.imageRoot, getImage(image))
+	layoutPath, tag := splitLayoutReference(dst)
+	authArgs, cleanup, err := p.authArgs(image, auth)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	args := append([]string{"copy"}, authArgs...)
+	return stagedLayoutPull(layoutPath, tag, func(layout string) error {
+		cmd := exec.CommandContext(ctx, "skopeo", append(args, "docker://"+image, "oci:"+layout+strings.TrimPrefix(dst, layoutPath))...)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to download image %s: %w", image, binaryError("skopeo", err))
+		}
+		return nil
+	})
+}
+
+// authArgs returns the skopeo arguments for the credentials of a pull of image and a function removing what they refer to
+// Credentials of the request take precedence over the node's auth file. Passwords and identity tokens are written to
+// an auth file of their own only the runtime can read, as arguments are visible to every user of the node in ps
+func (p *skopeoPuller) authArgs(image string, auth *runtime.AuthConfig) ([]string, func(), error) {
+	var entry registryAuthEntry
+	switch {
+	case auth.GetUsername() != "":
+		entry.Auth = base64.StdEncoding.EncodeToString([]byte(auth.GetUsername() + ":" + auth.GetPassword()))
+	case auth.GetAuth() != "":
+		entry.Auth = auth.GetAuth()
+	case auth.GetRegistryToken() != "":
+		// A registry token is a short-lived bearer token, which auth files have no field for
+		return []string{"--src-registry-token", auth.GetRegistryToken()}, func() {}, nil
+	case auth.GetIdentityToken() != "":
+		entry.IdentityToken = auth.GetIdentityToken()
+	case p.authfile != "":
+		return []string{"--authfile", p.authfile}, func() {}, nil
+	default:
+		return nil, func() {}, nil
+	}
+
+	host, _, _ := parseImageReference(image)
+	data, err := json.Marshal(registryAuthfile{Auths: map[string]registryAuthEntry{normalizeAuthScope(host): entry}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode credentials: %v", err)
+	}
+	// CreateTemp creates the file with mode 0600
+	file, err := os.CreateTemp("", "demystifying-cri-auth-*.json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create auth file: %v", err)
+	}
+	cleanup := func() { os.Remove(file.Name()) }
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to write auth file: %v", err)
+	}
+	return []string{"--authfile", file.Name()}, cleanup, nil
+}
+
+// defaultAuthfile returns the first existing auth file of the standard locations used by containers tools and Docker
+func defaultAuthfile() string {
+	candidates := []string{os.Getenv("REGISTRY_AUTH_FILE")}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "containers", "auth.json"))
+	}
+	candidates = append(candidates, "/run/containers/0/auth.json")
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".docker", "config.json"))
+	}
+
+	for _, candidate := range candidates {
+		if candidate == "" {
+			continue
+		}
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
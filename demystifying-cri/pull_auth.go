@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+)
+
+// registryCredentials is what the native puller authenticates against a registry with
+type registryCredentials struct {
+	username      string
+	password      string
+	identityToken string // OAuth2 refresh token exchanged for a bearer token, e.g. of docker login to Azure
+	registryToken string // Bearer token sent as is
+}
+
+// registryAuthfile is the subset of a containers auth.json or Docker config.json which holds credentials
+type registryAuthfile struct {
+	Auths map[string]registryAuthEntry `json:"auths"`
+}
+
+// registryAuthEntry holds the credentials of a registry, namespace or repository in an auth file
+type registryAuthEntry struct {
+	Auth          string `json:"auth"` // Base64 encoded username:password
+	IdentityToken string `json:"identitytoken"`
+}
+
+// pullCredentials returns the credentials of a pull from host/repository like skopeoPuller.authArgs picks them
+// Credentials of the request take precedence over the node's auth file, whose most specific entry for the repository is used
+func pullCredentials(host, repository string, auth *runtime.AuthConfig, authfile string) (registryCredentials, error) {
+	if auth.GetUsername() != "" {
+		return registryCredentials{username: auth.GetUsername(), password: auth.GetPassword()}, nil
+	}
+	if auth.GetAuth() != "" {
+		return decodeBasicAuth(auth.GetAuth())
+	}
+	if auth.GetRegistryToken() != "" {
+		return registryCredentials{registryToken: auth.GetRegistryToken()}, nil
+	}
+	if auth.GetIdentityToken() != "" {
+		return registryCredentials{identityToken: auth.GetIdentityToken()}, nil
+	}
+	if authfile == "" {
+		return registryCredentials{}, nil
+	}
+
+	data, err := os.ReadFile(authfile)
+	if os.IsNotExist(err) {
+		return registryCredentials{}, nil
+	} else if err != nil {
+		return registryCredentials{}, fmt.Errorf("failed to read auth file: %v", err)
+	}
+	var file registryAuthfile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return registryCredentials{}, fmt.Errorf("failed to parse auth file %s: %v", authfile, err)
+	}
+
+	// Entries may be scoped to a namespace or repository, and Docker writes Docker Hub's as https://index.docker.io/v1/
+	entries := make(map[string]registryAuthEntry)
+	for key, entry := range file.Auths {
+		scope := normalizeAuthScope(key)
+		if _, exists := entries[scope]; !exists || key == scope {
+			entries[scope] = entry
+		}
+	}
+	for scope := normalizeAuthScope(host) + "/" + repository; ; {
+		if entry, exists := entries[scope]; exists {
+			credentials := registryCredentials{identityToken: entry.IdentityToken}
+			if entry.Auth != "" {
+				basic, err := decodeBasicAuth(entry.Auth)
+				if err != nil {
+					return registryCredentials{}, fmt.Errorf("invalid entry %s in auth file %s: %v", scope, authfile, err)
+				}
+				credentials.username, credentials.password = basic.username, basic.password
+			}
+			return credentials, nil
+		}
+		index := strings.LastIndex(scope, "/")
+		if index < 0 {
+			return registryCredentials{}, nil
+		}
+		scope = scope[:index]
+	}
+}
+
+// normalizeAuthScope strips the scheme and API version of an auth file key and names Docker Hub docker.io
+func normalizeAuthScope(key string) string {
+	scope := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	scope = strings.TrimSuffix(strings.TrimSuffix(scope, "/"), "/v1")
+	host, path, _ := strings.Cut(scope, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		host = "docker.io"
+	}
+	if path == "" {
+		return host
+	}
+	return host + "/" + path
+}
+
+// decodeBasicAuth splits the base64 encoded username:password of an AuthConfig or auth file entry
+func decodeBasicAuth(auth string) (registryCredentials, error) {
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return registryCredentials{}, fmt.Errorf("failed to decode credentials: %v", err)
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return registryCredentials{}, fmt.Errorf("credentials are not of the form username:password")
+	}
+	return registryCredentials{username: username, password: password}, nil
+}
+
+// authorize answers the WWW-Authenticate challenge of a registry, after which requests carry the Authorization header it returns
+// Basic challenges are answered with the username and password, Bearer challenges with a token of the challenge's realm
+func (c *registryClient) authorize(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch {
+	case strings.EqualFold(scheme, "Basic"):
+		if c.credentials.username == "" {
+			return "", fmt.Errorf("registry %s requires credentials", c.host)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.credentials.username+":"+c.credentials.password)), nil
+	case strings.EqualFold(scheme, "Bearer"):
+		token, err := fetchToken(ctx, c.httpClient(), params, c.credentials)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+}
+
+// parseChallenge splits a WWW-Authenticate challenge into its scheme and its parameters with lower case names
+// Values are tokens or quoted strings, which may contain commas and backslash escapes, e.g. scope="repository:app:pull,push"
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for rest = strings.TrimLeft(rest, " ,"); rest != ""; rest = strings.TrimLeft(rest, " ,") {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimLeft(value, " ")
+		if !strings.HasPrefix(value, `"`) {
+			token, remainder, _ := strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(token)
+			rest = remainder
+			continue
+		}
+		var quoted strings.Builder
+		i := 1
+		for ; i < len(value) && value[i] != '"'; i++ {
+			if value[i] == '\\' && i+1 < len(value) {
+				i++
+			}
+			quoted.WriteByte(value[i])
+		}
+		params[key] = quoted.String()
+		rest = value[min(i+1, len(value)):]
+	}
+	return scheme, params
+}
+
+// fetchToken requests a bearer token from the realm of the parameters of a WWW-Authenticate challenge
+// Without credentials the token is anonymous, a username and password are sent with basic auth,
+// and an identity token is exchanged with the OAuth2 refresh token grant
+func fetchToken(ctx context.Context, client *http.Client, params map[string]string, credentials registryCredentials) (string, error) {
+	var req *http.Request
+	var err error
+	if credentials.identityToken != "" {
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {credentials.identityToken},
+			"client_id":     {"demystifying-cri"},
+		}
+		for _, key := range []string{"service", "scope"} {
+			if params[key] != "" {
+				form.Set(key, params[key])
+			}
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, params["realm"], strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, params["realm"], nil)
+		if err != nil {
+			return "", err
+		}
+		query := req.URL.Query()
+		for _, key := range []string{"service", "scope"} {
+			if params[key] != "" {
+				query.Set(key, params[key])
+			}
+		}
+		req.URL.RawQuery = query.Encode()
+		if credentials.username != "" {
+			req.SetBasicAuth(credentials.username, credentials.password)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request returned %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to parse token: %v", err)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
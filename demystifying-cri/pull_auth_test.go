@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestPullCredentials(t *testing.T) {
+	basic := func(username, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	}
+	authfile := filepath.Join(t.TempDir(), "auth.json")
+	content := fmt.Sprintf(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": %q},
+		"quay.io": {"auth": %q},
+		"quay.io/team": {"auth": %q},
+		"registry.example.com": {"identitytoken": "refresh"}
+	}}`, basic("hub", "hubpass"), basic("quay", "quaypass"), basic("team", "teampass"))
+	if err := os.WriteFile(authfile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		host, repository string
+		auth             *runtime.AuthConfig
+		authfile         string
+		want             registryCredentials
+	}{
+		{"request username", "quay.io", "app", &runtime.AuthConfig{Username: "user", Password: "pass"}, authfile, registryCredentials{username: "user", password: "pass"}},
+		{"request auth", "quay.io", "app", &runtime.AuthConfig{Auth: basic("user", "pass")}, authfile, registryCredentials{username: "user", password: "pass"}},
+		{"request registry token", "quay.io", "app", &runtime.AuthConfig{RegistryToken: "token"}, authfile, registryCredentials{registryToken: "token"}},
+		{"request identity token", "quay.io", "app", &runtime.AuthConfig{IdentityToken: "refresh"}, authfile, registryCredentials{identityToken: "refresh"}},
+		{"docker hub", "registry-1.docker.io", "library/alpine", nil, authfile, registryCredentials{username: "hub", password: "hubpass"}},
+		{"registry", "quay.io", "other/app", nil, authfile, registryCredentials{username: "quay", password: "quaypass"}},
+		{"namespace", "quay.io", "team/app", nil, authfile, registryCredentials{username: "team", password: "teampass"}},
+		{"identity token", "registry.example.com", "app", nil, authfile, registryCredentials{identityToken: "refresh"}},
+		{"unknown registry", "ghcr.io", "app", nil, authfile, registryCredentials{}},
+		{"no auth file", "quay.io", "app", nil, "", registryCredentials{}},
+		{"missing auth file", "quay.io", "app", nil, filepath.Join(t.TempDir(), "missing.json"), registryCredentials{}},
+	}
+	for _, test := range tests {
+		got, err := pullCredentials(test.host, test.repository, test.auth, test.authfile)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFetchToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("service") != "registry" || r.FormValue("scope") != "repository:app:pull,push" {
+			http.Error(w, "wrong service or scope", http.StatusBadRequest)
+			return
+		}
+		if username, password, ok := r.BasicAuth(); ok {
+			if username != "user" || password != "pass" {
+				http.Error(w, "wrong credentials", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token": "basic"}`)
+			return
+		}
+		if r.Method == http.MethodPost {
+			if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" {
+				http.Error(w, "wrong grant", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"access_token": "oauth"}`)
+			return
+		}
+		fmt.Fprint(w, `{"token": "anonymous"}`)
+	}))
+	defer server.Close()
+	_, params := parseChallenge(fmt.Sprintf(`Bearer realm=%q,service="registry",scope="repository:app:pull,push"`, server.URL))
+
+	tests := []struct {
+		credentials registryCredentials
+		want        string
+	}{
+		{registryCredentials{}, "anonymous"},
+		{registryCredentials{username: "user", password: "pass"}, "basic"},
+		{registryCredentials{identityToken: "refresh"}, "oauth"},
+	}
+	for _, test := range tests {
+		token, err := fetchToken(context.Background(), http.DefaultClient, params, test.credentials)
+		if err != nil {
+			t.Errorf("fetchToken with %+v: %v", test.credentials, err)
+			continue
+		}
+		if token != test.want {
+			t.Errorf("fetchToken with %+v = %q, want %q", test.credentials, token, test.want)
+		}
+	}
+
+	if _, err := fetchToken(context.Background(), http.DefaultClient, params, registryCredentials{username: "user", password: "wrong"}); err == nil {
+		t.Error("fetchToken with wrong credentials succeeded")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		challenge, scheme string
+		params            map[string]string
+	}{
+		{`Basic realm="registry"`, "Basic", map[string]string{"realm": "registry"}},
+		{
+			`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:app:pull,push"`,
+			"Bearer",
+			map[string]string{"realm": "https://auth.example.com/token", "service": "registry.example.com", "scope": "repository:app:pull,push"},
+		},
+		{
+			`Bearer realm="https://auth.example.com/token", scope="repository:a:pull,push repository:b:pull" , Service=registry`,
+			"Bearer",
+			map[string]string{"realm": "https://auth.example.com/token", "scope": "repository:a:pull,push repository:b:pull", "service": "registry"},
+		},
+		{`Bearer realm="say \"hi\", \\o/"`, "Bearer", map[string]string{"realm": `say "hi", \o/`}},
+		{`Bearer realm="unterminated`, "Bearer", map[string]string{"realm": "unterminated"}},
+		{`Bearer`, "Bearer", map[string]string{}},
+	}
+	for _, test := range tests {
+		scheme, params := parseChallenge(test.challenge)
+		if scheme != test.scheme || !maps.Equal(params, test.params) {
+			t.Errorf("parseChallenge(%q) = %q, %v, want %q, %v", test.challenge, scheme, params, test.scheme, test.params)
+		}
+	}
+}
+
+func TestAuthorizeBasic(t *testing.T) {
+	client := &registryClient{host: "registry.example.com", credentials: registryCredentials{username: "user", password: "pass"}}
+	authorization, err := client.authorize(context.Background(), `Basic realm="registry"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")); authorization != want {
+		t.Errorf("authorize = %q, want %q", authorization, want)
+	}
+
+	client.credentials = registryCredentials{}
+	if _, err := client.authorize(context.Background(), `Basic realm="registry"`); err == nil {
+		t.Error("authorize without credentials succeeded")
+	}
+}
+
+func TestNativePullAuthenticates(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("scope") != "repository:team/app:pull,push" {
+			http.Error(w, "wrong scope", http.StatusBadRequest)
+			return
+		}
+		if username, password, _ := r.BasicAuth(); username != "user" || password != "pass" {
+			http.Error(w, "wrong credentials", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"token": "granted"}`)
+	}))
+	defer tokenServer.Close()
+
+	challenges := map[string]struct {
+		challenge, authorization string
+	}{
+		"basic": {`Basic realm="registry"`, "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))},
+		"bearer": {
+			fmt.Sprintf(`Bearer realm=%q,service="registry",scope="repository:team/app:pull,push"`, tokenServer.URL),
+			"Bearer granted",
+		},
+	}
+	for name, challenge := range challenges {
+		registry := newTestRegistry(t, "team/app")
+		manifest := registry.addImage(mediaTypeOCIConfig, mediaTypeOCILayerGzip)
+		manifest["mediaType"] = mediaTypeOCIManifest
+		registry.addManifest(t, "v1", mediaTypeOCIManifest, manifest)
+		registry.authorize = func(w http.ResponseWriter, r *http.Request) bool {
+			if r.Header.Get("Authorization") == challenge.authorization {
+				return true
+			}
+			w.Header().Set("WWW-Authenticate", challenge.challenge)
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+
+		puller := &nativePuller{imageRoot: t.TempDir(), client: registry.Client()}
+		image := registry.host + "/team/app:v1"
+		if err := puller.Pull(context.Background(), image, nil); err == nil {
+			t.Errorf("%s: Pull without credentials succeeded", name)
+		}
+		if err := puller.Pull(context.Background(), image, &runtime.AuthConfig{Username: "user", Password: "wrong"}); err == nil {
+			t.Errorf("%s: Pull with wrong credentials succeeded", name)
+		}
+		if err := puller.Pull(context.Background(), image, &runtime.AuthConfig{Username: "user", Password: "pass"}); err != nil {
+			t.Errorf("%s: Pull with credentials: %v", name, err)
+		}
+	}
+}
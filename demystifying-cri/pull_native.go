@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	goruntime "runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+)
+
+// Media types the native backend understands, Docker ones are converted to their OCI counterparts
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIConfig      = "application/vnd.oci.image.config.v1+json"
+	mediaTypeOCILayerGzip   = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerConfig   = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// maxManifestSize bounds how much of a manifest response is read, registries reject manifests above 4MiB as well
+const maxManifestSize = 4 << 20
+
+// digestPattern matches the only digests the native backend accepts, anything else could point outside of the layout
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// ociDescriptor references a blob in a registry or an OCI layout
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+// ociPlatform is the platform of an image in a multi-platform index
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ociManifest is either an image manifest or an index, depending on the media type
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        *ociDescriptor  `json:"config,omitempty"`
+	Layers        []ociDescriptor `json:"layers,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests,omitempty"`
+}
+
+// registryClient talks to a Docker registry v2 API, authenticating once the registry asks for it
+type registryClient struct {
+	host          string
+	repository    string
+	credentials   registryCredentials
+	authorization string       // Authorization header of all requests, set by authorize after the first challenge
+	client        *http.Client // Client of all requests including token requests, http.DefaultClient if nil
+}
+
+// nativePuller implements imagePuller by talking to the registry itself
+type nativePuller struct {
+	imageRoot string
+	authfile  string       // Registry credentials of the node, used for pulls without per-request auth
+	client    *http.Client // Client registries are talked to with, http.DefaultClient if nil
+}
+
+// Pull downloads an image into an OCI layout at imageRoot without any external binaries
+// The layout is written the same way skopeo writes it, so umoci can unpack it afterwards
+func (p *nativePuller) Pull(ctx context.Context, image string, auth *runtime.AuthConfig) error {
+	host, repository, reference := parseImageReference(image)
+	layoutPath, tag := splitLayoutReference(filepath.Join(p.imageRoot, getImage(image)))
+	credentials, err := pullCredentials(host, repository, auth, p.authfile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve credentials for %s: %v", image, err)
+	}
+	client := &registryClient{host: host, repository: repository, credentials: credentials, client: p.client}
+	if credentials.registryToken != "" {
+		client.authorization = "Bearer " + credentials.registryToken
+	}
+
+	// The digest of what the reference resolved to is the image's digest in the registry, even for multi-platform images
+	manifest, raw, registryDigest, err := client.manifest(ctx, reference)
+	if err != nil {
+		return fmt.Errorf("failed to fetch manifest of %s: %v", image, err)
+	}
+
+	// Pick the manifest for this platform from multi-platform images
+	digest := registryDigest
+	if manifest.MediaType == mediaTypeOCIIndex || manifest.MediaType == mediaTypeDockerList {
+		platformDigest, err := platformManifest(manifest, goruntime.GOOS, goruntime.GOARCH, platformVariant())
+		if err != nil {
+			return fmt.Errorf("failed to resolve platform of %s: %v", image, err)
+		}
+		if manifest, raw, digest, err = client.manifest(ctx, platformDigest); err != nil {
+			return fmt.Errorf("failed to fetch manifest of %s: %v", image, err)
+		}
+	}
+	if manifest.Config == nil {
+		return fmt.Errorf("unsupported manifest type %q for image %s", manifest.MediaType, image)
+	}
+
+	blobsPath := filepath.Join(layoutPath, "blobs", "sha256")
+	if err := os.MkdirAll(blobsPath, 0755); err != nil {
+		return fmt.Errorf("failed to create OCI layout at %s: %v", layoutPath, err)
+	}
+
+	// Download config and layers, skipping blobs already present from other tags
+	for _, blob := range append([]ociDescriptor{*manifest.Config}, manifest.Layers...) {
+		if err := client.downloadBlob(ctx, blob, blobsPath); err != nil {
+			return fmt.Errorf("failed to download blob %s of %s: %v", blob.Digest, image, err)
+		}
+	}
+
+	// OCI manifests are stored as the registry sent them, Docker ones are converted as umoci only reads OCI media types
+	if manifest.MediaType == mediaTypeDockerManifest {
+		if raw, err = convertToOCI(raw); err != nil {
+			return fmt.Errorf("failed to convert manifest of %s: %v", image, err)
+		}
+		sum := sha256.Sum256(raw)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	if err := os.WriteFile(layoutBlobPath(layoutPath, digest), raw, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest of %s: %v", image, err)
+	}
+
+	descriptor := ociDescriptor{
+		MediaType:   mediaTypeOCIManifest,
+		Digest:      digest,
+		Size:        int64(len(raw)),
+		Annotations: map[string]string{"org.opencontainers.image.ref.name": tag},
+	}
+	if registryDigest != digest {
+		descriptor.Annotations[annotationRegistryDigest] = registryDigest
+	}
+	return writeLayoutIndex(layoutPath, tag, descriptor)
+}
+
+// manifest fetches a manifest or index by tag or digest and returns it parsed, as sent and with its digest
+// A manifest fetched by digest must hash to it, so a registry or proxy can't swap in a different one
+func (c *registryClient) manifest(ctx context.Context, reference string) (*ociManifest, []byte, string, error) {
+	requestedDigest := strings.Contains(reference, ":")
+	if requestedDigest && !digestPattern.MatchString(reference) {
+		return nil, nil, "", fmt.Errorf("unsupported digest %q", reference)
+	}
+
+	resp, err := c.get(ctx, "manifests/"+reference, strings.Join([]string{
+		mediaTypeOCIIndex, mediaTypeOCIManifest, mediaTypeDockerList, mediaTypeDockerManifest,
+	}, ", "))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if len(raw) > maxManifestSize {
+		return nil, nil, "", fmt.Errorf("manifest exceeds %d bytes", maxManifestSize)
+	}
+	sum := sha256.Sum256(raw)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if requestedDigest && digest != reference {
+		return nil, nil, "", fmt.Errorf("manifest has digest %s instead of the requested one", digest)
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, nil, "", fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	return &manifest, raw, digest, nil
+}
+
+// downloadBlob stores a blob in the layout and verifies its digest
+func (c *registryClient) downloadBlob(ctx context.Context, blob ociDescriptor, blobsPath string) error {
+	// The digest comes from the registry, so it is checked before it becomes part of a path
+	if !digestPattern.MatchString(blob.Digest) {
+		return fmt.Errorf("unsupported digest %q", blob.Digest)
+	}
+	hexDigest := strings.TrimPrefix(blob.Digest, "sha256:")
+	dst := filepath.Join(blobsPath, hexDigest)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+
+	resp, err := c.get(ctx, "blobs/"+blob.Digest, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Write to a temporary file first, so an interrupted download never looks complete
+	tmp, err := os.CreateTemp(blobsPath, ".download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != hexDigest {
+		return fmt.Errorf("digest mismatch, got sha256:%s", actual)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+// get performs an authenticated GET against the repository, answering the registry's challenge if required
+func (c *registryClient) get(ctx context.Context, path, accept string) (*http.Response, error) {
+	url := fmt.Sprintf("https://%s/v2/%s/%s", c.host, c.repository, path)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if c.authorization, err = c.authorize(ctx, challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+		}
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("GET %s is unauthorized", url)
+}
+
+// httpClient returns the client requests to the registry and its token service are made with
+func (c *registryClient) httpClient() *http.Client {
+	if c.client != nil {
+		return c.client
+	}
+	return http.DefaultClient
+}
+
+// platformManifest returns the digest of the manifest of an index which best matches the platform, like containerd picks it
+// ARM variants run images of older variants, so a v7 node takes a v6 image if there is no v7 one, but never a v8 one
+func platformManifest(index *ociManifest, os, architecture, variant string) (string, error) {
+	best, bestVariant := "", -1
+	for _, manifest := range index.Manifests {
+		platform := manifest.Platform
+		if platform == nil || platform.OS != os || platform.Architecture != architecture {
+			continue
+		}
+		// Variants only tell ARM images apart, where a missing one means the default of the architecture
+		imageVariant := 0
+		if architecture == "arm" || architecture == "arm64" {
+			imageVariant = armVariant(architecture, platform.Variant)
+			if imageVariant > armVariant(architecture, variant) {
+				continue
+			}
+		}
+		if imageVariant > bestVariant {
+			best, bestVariant = manifest.Digest, imageVariant
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no manifest for %s", path.Join(os, architecture, variant))
+	}
+	return best, nil
+}
+
+// armVariant returns the version of an ARM variant like v7, with v7 for 32 bit and v8 for 64 bit if it is empty
+func armVariant(architecture, variant string) int {
+	if version, err := strconv.Atoi(strings.TrimPrefix(variant, "v")); err == nil {
+		return version
+	}
+	if architecture == "arm64" {
+		return 8
+	}
+	return 7
+}
+
+// platformVariant returns the variant of the platform the runtime was built for, which is only set for ARM
+// 32 bit ARM builds record GOARM, e.g. 6 for a Raspberry Pi Zero, while Go defaults to 7 when it isn't set
+func platformVariant() string {
+	switch goruntime.GOARCH {
+	case "arm64":
+		return "v8"
+	case "arm":
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "GOARM" {
+					version, _, _ := strings.Cut(setting.Value, ",")
+					return "v" + version
+				}
+			}
+		}
+		return "v7"
+	}
+	return ""
+}
+
+// convertToOCI rewrites the Docker media types of a manifest to the OCI ones umoci expects
+// Only the media types are replaced, every other field like annotations or subject is kept as the registry sent it
+func convertToOCI(raw []byte) ([]byte, error) {
+	var manifest map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, err
+	}
+	mediaType, err := json.Marshal(mediaTypeOCIManifest)
+	if err != nil {
+		return nil, err
+	}
+	manifest["mediaType"] = mediaType
+
+	convert := func(descriptor json.RawMessage, from, to string) (json.RawMessage, error) {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(descriptor, &fields); err != nil {
+			return nil, err
+		}
+		var current string
+		if err := json.Unmarshal(fields["mediaType"], &current); err == nil && current == from {
+			if fields["mediaType"], err = json.Marshal(to); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(fields)
+	}
+	if manifest["config"], err = convert(manifest["config"], mediaTypeDockerConfig, mediaTypeOCIConfig); err != nil {
+		return nil, fmt.Errorf("invalid config descriptor: %v", err)
+	}
+	var layers []json.RawMessage
+	if err := json.Unmarshal(manifest["layers"], &layers); err != nil {
+		return nil, fmt.Errorf("invalid layers: %v", err)
+	}
+	for i := range layers {
+		if layers[i], err = convert(layers[i], mediaTypeDockerLayer, mediaTypeOCILayerGzip); err != nil {
+			return nil, fmt.Errorf("invalid layer descriptor: %v", err)
+		}
+	}
+	if manifest["layers"], err = json.Marshal(layers); err != nil {
+		return nil, err
+	}
+	return json.Marshal(manifest)
+}
+
+// writeLayoutIndex adds or replaces the tag in the layout's index.json
+// The index is replaced by a rename, so a reader never sees it half written
+func writeLayoutIndex(layoutPath, tag string, manifest ociDescriptor) error {
+	indexPath := filepath.Join(layoutPath, "index.json")
+	index := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIIndex}
+	if data, err := os.ReadFile(indexPath); err == nil {
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", indexPath, err)
+		}
+	}
+
+	var manifests []ociDescriptor
+	for _, existing := range index.Manifests {
+		if existing.Annotations["org.opencontainers.image.ref.name"] != tag {
+			manifests = append(manifests, existing)
+		}
+	}
+	index.Manifests = append(manifests, manifest)
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(layoutPath, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		return err
+	}
+	tmpPath := indexPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, indexPath)
+}
+
+// parseImageReference splits an image into registry host, repository and tag or digest
+// Images without a registry are resolved against Docker Hub like Kubelet does
+func parseImageReference(image string) (host, repository, reference string) {
+	host = "docker.io"
+	name := image
+	if first, rest, found := strings.Cut(image, "/"); found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		host, name = first, rest
+	}
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+
+	// A tag next to a digest is only informative, the digest is what is pulled
+	name, digest, digested := strings.Cut(name, "@")
+	reference = "latest"
+	if index := strings.LastIndex(name, ":"); index > strings.LastIndex(name, "/") {
+		name, reference = name[:index], name[index+1:]
+	}
+	if digested {
+		reference = digest
+	}
+	return host, name, reference
+}
+
+// splitLayoutReference splits a path like skopeo's oci:path:tag destination into layout path and tag
+func splitLayoutReference(dst string) (string, string) {
+	if index := strings.LastIndex(dst, ":"); index > strings.LastIndex(dst, "/") {
+		return dst[:index], dst[index+1:]
+	}
+	return dst, "latest"
+}
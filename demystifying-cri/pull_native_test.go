@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image, host, repository, reference string
+	}{
+		{"alpine", "registry-1.docker.io", "library/alpine", "latest"},
+		{"alpine:3.20", "registry-1.docker.io", "library/alpine", "3.20"},
+		{"docker.io/library/alpine:3.20", "registry-1.docker.io", "library/alpine", "3.20"},
+		{"f1ko/demo", "registry-1.docker.io", "f1ko/demo", "latest"},
+		{"registry.k8s.io/pause:3.9", "registry.k8s.io", "pause", "3.9"},
+		{"localhost/app", "localhost", "app", "latest"},
+		{"localhost:5000/team/app:v1", "localhost:5000", "team/app", "v1"},
+		{"quay.io/app@sha256:abc", "quay.io", "app", "sha256:abc"},
+		{"quay.io/app:v1@sha256:abc", "quay.io", "app", "sha256:abc"},
+		{"localhost:5000/app:v1@sha256:abc", "localhost:5000", "app", "sha256:abc"},
+	}
+	for _, test := range tests {
+		host, repository, reference := parseImageReference(test.image)
+		if host != test.host || repository != test.repository || reference != test.reference {
+			t.Errorf("parseImageReference(%q) = %q, %q, %q, want %q, %q, %q", test.image, host, repository, reference, test.host, test.repository, test.reference)
+		}
+	}
+}
+
+// pulledDescriptor returns the descriptor index.json of the layout of image holds for its tag
+func pulledDescriptor(t *testing.T, imageRoot, image string) (string, *ociDescriptor) {
+	t.Helper()
+	layoutPath, tag := splitLayoutReference(filepath.Join(imageRoot, getImage(image)))
+	descriptor, err := readLayoutDescriptor(layoutPath, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layoutPath, descriptor
+}
+
+func TestNativePullStoresManifestAsSent(t *testing.T) {
+	registry := newTestRegistry(t, "team/app")
+	manifest := registry.addImage(mediaTypeOCIConfig, mediaTypeOCILayerGzip)
+	manifest["mediaType"] = mediaTypeOCIManifest
+	manifest["artifactType"] = "application/vnd.example"
+	manifest["annotations"] = map[string]string{"org.opencontainers.image.source": "https://example.com"}
+	manifest["subject"] = registry.addBlob(mediaTypeOCIManifest, []byte("{}"))
+	digest := registry.addManifest(t, "v1", mediaTypeOCIManifest, manifest)
+
+	imageRoot := t.TempDir()
+	image := registry.host + "/team/app:v1"
+	if err := registry.pull(imageRoot, image); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+
+	layoutPath, descriptor := pulledDescriptor(t, imageRoot, image)
+	if descriptor.Digest != digest || registryDigest(descriptor) != digest {
+		t.Errorf("stored manifest has digest %s and registry digest %s, want %s for both", descriptor.Digest, registryDigest(descriptor), digest)
+	}
+	stored, err := os.ReadFile(layoutBlobPath(layoutPath, descriptor.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent := registry.manifests["v1"].body; !bytes.Equal(stored, sent) {
+		t.Errorf("stored manifest = %s, want it as sent %s", stored, sent)
+	}
+
+	record, err := (&DemystifyingCRI{imageRoot: imageRoot}).readImageRecord(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.manifestDigest != digest {
+		t.Errorf("image record has manifest digest %s, want %s", record.manifestDigest, digest)
+	}
+}
+
+func TestNativePullConvertsDockerManifest(t *testing.T) {
+	registry := newTestRegistry(t, "team/app")
+	manifest := registry.addImage(mediaTypeDockerConfig, mediaTypeDockerLayer)
+	manifest["mediaType"] = mediaTypeDockerManifest
+	manifest["annotations"] = map[string]string{"kept": "true"}
+	digest := registry.addManifest(t, "v1", mediaTypeDockerManifest, manifest)
+
+	imageRoot := t.TempDir()
+	image := registry.host + "/team/app:v1"
+	if err := registry.pull(imageRoot, image); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+
+	layoutPath, descriptor := pulledDescriptor(t, imageRoot, image)
+	if registryDigest(descriptor) != digest {
+		t.Errorf("registry digest = %s, want %s", registryDigest(descriptor), digest)
+	}
+	stored, err := os.ReadFile(layoutBlobPath(layoutPath, descriptor.Digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if testDigest(stored) != descriptor.Digest {
+		t.Errorf("converted manifest is stored under %s but has digest %s", descriptor.Digest, testDigest(stored))
+	}
+	var converted struct {
+		ociManifest
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(stored, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if converted.MediaType != mediaTypeOCIManifest || converted.Config.MediaType != mediaTypeOCIConfig || converted.Layers[0].MediaType != mediaTypeOCILayerGzip {
+		t.Errorf("converted manifest has media types %s, %s and %s, want OCI ones", converted.MediaType, converted.Config.MediaType, converted.Layers[0].MediaType)
+	}
+	if converted.Annotations["kept"] != "true" {
+		t.Errorf("converted manifest lost its annotations: %s", stored)
+	}
+}
+
+func TestNativePullByDigest(t *testing.T) {
+	registry := newTestRegistry(t, "team/app")
+	manifest := registry.addImage(mediaTypeOCIConfig, mediaTypeOCILayerGzip)
+	manifest["mediaType"] = mediaTypeOCIManifest
+	digest := registry.addManifest(t, "", mediaTypeOCIManifest, manifest)
+
+	imageRoot := t.TempDir()
+	image := registry.host + "/team/app@" + digest
+	if err := registry.pull(imageRoot, image); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	if _, descriptor := pulledDescriptor(t, imageRoot, image); descriptor.Digest != digest {
+		t.Errorf("manifest pulled by digest is stored as %s, want %s", descriptor.Digest, digest)
+	}
+
+	// A registry answering with a different manifest than the one asked for is caught
+	manifest["annotations"] = map[string]string{"swapped": "true"}
+	swapped := registry.addManifest(t, "", mediaTypeOCIManifest, manifest)
+	registry.manifests[digest] = registry.manifests[swapped]
+	if err := registry.pull(t.TempDir(), image); err == nil || !strings.Contains(err.Error(), "instead of the requested one") {
+		t.Errorf("Pull of a swapped manifest = %v, want a digest mismatch", err)
+	}
+
+	if err := registry.pull(t.TempDir(), registry.host+"/team/app@sha512:"+strings.Repeat("a", 128)); err == nil {
+		t.Error("Pull by a sha512 digest succeeded")
+	}
+}
+
+func TestNativePullRejectsInvalidBlobDigests(t *testing.T) {
+	for _, digest := range []string{"sha256:../../../escaped", "sha512:" + strings.Repeat("a", 128), "sha256:" + strings.Repeat("A", 64), "sha256:abc"} {
+		registry := newTestRegistry(t, "team/app")
+		manifest := registry.addImage(mediaTypeOCIConfig, mediaTypeOCILayerGzip)
+		manifest["mediaType"] = mediaTypeOCIManifest
+		manifest["layers"] = []ociDescriptor{{MediaType: mediaTypeOCILayerGzip, Digest: digest, Size: 5}}
+		registry.addManifest(t, "v1", mediaTypeOCIManifest, manifest)
+
+		imageRoot := t.TempDir()
+		if err := registry.pull(imageRoot, registry.host+"/team/app:v1"); err == nil || !strings.Contains(err.Error(), "unsupported digest") {
+			t.Errorf("Pull with layer digest %q = %v, want an unsupported digest", digest, err)
+		}
+		if _, err := os.Stat(filepath.Join(imageRoot, "escaped")); !os.IsNotExist(err) {
+			t.Errorf("layer digest %q wrote outside of the layout", digest)
+		}
+	}
+}
+
+func TestNativePullRecordsIndexDigest(t *testing.T) {
+	registry := newTestRegistry(t, "team/app")
+	manifest := registry.addImage(mediaTypeOCIConfig, mediaTypeOCILayerGzip)
+	manifest["mediaType"] = mediaTypeOCIManifest
+	platformDigest := registry.addManifest(t, "", mediaTypeOCIManifest, manifest)
+	index := ociManifest{SchemaVersion: 2, MediaType: mediaTypeOCIIndex, Manifests: []ociDescriptor{{
+		MediaType: mediaTypeOCIManifest,
+		Digest:    platformDigest,
+		Platform:  &ociPlatform{OS: goruntime.GOOS, Architecture: goruntime.GOARCH},
+	}}}
+	indexDigest := registry.addManifest(t, "v1", mediaTypeOCIIndex, index)
+
+	imageRoot := t.TempDir()
+	image := registry.host + "/team/app:v1"
+	if err := registry.pull(imageRoot, image); err != nil {
+		t.Fatalf("Pull: %v", err)
+	}
+	_, descriptor := pulledDescriptor(t, imageRoot, image)
+	if descriptor.Digest != platformDigest || registryDigest(descriptor) != indexDigest {
+		t.Errorf("stored manifest %s with registry digest %s, want %s with %s", descriptor.Digest, registryDigest(descriptor), platformDigest, indexDigest)
+	}
+}
+
+func TestPlatformManifest(t *testing.T) {
+	index := &ociManifest{Manifests: []ociDescriptor{
+		{Digest: "amd64", Platform: &ociPlatform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "arm-v5", Platform: &ociPlatform{OS: "linux", Architecture: "arm", Variant: "v5"}},
+		{Digest: "arm-v7", Platform: &ociPlatform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{Digest: "arm-v6", Platform: &ociPlatform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{Digest: "arm64", Platform: &ociPlatform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{Digest: "windows", Platform: &ociPlatform{OS: "windows", Architecture: "amd64"}},
+	}}
+	tests := []struct {
+		os, architecture, variant, digest string
+	}{
+		{"linux", "amd64", "", "amd64"},
+		{"windows", "amd64", "", "windows"},
+		{"linux", "arm", "v7", "arm-v7"},
+		{"linux", "arm", "v6", "arm-v6"},
+		{"linux", "arm", "v5", "arm-v5"},
+		{"linux", "arm", "v8", "arm-v7"},
+		{"linux", "arm", "", "arm-v7"},
+		{"linux", "arm64", "v8", "arm64"},
+		{"linux", "arm64", "", "arm64"},
+		{"linux", "arm", "v4", ""},
+		{"linux", "s390x", "", ""},
+	}
+	for _, test := range tests {
+		digest, err := platformManifest(index, test.os, test.architecture, test.variant)
+		if digest != test.digest || (err != nil) != (test.digest == "") {
+			t.Errorf("platformManifest(%s/%s/%s) = %q, %v, want %q", test.os, test.architecture, test.variant, digest, err, test.digest)
+		}
+	}
+
+	// Images without a variant are the default one of the architecture, so they only run on v7 and later
+	index = &ociManifest{Manifests: []ociDescriptor{{Digest: "arm", Platform: &ociPlatform{OS: "linux", Architecture: "arm"}}}}
+	for variant, want := range map[string]string{"v7": "arm", "v6": ""} {
+		if digest, _ := platformManifest(index, "linux", "arm", variant); digest != want {
+			t.Errorf("platformManifest(linux/arm/%s) of an image without variant = %q, want %q", variant, digest, want)
+		}
+	}
+}
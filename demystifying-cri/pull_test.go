@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeSkopeo puts a skopeo into PATH which fails every pull, recording its arguments as well as
+// the mode and content of the auth file it was passed into dir
+func fakeSkopeo(t *testing.T) string {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo "$@" > ` + dir + `/args
+while [ $# -gt 0 ]; do
+	if [ "$1" = --authfile ]; then
+		stat -c %a "$2" > ` + dir + `/mode
+		cat "$2" > ` + dir + `/authfile
+	fi
+	shift
+done
+exit 1
+`
+	if err := os.WriteFile(filepath.Join(dir, "skopeo"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	return dir
+}
+
+func TestSkopeoPullPassesCredentialsInAuthfile(t *testing.T) {
+	nodeAuthfile := filepath.Join(t.TempDir(), "auth.json")
+	basic := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	tests := []struct {
+		auth  *runtime.AuthConfig
+		entry registryAuthEntry // Entry of the auth file written for the pull, empty if the node's is passed
+	}{
+		{&runtime.AuthConfig{Username: "user", Password: "secret"}, registryAuthEntry{Auth: basic}},
+		{&runtime.AuthConfig{Auth: basic}, registryAuthEntry{Auth: basic}},
+		{&runtime.AuthConfig{IdentityToken: "secret"}, registryAuthEntry{IdentityToken: "secret"}},
+		{nil, registryAuthEntry{}},
+	}
+	for _, test := range tests {
+		dir := fakeSkopeo(t)
+		puller := &skopeoPuller{imageRoot: t.TempDir(), authfile: nodeAuthfile}
+		if err := puller.Pull(context.Background(), "registry.example.com/app:v1", test.auth); err == nil {
+			t.Fatal("Pull with a failing skopeo succeeded")
+		}
+
+		args, err := os.ReadFile(filepath.Join(dir, "args"))
+		if err != nil {
+			t.Fatalf("skopeo wasn't run: %v", err)
+		}
+		if strings.Contains(string(args), "secret") || strings.Contains(string(args), basic) {
+			t.Errorf("skopeo arguments %q contain the credentials of %v", args, test.auth)
+		}
+		fields := strings.Fields(string(args))
+		var authfile string
+		for i, field := range fields[:len(fields)-1] {
+			if field == "--authfile" {
+				authfile = fields[i+1]
+			}
+		}
+
+		if test.entry == (registryAuthEntry{}) {
+			if authfile != nodeAuthfile {
+				t.Errorf("skopeo for %v got auth file %q, want the node's %q", test.auth, authfile, nodeAuthfile)
+			}
+			continue
+		}
+		if authfile == "" || authfile == nodeAuthfile {
+			t.Errorf("skopeo for %v got auth file %q, want one of the pull", test.auth, authfile)
+			continue
+		}
+		if _, err := os.Stat(authfile); !os.IsNotExist(err) {
+			t.Errorf("auth file %s of the pull was left behind", authfile)
+		}
+		if mode, _ := os.ReadFile(filepath.Join(dir, "mode")); strings.TrimSpace(string(mode)) != "600" {
+			t.Errorf("auth file of the pull had mode %q, want 600", mode)
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, "authfile"))
+		var file registryAuthfile
+		if err := json.Unmarshal(data, &file); err != nil {
+			t.Fatalf("auth file of the pull %q: %v", data, err)
+		}
+		if entry := file.Auths["registry.example.com"]; entry != test.entry || len(file.Auths) != 1 {
+			t.Errorf("auth file for %v = %s, want only the entry %+v for registry.example.com", test.auth, data, test.entry)
+		}
+	}
+}
+
+func TestPullCancelledByLastWaiter(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho $$ > " + dir + "/pid\nexec sleep 60\n"
+	if err := os.WriteFile(filepath.Join(dir, "skopeo"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	store := newImageStore()
+	puller := &skopeoPuller{imageRoot: t.TempDir()}
+	fetch := func(ctx context.Context) (*imageRecord, error) {
+		return nil, puller.Pull(ctx, testImage, nil)
+	}
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	errs := make(chan error, 2)
+	for _, ctx := range []context.Context{first, second} {
+		go func(ctx context.Context) { errs <- store.pull(ctx, testImage, fetch) }(ctx)
+	}
+
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("skopeo wasn't started")
+		}
+		data, _ := os.ReadFile(filepath.Join(dir, "pid"))
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	cancelFirst()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("pull of the cancelled waiter = %v, want context.Canceled", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if status := processStatus(pid); status != "running" {
+		t.Fatalf("skopeo is %s after one of two waiters cancelled, want running", status)
+	}
+
+	cancelSecond()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("pull of the last waiter = %v, want context.Canceled", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); processStatus(pid) == "running"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("skopeo wasn't killed after the last waiter cancelled")
+		}
+	}
+}
+
+// hangingPuller is an imagePuller whose pulls hang until they are cancelled, like one of an unreachable registry
+type hangingPuller struct{}
+
+func (hangingPuller) Pull(ctx context.Context, image string, auth *runtime.AuthConfig) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPullTimeouts(t *testing.T) {
+	const sandboxImage = "registry.k8s.io/pause:3.9"
+	tests := []struct {
+		image          string
+		pullTimeout    time.Duration
+		sandboxTimeout time.Duration
+	}{
+		{sandboxImage, time.Hour, 50 * time.Millisecond},
+		{"docker.io/library/app:1", 50 * time.Millisecond, time.Hour},
+	}
+	for _, test := range tests {
+		s, _ := newTestRuntime(t)
+		s.puller = hangingPuller{}
+		s.pullLimiter = newPullLimiter(registryLimits{}, nil)
+		s.sandboxImage = sandboxImage
+		s.pullTimeout, s.sandboxPullTimeout = test.pullTimeout, test.sandboxTimeout
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := s.PullImage(ctx, &runtime.PullImageRequest{Image: &runtime.ImageSpec{Image: test.image}})
+		cancel()
+		if status.Code(err) != codes.DeadlineExceeded || !strings.Contains(err.Error(), "50ms") {
+			t.Errorf("PullImage(%s) with a hanging registry = %v, want DeadlineExceeded after 50ms", test.image, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// registryLimits bounds how hard a registry is hit, 0 leaves the respective limit off
+type registryLimits struct {
+	MaxConcurrentPulls int `json:"maxConcurrentPulls,omitempty"` // Pulls running at the same time, further pulls queue
+	PullsPerMinute     int `json:"pullsPerMinute,omitempty"`     // Rate at which pulls may start, bursts of this size are allowed
+}
+
+// pullLimiter queues image pulls per registry host, so anonymous rate limits like Docker Hub's aren't exceeded
+type pullLimiter struct {
+	defaults registryLimits            // Limits of hosts without their own entry
+	hosts    map[string]registryLimits // Limits per registry host as written in image references, e.g. docker.io
+
+	mu       sync.Mutex
+	limiters map[string]*hostLimiter
+}
+
+// hostLimiter enforces the limits of a single registry host
+type hostLimiter struct {
+	slots chan struct{} // Held by running pulls, nil without a concurrency limit
+
+	mu     sync.Mutex
+	rate   float64   // Tokens added per second, 0 without a rate limit
+	burst  float64   // Maximum number of tokens
+	tokens float64   // Tokens available at last, negative while pulls wait for a token
+	last   time.Time // When tokens was last updated
+}
+
+// newPullLimiter returns a limiter applying the defaults to all hosts not listed in hosts
+func newPullLimiter(defaults registryLimits, hosts map[string]registryLimits) *pullLimiter {
+	return &pullLimiter{
+		defaults: defaults,
+		hosts:    hosts,
+		limiters: make(map[string]*hostLimiter),
+	}
+}
+
+// setHosts replaces the limits per registry host, e.g. after the config file changed
+// Hosts whose limits changed get a new limiter on their next pull, pulls holding a slot of the old one release it there
+func (l *pullLimiter) setHosts(hosts map[string]registryLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for host := range l.limiters {
+		old, oldExists := l.hosts[host]
+		updated, updatedExists := hosts[host]
+		if old != updated || oldExists != updatedExists {
+			delete(l.limiters, host)
+		}
+	}
+	l.hosts = hosts
+}
+
+// hostLimits returns the limits per registry host
+func (l *pullLimiter) hostLimits() map[string]registryLimits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.hosts
+}
+
+// limiter returns the limiter of a registry host, creating it on first use
+func (l *pullLimiter) limiter(host string) *hostLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limiter, exists := l.limiters[host]; exists {
+		return limiter
+	}
+
+	limits, exists := l.hosts[host]
+	if !exists {
+		limits = l.defaults
+	}
+	limiter := &hostLimiter{
+		rate:   float64(limits.PullsPerMinute) / 60,
+		burst:  float64(limits.PullsPerMinute),
+		tokens: float64(limits.PullsPerMinute),
+		last:   time.Now(),
+	}
+	if limits.MaxConcurrentPulls > 0 {
+		limiter.slots = make(chan struct{}, limits.MaxConcurrentPulls)
+	}
+	l.limiters[host] = limiter
+	return limiter
+}
+
+// acquire waits until a pull of image may start and returns a function to call once it finished
+// Waiting ends early with the error of ctx, without holding on to a slot or token
+func (l *pullLimiter) acquire(ctx context.Context, image string) (func(), error) {
+	limiter := l.limiter(registryHost(image))
+
+	if err := limiter.waitToken(ctx); err != nil {
+		return nil, err
+	}
+
+	if limiter.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case limiter.slots <- struct{}{}:
+		return func() { <-limiter.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// waitToken takes a token of the bucket, waiting for it to be refilled if necessary
+func (limiter *hostLimiter) waitToken(ctx context.Context) error {
+	if limiter.rate == 0 {
+		return nil
+	}
+
+	// Reserve a token right away, so waiting pulls are served in order
+	limiter.mu.Lock()
+	now := time.Now()
+	limiter.tokens = min(limiter.burst, limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate)
+	limiter.last = now
+	limiter.tokens--
+	wait := time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	limiter.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Hand the reserved token back for the pulls queued behind this one
+		limiter.mu.Lock()
+		limiter.tokens++
+		limiter.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// registryHost returns the registry host of an image as written in references, so Docker Hub is docker.io
+func registryHost(image string) string {
+	host, _, _ := parseImageReference(image)
+	if host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+// countingPuller is an imagePuller recording how many pulls per registry host ran at the same time at most
+type countingPuller struct {
+	mu      sync.Mutex
+	running map[string]int
+	peak    map[string]int
+}
+
+func (p *countingPuller) Pull(ctx context.Context, image string, auth *runtime.AuthConfig) error {
+	host := registryHost(image)
+	p.mu.Lock()
+	p.running[host]++
+	p.peak[host] = max(p.peak[host], p.running[host])
+	p.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	p.mu.Lock()
+	p.running[host]--
+	p.mu.Unlock()
+	return errors.New("registry is out of images")
+}
+
+func TestPullsToTheSameHostQueue(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	puller := &countingPuller{running: make(map[string]int), peak: make(map[string]int)}
+	s.puller = puller
+	s.pullLimiter = newPullLimiter(registryLimits{MaxConcurrentPulls: 2}, map[string]registryLimits{"quay.io": {MaxConcurrentPulls: 1}})
+
+	var images []string
+	for i := 0; i < 6; i++ {
+		images = append(images, fmt.Sprintf("docker.io/library/app%d:1", i), fmt.Sprintf("quay.io/team/app%d:1", i))
+	}
+	var wg sync.WaitGroup
+	for _, image := range images {
+		wg.Add(1)
+		go func(image string) {
+			defer wg.Done()
+			s.PullImage(context.Background(), &runtime.PullImageRequest{Image: &runtime.ImageSpec{Image: image}})
+		}(image)
+	}
+	wg.Wait()
+
+	if peak := puller.peak["docker.io"]; peak != 2 {
+		t.Errorf("at most %d pulls from docker.io ran at the same time, want the default limit of 2", peak)
+	}
+	if peak := puller.peak["quay.io"]; peak != 1 {
+		t.Errorf("at most %d pulls from quay.io ran at the same time, want its own limit of 1", peak)
+	}
+}
+
+func TestQueuedPullIsCancelled(t *testing.T) {
+	limiter := newPullLimiter(registryLimits{MaxConcurrentPulls: 1}, nil)
+	release, err := limiter.acquire(context.Background(), "docker.io/library/app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, "docker.io/library/app:2"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire while the only slot is held = %v, want the error of the context", err)
+	}
+
+	// The cancelled pull must not keep a slot
+	release()
+	next, err := limiter.acquire(context.Background(), "docker.io/library/app:3")
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	next()
+}
+
+func TestPullsPerMinute(t *testing.T) {
+	limiter := newPullLimiter(registryLimits{PullsPerMinute: 2}, nil)
+	for i := 0; i < 2; i++ {
+		release, err := limiter.acquire(context.Background(), "docker.io/library/app:1")
+		if err != nil {
+			t.Fatalf("acquire within the burst: %v", err)
+		}
+		release()
+	}
+
+	// The third pull within a minute has to wait about 30s for a token
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, "docker.io/library/app:1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire beyond the burst = %v, want it to wait for a token", err)
+	}
+}
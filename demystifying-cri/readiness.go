@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cniConfDir is where CNI network configurations are looked up
+const cniConfDir = "/etc/cni/net.d"
+
+// prepare runs everything that must succeed before the runtime can handle requests
+// Missing mandatory dependencies are returned as error, so the caller can fail fast
+func (s *DemystifyingCRI) prepare(ctx context.Context) error {
+	if err := s.checkBinaries(); err != nil {
+		return err
+	}
+
+	s.detectCgroups()
+	fmt.Printf("Detected cgroup v2: %t, cgroup driver: %s\n", s.cgroupV2, s.cgroupDriver)
+	s.detectSwap()
+	s.detectSELinux()
+
+	s.cniConfigured = probeCNI()
+	if !s.cniConfigured {
+		log.Printf("no CNI configuration found in %s", cniConfDir)
+	}
+	if s.networkPlugin == "" {
+		s.networkPlugin = "none"
+		if s.cniConfigured {
+			s.networkPlugin = "cni"
+		}
+	}
+	fmt.Printf("Using network plugin %s\n", s.networkPlugin)
+
+	// Fall back to a full copy of the image per container where the writable layer can't be an overlay
+	if s.sharedRootfs {
+		if err := s.probeOverlay(); err != nil {
+			log.Printf("giving every container a full copy of its image: %v", err)
+			s.sharedRootfs = false
+		}
+	}
+
+	// Remove bundles a crashed predecessor left behind
+	if err := s.sweepOrphanBundles(); err != nil {
+		log.Printf("failed to sweep orphaned bundles: %v", err)
+	}
+
+	// Create directory for images
+	if err := os.MkdirAll(s.imageRoot, 0755); err != nil {
+		return fmt.Errorf("failed to create images directory: %v", err)
+	}
+
+	if err := s.prepareSandboxImage(ctx); err != nil {
+		return err
+	}
+
+	// Restore the remaining images only now, as a restored sandbox image would keep the Always policy from pulling it
+	s.restoreImages()
+	return nil
+}
+
+// sandboxImagePullPolicies are the values of --sandbox-image-pull-policy, named like Kubernetes' image pull policies
+var sandboxImagePullPolicies = []string{"Always", "IfNotPresent", "Never"}
+
+// prepareSandboxImage pulls the sandbox image or uses the copy in imageRoot, depending on the pull policy
+// Never is meant for air-gapped nodes with a pre-loaded image, where a pull attempt could only hang or fail
+func (s *DemystifyingCRI) prepareSandboxImage(ctx context.Context) error {
+	if s.sandboxPolicy != "Always" {
+		err := checkLayoutComplete(splitLayoutReference(filepath.Join(s.imageRoot, getImage(s.sandboxImage))))
+		var record *imageRecord
+		if err == nil {
+			record, err = s.readImageRecord(s.sandboxImage)
+		}
+		if err == nil {
+			// A pre-loaded image has no recorded reference yet
+			if err := s.recordImageRef(s.sandboxImage); err != nil {
+				log.Printf("%v", err)
+			}
+			s.images.add(record)
+			return nil
+		}
+		if s.sandboxPolicy == "Never" {
+			return fmt.Errorf("sandbox image %s is not present in %s and the pull policy is Never: %v", s.sandboxImage, s.imageRoot, err)
+		}
+	}
+
+	if err := s.downloadImage(ctx, s.sandboxImage, nil); err != nil {
+		return fmt.Errorf("failed to download sandbox image: %v", err)
+	}
+	return nil
+}
+
+// checkBinaries verifies that all external tools the configured backends shell out to are installed
+func (s *DemystifyingCRI) checkBinaries() error {
+	binaries := []string{"runc"}
+	if s.pullBackend == "skopeo" {
+		binaries = append(binaries, "skopeo")
+	}
+	if s.unpackBackend == "umoci" {
+		binaries = append(binaries, "umoci")
+	}
+
+	var missing []string
+	for _, binary := range binaries {
+		if _, err := exec.LookPath(binary); err != nil {
+			missing = append(missing, binary)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required binaries: %s, install them or add them to PATH", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// binaryError turns the error of running a binary which is not installed into FailedPrecondition naming it
+// Callers wrap it with %w, so the code reaches Kubelet instead of a cryptic exec error
+func binaryError(binary string, err error) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return status.Errorf(codes.FailedPrecondition, "%s is not installed or not in PATH", binary)
+	}
+	return err
+}
+
+// detectCgroups determines the cgroup version and the cgroup driver of the node
+// systemd is used as driver whenever the node was booted with systemd, like Kubelet recommends
+func (s *DemystifyingCRI) detectCgroups() {
+	_, err := os.Stat("/sys/fs/cgroup/cgroup.controllers")
+	s.cgroupV2 = err == nil
+
+	s.cgroupDriver = "cgroupfs"
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		s.cgroupDriver = "systemd"
+	}
+}
+
+// detectSwap determines whether swap limits can be applied to containers
+// Without active swap there is nothing to limit, and on cgroup v1 the kernel may have been booted without swap accounting
+func (s *DemystifyingCRI) detectSwap() {
+	data, err := os.ReadFile("/proc/swaps")
+	// The first line is the header
+	if err != nil || len(strings.Split(strings.TrimSpace(string(data)), "\n")) < 2 {
+		s.swapAccounting = false
+		return
+	}
+
+	s.swapAccounting = true
+	if !s.cgroupV2 {
+		_, err := os.Stat(filepath.Join(cgroupRoot, "memory", "memory.memsw.limit_in_bytes"))
+		s.swapAccounting = err == nil
+	}
+}
+
+// probeCNI reports whether a CNI network configuration is present
+func probeCNI() bool {
+	for _, pattern := range []string{"*.conf", "*.conflist", "*.json"} {
+		matches, _ := filepath.Glob(filepath.Join(cniConfDir, pattern))
+		if len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRoots fails fast if the roots are unusable or overlap in a way that lets bundles and images collide
+// Bundles, the graveyard and shared rootfs are direct children of runtimeRoot, image layouts are nested below imageRoot
+func validateRoots(runtimeRoot, imageRoot string) error {
+	for _, root := range []string{runtimeRoot, imageRoot} {
+		if !filepath.IsAbs(root) {
+			return fmt.Errorf("%s is not an absolute path", root)
+		}
+	}
+
+	runtimeRoot, imageRoot = filepath.Clean(runtimeRoot), filepath.Clean(imageRoot)
+	if runtimeRoot == imageRoot {
+		return fmt.Errorf("runtime root and image root must differ")
+	}
+	if rel, err := filepath.Rel(imageRoot, runtimeRoot); err == nil && !strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("runtime root %s must not be below image root %s", runtimeRoot, imageRoot)
+	}
+
+	// IDs of sandboxes and containers always contain a dash, so such directories may become bundles
+	if rel, err := filepath.Rel(runtimeRoot, imageRoot); err == nil && !strings.HasPrefix(rel, "..") {
+		top, _, _ := strings.Cut(rel, string(filepath.Separator))
+		if strings.Contains(top, "-") || strings.HasPrefix(top, ".") || top == graveyardDir || top == sharedRootfsDir {
+			return fmt.Errorf("image root %s collides with the bundles in %s, use a directory without dashes", imageRoot, runtimeRoot)
+		}
+	}
+
+	for _, root := range []string{runtimeRoot, imageRoot} {
+		if _, err := checkWritable(root); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readinessInterceptor rejects CRI calls until prepare finished, health checks are always answered
+func (s *DemystifyingCRI) readinessInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !s.ready.Load() && !strings.HasPrefix(info.FullMethod, "/grpc.health.") {
+		return nil, status.Error(codes.Unavailable, "runtime is not ready yet")
+	}
+	return handler(ctx, req)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMissingBinaries(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	tests := []struct {
+		pullBackend, unpackBackend string
+		missing                    string
+	}{
+		{"skopeo", "umoci", "runc, skopeo, umoci"},
+		{"native", "native", "runc"},
+	}
+	for _, test := range tests {
+		s := &DemystifyingCRI{pullBackend: test.pullBackend, unpackBackend: test.unpackBackend}
+		if err := s.checkBinaries(); err == nil || !strings.Contains(err.Error(), "missing required binaries: "+test.missing+",") {
+			t.Errorf("checkBinaries with %s and %s backends = %v, want %s missing", test.pullBackend, test.unpackBackend, err, test.missing)
+		}
+	}
+
+	// Handlers report the missing runc instead of the exec error
+	r := &runcBinary{path: "runc"}
+	if _, err := r.State("app"); status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), "runc is not installed") {
+		t.Errorf("runc state without runc = %v, want FailedPrecondition naming runc", err)
+	}
+	if err := r.Start("app"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("runc start without runc = %v, want FailedPrecondition", err)
+	}
+}
+
+func TestPrepareSandboxImagePolicies(t *testing.T) {
+	const missing = "registry.k8s.io/pause:3.9"
+	tests := []struct {
+		policy  string
+		image   string
+		pulled  bool // Whether the image is pulled
+		failure bool // Whether preparing fails, which happens when a missing image isn't pulled or the pull fails
+	}{
+		{"Always", testImage, true, false},
+		{"Always", missing, true, true},
+		{"IfNotPresent", testImage, false, false},
+		{"IfNotPresent", missing, true, true},
+		{"Never", testImage, false, false},
+		{"Never", missing, false, true},
+	}
+	for _, test := range tests {
+		s, _ := newTestRuntime(t)
+		s.images = newImageStore()
+		puller := &fakePuller{release: make(chan struct{})}
+		close(puller.release)
+		s.puller = puller
+		s.pullLimiter = newPullLimiter(registryLimits{}, nil)
+		s.sandboxImage, s.sandboxPolicy = test.image, test.policy
+
+		err := s.prepareSandboxImage(context.Background())
+		if failed := err != nil; failed != test.failure {
+			t.Errorf("prepareSandboxImage of %s with policy %s = %v, want failure %v", test.image, test.policy, err, test.failure)
+		}
+		if pulled := len(puller.calls()) > 0; pulled != test.pulled {
+			t.Errorf("prepareSandboxImage of %s with policy %s pulled %v, want %v", test.image, test.policy, pulled, test.pulled)
+		}
+		if _, stored := s.images.get(test.image); stored == test.failure {
+			t.Errorf("sandbox image %s with policy %s stored %v, want %v", test.image, test.policy, stored, !test.failure)
+		}
+	}
+}
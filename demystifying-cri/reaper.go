@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+// defaultReapInterval is how often the reaper checks whether running containers have exited, unless --reap-interval is set
+const defaultReapInterval = time.Second
+
+// reap periodically marks containers whose process is gone as exited and sandboxes whose pause process is gone as not ready
+// The containers are started detached by runc, so polling their state is the only way to notice an exit,
+// unless --exit-events is enabled, then the reaper only makes sure every container is watched, see watchExit
+func (s *DemystifyingCRI) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if s.exitEvents.Load() {
+			s.watchExits()
+			continue
+		}
+
+		// Collect running containers and ready sandboxes first, so runc is not called while holding the lock
+		var running, ready []string
+		s.mu.RLock()
+		for id, container := range s.containers {
+			if container.State == runtime.ContainerState_CONTAINER_RUNNING {
+				running = append(running, id)
+			}
+		}
+		for id, sandbox := range s.sandboxes {
+			if sandbox.State == runtime.PodSandboxState_SANDBOX_READY {
+				ready = append(ready, id)
+			}
+		}
+		s.mu.RUnlock()
+
+		for _, id := range running {
+			if !s.processAlive(id) {
+				s.markExited(id)
+			}
+		}
+		for _, id := range ready {
+			if !s.processAlive(id) {
+				s.markSandboxNotReady(id)
+			}
+		}
+	}
+}
+
+// processAlive reports whether the process of a runc container is still there
+// runc state fails if the container is gone entirely, which also means it exited
+func (s *DemystifyingCRI) processAlive(id string) bool {
+	state, err := s.oci.State(id)
+	return err == nil && state.Status != "stopped"
+}
+
+// markExited transitions a running container to exited and records when that happened and how it exited
+// Callers only mark containers whose process is gone, so its exit status is ready to be collected
+func (s *DemystifyingCRI) markExited(containerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	container, exists := s.containers[containerID]
+	if !exists || container.State != runtime.ContainerState_CONTAINER_RUNNING {
+		return
+	}
+
+	// Keep the timestamps monotonic even if the wall clock jumped backwards
+	finishedAt := time.Now().UnixNano()
+	if finishedAt < container.startedAt {
+		finishedAt = container.startedAt
+	}
+
+	exitCode, known := s.collectExitStatus(container.pid)
+	if !known {
+		log.Printf("exit status of container %s is unknown, reporting exit code %d", containerID, exitCode)
+	}
+
+	container.State = runtime.ContainerState_CONTAINER_EXITED
+	container.finishedAt = finishedAt
+	container.exitCode = exitCode
+	container.exitReason = exitReason(exitCode, known)
+	container.paused = false
+	container.pid = 0
+	s.emitContainerEvent(container.PodSandboxId, containerID, runtime.ContainerEventType_CONTAINER_STOPPED_EVENT)
+}
+
+// reapContainer reaps the process of a container which was deleted without being marked as exited, e.g. killed by RemoveContainer
+func (s *DemystifyingCRI) reapContainer(containerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if container, exists := s.containers[containerID]; exists {
+		s.collectExitStatus(container.pid)
+		container.pid = 0
+	}
+}
+
+// reapSandbox reaps the pause process of a sandbox once it exited, the sandbox keeps its namespaces no longer
+func (s *DemystifyingCRI) reapSandbox(sandbox *sandboxRecord) {
+	sandbox.mu.Lock()
+	defer sandbox.mu.Unlock()
+
+	s.collectExitStatus(sandbox.pid)
+	sandbox.pid = 0
+}
+
+// markSandboxNotReady transitions a sandbox whose pause process died to not ready
+// The namespaces of the pod died with the pause process, so the sandbox can't be repaired in place.
+// Instead Kubelet notices the not ready sandbox, stops its containers and calls RunPodSandbox again,
+// which replaces the dead pause container with a new one, see removeDeadSandbox.
+func (s *DemystifyingCRI) markSandboxNotReady(sandboxID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sandbox, exists := s.sandboxes[sandboxID]; exists {
+		sandbox.State = runtime.PodSandboxState_SANDBOX_NOTREADY
+		s.reapSandbox(sandbox)
+	}
+}
+
+// removeDeadSandbox deletes the runc container of a sandbox whose pause process died and forgets about the sandbox
+func (s *DemystifyingCRI) removeDeadSandbox(sandboxID string) error {
+	if err := s.oci.Delete(sandboxID, true); err != nil && !containerGone(err) && s.processAlive(sandboxID) {
+		return fmt.Errorf("failed to delete dead sandbox %s: %w", sandboxID, err)
+	}
+
+	s.mu.Lock()
+	if sandbox, exists := s.sandboxes[sandboxID]; exists {
+		s.reapSandbox(sandbox)
+		delete(s.sandboxIDs, sandboxKey(sandbox.Metadata))
+	}
+	delete(s.sandboxes, sandboxID)
+	s.mu.Unlock()
+
+	return nil
+}
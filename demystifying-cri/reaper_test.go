@@ -0,0 +1,65 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+// waitForState polls until a container reached state and returns how long that took, failing the test after timeout
+func waitForState(t *testing.T, s *DemystifyingCRI, containerID string, state runtime.ContainerState, timeout time.Duration) time.Duration {
+	t.Helper()
+	begin := time.Now()
+	for time.Since(begin) < timeout {
+		if containerState(t, s, containerID).State == state {
+			return time.Since(begin)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("container %s is not %v after %v", containerID, state, timeout)
+	return 0
+}
+
+func TestReapUsesInterval(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	containerID := startTestContainers(t, s, "app")[0]
+
+	// The default interval is 1s, so an exit noticed well before is only noticed with the configured one
+	go s.reap(20 * time.Millisecond)
+	if err := oci.Kill(containerID, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := waitForState(t, s, containerID, runtime.ContainerState_CONTAINER_EXITED, 5*time.Second); elapsed > 500*time.Millisecond {
+		t.Errorf("exit was detected after %v, want within a few intervals of 20ms", elapsed)
+	}
+	if status := containerState(t, s, containerID); status.ExitCode != 137 {
+		t.Errorf("exit code = %d, want 137", status.ExitCode)
+	}
+}
+
+func TestExitEventsDetectExitWithoutPolling(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	s.exitEvents.Store(true)
+	containerID := startTestContainers(t, s, "app")[0]
+
+	// No reaper is running, StartContainer's watch alone notices the exit
+	if err := oci.Kill(containerID, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, s, containerID, runtime.ContainerState_CONTAINER_EXITED, 5*time.Second)
+	if !s.exitEvents.Load() {
+		t.Errorf("exit events were disabled although they reported the exit")
+	}
+}
+
+func TestExitEventsNeedCgroupV2(t *testing.T) {
+	for _, cgroupV2 := range []bool{false, true} {
+		s := &DemystifyingCRI{cgroupV2: cgroupV2}
+		s.enableExitEvents()
+		if s.exitEvents.Load() != cgroupV2 {
+			t.Errorf("exit events with cgroup v2 %v = %v, want %v", cgroupV2, s.exitEvents.Load(), cgroupV2)
+		}
+	}
+}
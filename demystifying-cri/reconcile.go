@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+// reconcile periodically compares the records with runc list and repairs drift, e.g. after containers were deleted behind our back
+// State transitions go through the same functions as the reaper's, so both never disagree on how a record is updated
+func (s *DemystifyingCRI) reconcile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	reported := make(map[string]bool)
+	for range ticker.C {
+		s.reconcileOnce(reported)
+	}
+}
+
+// reconcileOnce runs a single reconciliation, unknown runc containers are only logged once by remembering them in reported
+func (s *DemystifyingCRI) reconcileOnce(reported map[string]bool) {
+	// Collect the records before listing, so a container created in between is never mistaken as vanished
+	var running, ready []string
+	known := make(map[string]bool)
+	s.mu.RLock()
+	for id, container := range s.containers {
+		known[id] = true
+		if container.State == runtime.ContainerState_CONTAINER_RUNNING {
+			running = append(running, id)
+		}
+	}
+	for id, sandbox := range s.sandboxes {
+		known[id] = true
+		if sandbox.State == runtime.PodSandboxState_SANDBOX_READY {
+			ready = append(ready, id)
+		}
+	}
+	s.mu.RUnlock()
+
+	states, err := s.oci.List()
+	if err != nil {
+		log.Printf("failed to list runc containers: %v", err)
+		return
+	}
+
+	alive := make(map[string]bool)
+	for _, state := range states {
+		if state.Status != "stopped" {
+			alive[state.ID] = true
+		}
+
+		// runc containers of other tools live outside of runtimeRoot and are none of our business
+		if known[state.ID] || reported[state.ID] || !strings.HasPrefix(state.Bundle, s.runtimeRoot+string(filepath.Separator)) {
+			continue
+		}
+		log.Printf("runc container %s with bundle %s has no record", state.ID, state.Bundle)
+		reported[state.ID] = true
+	}
+
+	for _, id := range running {
+		if !alive[id] {
+			log.Printf("container %s vanished from runc, marking it as exited", id)
+			s.markExited(id)
+		}
+	}
+	for _, id := range ready {
+		if !alive[id] {
+			log.Printf("sandbox %s vanished from runc, marking it as not ready", id)
+			s.markSandboxNotReady(id)
+		}
+	}
+}
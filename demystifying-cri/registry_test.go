@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testRegistry is a registry v2 API serving a single repository from memory
+type testRegistry struct {
+	*httptest.Server
+	host string
+
+	mu         sync.Mutex
+	manifests  map[string]testManifest // Manifests by tag and digest
+	blobs      map[string][]byte       // Blobs by digest
+	authorize  func(w http.ResponseWriter, r *http.Request) bool
+	requests   []string // Paths of all requests below the repository, like manifests/v1
+	repository string
+}
+
+// testManifest is a manifest as the registry serves it
+type testManifest struct {
+	mediaType string
+	body      []byte
+}
+
+// newTestRegistry starts a TLS registry serving repository, closed at the end of the test
+func newTestRegistry(t *testing.T, repository string) *testRegistry {
+	r := &testRegistry{
+		manifests:  make(map[string]testManifest),
+		blobs:      make(map[string][]byte),
+		repository: repository,
+	}
+	r.Server = httptest.NewTLSServer(http.HandlerFunc(r.serve))
+	r.host = strings.TrimPrefix(r.URL, "https://")
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	path, found := strings.CutPrefix(req.URL.Path, "/v2/"+r.repository+"/")
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+	r.requests = append(r.requests, path)
+	if r.authorize != nil && !r.authorize(w, req) {
+		return
+	}
+
+	if reference, found := strings.CutPrefix(path, "manifests/"); found {
+		manifest, exists := r.manifests[reference]
+		if !exists {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", manifest.mediaType)
+		w.Write(manifest.body)
+		return
+	}
+	if digest, found := strings.CutPrefix(path, "blobs/"); found {
+		blob, exists := r.blobs[digest]
+		if !exists {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write(blob)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+// testDigest returns the sha256 digest of data
+func testDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// addBlob stores a blob and returns its descriptor
+func (r *testRegistry) addBlob(mediaType string, data []byte) ociDescriptor {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	digest := testDigest(data)
+	r.blobs[digest] = data
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+}
+
+// addManifest stores a manifest under its digest and tag, if not empty, and returns its digest
+func (r *testRegistry) addManifest(t *testing.T, tag, mediaType string, manifest any) string {
+	t.Helper()
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	digest := testDigest(body)
+	r.manifests[digest] = testManifest{mediaType: mediaType, body: body}
+	if tag != "" {
+		r.manifests[tag] = testManifest{mediaType: mediaType, body: body}
+	}
+	return digest
+}
+
+// addImage stores an image with a config and one layer and returns the manifest, which isn't stored yet
+func (r *testRegistry) addImage(configMediaType, layerMediaType string) map[string]any {
+	return map[string]any{
+		"schemaVersion": 2,
+		"config":        r.addBlob(configMediaType, []byte(`{"config":{"Cmd":["sh"]}}`)),
+		"layers":        []ociDescriptor{r.addBlob(layerMediaType, []byte("layer"))},
+	}
+}
+
+// pull pulls image from the registry with a nativePuller into imageRoot
+func (r *testRegistry) pull(imageRoot, image string) error {
+	puller := &nativePuller{imageRoot: imageRoot, client: r.Client()}
+	return puller.Pull(context.Background(), image, nil)
+}
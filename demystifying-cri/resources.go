@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// applyResources translates the CRI resource limits onto the OCI spec
+// Unified cgroup settings are only applied on cgroup v2, as runc rejects them on v1
+func (s *DemystifyingCRI) applyResources(g *generate.Generator, resources *runtime.LinuxContainerResources) error {
+	if resources == nil {
+		return nil
+	}
+
+	if resources.CpuPeriod > 0 {
+		g.SetLinuxResourcesCPUPeriod(uint64(resources.CpuPeriod))
+	}
+	if resources.CpuQuota > 0 {
+		g.SetLinuxResourcesCPUQuota(resources.CpuQuota)
+	}
+	if resources.CpuShares > 0 {
+		g.SetLinuxResourcesCPUShares(uint64(resources.CpuShares))
+	}
+	if resources.MemoryLimitInBytes > 0 {
+		g.SetLinuxResourcesMemoryLimit(resources.MemoryLimitInBytes)
+	}
+	if swap, err := s.swapLimit(resources); err != nil {
+		return err
+	} else if swap != 0 {
+		g.SetLinuxResourcesMemorySwap(swap)
+	}
+	if resources.OomScoreAdj != 0 {
+		g.SetProcessOOMScoreAdj(int(resources.OomScoreAdj))
+	}
+
+	// Pin the container to the CPUs and memory nodes chosen by the CPU manager
+	if resources.CpusetCpus != "" {
+		if err := checkCpuset(resources.CpusetCpus); err != nil {
+			return err
+		}
+		g.SetLinuxResourcesCPUCpus(resources.CpusetCpus)
+	}
+	if resources.CpusetMems != "" {
+		if err := checkCpuset(resources.CpusetMems); err != nil {
+			return err
+		}
+		g.SetLinuxResourcesCPUMems(resources.CpusetMems)
+	}
+
+	// runc configures the hugetlb controller for every page size in the spec
+	for _, hugepage := range resources.HugepageLimits {
+		if err := checkHugepageSize(hugepage.PageSize); err != nil {
+			return err
+		}
+		g.AddLinuxResourcesHugepageLimit(hugepage.PageSize, hugepage.Limit)
+	}
+
+	// Raw cgroup v2 files like io.max or memory.high are written by runc as they are
+	if len(resources.Unified) > 0 {
+		if !s.cgroupV2 {
+			log.Printf("ignoring unified cgroup settings as the node does not use cgroup v2")
+			return nil
+		}
+		if g.Config.Linux == nil {
+			g.Config.Linux = &rspec.Linux{}
+		}
+		if g.Config.Linux.Resources == nil {
+			g.Config.Linux.Resources = &rspec.LinuxResources{}
+		}
+		unified := make(map[string]string, len(resources.Unified))
+		for key, value := range resources.Unified {
+			unified[key] = value
+		}
+		g.Config.Linux.Resources.Unified = unified
+	}
+
+	return nil
+}
+
+// swapLimit returns the OCI swap limit of a container, which like the CRI one is the limit of memory and swap combined
+// runc writes it to memory.memsw.limit_in_bytes on cgroup v1 and converts it to memory.swap.max on v2
+// 0 means no limit is set, either because none was requested or because the node can't account swap
+func (s *DemystifyingCRI) swapLimit(resources *runtime.LinuxContainerResources) (int64, error) {
+	swap := resources.MemorySwapLimitInBytes
+	if swap == 0 {
+		return 0, nil
+	}
+	// -1 leaves swap unlimited, anything else can't be below the memory it includes
+	if swap > 0 && resources.MemoryLimitInBytes > 0 && swap < resources.MemoryLimitInBytes {
+		return 0, status.Errorf(codes.InvalidArgument, "memory swap limit %d is below the memory limit %d", swap, resources.MemoryLimitInBytes)
+	}
+	if !s.swapAccounting {
+		log.Printf("ignoring memory swap limit as the node does not account swap")
+		return 0, nil
+	}
+	return swap, nil
+}
+
+// checkCpuset validates a cpuset list like 0-3,5,7-8
+func checkCpuset(cpuset string) error {
+	for _, part := range strings.Split(cpuset, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.ParseUint(first, 10, 32)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid cpuset %q", cpuset)
+		}
+		if !isRange {
+			continue
+		}
+		end, err := strconv.ParseUint(last, 10, 32)
+		if err != nil || end < start {
+			return status.Errorf(codes.InvalidArgument, "invalid cpuset %q", cpuset)
+		}
+	}
+
+	return nil
+}
+
+// checkHugepageSize verifies that the node supports hugepages of the given size, e.g. 2MB or 1GB
+func checkHugepageSize(pageSize string) error {
+	units := map[string]uint64{"KB": 1, "MB": 1024, "GB": 1024 * 1024}
+	unit := strings.TrimLeft(pageSize, "0123456789")
+	size, err := strconv.ParseUint(strings.TrimSuffix(pageSize, unit), 10, 64)
+	if err != nil || units[unit] == 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid hugepage size %q", pageSize)
+	}
+
+	path := fmt.Sprintf("/sys/kernel/mm/hugepages/hugepages-%dkB", size*units[unit])
+	if _, err := os.Stat(path); err != nil {
+		return status.Errorf(codes.InvalidArgument, "hugepage size %s is not available on this node", pageSize)
+	}
+
+	return nil
+}
+
+// updateResources changes the resource limits of a running container with runc update
+func (s *DemystifyingCRI) updateResources(containerID string, resources *runtime.LinuxContainerResources) error {
+	if resources == nil {
+		return nil
+	}
+	if s.rootless {
+		return status.Errorf(codes.FailedPrecondition, "resource limits are not supported in rootless mode")
+	}
+
+	update := &rspec.LinuxResources{CPU: &rspec.LinuxCPU{}}
+	if resources.CpuPeriod > 0 {
+		period := uint64(resources.CpuPeriod)
+		update.CPU.Period = &period
+	}
+	if resources.CpuQuota > 0 {
+		update.CPU.Quota = &resources.CpuQuota
+	}
+	if resources.CpuShares > 0 {
+		shares := uint64(resources.CpuShares)
+		update.CPU.Shares = &shares
+	}
+	if resources.MemoryLimitInBytes > 0 {
+		update.Memory = &rspec.LinuxMemory{Limit: &resources.MemoryLimitInBytes}
+	}
+	if swap, err := s.swapLimit(resources); err != nil {
+		return err
+	} else if swap != 0 {
+		if update.Memory == nil {
+			update.Memory = &rspec.LinuxMemory{}
+		}
+		update.Memory.Swap = &swap
+	}
+	if resources.CpusetCpus != "" {
+		if err := checkCpuset(resources.CpusetCpus); err != nil {
+			return err
+		}
+		update.CPU.Cpus = resources.CpusetCpus
+	}
+	if resources.CpusetMems != "" {
+		if err := checkCpuset(resources.CpusetMems); err != nil {
+			return err
+		}
+		update.CPU.Mems = resources.CpusetMems
+	}
+
+	if err := s.oci.Update(containerID, update); err != nil {
+		return fmt.Errorf("failed to update resources of container %s: %w", containerID, err)
+	}
+
+	return nil
+}
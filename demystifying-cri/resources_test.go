@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// specWithResources applies resources to a default spec and returns the config.json runc would read
+func specWithResources(t *testing.T, s *DemystifyingCRI, resources *runtime.LinuxContainerResources) *rspec.Spec {
+	t.Helper()
+	g, err := generate.New("linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.applyResources(&g, resources); err != nil {
+		t.Fatalf("applyResources: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := g.SaveToFile(path, generate.ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec rspec.Spec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return &spec
+}
+
+func TestCheckHugepageSize(t *testing.T) {
+	for _, pageSize := range []string{"", "2", "MB", "2TB", "2mb", "-2MB", "1.5GB"} {
+		if err := checkHugepageSize(pageSize); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("checkHugepageSize(%q) = %v, want InvalidArgument", pageSize, err)
+		}
+	}
+
+	// 3MB pages exist on no architecture, while 2MB pages only exist on some nodes
+	if err := checkHugepageSize("3MB"); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("checkHugepageSize(3MB) = %v, want InvalidArgument", err)
+	}
+	if _, err := os.Stat("/sys/kernel/mm/hugepages/hugepages-2048kB"); err == nil {
+		if err := checkHugepageSize("2MB"); err != nil {
+			t.Errorf("checkHugepageSize(2MB) = %v, want nil", err)
+		}
+	}
+}
+
+func TestApplyHugepageLimits(t *testing.T) {
+	if _, err := os.Stat("/sys/kernel/mm/hugepages/hugepages-2048kB"); err != nil {
+		t.Skip("node has no 2MB hugepages")
+	}
+
+	spec := specWithResources(t, &DemystifyingCRI{}, &runtime.LinuxContainerResources{
+		HugepageLimits: []*runtime.HugepageLimit{{PageSize: "2MB", Limit: 4 << 20}},
+	})
+	limits := spec.Linux.Resources.HugepageLimits
+	if len(limits) != 1 || limits[0].Pagesize != "2MB" || limits[0].Limit != 4<<20 {
+		t.Errorf("hugepage limits in config.json = %+v, want 2MB limited to %d", limits, 4<<20)
+	}
+
+	g, err := generate.New("linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&DemystifyingCRI{}).applyResources(&g, &runtime.LinuxContainerResources{
+		HugepageLimits: []*runtime.HugepageLimit{{PageSize: "3MB", Limit: 4 << 20}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("applyResources with 3MB hugepages = %v, want InvalidArgument", err)
+	}
+}
+
+func TestCheckCpuset(t *testing.T) {
+	tests := []struct {
+		cpuset string
+		valid  bool
+	}{
+		{"0", true},
+		{"0-3", true},
+		{"0-3,5,7-8", true},
+		{"2-2", true},
+		{"", false},
+		{"3-1", false},
+		{"0-", false},
+		{"-1", false},
+		{"0,,1", false},
+		{"a-b", false},
+		{"0-3 ", false},
+	}
+	for _, test := range tests {
+		err := checkCpuset(test.cpuset)
+		if test.valid && err != nil {
+			t.Errorf("checkCpuset(%q) = %v, want nil", test.cpuset, err)
+		}
+		if !test.valid && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("checkCpuset(%q) = %v, want InvalidArgument", test.cpuset, err)
+		}
+	}
+}
+
+func TestApplyCpuset(t *testing.T) {
+	spec := specWithResources(t, &DemystifyingCRI{}, &runtime.LinuxContainerResources{CpusetCpus: "2-3", CpusetMems: "0"})
+	if cpu := spec.Linux.Resources.CPU; cpu.Cpus != "2-3" || cpu.Mems != "0" {
+		t.Errorf("cpuset in config.json = %q and %q, want 2-3 and 0", cpu.Cpus, cpu.Mems)
+	}
+}
+
+func TestApplyUnified(t *testing.T) {
+	unified := map[string]string{"io.max": "8:0 rbps=1048576", "memory.high": "67108864"}
+	resources := &runtime.LinuxContainerResources{Unified: unified}
+
+	spec := specWithResources(t, &DemystifyingCRI{cgroupV2: true}, resources)
+	if got := spec.Linux.Resources.Unified; !maps.Equal(got, unified) {
+		t.Errorf("unified in config.json on cgroup v2 = %v, want %v", got, unified)
+	}
+
+	// runc rejects unified settings on cgroup v1, so they are dropped there
+	spec = specWithResources(t, &DemystifyingCRI{}, resources)
+	if spec.Linux.Resources != nil && spec.Linux.Resources.Unified != nil {
+		t.Errorf("unified in config.json on cgroup v1 = %v, want none", spec.Linux.Resources.Unified)
+	}
+}
+
+func TestApplySwapLimit(t *testing.T) {
+	tests := []struct {
+		s      *DemystifyingCRI
+		memory int64
+		swap   int64
+		want   *int64 // Swap limit in config.json, nil if none is set
+	}{
+		{&DemystifyingCRI{swapAccounting: true}, 64 << 20, 128 << 20, proto.Int64(128 << 20)},
+		{&DemystifyingCRI{swapAccounting: true, cgroupV2: true}, 64 << 20, 128 << 20, proto.Int64(128 << 20)},
+		{&DemystifyingCRI{swapAccounting: true}, 64 << 20, -1, proto.Int64(-1)},
+		{&DemystifyingCRI{swapAccounting: true}, 64 << 20, 0, nil},
+		{&DemystifyingCRI{}, 64 << 20, 128 << 20, nil},
+	}
+	for _, test := range tests {
+		spec := specWithResources(t, test.s, &runtime.LinuxContainerResources{MemoryLimitInBytes: test.memory, MemorySwapLimitInBytes: test.swap})
+		var got *int64
+		if memory := spec.Linux.Resources.Memory; memory != nil {
+			got = memory.Swap
+		}
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Errorf("swap limit %d with swap accounting %v in config.json = %v, want %v", test.swap, test.s.swapAccounting, got, test.want)
+		}
+	}
+
+	g, err := generate.New("linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&DemystifyingCRI{swapAccounting: true}).applyResources(&g, &runtime.LinuxContainerResources{MemoryLimitInBytes: 128 << 20, MemorySwapLimitInBytes: 64 << 20})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("applyResources with swap below memory = %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// annotationUlimits sets rlimits of a single container on top of --default-ulimits, e.g. nofile=65536:65536,nproc=4096
+const annotationUlimits = "demystifying-cri/ulimits"
+
+// defaultUlimits matches the nofile limit of containerd's default spec
+const defaultUlimits = "nofile=1024:1024"
+
+// ulimit is a resource limit of the container process, applied as OCI rlimit
+type ulimit struct {
+	name string // Lower-case name without prefix like ulimit -a shows it, e.g. nofile
+	soft uint64
+	hard uint64
+}
+
+// String formats the limit like it is parsed by parseUlimits
+func (limit ulimit) String() string {
+	return fmt.Sprintf("%s=%d:%d", limit.name, limit.soft, limit.hard)
+}
+
+// parseUlimits parses comma separated limits of the form name=soft:hard, where name=value sets both to value
+func parseUlimits(value string) ([]ulimit, error) {
+	var ulimits []ulimit
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		name, limits, found := strings.Cut(entry, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("ulimit %q is not of the form name=soft:hard", entry)
+		}
+		softValue, hardValue, hasHard := strings.Cut(limits, ":")
+		if !hasHard {
+			hardValue = softValue
+		}
+		soft, err := strconv.ParseUint(softValue, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid soft limit of ulimit %s: %v", name, err)
+		}
+		hard, err := strconv.ParseUint(hardValue, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hard limit of ulimit %s: %v", name, err)
+		}
+		if soft > hard {
+			return nil, fmt.Errorf("soft limit of ulimit %s exceeds its hard limit", name)
+		}
+
+		ulimits = append(ulimits, ulimit{name: strings.ToLower(name), soft: soft, hard: hard})
+	}
+	return ulimits, nil
+}
+
+// applyUlimits sets the default rlimits of the node and those of the container's annotation on top
+// A limit set by both replaces the default, as does a limit the image's spec already had
+func (s *DemystifyingCRI) applyUlimits(g *generate.Generator, annotations map[string]string) error {
+	ulimits := s.ulimits
+	if value, ok := annotations[annotationUlimits]; ok {
+		requested, err := parseUlimits(value)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid %s annotation: %v", annotationUlimits, err)
+		}
+		ulimits = append(append([]ulimit(nil), ulimits...), requested...)
+	}
+
+	for _, limit := range ulimits {
+		g.AddProcessRlimits("RLIMIT_"+strings.ToUpper(limit.name), limit.hard, limit.soft)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseUlimits(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []ulimit
+	}{
+		{"", nil},
+		{defaultUlimits, []ulimit{{"nofile", 1024, 1024}}},
+		{"nofile=1024:65536, NPROC=4096", []ulimit{{"nofile", 1024, 65536}, {"nproc", 4096, 4096}}},
+	}
+	for _, test := range tests {
+		if got, err := parseUlimits(test.value); err != nil || !slices.Equal(got, test.want) {
+			t.Errorf("parseUlimits(%q) = %v, %v, want %v", test.value, got, err, test.want)
+		}
+	}
+
+	for _, value := range []string{"nofile", "=1024", "nofile=many", "nofile=1024:lots", "nofile=2048:1024"} {
+		if _, err := parseUlimits(value); err == nil {
+			t.Errorf("parseUlimits(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestUlimitsAppearInRlimits(t *testing.T) {
+	create := func(s *DemystifyingCRI, name string, annotations map[string]string) (*runtime.CreateContainerResponse, error) {
+		return s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+			PodSandboxId: "sandbox",
+			Config: &runtime.ContainerConfig{
+				Metadata:    &runtime.ContainerMetadata{Name: name},
+				Image:       &runtime.ImageSpec{Image: testImage},
+				Annotations: annotations,
+			},
+		})
+	}
+	rlimit := func(spec *rspec.Spec, name string) *rspec.POSIXRlimit {
+		for i, limit := range spec.Process.Rlimits {
+			if limit.Type == name {
+				return &spec.Process.Rlimits[i]
+			}
+		}
+		return nil
+	}
+
+	s, _ := newTestRuntime(t)
+	s.ulimits = []ulimit{{"nofile", 1024, 1024}}
+	resp, err := create(s, "default", nil)
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	spec := containerSpec(t, s, resp.ContainerId)
+	if nofile := rlimit(spec, "RLIMIT_NOFILE"); nofile == nil || nofile.Soft != 1024 || nofile.Hard != 1024 {
+		t.Errorf("RLIMIT_NOFILE of a container with default ulimits = %+v, want 1024:1024", nofile)
+	}
+
+	resp, err = create(s, "raised", map[string]string{annotationUlimits: "nofile=65536,nproc=1024:4096"})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	spec = containerSpec(t, s, resp.ContainerId)
+	if nofile := rlimit(spec, "RLIMIT_NOFILE"); nofile == nil || nofile.Soft != 65536 || nofile.Hard != 65536 {
+		t.Errorf("RLIMIT_NOFILE of a container raising it = %+v, want 65536:65536", nofile)
+	}
+	if nproc := rlimit(spec, "RLIMIT_NPROC"); nproc == nil || nproc.Soft != 1024 || nproc.Hard != 4096 {
+		t.Errorf("RLIMIT_NPROC of a container setting it = %+v, want 1024:4096", nproc)
+	}
+
+	if _, err := create(s, "invalid", map[string]string{annotationUlimits: "nofile=lots"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateContainer with an invalid ulimits annotation = %v, want InvalidArgument", err)
+	}
+}
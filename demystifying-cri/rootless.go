@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// rootlessRuntimeRoot returns the default runtime root of an unprivileged user, $XDG_DATA_HOME/demystifying-cri
+func rootlessRuntimeRoot() string {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, _ := os.UserHomeDir()
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "demystifying-cri")
+}
+
+// rootlessSocketPath returns the CRI socket of an unprivileged user, who can't create sockets in /var/run
+func rootlessSocketPath() string {
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		runtimeDir = os.TempDir()
+	}
+	return filepath.Join(runtimeDir, "demystifying-cri.sock")
+}
+
+// applyUserNamespace maps root of the container to the user the runtime runs as
+// Sandboxes get a new user namespace, containers join the one of their sandbox at userNsPath
+// The mappings are set in both cases, as runc refuses rootless containers without them
+func applyUserNamespace(g *generate.Generator, userNsPath string) error {
+	if err := g.AddOrReplaceLinuxNamespace("user", userNsPath); err != nil {
+		return fmt.Errorf("failed to set user namespace: %v", err)
+	}
+
+	g.ClearLinuxUIDMappings()
+	g.ClearLinuxGIDMappings()
+	g.AddLinuxUIDMapping(uint32(os.Geteuid()), 0, 1)
+	g.AddLinuxGIDMapping(uint32(os.Getegid()), 0, 1)
+	return nil
+}
+
+// dropPrivilegedSettings removes the parts of a spec an unprivileged user can't apply
+// Without a delegated cgroup runc can't create one, so the container stays in the cgroup of the runtime
+func dropPrivilegedSettings(g *generate.Generator) {
+	g.SetLinuxCgroupsPath("")
+	if g.Config.Linux != nil {
+		g.Config.Linux.Resources = nil
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// ociRuntime is the low-level runtime containers are run with
+// Handlers only talk to it through this interface, so they never shell out to runc directly
+type ociRuntime interface {
+	// Run creates and starts a container from the bundle and returns once it is running in the background
+	Run(id, bundle string, stdio runtimeIO) error
+	// Create sets up a container from the bundle without starting its process
+	Create(id, bundle string, stdio runtimeIO) error
+	// Start runs the process of a created container
+	Start(id string) error
+	Kill(id string, signal syscall.Signal) error
+	// Delete removes a stopped container, with force a running one is killed first
+	Delete(id string, force bool) error
+	State(id string) (*runcStateInfo, error)
+	List() ([]runcStateInfo, error)
+	Pause(id string) error
+	Resume(id string) error
+	Update(id string, resources *rspec.LinuxResources) error
+	// Exec runs an additional process in a running container and returns its exit code
+	// Once ctx is done the process is killed, output written up to then is kept in stdio
+	Exec(ctx context.Context, id string, args []string, stdio runtimeIO) (int, error)
+	// Checkpoint dumps the state of a container into imagePath and stops it
+	Checkpoint(ctx context.Context, id, imagePath string) error
+	// Events blocks until the runtime stops reporting events of a container, on cgroup v2 once its processes exited
+	Events(ctx context.Context, id string) error
+}
+
+// runtimeIO is the stdio a container is created with
+type runtimeIO struct {
+	Stdin         io.Reader
+	Stdout        io.Writer
+	Stderr        io.Writer
+	ConsoleSocket string // Socket the terminal master is sent to, only set for TTY containers
+}
+
+// runcStateInfo is the subset of the JSON printed by runc state which is relevant to us
+type runcStateInfo struct {
+	ID     string `json:"id"`
+	Pid    int    `json:"pid"`
+	Status string `json:"status"` // One of creating, created, running, paused or stopped
+	Bundle string `json:"bundle"`
+}
+
+// runcBinary implements ociRuntime by running the runc binary
+type runcBinary struct {
+	path     string
+	root     string // State directory passed as --root, empty uses runc's default
+	rootless bool   // Passed as --rootless, so runc doesn't attempt privileged operations
+}
+
+// command returns a runc command with the global options applied
+func (r *runcBinary) command(ctx context.Context, args ...string) *exec.Cmd {
+	if r.root != "" {
+		args = append([]string{"--root", r.root}, args...)
+	}
+	if r.rootless {
+		args = append([]string{"--rootless", "true"}, args...)
+	}
+	return exec.CommandContext(ctx, r.path, args...)
+}
+
+func (r *runcBinary) Run(id, bundle string, stdio runtimeIO) error {
+	return r.runWithIO(stdio, "run", "-d", "--bundle", bundle, id)
+}
+
+func (r *runcBinary) Create(id, bundle string, stdio runtimeIO) error {
+	return r.runWithIO(stdio, "create", "--bundle", bundle, id)
+}
+
+// runWithIO runs a runc command whose stdio is handed on to the container
+func (r *runcBinary) runWithIO(stdio runtimeIO, args ...string) error {
+	if stdio.ConsoleSocket != "" {
+		args = append(args[:len(args)-1], "--console-socket", stdio.ConsoleSocket, args[len(args)-1])
+	}
+	cmd := r.command(context.Background(), args...)
+	cmd.Stdin = stdio.Stdin
+	cmd.Stdout = stdio.Stdout
+	cmd.Stderr = stdio.Stderr
+	return binaryError(r.path, cmd.Run())
+}
+
+func (r *runcBinary) Start(id string) error {
+	return r.run(nil, "start", id)
+}
+
+func (r *runcBinary) Kill(id string, signal syscall.Signal) error {
+	return r.run(nil, "kill", id, strconv.Itoa(int(signal)))
+}
+
+func (r *runcBinary) Delete(id string, force bool) error {
+	if force {
+		return r.run(nil, "delete", "--force", id)
+	}
+	return r.run(nil, "delete", id)
+}
+
+// State returns the state of a runc container
+func (r *runcBinary) State(id string) (*runcStateInfo, error) {
+	out, err := r.command(context.Background(), "state", id).Output()
+	if err != nil {
+		return nil, binaryError(r.path, err)
+	}
+
+	var state runcStateInfo
+	if err := json.Unmarshal(out, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse runc state output: %v", err)
+	}
+
+	return &state, nil
+}
+
+// List returns the state of all runc containers
+func (r *runcBinary) List() ([]runcStateInfo, error) {
+	out, err := r.command(context.Background(), "list", "--format", "json").Output()
+	if err != nil {
+		return nil, binaryError(r.path, err)
+	}
+
+	// runc prints null instead of an empty list
+	var states []runcStateInfo
+	if err := json.Unmarshal(out, &states); err != nil {
+		return nil, fmt.Errorf("failed to parse runc list output: %v", err)
+	}
+
+	return states, nil
+}
+
+func (r *runcBinary) Pause(id string) error {
+	return r.run(nil, "pause", id)
+}
+
+func (r *runcBinary) Resume(id string) error {
+	return r.run(nil, "resume", id)
+}
+
+// Update hands the resources to runc update as JSON on stdin
+func (r *runcBinary) Update(id string, resources *rspec.LinuxResources) error {
+	data, err := json.Marshal(resources)
+	if err != nil {
+		return err
+	}
+	return r.run(bytes.NewReader(data), "update", "--resources", "-", id)
+}
+
+func (r *runcBinary) Exec(ctx context.Context, id string, args []string, stdio runtimeIO) (int, error) {
+	pidDir, err := os.MkdirTemp("", "exec-")
+	if err != nil {
+		return -1, fmt.Errorf("failed to create pid file directory: %v", err)
+	}
+	defer os.RemoveAll(pidDir)
+	pidFile := filepath.Join(pidDir, "pid")
+
+	cmd := r.command(ctx, append([]string{"exec", "--pid-file", pidFile, id}, args...)...)
+	cmd.Stdin = stdio.Stdin
+	cmd.Stdout = stdio.Stdout
+	cmd.Stderr = stdio.Stderr
+	// Killing runc would leave the process running in the container, so the process itself is killed
+	// runc exits once the process is gone, runc is only killed if it didn't start the process yet
+	cmd.Cancel = func() error {
+		if data, err := os.ReadFile(pidFile); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				return syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+		return cmd.Process.Kill()
+	}
+	// Children of the process may keep the output open, which must not block forever
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, binaryError(r.path, err)
+	}
+	return 0, nil
+}
+
+func (r *runcBinary) Checkpoint(ctx context.Context, id, imagePath string) error {
+	cmd := r.command(ctx, "checkpoint", "--image-path", imagePath, id)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", binaryError(r.path, err), out)
+	}
+	return nil
+}
+
+// eventsStatsInterval is how often runc events samples stats, which are only a side effect, as collectStats reads cgroups itself
+const eventsStatsInterval = "24h"
+
+// Events runs runc events until it exits, which it does once the container stopped and its cgroup is empty
+func (r *runcBinary) Events(ctx context.Context, id string) error {
+	var stderr bytes.Buffer
+	cmd := r.command(ctx, "events", "--interval", eventsStatsInterval, id)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", runcError(binaryError(r.path, err), stderr.Bytes()), stderr.Bytes())
+	}
+	return nil
+}
+
+// run runs a runc command and includes its output in the error
+func (r *runcBinary) run(stdin io.Reader, args ...string) error {
+	cmd := r.command(context.Background(), args...)
+	cmd.Stdin = stdin
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", runcError(binaryError(r.path, err), out), out)
+	}
+	return nil
+}
+
+// Errors of runc meaning a container already reached the state a kill or delete was meant to bring it into
+var (
+	errContainerNotExist   = errors.New("container does not exist")
+	errContainerNotRunning = errors.New("container not running")
+)
+
+// runcError classifies a failed runc command by the message it printed
+// runc exits with 1 for every error, so the message is the only way to tell a container that vanished from a failure
+func runcError(err error, out []byte) error {
+	switch message := string(out); {
+	case strings.Contains(message, "does not exist"):
+		return fmt.Errorf("%w: %w", errContainerNotExist, err)
+	case strings.Contains(message, "not running"), strings.Contains(message, "process already finished"):
+		return fmt.Errorf("%w: %w", errContainerNotRunning, err)
+	}
+	return err
+}
+
+// containerGone reports whether a kill or delete failed only because the container already exited or was deleted
+// This happens when the reaper or a concurrent request got to the container first, so callers treat it as success
+func containerGone(err error) bool {
+	return errors.Is(err, errContainerNotExist) || errors.Is(err, errContainerNotRunning)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// fakeOCI implements ociRuntime for handler tests without runc
+// Every container process is a sleep, or the configured command, started as child of the test with the stdio runc would
+// hand to it, so signals, exit statuses and output behave like with runc once the runtime became the subreaper of the
+// container processes
+type fakeOCI struct {
+	mu         sync.Mutex
+	containers map[string]*fakeContainer
+	calls      []string                // Operations in the order they were called, like "create c1"
+	ignoreTerm bool                    // Whether container processes ignore SIGTERM, so only SIGKILL stops them
+	command    string                  // Command container processes exec, defaults to sleeping
+	checkpoint error                   // Error Checkpoint fails with
+	updates    []*rspec.LinuxResources // Resources passed to Update
+}
+
+// fakeContainer is a container of fakeOCI
+type fakeContainer struct {
+	bundle  string
+	process *os.Process
+	started bool
+}
+
+// newFakeOCI returns a fakeOCI whose remaining processes are killed at the end of the test
+func newFakeOCI(t *testing.T) *fakeOCI {
+	f := &fakeOCI{containers: make(map[string]*fakeContainer)}
+	t.Cleanup(func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, container := range f.containers {
+			container.process.Kill()
+			container.process.Wait()
+		}
+	})
+	return f
+}
+
+func (f *fakeOCI) record(call string, args ...any) {
+	f.calls = append(f.calls, strings.TrimSpace(call+" "+fmt.Sprint(args...)))
+}
+
+func (f *fakeOCI) create(id, bundle string, started bool, stdio runtimeIO) error {
+	if _, exists := f.containers[id]; exists {
+		return fmt.Errorf("container with id %s already exists", id)
+	}
+	// Ignored signals stay ignored across exec, so the sleep is the container's init either way
+	command := f.command
+	if command == "" {
+		command = "sleep 1000"
+	}
+	script := "exec " + command
+	if f.ignoreTerm {
+		script = "trap '' TERM; " + script
+	}
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdio.Stdin, stdio.Stdout, stdio.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// Wait for the exec, otherwise a signal may reach the shell before it set up the trap
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if comm, _ := os.ReadFile("/proc/" + strconv.Itoa(cmd.Process.Pid) + "/comm"); len(comm) > 0 && string(comm) != "sh\n" {
+			break
+		}
+	}
+	f.containers[id] = &fakeContainer{bundle: bundle, process: cmd.Process, started: started}
+	return nil
+}
+
+func (f *fakeOCI) Run(id, bundle string, stdio runtimeIO) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("run", id)
+	return f.create(id, bundle, true, stdio)
+}
+
+func (f *fakeOCI) Create(id, bundle string, stdio runtimeIO) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("create", id)
+	if stdio.ConsoleSocket != "" {
+		if err := sendConsole(stdio.ConsoleSocket); err != nil {
+			return err
+		}
+	}
+	return f.create(id, bundle, false, stdio)
+}
+
+// sendConsole hands a pipe to the console socket of a TTY container like runc hands the terminal master
+func sendConsole(socketPath string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, _, err = conn.WriteMsgUnix([]byte("/dev/pts/0"), syscall.UnixRights(int(w.Fd())), nil)
+	return err
+}
+
+func (f *fakeOCI) Start(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("start", id)
+	container, exists := f.containers[id]
+	if !exists {
+		return runcError(errors.New("exit status 1"), []byte("container does not exist"))
+	}
+	if container.started {
+		return errors.New("cannot start a container that has stopped")
+	}
+	container.started = true
+	return nil
+}
+
+func (f *fakeOCI) Kill(id string, signal syscall.Signal) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("kill", id, " ", int(signal))
+	container, exists := f.containers[id]
+	if !exists {
+		return runcError(errors.New("exit status 1"), []byte("container does not exist"))
+	}
+	if processStatus(container.process.Pid) == "stopped" {
+		return runcError(errors.New("exit status 1"), []byte("container not running"))
+	}
+	return container.process.Signal(signal)
+}
+
+func (f *fakeOCI) Delete(id string, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("delete", id)
+	container, exists := f.containers[id]
+	if !exists {
+		return runcError(errors.New("exit status 1"), []byte("container does not exist"))
+	}
+	if processStatus(container.process.Pid) != "stopped" {
+		if !force {
+			return errors.New("cannot delete container that is not stopped")
+		}
+		container.process.Kill()
+		for processStatus(container.process.Pid) != "stopped" {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	delete(f.containers, id)
+	return nil
+}
+
+func (f *fakeOCI) State(id string) (*runcStateInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	container, exists := f.containers[id]
+	if !exists {
+		return nil, runcError(errors.New("exit status 1"), []byte("container does not exist"))
+	}
+	status := processStatus(container.process.Pid)
+	if status == "running" && !container.started {
+		status = "created"
+	}
+	return &runcStateInfo{ID: id, Pid: container.process.Pid, Status: status, Bundle: container.bundle}, nil
+}
+
+func (f *fakeOCI) List() ([]runcStateInfo, error) {
+	f.mu.Lock()
+	ids := make([]string, 0, len(f.containers))
+	for id := range f.containers {
+		ids = append(ids, id)
+	}
+	f.mu.Unlock()
+
+	var states []runcStateInfo
+	for _, id := range ids {
+		if state, err := f.State(id); err == nil {
+			states = append(states, *state)
+		}
+	}
+	return states, nil
+}
+
+func (f *fakeOCI) Pause(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("pause", id)
+	return nil
+}
+
+func (f *fakeOCI) Resume(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("resume", id)
+	return nil
+}
+
+func (f *fakeOCI) Update(id string, resources *rspec.LinuxResources) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("update", id)
+	f.updates = append(f.updates, resources)
+	return nil
+}
+
+// Exec runs the command on the host, which is killed once ctx is done like runc exec is
+func (f *fakeOCI) Exec(ctx context.Context, id string, args []string, stdio runtimeIO) (int, error) {
+	f.mu.Lock()
+	f.record("exec", id)
+	f.mu.Unlock()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdio.Stdin, stdio.Stdout, stdio.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+func (f *fakeOCI) Checkpoint(ctx context.Context, id, imagePath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("checkpoint", id)
+	if f.checkpoint != nil {
+		return f.checkpoint
+	}
+	// Like runc without --leave-running, the process ends once it was dumped
+	container, exists := f.containers[id]
+	if !exists {
+		return runcError(errors.New("exit status 1"), []byte("container does not exist"))
+	}
+	return container.process.Signal(syscall.SIGKILL)
+}
+
+// Events returns once the container's process exited, like runc events does on cgroup v2
+func (f *fakeOCI) Events(ctx context.Context, id string) error {
+	f.mu.Lock()
+	container, exists := f.containers[id]
+	f.mu.Unlock()
+	if !exists {
+		return runcError(errors.New("exit status 1"), []byte("container does not exist"))
+	}
+	for processStatus(container.process.Pid) != "stopped" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// processStatus returns running for a live process and stopped once it exited, like runc state does for the container's init
+func processStatus(pid int) string {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return "stopped"
+	}
+	if fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:])); len(fields) > 0 && fields[0] == "Z" {
+		return "stopped"
+	}
+	return "running"
+}
+
+func TestRuncError(t *testing.T) {
+	exitErr := errors.New("exit status 1")
+	tests := []struct {
+		out  string
+		gone bool
+	}{
+		{"container does not exist", true},
+		{`time="..." level=error msg="container not running"`, true},
+		{"process already finished", true},
+		{"cannot delete container that is not stopped: unknown", false},
+		{"permission denied", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := runcError(exitErr, []byte(test.out))
+		if !errors.Is(err, exitErr) {
+			t.Errorf("runcError(%q) = %v, which doesn't wrap the error of runc", test.out, err)
+		}
+		if gone := containerGone(err); gone != test.gone {
+			t.Errorf("containerGone(runcError(%q)) = %v, want %v", test.out, gone, test.gone)
+		}
+		// Callers wrap the error once more before it is checked
+		if gone := containerGone(fmt.Errorf("failed to delete container: %w", err)); gone != test.gone {
+			t.Errorf("containerGone of wrapped runcError(%q) = %v, want %v", test.out, gone, test.gone)
+		}
+	}
+}
+
+func TestRuncBinaryPassesRootless(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\necho \"$@\" >> " + dir + "/args\n"
+	if err := os.WriteFile(filepath.Join(dir, "runc"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rootless := range []bool{true, false} {
+		os.Remove(filepath.Join(dir, "args"))
+		r := &runcBinary{path: filepath.Join(dir, "runc"), root: "/run/user/1000/runc", rootless: rootless}
+		if err := r.Start("app"); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		if err := r.Kill("app", syscall.SIGTERM); err != nil {
+			t.Fatalf("Kill: %v", err)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, "args"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"--root /run/user/1000/runc start app", "--root /run/user/1000/runc kill app 15"}
+		if rootless {
+			for i := range want {
+				want[i] = "--rootless true " + want[i]
+			}
+		}
+		if got := strings.Split(strings.TrimSpace(string(data)), "\n"); !slices.Equal(got, want) {
+			t.Errorf("runc arguments with rootless %v = %q, want %q", rootless, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sandboxCommand returns a command running a host binary in the network, IPC and UTS namespaces of a sandbox's pause process
+// The pause image contains nothing but the pause binary, so runc exec into it couldn't run any tools
+func (s *DemystifyingCRI) sandboxCommand(ctx context.Context, sandboxID string, args []string) (*exec.Cmd, error) {
+	s.mu.RLock()
+	sandbox, exists := s.sandboxes[sandboxID]
+	ready := exists && sandbox.State == runtime.PodSandboxState_SANDBOX_READY
+	s.mu.RUnlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "sandbox %s does not exist", sandboxID)
+	}
+	if !ready {
+		return nil, status.Errorf(codes.FailedPrecondition, "sandbox %s is not ready", sandboxID)
+	}
+
+	pod, err := s.podResources(sandbox)
+	if err != nil {
+		return nil, err
+	}
+
+	nsenterArgs := []string{"--target", strconv.Itoa(pod.pid), "--net", "--ipc", "--uts"}
+	// The namespaces of a rootless sandbox are owned by its user namespace, which has to be entered first
+	if s.rootless {
+		nsenterArgs = append(nsenterArgs, "--user", "--preserve-credentials")
+	}
+	cmd := exec.CommandContext(ctx, "nsenter", append(append(nsenterArgs, "--"), args...)...)
+	// Children of the command may keep the output open, which must not block forever
+	cmd.WaitDelay = time.Second
+	return cmd, nil
+}
+
+// runSandboxCommand runs a command returned by sandboxCommand and returns its exit code
+func runSandboxCommand(cmd *exec.Cmd, stdout, stderr io.Writer) (int, error) {
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, binaryError("nsenter", err)
+	}
+	return 0, nil
+}
+
+// debugExecSandbox runs the command given by the cmd query parameters in the sandbox given by the id query parameter
+// e.g. curl --unix-socket /var/run/demystifying-cri-debug.sock -X POST 'localhost/exec-sandbox?id=<sandbox>&cmd=ip&cmd=addr'
+// The output of the command is streamed, followed by a line with its exit code
+func (s *DemystifyingCRI) debugExecSandbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sandboxID := r.URL.Query().Get("id")
+	args := r.URL.Query()["cmd"]
+	if sandboxID == "" || len(args) == 0 {
+		http.Error(w, "missing id or cmd parameter", http.StatusBadRequest)
+		return
+	}
+
+	cmd, err := s.sandboxCommand(r.Context(), sandboxID, args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	exitCode, err := runSandboxCommand(cmd, w, w)
+	if err != nil {
+		// The command may have written output already, so the status can't be changed anymore
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintf(w, "exit code %d\n", exitCode)
+}
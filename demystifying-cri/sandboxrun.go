@@ -0,0 +1,32 @@
+package main
+
+// sandboxRun is a RunPodSandbox call in progress, which concurrent calls for the same pod wait for instead of racing on its bundle
+type sandboxRun struct {
+	done      chan struct{} // Closed once the call finished
+	sandboxID string        // ID of the sandbox the call ran, only valid after done was closed
+	err       error         // Result of the call, only valid after done was closed
+}
+
+// joinSandboxRun returns the RunPodSandbox call in progress for the pod with the given sandboxKey
+// If there is none a new one is registered and true is returned, the caller must then finish it with finishSandboxRun
+func (s *DemystifyingCRI) joinSandboxRun(key string) (*sandboxRun, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if run, inFlight := s.sandboxRuns[key]; inFlight {
+		return run, false
+	}
+	run := &sandboxRun{done: make(chan struct{})}
+	s.sandboxRuns[key] = run
+	return run, true
+}
+
+// finishSandboxRun hands the result of a call registered by joinSandboxRun to all waiting calls
+func (s *DemystifyingCRI) finishSandboxRun(key string, run *sandboxRun, sandboxID string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run.sandboxID, run.err = sandboxID, err
+	close(run.done)
+	delete(s.sandboxRuns, key)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConcurrentRunPodSandboxRunsOnce(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	enableTestSandboxes(s)
+
+	// The delay keeps the first call in flight while the second one arrives
+	config := sandboxConfig("pod-a")
+	config.Annotations = map[string]string{annotationDelayStart: "200ms"}
+
+	ids := make([]string, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := s.RunPodSandbox(context.Background(), &runtime.RunPodSandboxRequest{Config: config})
+			ids[i], errs[i] = resp.GetPodSandboxId(), err
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("RunPodSandbox: %v", err)
+		}
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("concurrent RunPodSandbox calls returned %s and %s, want the same sandbox", ids[0], ids[1])
+	}
+	if runs := strings.Count(strings.Join(oci.calls, "\n"), "run "); runs != 1 {
+		t.Errorf("runtime calls = %q, want a single pause process", oci.calls)
+	}
+	if len(s.sandboxRuns) != 0 {
+		t.Errorf("sandbox runs in flight = %v after the calls returned, want none", s.sandboxRuns)
+	}
+}
+
+func TestConcurrentRunPodSandboxSharesError(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	enableTestSandboxes(s)
+
+	// The first call fails only after the delay, the waiting call gets its error instead of running the sandbox again
+	s.postStartCheck = 200 * time.Millisecond
+	oci.command = "true"
+
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = s.RunPodSandbox(context.Background(), &runtime.RunPodSandboxRequest{Config: sandboxConfig("pod-a")})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("RunPodSandbox = %v, want the FailedPrecondition of the exited pause process", err)
+		}
+	}
+	if runs := strings.Count(strings.Join(oci.calls, "\n"), "run "); runs != 1 {
+		t.Errorf("runtime calls = %q, want a single pause process", oci.calls)
+	}
+}
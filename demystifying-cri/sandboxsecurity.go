@@ -0,0 +1,59 @@
+package main
+
+import (
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// unconfinedProfile is the value of --sandbox-seccomp-profile and --sandbox-apparmor-profile leaving pause processes unconfined
+const unconfinedProfile = "unconfined"
+
+// pauseBlockedSyscalls are the syscalls the built-in seccomp profile of pause processes denies with EPERM
+// The pause binary itself needs next to nothing, but runc still runs in the process until it executes the command,
+// which may also be replaced by --sandbox-command, so an allowlist would be fragile.
+// Instead everything is denied that could reach beyond the pod's namespaces, which the pause process holds for all its containers
+var pauseBlockedSyscalls = []string{
+	"acct", "add_key", "bpf", "clock_adjtime", "clock_settime", "create_module", "delete_module",
+	"finit_module", "fsconfig", "fsmount", "fsopen", "fspick", "get_kernel_syms", "init_module",
+	"ioperm", "iopl", "kcmp", "kexec_file_load", "kexec_load", "keyctl", "lookup_dcookie", "mbind", "mount",
+	"mount_setattr", "move_mount", "move_pages", "name_to_handle_at", "nfsservctl", "open_by_handle_at", "open_tree",
+	"perf_event_open", "pivot_root", "process_vm_readv", "process_vm_writev", "ptrace",
+	"query_module", "quotactl", "reboot", "request_key", "set_mempolicy", "setns", "settimeofday", "swapoff",
+	"swapon", "sysfs", "umount", "umount2", "unshare", "uselib", "userfaultfd", "ustat", "vm86", "vm86old",
+}
+
+// defaultPauseSeccomp returns the seccomp profile of pause processes used without --sandbox-seccomp-profile
+func defaultPauseSeccomp() *rspec.LinuxSeccomp {
+	return &rspec.LinuxSeccomp{
+		DefaultAction: rspec.ActAllow,
+		Syscalls: []rspec.LinuxSyscall{{
+			Names:  append([]string{}, pauseBlockedSyscalls...),
+			Action: rspec.ActErrno,
+		}},
+	}
+}
+
+// applySandboxSecurityProfiles confines a pause process like applySecurityProfiles, except that RuntimeDefault,
+// which is also what a missing profile means, selects the profiles of pause processes instead of the ones of containers
+func (s *DemystifyingCRI) applySandboxSecurityProfiles(g *generate.Generator, seccomp, apparmor *runtime.SecurityProfile) error {
+	if err := s.applySecurityProfiles(g, seccomp, apparmor); err != nil {
+		return err
+	}
+
+	if seccomp.GetProfileType() == runtime.SecurityProfile_RuntimeDefault {
+		g.Config.Linux.Seccomp = s.sandboxSeccomp
+	}
+	// Without a profile of their own pause processes get the default of containers, as AppArmor profiles must be loaded on the node
+	if apparmor.GetProfileType() == runtime.SecurityProfile_RuntimeDefault {
+		switch s.sandboxApparmor {
+		case "":
+		case unconfinedProfile:
+			g.SetProcessApparmorProfile("")
+		default:
+			g.SetProcessApparmorProfile(s.sandboxApparmor)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// annotationGracePeriod is set by Kubelet on every container to the termination grace period of its pod in seconds
+const annotationGracePeriod = "io.kubernetes.pod.terminationGracePeriod"
+
+// defaultGracePeriod is used for containers without annotationGracePeriod, matching the default of Kubernetes
+const defaultGracePeriod = 30
+
+// StopPodSandbox stops all containers of a sandbox and only then kills its pause process
+// The pause process owns the pod's namespaces, so killing it first would pull the network from under shutting down containers.
+// Kubelet usually stopped the containers already, the remaining ones get the grace period of their pod.
+// Stopping a sandbox which is already stopped or gone is not an error, as required by the CRI.
+func (s *DemystifyingCRI) StopPodSandbox(ctx context.Context, req *runtime.StopPodSandboxRequest) (*runtime.StopPodSandboxResponse, error) {
+	s.mu.RLock()
+	_, exists := s.sandboxes[req.PodSandboxId]
+	var members []*runtime.StopContainerRequest
+	for _, container := range s.containers {
+		if container.PodSandboxId == req.PodSandboxId && container.State == runtime.ContainerState_CONTAINER_RUNNING {
+			members = append(members, &runtime.StopContainerRequest{ContainerId: container.Id, Timeout: gracePeriod(container.Annotations)})
+		}
+	}
+	s.mu.RUnlock()
+	if !exists {
+		return &runtime.StopPodSandboxResponse{}, nil
+	}
+
+	// Stop the containers in parallel, so the slowest one bounds the shutdown instead of their sum
+	var wg sync.WaitGroup
+	errs := make([]error, len(members))
+	for i, member := range members {
+		wg.Add(1)
+		go func(i int, member *runtime.StopContainerRequest) {
+			defer wg.Done()
+			if _, err := s.StopContainer(ctx, member); err != nil {
+				errs[i] = fmt.Errorf("failed to stop container %s: %w", member.ContainerId, err)
+			}
+		}(i, member)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	// A pod network would be torn down here, after its containers are gone and while the pause process still holds the netns.
+	// The runtime doesn't set up pod networks through CNI yet, so only the forwarding of its host ports is removed.
+	if err := s.removeHostPorts(ctx, req.PodSandboxId); err != nil {
+		return nil, err
+	}
+
+	if err := s.stopPause(ctx, req.PodSandboxId); err != nil {
+		return nil, err
+	}
+	s.markSandboxNotReady(req.PodSandboxId)
+
+	return &runtime.StopPodSandboxResponse{}, nil
+}
+
+// stopPause kills the pause process of a sandbox, which has nothing to shut down gracefully
+func (s *DemystifyingCRI) stopPause(ctx context.Context, sandboxID string) error {
+	if !s.processAlive(sandboxID) {
+		return nil
+	}
+	if err := s.oci.Kill(sandboxID, syscall.SIGKILL); err != nil && !containerGone(err) && s.processAlive(sandboxID) {
+		return fmt.Errorf("failed to kill pause process of sandbox %s: %w", sandboxID, err)
+	}
+	if !s.waitForExit(ctx, sandboxID, time.Now().Add(stopKillTimeout)) {
+		return status.Errorf(codes.DeadlineExceeded, "pause process of sandbox %s did not exit after SIGKILL", sandboxID)
+	}
+	return nil
+}
+
+// gracePeriod returns the termination grace period Kubelet recorded in a container's annotations
+func gracePeriod(annotations map[string]string) int64 {
+	value, ok := annotations[annotationGracePeriod]
+	if !ok {
+		return defaultGracePeriod
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		log.Printf("ignoring invalid %s annotation %q", annotationGracePeriod, value)
+		return defaultGracePeriod
+	}
+	return seconds
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// defaultSandboxOOMScoreAdj makes the kernel kill the pause process last, as its death takes the pod's namespaces along
+// It matches containerd, leaving -999 and -1000 to Kubelet and critical node daemons
+const defaultSandboxOOMScoreAdj = -998
+
+// applySandboxScheduling sets the OOM score, nice value and CPU shares of a sandbox's pause process
+// Unprivileged users can't lower the OOM score or nice value, so rootless sandboxes keep the runtime's own
+func (s *DemystifyingCRI) applySandboxScheduling(g *generate.Generator) {
+	if !s.rootless || s.sandboxOOMScoreAdj >= 0 {
+		g.SetProcessOOMScoreAdj(s.sandboxOOMScoreAdj)
+	}
+	if s.sandboxNice != 0 && (!s.rootless || s.sandboxNice > 0) {
+		g.Config.Process.Scheduler = &rspec.Scheduler{Policy: rspec.SchedOther, Nice: int32(s.sandboxNice)}
+	}
+	if s.sandboxCPUShares != 0 {
+		g.SetLinuxResourcesCPUShares(s.sandboxCPUShares)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+func TestApplySandboxScheduling(t *testing.T) {
+	tests := []struct {
+		name        string
+		rootless    bool
+		oomScoreAdj int
+		nice        int
+		cpuShares   uint64
+		wantOOM     string // OOM score adjustment of the pause spec, unset if it is left to the runtime
+		wantNice    string // Nice value of the pause spec, unset without a scheduler
+		wantShares  string
+	}{
+		{"default", false, defaultSandboxOOMScoreAdj, 0, 0, "-998", "unset", "unset"},
+		{"configured", false, -500, -5, 256, "-500", "-5", "256"},
+		{"rootless keeps the values of the runtime", true, defaultSandboxOOMScoreAdj, -5, 0, "unset", "unset", "unset"},
+		{"rootless raises values", true, 500, 5, 0, "500", "5", "unset"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &DemystifyingCRI{rootless: test.rootless, sandboxOOMScoreAdj: test.oomScoreAdj, sandboxNice: test.nice, sandboxCPUShares: test.cpuShares}
+			g, err := generate.New("linux")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.applySandboxScheduling(&g)
+
+			oom, nice, shares := "unset", "unset", "unset"
+			if process := g.Config.Process; process.OOMScoreAdj != nil {
+				oom = fmt.Sprint(*process.OOMScoreAdj)
+			}
+			if scheduler := g.Config.Process.Scheduler; scheduler != nil {
+				nice = fmt.Sprint(scheduler.Nice)
+			}
+			if resources := g.Config.Linux.Resources; resources != nil && resources.CPU != nil && resources.CPU.Shares != nil {
+				shares = fmt.Sprint(*resources.CPU.Shares)
+			}
+			if oom != test.wantOOM {
+				t.Errorf("oomScoreAdj = %s, want %s", oom, test.wantOOM)
+			}
+			if nice != test.wantNice {
+				t.Errorf("nice = %s, want %s", nice, test.wantNice)
+			}
+			if shares != test.wantShares {
+				t.Errorf("cpu shares = %s, want %s", shares, test.wantShares)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// loadSeccompProfile reads a seccomp profile in the format of the OCI spec's linux.seccomp section
+func loadSeccompProfile(path string) (*rspec.LinuxSeccomp, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile: %v", err)
+	}
+	var profile rspec.LinuxSeccomp
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse seccomp profile %s: %v", path, err)
+	}
+	return &profile, nil
+}
+
+// noNewPrivilegesPolicies are the values of --no-new-privileges, selecting which containers can't gain privileges
+// requested only follows the security context, non-root also covers containers not running as root and always covers all
+var noNewPrivilegesPolicies = []string{"requested", "non-root", "always"}
+
+// applyNoNewPrivileges sets no_new_privs, which keeps setuid binaries and file capabilities from granting privileges
+// It must be called after the process user was set, as the non-root policy depends on it
+func (s *DemystifyingCRI) applyNoNewPrivileges(g *generate.Generator, securityContext *runtime.LinuxContainerSecurityContext) {
+	noNewPrivs := securityContext.GetNoNewPrivs()
+	switch s.noNewPrivileges {
+	case "non-root":
+		noNewPrivs = noNewPrivs || g.Config.Process.User.UID != 0
+	case "always":
+		noNewPrivs = true
+	}
+	g.SetProcessNoNewPrivileges(noNewPrivs)
+}
+
+// applySecurityProfiles confines a sandbox or container with the seccomp and AppArmor profiles of its security context
+// RuntimeDefault, which is also what a missing profile means, selects the defaults configured for the node
+// Without a configured default RuntimeDefault leaves the process unconfined
+func (s *DemystifyingCRI) applySecurityProfiles(g *generate.Generator, seccomp, apparmor *runtime.SecurityProfile) error {
+	if g.Config.Linux == nil {
+		g.Config.Linux = &rspec.Linux{}
+	}
+
+	switch seccomp.GetProfileType() {
+	case runtime.SecurityProfile_RuntimeDefault:
+		if s.defaultSeccomp != nil {
+			g.Config.Linux.Seccomp = s.defaultSeccomp
+		}
+	case runtime.SecurityProfile_Localhost:
+		profile, err := loadSeccompProfile(seccomp.LocalhostRef)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid localhost seccomp profile: %v", err)
+		}
+		g.Config.Linux.Seccomp = profile
+	case runtime.SecurityProfile_Unconfined:
+		g.Config.Linux.Seccomp = nil
+	}
+
+	switch apparmor.GetProfileType() {
+	case runtime.SecurityProfile_RuntimeDefault:
+		if s.defaultApparmor != "" {
+			g.SetProcessApparmorProfile(s.defaultApparmor)
+		}
+	case runtime.SecurityProfile_Localhost:
+		if apparmor.LocalhostRef == "" {
+			return status.Error(codes.InvalidArgument, "localhost AppArmor profile requires a profile name")
+		}
+		g.SetProcessApparmorProfile(apparmor.LocalhostRef)
+	case runtime.SecurityProfile_Unconfined:
+		g.SetProcessApparmorProfile("")
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// writeSeccompProfile writes a seccomp profile with the given default action and returns its path
+func writeSeccompProfile(t *testing.T, action rspec.LinuxSeccompAction) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "seccomp.json")
+	if err := os.WriteFile(path, []byte(`{"defaultAction": "`+string(action)+`"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestApplySecurityProfiles(t *testing.T) {
+	defaultSeccomp, err := loadSeccompProfile(writeSeccompProfile(t, rspec.ActErrno))
+	if err != nil {
+		t.Fatal(err)
+	}
+	localhost := writeSeccompProfile(t, rspec.ActLog)
+	configured := &DemystifyingCRI{defaultSeccomp: defaultSeccomp, defaultApparmor: "cri-default"}
+
+	tests := []struct {
+		name              string
+		s                 *DemystifyingCRI
+		seccomp, apparmor *runtime.SecurityProfile
+		action            rspec.LinuxSeccompAction // Default action of the applied seccomp profile, empty if unconfined
+		apparmorProfile   string
+	}{
+		{name: "defaults", s: configured, action: rspec.ActErrno, apparmorProfile: "cri-default"},
+		{
+			name:            "runtime default",
+			s:               configured,
+			seccomp:         &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_RuntimeDefault},
+			apparmor:        &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_RuntimeDefault},
+			action:          rspec.ActErrno,
+			apparmorProfile: "cri-default",
+		},
+		{
+			name:            "localhost overrides",
+			s:               configured,
+			seccomp:         &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_Localhost, LocalhostRef: localhost},
+			apparmor:        &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_Localhost, LocalhostRef: "custom"},
+			action:          rspec.ActLog,
+			apparmorProfile: "custom",
+		},
+		{
+			name:     "unconfined overrides",
+			s:        configured,
+			seccomp:  &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_Unconfined},
+			apparmor: &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_Unconfined},
+		},
+		{name: "no defaults configured", s: &DemystifyingCRI{}},
+	}
+	for _, test := range tests {
+		g, err := generate.New("linux")
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.Config.Linux.Seccomp = nil
+		if err := test.s.applySecurityProfiles(&g, test.seccomp, test.apparmor); err != nil {
+			t.Errorf("%s: applySecurityProfiles: %v", test.name, err)
+			continue
+		}
+		var action rspec.LinuxSeccompAction
+		if g.Config.Linux.Seccomp != nil {
+			action = g.Config.Linux.Seccomp.DefaultAction
+		}
+		if action != test.action {
+			t.Errorf("%s: seccomp default action = %q, want %q", test.name, action, test.action)
+		}
+		if profile := g.Config.Process.ApparmorProfile; profile != test.apparmorProfile {
+			t.Errorf("%s: AppArmor profile = %q, want %q", test.name, profile, test.apparmorProfile)
+		}
+	}
+}
+
+func TestApplySecurityProfilesRejectsInvalidLocalhost(t *testing.T) {
+	s := &DemystifyingCRI{}
+	tests := []struct {
+		seccomp, apparmor *runtime.SecurityProfile
+	}{
+		{seccomp: &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_Localhost, LocalhostRef: filepath.Join(t.TempDir(), "missing.json")}},
+		{apparmor: &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_Localhost}},
+	}
+	for _, test := range tests {
+		g, err := generate.New("linux")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.applySecurityProfiles(&g, test.seccomp, test.apparmor); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("applySecurityProfiles(%v, %v) = %v, want InvalidArgument", test.seccomp, test.apparmor, err)
+		}
+	}
+}
+
+func TestNoNewPrivilegesInConfig(t *testing.T) {
+	tests := []struct {
+		policy          string
+		securityContext *runtime.LinuxContainerSecurityContext
+		want            bool
+	}{
+		{"requested", nil, false},
+		{"requested", &runtime.LinuxContainerSecurityContext{NoNewPrivs: true}, true},
+		{"requested", &runtime.LinuxContainerSecurityContext{RunAsUser: &runtime.Int64Value{Value: 1000}}, false},
+		{"non-root", &runtime.LinuxContainerSecurityContext{RunAsUser: &runtime.Int64Value{Value: 1000}}, true},
+		{"non-root", &runtime.LinuxContainerSecurityContext{RunAsUser: &runtime.Int64Value{Value: 0}}, false},
+		{"always", nil, true},
+	}
+	for i, test := range tests {
+		s, _ := newTestRuntime(t)
+		s.noNewPrivileges = test.policy
+		resp, err := s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+			PodSandboxId: "sandbox",
+			Config: &runtime.ContainerConfig{
+				Metadata: &runtime.ContainerMetadata{Name: fmt.Sprintf("app-%d", i)},
+				Image:    &runtime.ImageSpec{Image: testImage},
+				Linux:    &runtime.LinuxContainerConfig{SecurityContext: test.securityContext},
+			},
+		})
+		if err != nil {
+			t.Fatalf("CreateContainer: %v", err)
+		}
+		if got := containerSpec(t, s, resp.ContainerId).Process.NoNewPrivileges; got != test.want {
+			t.Errorf("noNewPrivileges with policy %s and %v = %v, want %v", test.policy, test.securityContext, got, test.want)
+		}
+	}
+}
+
+func TestCreateContainerSetsSELinuxLabels(t *testing.T) {
+	tests := []struct {
+		name       string
+		selinux    bool // Whether SELinux is enabled on the node
+		options    *runtime.SELinuxOption
+		process    string
+		mountLabel string
+	}{
+		{"all options", true, &runtime.SELinuxOption{User: "user_u", Role: "user_r", Type: "spc_t", Level: "s0:c1,c2"}, "user_u:user_r:spc_t:s0:c1,c2", "system_u:object_r:container_file_t:s0:c1,c2"},
+		{"level only", true, &runtime.SELinuxOption{Level: "s0:c3,c4"}, "system_u:system_r:container_t:s0:c3,c4", "system_u:object_r:container_file_t:s0:c3,c4"},
+		{"no options", true, nil, "", ""},
+		{"SELinux disabled", false, &runtime.SELinuxOption{Level: "s0:c3,c4"}, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestRuntime(t)
+			s.selinux = test.selinux
+			resp, err := s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+				PodSandboxId: "sandbox",
+				Config: &runtime.ContainerConfig{
+					Metadata: &runtime.ContainerMetadata{Name: "app"},
+					Image:    &runtime.ImageSpec{Image: testImage},
+					Linux: &runtime.LinuxContainerConfig{SecurityContext: &runtime.LinuxContainerSecurityContext{
+						SelinuxOptions: test.options,
+					}},
+				},
+			})
+			if err != nil {
+				t.Fatalf("CreateContainer: %v", err)
+			}
+
+			spec := containerSpec(t, s, resp.ContainerId)
+			if spec.Process.SelinuxLabel != test.process {
+				t.Errorf("process label = %q, want %q", spec.Process.SelinuxLabel, test.process)
+			}
+			if spec.Linux.MountLabel != test.mountLabel {
+				t.Errorf("mount label = %q, want %q", spec.Linux.MountLabel, test.mountLabel)
+			}
+		})
+	}
+}
+
+func TestPauseSpecCarriesSandboxProfiles(t *testing.T) {
+	localhost := writeSeccompProfile(t, rspec.ActLog)
+	tests := []struct {
+		name            string
+		sandboxApparmor string
+		securityContext *runtime.LinuxSandboxSecurityContext
+		action          rspec.LinuxSeccompAction // Default action of the applied seccomp profile
+		blocksMount     bool                     // Whether the profile is the built-in one of pause processes
+		apparmorProfile string
+	}{
+		{name: "defaults of pause processes", sandboxApparmor: "pause-profile", action: rspec.ActAllow, blocksMount: true, apparmorProfile: "pause-profile"},
+		{name: "AppArmor default of containers", action: rspec.ActAllow, blocksMount: true, apparmorProfile: "cri-default"},
+		{name: "unconfined AppArmor", sandboxApparmor: unconfinedProfile, action: rspec.ActAllow, blocksMount: true},
+		{
+			name:            "profiles of the pod",
+			sandboxApparmor: "pause-profile",
+			securityContext: &runtime.LinuxSandboxSecurityContext{
+				Seccomp:  &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_Localhost, LocalhostRef: localhost},
+				Apparmor: &runtime.SecurityProfile{ProfileType: runtime.SecurityProfile_Localhost, LocalhostRef: "pod-profile"},
+			},
+			action:          rspec.ActLog,
+			apparmorProfile: "pod-profile",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestRuntime(t)
+			enableTestSandboxes(s)
+			s.defaultApparmor = "cri-default"
+			s.sandboxSeccomp = defaultPauseSeccomp()
+			s.sandboxApparmor = test.sandboxApparmor
+
+			config := sandboxConfig("pod-a")
+			config.Linux = &runtime.LinuxPodSandboxConfig{SecurityContext: test.securityContext}
+			resp, err := s.RunPodSandbox(context.Background(), &runtime.RunPodSandboxRequest{Config: config})
+			if err != nil {
+				t.Fatalf("RunPodSandbox: %v", err)
+			}
+
+			spec := containerSpec(t, s, resp.PodSandboxId)
+			if spec.Linux.Seccomp == nil || spec.Linux.Seccomp.DefaultAction != test.action {
+				t.Fatalf("seccomp profile of the pause spec = %+v, want default action %q", spec.Linux.Seccomp, test.action)
+			}
+			blocksMount := len(spec.Linux.Seccomp.Syscalls) > 0 && slices.Contains(spec.Linux.Seccomp.Syscalls[0].Names, "mount") &&
+				spec.Linux.Seccomp.Syscalls[0].Action == rspec.ActErrno
+			if blocksMount != test.blocksMount {
+				t.Errorf("pause spec blocks mount = %v, want %v", blocksMount, test.blocksMount)
+			}
+			if spec.Process.ApparmorProfile != test.apparmorProfile {
+				t.Errorf("AppArmor profile of the pause spec = %q, want %q", spec.Process.ApparmorProfile, test.apparmorProfile)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// specStagesFile is where the stages of a container's OCI spec are kept in its bundle, next to config.json
+const specStagesFile = "spec-stages.json"
+
+// specStage is what one step of CreateContainer changed in the OCI spec of a container
+// Changes are lines like "+ process.env[1]: ..." for added, "- ..." for removed and "~ ...: old -> new" for changed values
+type specStage struct {
+	Stage   string   `json:"stage"`
+	Changes []string `json:"changes"`
+}
+
+// specStages records how CreateContainer transforms the default spec of a bundle, step by step
+// Every snapshot is flattened into JSON paths and compared with the previous one, with env values redacted
+type specStages struct {
+	redact   func(*rspec.Spec)
+	previous map[string]string
+	stages   []specStage
+	err      error // First error of flattening a snapshot, returned by save
+}
+
+// newSpecStages starts recording at the default spec of a bundle
+func (s *DemystifyingCRI) newSpecStages(spec *rspec.Spec) *specStages {
+	stages := &specStages{redact: s.redactSpec}
+	stages.previous, stages.err = stages.flatten(spec)
+	return stages
+}
+
+// record adds a stage with the changes since the previous stage
+func (stages *specStages) record(name string, spec *rspec.Spec) {
+	if stages.err != nil {
+		return
+	}
+	current, err := stages.flatten(spec)
+	if err != nil {
+		stages.err = err
+		return
+	}
+	stages.stages = append(stages.stages, specStage{Stage: name, Changes: diffSpecs(stages.previous, current)})
+	stages.previous = current
+}
+
+// recordImageDefaults adds a stage with the image's process defaults alone, as applyProcessConfig applies them together with the CRI config
+// It is skipped if the image's defaults can't be applied on their own, e.g. because the CRI config replaces an unknown user of the image
+func (stages *specStages) recordImageDefaults(spec *rspec.Spec, rootfs string, image *ociImageConfig) {
+	defaults, err := copySpec(spec)
+	if err != nil {
+		return
+	}
+	g := generate.NewFromSpec(defaults)
+	if err := applyProcessConfig(&g, rootfs, image, &runtime.ContainerConfig{}); err != nil {
+		return
+	}
+	stages.record("image", g.Config)
+}
+
+// save writes the recorded stages into the bundle, where containerInfo reads them from
+func (stages *specStages) save(bundlePath string) error {
+	if stages.err != nil {
+		return fmt.Errorf("failed to record OCI spec stages: %v", stages.err)
+	}
+	data, err := json.Marshal(stages.stages)
+	if err != nil {
+		return fmt.Errorf("failed to encode OCI spec stages: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(bundlePath, specStagesFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to save OCI spec stages: %v", err)
+	}
+	return nil
+}
+
+// flatten returns the redacted values of a spec by JSON path, e.g. linux.namespaces[0].type
+func (stages *specStages) flatten(spec *rspec.Spec) (map[string]string, error) {
+	redacted, err := copySpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	stages.redact(redacted)
+
+	data, err := json.Marshal(redacted)
+	if err != nil {
+		return nil, err
+	}
+	// Numbers are kept as they are, limits like the maximum int64 don't survive a float64
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var tree interface{}
+	if err := decoder.Decode(&tree); err != nil {
+		return nil, err
+	}
+
+	flat := make(map[string]string)
+	if err := flattenJSON(flat, "", tree); err != nil {
+		return nil, err
+	}
+	return flat, nil
+}
+
+// flattenJSON stores the leaves of a decoded JSON value by path, empty objects and arrays are leaves as well
+func flattenJSON(flat map[string]string, path string, value interface{}) error {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if len(value) == 0 {
+			flat[path] = "{}"
+		}
+		for key, child := range value {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			if err := flattenJSON(flat, childPath, child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if len(value) == 0 {
+			flat[path] = "[]"
+		}
+		for i, child := range value {
+			if err := flattenJSON(flat, fmt.Sprintf("%s[%d]", path, i), child); err != nil {
+				return err
+			}
+		}
+	default:
+		info := make(map[string]string)
+		if err := setInfoJSON(info, path, value); err != nil {
+			return err
+		}
+		flat[path] = info[path]
+	}
+	return nil
+}
+
+// diffSpecs returns the changes between two flattened specs, sorted by path
+func diffSpecs(before, after map[string]string) []string {
+	type change struct{ path, line string }
+	var changes []change
+	for path, value := range after {
+		old, existed := before[path]
+		switch {
+		case !existed:
+			changes = append(changes, change{path, fmt.Sprintf("+ %s: %s", path, value)})
+		case old != value:
+			changes = append(changes, change{path, fmt.Sprintf("~ %s: %s -> %s", path, old, value)})
+		}
+	}
+	for path, value := range before {
+		if _, exists := after[path]; !exists {
+			changes = append(changes, change{path, fmt.Sprintf("- %s: %s", path, value)})
+		}
+	}
+	slices.SortFunc(changes, func(a, b change) int { return strings.Compare(a.path, b.path) })
+
+	lines := make([]string, 0, len(changes))
+	for _, change := range changes {
+		lines = append(lines, change.line)
+	}
+	return lines
+}
+
+// copySpec returns a deep copy of an OCI spec
+func copySpec(spec *rspec.Spec) (*rspec.Spec, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	var copied rspec.Spec
+	if err := json.Unmarshal(data, &copied); err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
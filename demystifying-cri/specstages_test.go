@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestContainerStatusReportsSpecStages(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	s.redactedEnv = []string{"*TOKEN*"}
+	ctx := context.Background()
+
+	resp, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+		PodSandboxId: "sandbox",
+		Config: &runtime.ContainerConfig{
+			Metadata: &runtime.ContainerMetadata{Name: "app"},
+			Image:    &runtime.ImageSpec{Image: testImage},
+			Envs:     []*runtime.KeyValue{{Key: "MODE", Value: "demo"}, {Key: "API_TOKEN", Value: "secret"}},
+			Linux:    &runtime.LinuxContainerConfig{Resources: &runtime.LinuxContainerResources{MemoryLimitInBytes: 64 << 20}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	status, err := s.ContainerStatus(ctx, &runtime.ContainerStatusRequest{ContainerId: resp.ContainerId, Verbose: true})
+	if err != nil {
+		t.Fatalf("ContainerStatus: %v", err)
+	}
+	var stages []specStage
+	if err := json.Unmarshal([]byte(status.Info["specStages"]), &stages); err != nil {
+		t.Fatalf("specStages in verbose info %q: %v", status.Info["specStages"], err)
+	}
+
+	var names []string
+	changes := make(map[string]string)
+	for _, stage := range stages {
+		names = append(names, stage.Stage)
+		changes[stage.Stage] = strings.Join(stage.Changes, "\n")
+	}
+	if want := []string{"image", "cri", "template", "resources", "security", "namespaces"}; !slices.Equal(names, want) {
+		t.Fatalf("stages = %q, want %q", names, want)
+	}
+	if !strings.Contains(changes["namespaces"], "/ns/net") {
+		t.Errorf("changes of the namespaces stage = %q, want the network namespace of the sandbox", changes["namespaces"])
+	}
+	if !strings.Contains(changes["cri"], `"MODE=demo"`) || !strings.Contains(changes["cri"], `"API_TOKEN=<redacted>"`) {
+		t.Errorf("changes of the cri stage = %q, want the env of the CRI config with the token redacted", changes["cri"])
+	}
+	if strings.Contains(status.Info["specStages"], "secret") {
+		t.Errorf("spec stages %q reveal the redacted token", status.Info["specStages"])
+	}
+	if !strings.Contains(changes["resources"], "linux.resources.memory.limit: 67108864") {
+		t.Errorf("changes of the resources stage = %q, want the memory limit", changes["resources"])
+	}
+	if changes["template"] != "" {
+		t.Errorf("changes of the template stage without a template = %q, want none", changes["template"])
+	}
+}
+
+func TestDiffSpecs(t *testing.T) {
+	before := map[string]string{"process.cwd": `"/"`, "process.env[0]": `"A=1"`, "hostname": `"old"`}
+	after := map[string]string{"process.cwd": `"/srv"`, "process.env[0]": `"A=1"`, "process.env[1]": `"B=2"`}
+	want := []string{
+		`- hostname: "old"`,
+		`~ process.cwd: "/" -> "/srv"`,
+		`+ process.env[1]: "B=2"`,
+	}
+	if got := diffSpecs(before, after); !slices.Equal(got, want) {
+		t.Errorf("diffSpecs = %q, want %q", got, want)
+	}
+}
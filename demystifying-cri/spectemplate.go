@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// loadSpecTemplate reads and validates the OCI spec every container's spec is based on
+// The root filesystem and the process come from the image, so a template setting them would be silently overridden
+func loadSpecTemplate(path string) (*rspec.Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec template: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var template rspec.Spec
+	if err := decoder.Decode(&template); err != nil {
+		return nil, fmt.Errorf("failed to parse spec template %s: %v", path, err)
+	}
+
+	switch {
+	case template.Version == "":
+		return nil, fmt.Errorf("spec template %s lacks ociVersion", path)
+	case template.Process == nil || template.Linux == nil:
+		return nil, fmt.Errorf("spec template %s lacks process or linux", path)
+	case template.Root != nil:
+		return nil, fmt.Errorf("spec template %s must not set root, it is the rootfs of the image", path)
+	case len(template.Process.Args) > 0 || template.Process.Cwd != "":
+		return nil, fmt.Errorf("spec template %s must not set process.args or process.cwd, they come from the image", path)
+	}
+	for _, mount := range template.Mounts {
+		if !filepath.IsAbs(mount.Destination) {
+			return nil, fmt.Errorf("spec template %s mounts to relative path %q", path, mount.Destination)
+		}
+	}
+	for _, maskedPath := range append(append([]string{}, template.Linux.MaskedPaths...), template.Linux.ReadonlyPaths...) {
+		if !filepath.IsAbs(maskedPath) {
+			return nil, fmt.Errorf("spec template %s masks relative path %q", path, maskedPath)
+		}
+	}
+	for _, rlimit := range template.Process.Rlimits {
+		if !strings.HasPrefix(rlimit.Type, "RLIMIT_") || rlimit.Soft > rlimit.Hard {
+			return nil, fmt.Errorf("spec template %s has invalid rlimit %s", path, rlimit.Type)
+		}
+	}
+	for _, env := range template.Process.Env {
+		if name, _, found := strings.Cut(env, "="); !found || name == "" {
+			return nil, fmt.Errorf("spec template %s has invalid env %q", path, env)
+		}
+	}
+	return &template, nil
+}
+
+// applySpecTemplate replaces the spec of a container with the template, keeping the rootfs and what the image's process needs
+// It must be called after the process was configured, so the CRI specific settings applied afterwards override the template
+func (s *DemystifyingCRI) applySpecTemplate(g *generate.Generator) error {
+	if s.specTemplate == nil {
+		return nil
+	}
+
+	// The template is shared by all containers, so every container works on a deep copy
+	spec, err := copySpec(s.specTemplate)
+	if err != nil {
+		return fmt.Errorf("failed to copy spec template: %v", err)
+	}
+
+	process := g.Config.Process
+	spec.Root = g.Config.Root
+	spec.Process.Args = process.Args
+	spec.Process.Cwd = process.Cwd
+	umask := spec.Process.User.Umask
+	spec.Process.User = process.User
+	if spec.Process.User.Umask == nil {
+		spec.Process.User.Umask = umask
+	}
+	spec.Process.Terminal = process.Terminal
+
+	// Variables of the image and the CRI config win over the defaults of the template
+	env := process.Env
+	for _, kv := range spec.Process.Env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !hasEnv(env, name) {
+			env = append(env, kv)
+		}
+	}
+	spec.Process.Env = env
+
+	g.Config = spec
+	return nil
+}
+
+// hasEnv reports whether env sets the variable name
+func hasEnv(env []string, name string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, name+"=") {
+			return true
+		}
+	}
+	return false
+}
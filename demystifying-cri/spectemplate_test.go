@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// writeSpecTemplate writes a spec template with the given process and linux sections and returns its path
+func writeSpecTemplate(t *testing.T, sections string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "template.json")
+	if err := os.WriteFile(path, []byte(`{"ociVersion": "1.0.2", `+sections+`}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSpecTemplateDefaultsAppearInSpec(t *testing.T) {
+	template, err := loadSpecTemplate(writeSpecTemplate(t, `
+		"process": {
+			"user": {"uid": 0, "gid": 0},
+			"env": ["TEMPLATE=1", "MODE=template"],
+			"rlimits": [{"type": "RLIMIT_NOFILE", "soft": 4096, "hard": 4096}]
+		},
+		"mounts": [{"destination": "/run/template", "type": "tmpfs", "source": "tmpfs"}],
+		"linux": {"maskedPaths": ["/proc/template"]}`))
+	if err != nil {
+		t.Fatalf("loadSpecTemplate: %v", err)
+	}
+
+	s, _ := newTestRuntime(t)
+	s.specTemplate = template
+	resp, err := s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+		PodSandboxId: "sandbox",
+		Config: &runtime.ContainerConfig{
+			Metadata: &runtime.ContainerMetadata{Name: "app"},
+			Image:    &runtime.ImageSpec{Image: testImage},
+			Envs:     []*runtime.KeyValue{{Key: "MODE", Value: "cri"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+
+	spec := containerSpec(t, s, resp.ContainerId)
+	if !slices.Contains(spec.Process.Env, "TEMPLATE=1") {
+		t.Errorf("env = %q, want TEMPLATE=1 of the template", spec.Process.Env)
+	}
+	if !slices.Contains(spec.Process.Env, "MODE=cri") || slices.Contains(spec.Process.Env, "MODE=template") {
+		t.Errorf("env = %q, want MODE of the CRI config to override the template", spec.Process.Env)
+	}
+	if !slices.ContainsFunc(spec.Process.Rlimits, func(r rspec.POSIXRlimit) bool { return r.Type == "RLIMIT_NOFILE" && r.Hard == 4096 }) {
+		t.Errorf("rlimits = %+v, want RLIMIT_NOFILE of the template", spec.Process.Rlimits)
+	}
+	if !slices.ContainsFunc(spec.Mounts, func(m rspec.Mount) bool { return m.Destination == "/run/template" }) {
+		t.Errorf("mounts = %+v, want /run/template of the template", spec.Mounts)
+	}
+	if !slices.Contains(spec.Linux.MaskedPaths, "/proc/template") {
+		t.Errorf("masked paths = %q, want /proc/template of the template", spec.Linux.MaskedPaths)
+	}
+
+	// The rootfs and process of the image are kept
+	if spec.Root == nil || spec.Root.Path == "" || !slices.Equal(spec.Process.Args, []string{"sleep", "1000"}) {
+		t.Errorf("root = %+v and args = %q, want the rootfs and command of the image", spec.Root, spec.Process.Args)
+	}
+
+	// Containers don't share the template
+	if slices.Contains(template.Process.Env, "MODE=cri") {
+		t.Errorf("template env = %q was modified by a container", template.Process.Env)
+	}
+}
+
+func TestLoadSpecTemplateRejectsInvalidTemplates(t *testing.T) {
+	tests := []struct {
+		sections string
+		want     string // Part of the error
+	}{
+		{`"linux": {}`, "lacks process or linux"},
+		{`"process": {"user": {}}, "linux": {}, "root": {"path": "rootfs"}`, "must not set root"},
+		{`"process": {"user": {}, "args": ["sh"]}, "linux": {}`, "must not set process.args"},
+		{`"process": {"user": {}}, "linux": {}, "mounts": [{"destination": "run"}]`, "relative path"},
+		{`"process": {"user": {}}, "linux": {"maskedPaths": ["proc/kcore"]}`, "relative path"},
+		{`"process": {"user": {}, "rlimits": [{"type": "RLIMIT_NOFILE", "soft": 2, "hard": 1}]}, "linux": {}`, "invalid rlimit"},
+		{`"process": {"user": {}, "env": ["NOVALUE"]}, "linux": {}`, "invalid env"},
+		{`"process": {"user": {}}, "linux": {}, "unknown": true`, "failed to parse"},
+	}
+	for _, test := range tests {
+		if _, err := loadSpecTemplate(writeSpecTemplate(t, test.sections)); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("loadSpecTemplate(%s) = %v, want an error containing %q", test.sections, err, test.want)
+		}
+	}
+}
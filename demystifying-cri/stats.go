@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// statsEpoch anchors the timestamps of stats, see statsTimestamp
+var statsEpoch = time.Now()
+
+// statsTimestamp converts a time into the Unix nanoseconds reported in stats
+// The wall clock is read only once, the offset from it is measured with the monotonic clock,
+// so successive samples never go back in time when the wall clock is adjusted and CPU rates never see a negative interval
+func statsTimestamp(t time.Time) int64 {
+	return statsEpoch.UnixNano() + int64(t.Sub(statsEpoch))
+}
+
+// ContainerStats returns the most recent sample of the stats collector together with the writable layer usage
+// A running container which was started after the last sample is sampled right away, so its stats are never missing
+func (s *DemystifyingCRI) ContainerStats(ctx context.Context, req *runtime.ContainerStatsRequest) (*runtime.ContainerStatsResponse, error) {
+	s.mu.RLock()
+	container, exists := s.containers[req.ContainerId]
+	var logPath string
+	var sampleable bool
+	if exists {
+		logPath = container.logPath
+		sampleable = container.State == runtime.ContainerState_CONTAINER_RUNNING && container.cgroupsPath != ""
+	}
+	s.mu.RUnlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "container %s does not exist", req.ContainerId)
+	}
+
+	s.statsMu.RLock()
+	stats, sampled := s.stats[req.ContainerId]
+	s.statsMu.RUnlock()
+	if !sampled {
+		if !sampleable {
+			// Containers which aren't running have no usage to report, like rootless ones without a cgroup
+			return &runtime.ContainerStatsResponse{}, nil
+		}
+		stats = s.sampleContainer(container, nil)
+		s.statsMu.Lock()
+		s.stats[req.ContainerId] = stats
+		s.statsMu.Unlock()
+	}
+
+	stats, err := s.withWritableLayer(ctx, stats, req.ContainerId, logPath)
+	if err != nil {
+		return nil, err
+	}
+	return &runtime.ContainerStatsResponse{Stats: stats}, nil
+}
+
+// ListContainerStats returns the cached stats of all containers matching the filter
+func (s *DemystifyingCRI) ListContainerStats(ctx context.Context, req *runtime.ListContainerStatsRequest) (*runtime.ListContainerStatsResponse, error) {
+	filter := req.GetFilter()
+
+	type sampledContainer struct {
+		stats   *runtime.ContainerStats
+		logPath string
+	}
+	var sampled []sampledContainer
+
+	s.mu.RLock()
+	s.statsMu.RLock()
+	for id, container := range s.containers {
+		if filter.GetId() != "" && filter.GetId() != id {
+			continue
+		}
+		if filter.GetPodSandboxId() != "" && filter.GetPodSandboxId() != container.PodSandboxId {
+			continue
+		}
+		if !matchLabels(container.Labels, filter.GetLabelSelector()) {
+			continue
+		}
+		if stats, exists := s.stats[id]; exists {
+			sampled = append(sampled, sampledContainer{stats: stats, logPath: container.logPath})
+		}
+	}
+	s.statsMu.RUnlock()
+	s.mu.RUnlock()
+
+	// The bundles are walked without holding the locks, as a walk may take a while
+	list := make([]*runtime.ContainerStats, 0, len(sampled))
+	for _, container := range sampled {
+		stats, err := s.withWritableLayer(ctx, container.stats, container.stats.Attributes.Id, container.logPath)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, stats)
+	}
+
+	return &runtime.ListContainerStatsResponse{Stats: list}, nil
+}
+
+// collectStats periodically samples the cgroups of all running containers into the stats cache
+// Serving stats from the cache bounds their staleness by interval without reading cgroups on every call
+func (s *DemystifyingCRI) collectStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.sampleAll()
+	}
+}
+
+// sampleAll replaces the stats cache with a fresh sample of all running containers
+func (s *DemystifyingCRI) sampleAll() {
+	s.mu.RLock()
+	var running []*containerRecord
+	for _, container := range s.containers {
+		// Rootless containers have no cgroup of their own to sample
+		if container.State == runtime.ContainerState_CONTAINER_RUNNING && container.cgroupsPath != "" {
+			running = append(running, container)
+		}
+	}
+	s.mu.RUnlock()
+
+	samples := make(map[string]*runtime.ContainerStats, len(running))
+	for _, container := range running {
+		s.statsMu.RLock()
+		previous := s.stats[container.Id]
+		s.statsMu.RUnlock()
+		samples[container.Id] = s.sampleContainer(container, previous)
+	}
+
+	// Replacing the whole cache evicts removed and exited containers
+	s.statsMu.Lock()
+	s.stats = samples
+	s.statsMu.Unlock()
+}
+
+// sampleContainer reads the current CPU and memory usage of a container from its cgroup
+// The previous sample is used to calculate the CPU usage rate
+func (s *DemystifyingCRI) sampleContainer(container *containerRecord, previous *runtime.ContainerStats) *runtime.ContainerStats {
+	now := statsTimestamp(time.Now())
+	stats := &runtime.ContainerStats{
+		Attributes: &runtime.ContainerAttributes{
+			Id:          container.Id,
+			Metadata:    container.Metadata,
+			Labels:      container.Labels,
+			Annotations: container.Annotations,
+		},
+		Cpu:    &runtime.CpuUsage{Timestamp: now},
+		Memory: &runtime.MemoryUsage{Timestamp: now},
+	}
+
+	var cpuUsage uint64
+	var err error
+	if s.cgroupV2 {
+		var cpuStat map[string]uint64
+		cpuStat, err = readCgroupKeyValues(filepath.Join(s.cgroupDir(container.cgroupsPath, "cpu"), "cpu.stat"))
+		cpuUsage = cpuStat["usage_usec"] * uint64(time.Microsecond)
+	} else {
+		cpuUsage, err = readCgroupUint(filepath.Join(s.cgroupDir(container.cgroupsPath, "cpuacct"), "cpuacct.usage"))
+	}
+	if err == nil {
+		stats.Cpu.UsageCoreNanoSeconds = &runtime.UInt64Value{Value: cpuUsage}
+		if prev := previous.GetCpu(); prev.GetUsageCoreNanoSeconds() != nil && now > prev.Timestamp && cpuUsage >= prev.UsageCoreNanoSeconds.Value {
+			nanoCores := (cpuUsage - prev.UsageCoreNanoSeconds.Value) * uint64(time.Second) / uint64(now-prev.Timestamp)
+			stats.Cpu.UsageNanoCores = &runtime.UInt64Value{Value: nanoCores}
+		}
+	}
+
+	memoryDir := s.cgroupDir(container.cgroupsPath, "memory")
+	usageFile, statPrefix := "memory.usage_in_bytes", "total_"
+	if s.cgroupV2 {
+		usageFile, statPrefix = "memory.current", ""
+	}
+	usage, err := readCgroupUint(filepath.Join(memoryDir, usageFile))
+	if err != nil {
+		return stats
+	}
+	memoryStat, err := readCgroupKeyValues(filepath.Join(memoryDir, "memory.stat"))
+	if err != nil {
+		return stats
+	}
+
+	// The working set excludes inactive page cache the kernel can reclaim, like Kubelet expects
+	workingSet := usage
+	if inactive := memoryStat[statPrefix+"inactive_file"]; inactive < workingSet {
+		workingSet -= inactive
+	} else {
+		workingSet = 0
+	}
+	rss := memoryStat["total_rss"]
+	if s.cgroupV2 {
+		rss = memoryStat["anon"]
+	}
+
+	stats.Memory.UsageBytes = &runtime.UInt64Value{Value: usage}
+	stats.Memory.WorkingSetBytes = &runtime.UInt64Value{Value: workingSet}
+	stats.Memory.RssBytes = &runtime.UInt64Value{Value: rss}
+	stats.Memory.PageFaults = &runtime.UInt64Value{Value: memoryStat[statPrefix+"pgfault"]}
+	stats.Memory.MajorPageFaults = &runtime.UInt64Value{Value: memoryStat[statPrefix+"pgmajfault"]}
+
+	return stats
+}
+
+// matchLabels reports whether all labels of the selector are present with the same value
+func matchLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+// startTestContainers creates and starts a container for each name and returns their IDs
+func startTestContainers(t *testing.T, s *DemystifyingCRI, names ...string) []string {
+	t.Helper()
+	var ids []string
+	for _, name := range names {
+		id := createTestContainer(t, s, name)
+		if _, err := s.StartContainer(context.Background(), &runtime.StartContainerRequest{ContainerId: id}); err != nil {
+			t.Fatalf("StartContainer: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// cachedStats returns the sample of a container in the stats cache
+func cachedStats(s *DemystifyingCRI, containerID string) (*runtime.ContainerStats, bool) {
+	s.statsMu.RLock()
+	defer s.statsMu.RUnlock()
+	stats, exists := s.stats[containerID]
+	return stats, exists
+}
+
+func TestContainerStatsSamplesUncachedContainer(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	ctx := context.Background()
+	createdID := createTestContainer(t, s, "created")
+	runningID := startTestContainers(t, s, "app")[0]
+
+	resp, err := s.ContainerStats(ctx, &runtime.ContainerStatsRequest{ContainerId: runningID})
+	if err != nil {
+		t.Fatalf("ContainerStats: %v", err)
+	}
+	if resp.Stats.GetAttributes().GetId() != runningID || resp.Stats.GetCpu().GetTimestamp() == 0 {
+		t.Fatalf("ContainerStats of an uncached container = %v, want a fresh sample", resp.Stats)
+	}
+	if _, cached := cachedStats(s, runningID); !cached {
+		t.Errorf("sample taken by ContainerStats was not cached")
+	}
+
+	resp, err = s.ContainerStats(ctx, &runtime.ContainerStatsRequest{ContainerId: createdID})
+	if err != nil {
+		t.Fatalf("ContainerStats: %v", err)
+	}
+	if resp.Stats != nil {
+		t.Errorf("ContainerStats of a created container = %v, want no stats", resp.Stats)
+	}
+}
+
+func TestSampleAllEvictsContainers(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	ctx := context.Background()
+	ids := startTestContainers(t, s, "running", "exited", "removed")
+	runningID, exitedID, removedID := ids[0], ids[1], ids[2]
+
+	s.sampleAll()
+	for _, id := range ids {
+		if _, cached := cachedStats(s, id); !cached {
+			t.Fatalf("running container %s was not sampled", id)
+		}
+	}
+
+	for _, id := range []string{exitedID, removedID} {
+		if _, err := s.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: id, Timeout: 10}); err != nil {
+			t.Fatalf("StopContainer: %v", err)
+		}
+	}
+	if _, err := s.RemoveContainer(ctx, &runtime.RemoveContainerRequest{ContainerId: removedID}); err != nil {
+		t.Fatalf("RemoveContainer: %v", err)
+	}
+
+	s.sampleAll()
+	if _, cached := cachedStats(s, runningID); !cached {
+		t.Errorf("running container was evicted")
+	}
+	for _, id := range []string{exitedID, removedID} {
+		if _, cached := cachedStats(s, id); cached {
+			t.Errorf("container %s is still cached after it stopped running", id)
+		}
+	}
+}
+
+func TestCollectStatsUsesInterval(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	containerID := startTestContainers(t, s, "app")[0]
+
+	// The default interval is 10s, so two samples within a few seconds are only taken with the configured one
+	go s.collectStats(10 * time.Millisecond)
+
+	var first int64
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if stats, cached := cachedStats(s, containerID); cached {
+			if first == 0 {
+				first = stats.Cpu.Timestamp
+			} else if stats.Cpu.Timestamp > first {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("collectStats with an interval of 10ms did not sample the container twice within 5s")
+}
+
+func TestStatsTimestampsIncrease(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	containerID := startTestContainers(t, s, "app")[0]
+
+	var previous *runtime.ContainerStats
+	for i := 0; i < 5; i++ {
+		s.sampleAll()
+		resp, err := s.ContainerStats(context.Background(), &runtime.ContainerStatsRequest{ContainerId: containerID})
+		if err != nil {
+			t.Fatalf("ContainerStats: %v", err)
+		}
+		stats := resp.Stats
+		if stats.GetCpu().GetTimestamp() != stats.GetMemory().GetTimestamp() {
+			t.Errorf("cpu timestamp %d and memory timestamp %d of one sample differ", stats.GetCpu().GetTimestamp(), stats.GetMemory().GetTimestamp())
+		}
+		if previous != nil && stats.GetCpu().GetTimestamp() <= previous.GetCpu().GetTimestamp() {
+			t.Errorf("sample %d has timestamp %d, want after the previous %d", i, stats.GetCpu().GetTimestamp(), previous.GetCpu().GetTimestamp())
+		}
+		previous = stats
+	}
+
+	// Timestamps are measured from the wall clock at startup, so they still read as Unix time
+	if offset := time.Since(time.Unix(0, previous.GetCpu().GetTimestamp())); offset < 0 || offset > time.Minute {
+		t.Errorf("timestamp %d is %v away from now, want Unix nanoseconds", previous.GetCpu().GetTimestamp(), offset)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+
+	runtime "demystifying-cri/proto"
+)
+
+// containerStdio wires up the stdin and terminal of a container as requested by its config
+type containerStdio struct {
+	consoleSocket *net.UnixListener // Socket runc sends the terminal master to, only set for TTY containers
+	consoles      chan consoleResult
+	stdinReader   *os.File // Container side of the stdin pipe, handed to runc
+
+	console  *os.File       // Master side of the container's terminal
+	stdin    io.WriteCloser // Host side of the container's stdin, kept open for attaching
+	attached atomic.Bool    // Whether a client is attached, see attachContainer
+
+	stdinOnce   bool        // Whether stdin is closed once the first attached client detached
+	stdinClosed atomic.Bool // Whether stdin was closed because of stdinOnce
+}
+
+type consoleResult struct {
+	console *os.File
+	err     error
+}
+
+// newContainerStdio prepares a console socket for TTY containers and a stdin pipe for interactive ones
+// Non-interactive containers without a TTY keep running fully detached
+func newContainerStdio(bundle string, config *runtime.ContainerConfig) (*containerStdio, error) {
+	stdio := &containerStdio{stdinOnce: config.Stdin && config.StdinOnce}
+
+	if config.Tty {
+		socketPath := filepath.Join(bundle, "console.sock")
+		os.Remove(socketPath)
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create console socket: %v", err)
+		}
+		stdio.consoleSocket = ln
+		stdio.consoles = make(chan consoleResult, 1)
+		go func() {
+			console, err := receiveConsole(ln)
+			stdio.consoles <- consoleResult{console: console, err: err}
+		}()
+		return stdio, nil
+	}
+
+	if config.Stdin {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdin pipe: %v", err)
+		}
+		stdio.stdinReader = r
+		stdio.stdin = w
+	}
+
+	return stdio, nil
+}
+
+// consoleSocketPath returns where runc has to send the terminal to, empty if the container has none
+func (c *containerStdio) consoleSocketPath() string {
+	if c.consoleSocket == nil {
+		return ""
+	}
+	return c.consoleSocket.Addr().String()
+}
+
+// containerStdin returns what runc should pass on as the container's stdin, nil means /dev/null
+func (c *containerStdio) containerStdin() io.Reader {
+	if c.stdinReader == nil {
+		return nil
+	}
+	return c.stdinReader
+}
+
+// finish collects the terminal from runc and releases everything the host no longer needs
+// If runc failed, all remaining stdio is closed as well
+func (c *containerStdio) finish(runErr error) error {
+	if c.stdinReader != nil {
+		c.stdinReader.Close()
+	}
+
+	if c.consoleSocket != nil {
+		socketPath := c.consoleSocket.Addr().String()
+		if runErr != nil {
+			// Unblock the pending accept as runc will never connect
+			c.consoleSocket.Close()
+		}
+		result := <-c.consoles
+		c.consoleSocket.Close()
+		os.Remove(socketPath)
+		if runErr == nil && result.err != nil {
+			runErr = fmt.Errorf("failed to receive console: %v", result.err)
+		}
+		if result.console != nil {
+			c.console = result.console
+			c.stdin = result.console
+		}
+	}
+
+	if runErr != nil {
+		c.close()
+	}
+	return runErr
+}
+
+// closeStdin signals the end of input to the container, after which no client can write to stdin anymore
+// A terminal is kept open, as closing it would hang up the container, so end of input is sent as ^D instead
+func (c *containerStdio) closeStdin() {
+	if c.stdinClosed.Swap(true) {
+		return
+	}
+	if c.console != nil {
+		c.console.Write([]byte{4})
+	} else if c.stdin != nil {
+		c.stdin.Close()
+	}
+}
+
+// close releases the host side of the container's stdio
+func (c *containerStdio) close() {
+	if c.stdin != nil {
+		c.stdin.Close()
+	}
+	if c.console != nil && c.console != c.stdin {
+		c.console.Close()
+	}
+}
+
+// receiveConsole accepts runc's connection on the console socket and receives the terminal master fd
+func receiveConsole(ln *net.UnixListener) (*os.File, error) {
+	conn, err := ln.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	name := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(name, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, fmt.Errorf("expected a single control message, got %d", len(msgs))
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fds) != 1 {
+		return nil, fmt.Errorf("expected a single file descriptor, got %d", len(fds))
+	}
+
+	// Non-blocking terminals support read deadlines, which is how attached clients detach
+	if err := syscall.SetNonblock(fds[0], true); err != nil {
+		syscall.Close(fds[0])
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fds[0]), string(name[:n])), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestCreateContainerFollowsStdioConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		tty      bool
+		stdin    bool
+		terminal bool // Whether the container gets a terminal
+		open     bool // Whether stdin is kept open for attaching
+	}{
+		{name: "detached"},
+		{name: "stdin", stdin: true, open: true},
+		{name: "tty", tty: true, terminal: true, open: true},
+		{name: "interactive", tty: true, stdin: true, terminal: true, open: true},
+	}
+	for _, test := range tests {
+		s, _ := newTestRuntime(t)
+		resp, err := s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+			PodSandboxId: "sandbox",
+			Config: &runtime.ContainerConfig{
+				Metadata: &runtime.ContainerMetadata{Name: test.name},
+				Image:    &runtime.ImageSpec{Image: testImage},
+				Tty:      test.tty,
+				Stdin:    test.stdin,
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: CreateContainer: %v", test.name, err)
+		}
+
+		if terminal := containerSpec(t, s, resp.ContainerId).Process.Terminal; terminal != test.terminal {
+			t.Errorf("%s: process.terminal = %v, want %v", test.name, terminal, test.terminal)
+		}
+		s.mu.RLock()
+		stdio := s.containers[resp.ContainerId].stdio
+		s.mu.RUnlock()
+		if open := stdio.stdin != nil; open != test.open {
+			t.Errorf("%s: stdin kept open = %v, want %v", test.name, open, test.open)
+		}
+		if console := stdio.console != nil; console != test.terminal {
+			t.Errorf("%s: console received = %v, want %v", test.name, console, test.terminal)
+		}
+	}
+}
+
+func TestAttachStdinOnce(t *testing.T) {
+	for _, stdinOnce := range []bool{true, false} {
+		s, oci := newTestRuntime(t)
+		oci.command = "cat"
+		s.sandboxes["sandbox"].config.LogDirectory = t.TempDir()
+		ctx := context.Background()
+		resp, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+			PodSandboxId: "sandbox",
+			Config: &runtime.ContainerConfig{
+				Metadata:  &runtime.ContainerMetadata{Name: "app"},
+				Image:     &runtime.ImageSpec{Image: testImage},
+				LogPath:   "app/0.log",
+				Stdin:     true,
+				StdinOnce: stdinOnce,
+			},
+		})
+		if err != nil {
+			t.Fatalf("CreateContainer: %v", err)
+		}
+		containerID := resp.ContainerId
+		if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+			t.Fatalf("StartContainer: %v", err)
+		}
+
+		var output bytes.Buffer
+		if err := s.attachContainer(containerID, strings.NewReader("hello\n"), &output, nil); err != nil {
+			t.Fatalf("attachContainer: %v", err)
+		}
+		s.mu.RLock()
+		stdio := s.containers[containerID].stdio
+		s.mu.RUnlock()
+		if closed := stdio.stdinClosed.Load(); closed != stdinOnce {
+			t.Errorf("stdin closed after the first client detached with StdinOnce %v = %v", stdinOnce, closed)
+		}
+
+		if !stdinOnce {
+			// The container keeps its input for the next client
+			time.Sleep(100 * time.Millisecond)
+			if !s.processAlive(containerID) {
+				t.Errorf("container exited after a client detached without StdinOnce")
+			}
+			continue
+		}
+
+		// The client stays attached until the container closed its output, which cat does at the end of its input
+		if output.String() != "hello\n" {
+			t.Errorf("output of the attached client = %q, want its input echoed", output.String())
+		}
+		for deadline := time.Now().Add(5 * time.Second); s.processAlive(containerID); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("container didn't exit at the end of its input")
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Bounds of the interval at which a stopping container is checked for its exit
+const (
+	stopPollMin = 10 * time.Millisecond
+	stopPollMax = 100 * time.Millisecond
+)
+
+// stopKillTimeout bounds how long StopContainer waits for a container to disappear after SIGKILL
+const stopKillTimeout = 10 * time.Second
+
+// StopContainer sends the stop signal of the container's image, SIGTERM by default, and escalates to SIGKILL once req.Timeout seconds passed, a timeout of 0 kills right away
+// Kubelet passes the pod's termination grace period as timeout, so the SIGKILL is sent exactly at the deadline
+// Stopping a container which is not running is not an error, as required by the CRI
+func (s *DemystifyingCRI) StopContainer(ctx context.Context, req *runtime.StopContainerRequest) (*runtime.StopContainerResponse, error) {
+	// The grace period starts with the request, not after the lookup
+	deadline := time.Now().Add(time.Duration(req.Timeout) * time.Second)
+
+	s.mu.RLock()
+	container, exists := s.containers[req.ContainerId]
+	running := exists && container.State == runtime.ContainerState_CONTAINER_RUNNING
+	paused := running && container.paused
+	var stopSignal syscall.Signal
+	if exists {
+		stopSignal = container.stopSignal
+	}
+	s.mu.RUnlock()
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "container %s does not exist", req.ContainerId)
+	}
+	if !running {
+		return &runtime.StopContainerResponse{}, nil
+	}
+
+	// A frozen process can't handle the stop signal, so it is thawed first
+	if paused {
+		if err := s.unpauseContainer(req.ContainerId); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.Timeout > 0 {
+		if err := s.oci.Kill(req.ContainerId, stopSignal); err != nil && !containerGone(err) && s.processAlive(req.ContainerId) {
+			return nil, fmt.Errorf("failed to send %s to container %s: %w", unix.SignalName(stopSignal), req.ContainerId, err)
+		}
+		if s.waitForExit(ctx, req.ContainerId, deadline) {
+			s.markExited(req.ContainerId)
+			return &runtime.StopContainerResponse{}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+
+	if err := s.oci.Kill(req.ContainerId, syscall.SIGKILL); err != nil && !containerGone(err) && s.processAlive(req.ContainerId) {
+		return nil, fmt.Errorf("failed to send SIGKILL to container %s: %w", req.ContainerId, err)
+	}
+	if !s.waitForExit(ctx, req.ContainerId, time.Now().Add(stopKillTimeout)) {
+		return nil, status.Errorf(codes.DeadlineExceeded, "container %s did not exit after SIGKILL", req.ContainerId)
+	}
+	s.markExited(req.ContainerId)
+
+	return &runtime.StopContainerResponse{}, nil
+}
+
+// waitForExit polls the container with an increasing interval until it exited, the deadline passed or ctx is done
+// The last wait is cut short to end at the deadline, so the caller can escalate right on time
+func (s *DemystifyingCRI) waitForExit(ctx context.Context, containerID string, deadline time.Time) bool {
+	interval := stopPollMin
+	for {
+		if !s.processAlive(containerID) {
+			return true
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+
+		timer := time.NewTimer(min(interval, remaining))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		interval = min(interval*2, stopPollMax)
+	}
+}
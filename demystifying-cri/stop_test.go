@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+)
+
+func TestStopContainerEscalates(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	oci.ignoreTerm = true
+	ctx := context.Background()
+
+	containerID := createTestContainer(t, s, "app")
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+
+	begin := time.Now()
+	if _, err := s.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: containerID, Timeout: 1}); err != nil {
+		t.Fatalf("StopContainer: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < time.Second {
+		t.Errorf("StopContainer returned after %v, before the timeout of 1s", elapsed)
+	}
+	if status := containerState(t, s, containerID); status.ExitCode != 137 {
+		t.Errorf("exit code after escalation = %d, want 137", status.ExitCode)
+	}
+	if !slices.Contains(oci.calls, "kill "+containerID+" 9") {
+		t.Errorf("runtime calls = %q, want a SIGKILL", oci.calls)
+	}
+}
+
+func TestStopPodSandboxStopsContainersBeforePause(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	oci.ignoreTerm = true
+	ctx := context.Background()
+
+	// Give the sandbox a pause process of the fake, so killing it shows up in the runtime calls
+	if err := oci.Run("sandbox", t.TempDir(), runtimeIO{}); err != nil {
+		t.Fatal(err)
+	}
+	state, err := oci.State("sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sandboxes["sandbox"].pid = state.Pid
+
+	var containerIDs []string
+	for _, name := range []string{"app", "sidecar"} {
+		resp, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+			PodSandboxId: "sandbox",
+			Config: &runtime.ContainerConfig{
+				Metadata:    &runtime.ContainerMetadata{Name: name},
+				Image:       &runtime.ImageSpec{Image: testImage},
+				Annotations: map[string]string{annotationGracePeriod: "1"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("CreateContainer: %v", err)
+		}
+		if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: resp.ContainerId}); err != nil {
+			t.Fatalf("StartContainer: %v", err)
+		}
+		containerIDs = append(containerIDs, resp.ContainerId)
+	}
+
+	begin := time.Now()
+	if _, err := s.StopPodSandbox(ctx, &runtime.StopPodSandboxRequest{PodSandboxId: "sandbox"}); err != nil {
+		t.Fatalf("StopPodSandbox: %v", err)
+	}
+	// The containers ignore SIGTERM, so they are stopped in parallel within a single grace period
+	if elapsed := time.Since(begin); elapsed < time.Second || elapsed > 5*time.Second {
+		t.Errorf("StopPodSandbox returned after %v, want about the grace period of 1s", elapsed)
+	}
+
+	pauseKill := slices.Index(oci.calls, "kill sandbox 9")
+	if pauseKill < 0 {
+		t.Fatalf("runtime calls = %q, want the pause process killed", oci.calls)
+	}
+	for _, id := range containerIDs {
+		if kill := slices.Index(oci.calls, "kill "+id+" 9"); kill < 0 || kill > pauseKill {
+			t.Errorf("runtime calls = %q, want container %s killed before the pause process", oci.calls, id)
+		}
+		if status := containerState(t, s, id); status.State != runtime.ContainerState_CONTAINER_EXITED {
+			t.Errorf("container %s is %v after StopPodSandbox, want exited", id, status.State)
+		}
+	}
+	if state := s.sandboxes["sandbox"].State; state != runtime.PodSandboxState_SANDBOX_NOTREADY {
+		t.Errorf("sandbox is %v after StopPodSandbox, want not ready", state)
+	}
+
+	// Stopping it again is not an error
+	if _, err := s.StopPodSandbox(ctx, &runtime.StopPodSandboxRequest{PodSandboxId: "sandbox"}); err != nil {
+		t.Errorf("second StopPodSandbox: %v", err)
+	}
+}
+
+func TestStopContainerSendsStopSignalOfImage(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	ctx := context.Background()
+
+	const image = "docker.io/library/quit:1"
+	var config ociImageConfig
+	config.Config.Cmd = []string{"sleep", "1000"}
+	config.Config.StopSignal = "SIGQUIT"
+	writeTestImageConfig(t, s.imageRoot, image, config)
+	record, err := s.readImageRecord(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.images.add(record)
+
+	resp, err := s.CreateContainer(ctx, &runtime.CreateContainerRequest{
+		PodSandboxId: "sandbox",
+		Config: &runtime.ContainerConfig{
+			Metadata: &runtime.ContainerMetadata{Name: "app"},
+			Image:    &runtime.ImageSpec{Image: image},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	containerID := resp.ContainerId
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+	if _, err := s.StopContainer(ctx, &runtime.StopContainerRequest{ContainerId: containerID, Timeout: 10}); err != nil {
+		t.Fatalf("StopContainer: %v", err)
+	}
+
+	if !slices.Contains(oci.calls, "kill "+containerID+" 3") || slices.Contains(oci.calls, "kill "+containerID+" 15") {
+		t.Errorf("runtime calls = %q, want SIGQUIT instead of SIGTERM", oci.calls)
+	}
+	if status := containerState(t, s, containerID); status.ExitCode != 128+3 {
+		t.Errorf("exit code after SIGQUIT = %d, want %d", status.ExitCode, 128+3)
+	}
+}
+
+func TestParseStopSignal(t *testing.T) {
+	tests := []struct {
+		stopSignal string
+		want       syscall.Signal
+		valid      bool
+	}{
+		{"", syscall.SIGTERM, true},
+		{"SIGQUIT", syscall.SIGQUIT, true},
+		{"QUIT", syscall.SIGQUIT, true},
+		{"sigint", syscall.SIGINT, true},
+		{"3", syscall.SIGQUIT, true},
+		{"0", 0, false},
+		{"65", 0, false},
+		{"SIGFOO", 0, false},
+	}
+	for _, test := range tests {
+		got, err := parseStopSignal(test.stopSignal)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("parseStopSignal(%q) = %v, %v, want %v, valid %v", test.stopSignal, got, err, test.want, test.valid)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSignal is the highest signal number on Linux, SIGRTMAX
+const maxSignal = 64
+
+// parseStopSignal returns the signal of the StopSignal of an image config, SIGTERM if it is empty
+// Images name the signal like docker stop does, e.g. SIGQUIT, QUIT or 3
+func parseStopSignal(stopSignal string) (syscall.Signal, error) {
+	if stopSignal == "" {
+		return syscall.SIGTERM, nil
+	}
+	if number, err := strconv.Atoi(stopSignal); err == nil {
+		if number <= 0 || number > maxSignal {
+			return 0, fmt.Errorf("invalid stop signal %q", stopSignal)
+		}
+		return syscall.Signal(number), nil
+	}
+	name := strings.ToUpper(stopSignal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	signal := unix.SignalNum(name)
+	if signal == 0 {
+		return 0, fmt.Errorf("unknown stop signal %q", stopSignal)
+	}
+	return signal, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// tcpCredentials returns mutual TLS credentials for the TCP listener
+// Only clients presenting a certificate signed by the CA at clientCAPath are accepted, as the CRI grants root on the node
+func tcpCredentials(certPath, keyPath, clientCAPath string) (credentials.TransportCredentials, error) {
+	if certPath == "" || keyPath == "" || clientCAPath == "" {
+		return nil, fmt.Errorf("--tls-cert, --tls-key and --tls-client-ca are required with --tcp-addr")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %v", err)
+	}
+
+	caPEM, err := os.ReadFile(clientCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in client CA %s", clientCAPath)
+	}
+
+	return credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}), nil
+}
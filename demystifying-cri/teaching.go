@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Annotations of pods and containers to experiment with the behavior of the runtime and of Kubelet reacting to it
+const (
+	annotationDelayStart = "demystifying-cri/delay-start" // Waits e.g. 2s before starting the pause process or the container
+	annotationFailCreate = "demystifying-cri/fail-create" // Fails RunPodSandbox or CreateContainer if true
+	annotationLogSpec    = "demystifying-cri/log-spec"    // Logs the generated OCI spec if true
+)
+
+// teachingBehavior is what the teaching annotations of a pod or container ask for
+type teachingBehavior struct {
+	delayStart time.Duration
+	failCreate bool
+	logSpec    bool
+}
+
+// parseTeachingAnnotations reads the teaching annotations, rejecting invalid values so a typo isn't mistaken for the runtime ignoring them
+func parseTeachingAnnotations(annotations map[string]string) (teachingBehavior, error) {
+	var behavior teachingBehavior
+	if value, ok := annotations[annotationDelayStart]; ok {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			return behavior, status.Errorf(codes.InvalidArgument, "invalid %s annotation %q: must be a non-negative duration like 2s", annotationDelayStart, value)
+		}
+		behavior.delayStart = delay
+	}
+	for annotation, flag := range map[string]*bool{annotationFailCreate: &behavior.failCreate, annotationLogSpec: &behavior.logSpec} {
+		value, ok := annotations[annotation]
+		if !ok {
+			continue
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return behavior, status.Errorf(codes.InvalidArgument, "invalid %s annotation %q: must be true or false", annotation, value)
+		}
+		*flag = enabled
+	}
+	return behavior, nil
+}
+
+// simulatedCreateFailure returns the error of a sandbox or container whose fail-create annotation is set
+func (behavior teachingBehavior) simulatedCreateFailure(subject string) error {
+	if !behavior.failCreate {
+		return nil
+	}
+	return status.Errorf(codes.Internal, "failed to create %s: simulated failure requested by the %s annotation", subject, annotationFailCreate)
+}
+
+// logGeneratedSpec logs the OCI spec of a sandbox or container whose log-spec annotation is set
+func (behavior teachingBehavior) logGeneratedSpec(subject string, spec *rspec.Spec) {
+	if !behavior.logSpec {
+		return
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		log.Printf("failed to encode OCI spec of %s: %v", subject, err)
+		return
+	}
+	log.Printf("OCI spec of %s:\n%s", subject, data)
+}
+
+// waitStartDelay waits for the delay-start annotation before a sandbox or container is started
+// The wait is reported as its own phase of the RPC's latency
+func waitStartDelay(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	defer timePhase(ctx, "delay")()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
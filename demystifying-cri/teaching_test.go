@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// createAnnotatedContainer creates a container named app with the given annotations in the sandbox of newTestRuntime
+func createAnnotatedContainer(s *DemystifyingCRI, annotations map[string]string) (string, error) {
+	resp, err := s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+		PodSandboxId: "sandbox",
+		Config: &runtime.ContainerConfig{
+			Metadata:    &runtime.ContainerMetadata{Name: "app"},
+			Image:       &runtime.ImageSpec{Image: testImage},
+			Annotations: annotations,
+		},
+	})
+	return resp.GetContainerId(), err
+}
+
+func TestParseTeachingAnnotations(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		want        teachingBehavior
+		valid       bool
+	}{
+		{nil, teachingBehavior{}, true},
+		{map[string]string{annotationDelayStart: "2s"}, teachingBehavior{delayStart: 2 * time.Second}, true},
+		{map[string]string{annotationFailCreate: "true", annotationLogSpec: "1"}, teachingBehavior{failCreate: true, logSpec: true}, true},
+		{map[string]string{annotationFailCreate: "false"}, teachingBehavior{}, true},
+		{map[string]string{annotationDelayStart: "2"}, teachingBehavior{}, false},
+		{map[string]string{annotationDelayStart: "-1s"}, teachingBehavior{}, false},
+		{map[string]string{annotationLogSpec: "yes"}, teachingBehavior{}, false},
+	}
+	for _, test := range tests {
+		got, err := parseTeachingAnnotations(test.annotations)
+		if test.valid && (err != nil || got != test.want) {
+			t.Errorf("parseTeachingAnnotations(%v) = %+v, %v, want %+v", test.annotations, got, err, test.want)
+		}
+		if !test.valid && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("parseTeachingAnnotations(%v) = %v, want InvalidArgument", test.annotations, err)
+		}
+	}
+}
+
+func TestFailCreateAnnotation(t *testing.T) {
+	s, oci := newTestRuntime(t)
+	_, err := createAnnotatedContainer(s, map[string]string{annotationFailCreate: "true"})
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "simulated failure") {
+		t.Errorf("CreateContainer with %s = %v, want a simulated Internal error", annotationFailCreate, err)
+	}
+	if len(oci.calls) != 0 || len(s.containers) != 0 {
+		t.Errorf("runtime calls = %q and containers = %v after a simulated failure, want none", oci.calls, s.containers)
+	}
+}
+
+func TestDelayStartAnnotation(t *testing.T) {
+	s, _ := newTestRuntime(t)
+	containerID, err := createAnnotatedContainer(s, map[string]string{annotationDelayStart: "200ms"})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+
+	begin := time.Now()
+	if _, err := s.StartContainer(context.Background(), &runtime.StartContainerRequest{ContainerId: containerID}); err != nil {
+		t.Fatalf("StartContainer: %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 200*time.Millisecond {
+		t.Errorf("StartContainer returned after %v, before the delay of 200ms", elapsed)
+	}
+
+	// A cancelled start doesn't wait for the delay
+	s, _ = newTestRuntime(t)
+	if containerID, err = createAnnotatedContainer(s, map[string]string{annotationDelayStart: "1h"}); err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.StartContainer(ctx, &runtime.StartContainerRequest{ContainerId: containerID}); err == nil {
+		t.Errorf("StartContainer with a delay of 1h succeeded before its deadline")
+	}
+}
+
+func TestLogSpecAnnotation(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	s, _ := newTestRuntime(t)
+	containerID, err := createAnnotatedContainer(s, map[string]string{annotationLogSpec: "true"})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	if logged := output.String(); !strings.Contains(logged, "OCI spec of container "+containerID) || !strings.Contains(logged, `"ociVersion"`) {
+		t.Errorf("log = %q, want the OCI spec of container %s", logged, containerID)
+	}
+
+	output.Reset()
+	s, _ = newTestRuntime(t)
+	if _, err := createAnnotatedContainer(s, nil); err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	if strings.Contains(output.String(), "OCI spec of") {
+		t.Errorf("log = %q, want no spec without the annotation", output.String())
+	}
+}
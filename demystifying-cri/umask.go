@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/opencontainers/runtime-tools/generate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// annotationUmask sets the umask of a container's process as octal number, e.g. 0027
+const annotationUmask = "demystifying-cri/umask"
+
+// applyUmask sets the umask requested by annotationUmask, without it runc keeps its default of 0022
+func applyUmask(g *generate.Generator, annotations map[string]string) error {
+	value, ok := annotations[annotationUmask]
+	if !ok {
+		return nil
+	}
+	umask, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || umask > 0777 {
+		return status.Errorf(codes.InvalidArgument, "invalid %s annotation %q: must be an octal value between 0 and 0777", annotationUmask, value)
+	}
+	mask := uint32(umask)
+	g.Config.Process.User.Umask = &mask
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	runtime "demystifying-cri/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateContainerSetsUmask(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		want        string // Umask in the spec, unset if it is left to runc
+		code        codes.Code
+	}{
+		{nil, "unset", codes.OK},
+		{map[string]string{annotationUmask: "0027"}, "0027", codes.OK},
+		{map[string]string{annotationUmask: "077"}, "0077", codes.OK},
+		{map[string]string{annotationUmask: "0"}, "0000", codes.OK},
+		{map[string]string{annotationUmask: "0089"}, "", codes.InvalidArgument},
+		{map[string]string{annotationUmask: "01777"}, "", codes.InvalidArgument},
+		{map[string]string{annotationUmask: ""}, "", codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		s, _ := newTestRuntime(t)
+		resp, err := s.CreateContainer(context.Background(), &runtime.CreateContainerRequest{
+			PodSandboxId: "sandbox",
+			Config: &runtime.ContainerConfig{
+				Metadata:    &runtime.ContainerMetadata{Name: "app"},
+				Image:       &runtime.ImageSpec{Image: testImage},
+				Annotations: test.annotations,
+			},
+		})
+		if status.Code(err) != test.code {
+			t.Errorf("CreateContainer with annotations %v = %v, want code %v", test.annotations, err, test.code)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		got := "unset"
+		if umask := containerSpec(t, s, resp.ContainerId).Process.User.Umask; umask != nil {
+			got = fmt.Sprintf("%04o", *umask)
+		}
+		if got != test.want {
+			t.Errorf("umask with annotations %v = %s, want %s", test.annotations, got, test.want)
+		}
+	}
+}
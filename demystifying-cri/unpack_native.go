@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runtime-tools/generate"
+)
+
+// maxSymlinkHops bounds symlink resolution inside the rootfs to detect loops
+const maxSymlinkHops = 255
+
+// unpackImageNative extracts an image from the OCI layout at imagePath (layout:tag) into a bundle in-process
+// It produces the same bundle layout as umoci: a rootfs directory and a config.json derived from the image config
+func unpackImageNative(imagePath, bundlePath string) error {
+	layoutPath, tag := splitLayoutReference(imagePath)
+	manifest, err := readLayoutManifest(layoutPath, tag)
+	if err != nil {
+		return err
+	}
+	config, err := readLayoutConfig(layoutPath, manifest)
+	if err != nil {
+		return err
+	}
+
+	rootfs := filepath.Join(bundlePath, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+
+	// Layers are ordered from the base to the top, so later layers override earlier ones
+	for _, layer := range manifest.Layers {
+		if err := extractLayer(layoutBlobPath(layoutPath, layer.Digest), layer.MediaType, rootfs); err != nil {
+			return fmt.Errorf("failed to extract layer %s: %v", layer.Digest, err)
+		}
+	}
+
+	g, err := generate.New("linux")
+	if err != nil {
+		return err
+	}
+	g.SetRootPath("rootfs")
+	g.SetProcessArgs(append(config.Config.Entrypoint, config.Config.Cmd...))
+	g.ClearProcessEnv()
+	for _, env := range config.Config.Env {
+		name, value, _ := strings.Cut(env, "=")
+		g.AddProcessEnv(name, value)
+	}
+	if config.Config.WorkingDir != "" {
+		g.SetProcessCwd(config.Config.WorkingDir)
+	}
+	uid, gid, err := resolveUser(rootfs, config.Config.User)
+	if err != nil {
+		return err
+	}
+	g.SetProcessUID(uid)
+	g.SetProcessGID(gid)
+
+	return g.SaveToFile(filepath.Join(bundlePath, "config.json"), generate.ExportOptions{})
+}
+
+// extractLayer applies a (possibly gzip compressed) tar layer onto rootfs, honoring whiteout files
+// zstd compressed layers are rejected, as there is no zstd decoder in the standard library
+func extractLayer(blobPath, mediaType, rootfs string) error {
+	if strings.HasSuffix(mediaType, "zstd") {
+		return fmt.Errorf("unsupported layer media type %q: the native unpack backend can't decompress zstd layers", mediaType)
+	}
+
+	blob, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	var r io.Reader = bufio.NewReader(blob)
+	if strings.HasSuffix(mediaType, "gzip") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	// Paths this layer extracted, including their parents, which an opaque whiteout must keep
+	written := make(map[string]bool)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dir, base := filepath.Split(filepath.Clean("/" + hdr.Name))
+		parent, err := secureJoin(rootfs, dir)
+		if err != nil {
+			return err
+		}
+
+		// Opaque whiteouts hide everything lower layers put into the directory
+		// The entries of this layer may come before the whiteout in the tar, so they are kept
+		if base == ".wh..wh..opq" {
+			if err := clearOpaqueDir(parent, written); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Regular whiteouts delete a single file or directory of lower layers
+		if strings.HasPrefix(base, ".wh.") {
+			if err := os.RemoveAll(filepath.Join(parent, strings.TrimPrefix(base, ".wh."))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		path := filepath.Join(parent, base)
+		if err := extractEntry(tr, hdr, rootfs, path); err != nil {
+			return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+		}
+		for ; path != rootfs && !written[path]; path = filepath.Dir(path) {
+			written[path] = true
+		}
+	}
+}
+
+// clearOpaqueDir removes everything in dir which lower layers extracted, keeping the paths the current layer wrote
+func clearOpaqueDir(dir string, written map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !written[path] {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.IsDir() {
+			if err := clearOpaqueDir(path, written); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// extractEntry creates a single tar entry at path
+func extractEntry(tr *tar.Reader, hdr *tar.Header, rootfs, path string) error {
+	mode := os.FileMode(hdr.Mode).Perm()
+
+	// Replace whatever lower layers had at this path, except directories which are merged
+	if info, err := os.Lstat(path); err == nil && !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, mode); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+		if os.Geteuid() == 0 {
+			return os.Lchown(path, hdr.Uid, hdr.Gid)
+		}
+		return nil
+	case tar.TypeLink:
+		target, err := secureJoin(rootfs, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(target, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		// Only root may create device nodes, unprivileged unpacks skip them like umoci --rootless
+		if hdr.Typeflag != tar.TypeFifo && os.Geteuid() != 0 {
+			return nil
+		}
+		devType := map[byte]uint32{tar.TypeChar: syscall.S_IFCHR, tar.TypeBlock: syscall.S_IFBLK, tar.TypeFifo: syscall.S_IFIFO}[hdr.Typeflag]
+		major, minor := uint64(hdr.Devmajor), uint64(hdr.Devminor)
+		dev := (minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32)
+		if err := syscall.Mknod(path, devType|uint32(mode), int(dev)); err != nil {
+			return err
+		}
+	default:
+		// Other entry types like extended headers carry no file
+		return nil
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	// Apply the mode again as it was masked by the umask on creation
+	if err := os.Chmod(path, os.FileMode(hdr.Mode)&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)|modeType(path)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, hdr.AccessTime, hdr.ModTime)
+}
+
+// modeType keeps the type bits of an existing file when changing its permissions
+func modeType(path string) os.FileMode {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Mode().Type()
+}
+
+// secureJoin resolves path inside root as if root was the filesystem root
+// Symlinks are followed relative to root, so a layer can't write outside of the rootfs
+func secureJoin(root, path string) (string, error) {
+	resolved := ""
+	remaining := filepath.Clean("/" + path)
+	hops := 0
+
+	for remaining != "/" && remaining != "" {
+		component, rest, _ := strings.Cut(strings.TrimPrefix(remaining, "/"), "/")
+		remaining = "/" + rest
+		if rest == "" {
+			remaining = ""
+		}
+
+		next := filepath.Join(resolved, component)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many symlinks resolving %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join("/", resolved, target)
+		}
+		remaining = filepath.Clean(target + "/" + remaining)
+		resolved = ""
+	}
+
+	return filepath.Join(root, resolved), nil
+}
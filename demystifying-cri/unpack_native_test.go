@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeLayer writes an uncompressed tar layer with the given entries, names ending in / are directories
+func writeLayer(t *testing.T, names ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "layer.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}
+		if name[len(name)-1] == '/' {
+			hdr.Mode, hdr.Typeflag = 0755, tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// listRootfs returns the paths of all files and directories below rootfs
+func listRootfs(t *testing.T, rootfs string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == rootfs {
+			return err
+		}
+		relative, _ := filepath.Rel(rootfs, path)
+		if info.IsDir() {
+			relative += "/"
+		}
+		paths = append(paths, relative)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+func TestExtractLayerWhiteouts(t *testing.T) {
+	lower := []string{"dir/", "dir/old", "dir/sub/", "dir/sub/old", "keep", "remove"}
+	tests := []struct {
+		name  string
+		upper []string
+		want  []string
+	}{
+		{
+			name:  "opaque before entries",
+			upper: []string{"dir/", "dir/.wh..wh..opq", "dir/a"},
+			want:  []string{"dir/", "dir/a", "keep", "remove"},
+		},
+		{
+			name:  "opaque after entries",
+			upper: []string{"dir/", "dir/a", "dir/.wh..wh..opq"},
+			want:  []string{"dir/", "dir/a", "keep", "remove"},
+		},
+		{
+			name:  "opaque after nested entry",
+			upper: []string{"dir/sub/new", "dir/.wh..wh..opq"},
+			want:  []string{"dir/", "dir/sub/", "dir/sub/new", "keep", "remove"},
+		},
+		{
+			name:  "opaque keeps replaced file",
+			upper: []string{"dir/old", "dir/.wh..wh..opq"},
+			want:  []string{"dir/", "dir/old", "keep", "remove"},
+		},
+		{
+			name:  "whiteout",
+			upper: []string{".wh.remove", "dir/.wh.sub"},
+			want:  []string{"dir/", "dir/old", "keep"},
+		},
+	}
+	for _, test := range tests {
+		rootfs := t.TempDir()
+		if err := extractLayer(writeLayer(t, lower...), "application/vnd.oci.image.layer.v1.tar", rootfs); err != nil {
+			t.Fatalf("%s: failed to extract lower layer: %v", test.name, err)
+		}
+		if err := extractLayer(writeLayer(t, test.upper...), "application/vnd.oci.image.layer.v1.tar", rootfs); err != nil {
+			t.Fatalf("%s: failed to extract upper layer: %v", test.name, err)
+		}
+		if got := listRootfs(t, rootfs); !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestExtractLayerRejectsZstd(t *testing.T) {
+	rootfs := t.TempDir()
+	err := extractLayer(writeLayer(t, "file"), "application/vnd.oci.image.layer.v1.tar+zstd", rootfs)
+	if err == nil || !strings.Contains(err.Error(), "zstd") {
+		t.Fatalf("extractLayer of a zstd layer = %v, want an error naming zstd", err)
+	}
+	if got := listRootfs(t, rootfs); len(got) != 0 {
+		t.Errorf("extractLayer of a zstd layer extracted %v", got)
+	}
+}
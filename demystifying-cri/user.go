@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// resolveUser turns a user like name, uid, name:group or uid:gid into a UID and GID, looking up names in the rootfs
+func resolveUser(rootfs, user string) (uint32, uint32, error) {
+	if user == "" {
+		return 0, 0, nil
+	}
+
+	name, group, hasGroup := strings.Cut(user, ":")
+	uid, gid, err := lookupID(rootfs, "/etc/passwd", name)
+	if err != nil {
+		return 0, 0, err
+	}
+	if hasGroup {
+		if gid, _, err = lookupID(rootfs, "/etc/group", group); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// lookupID resolves a numeric or named entry of a passwd or group file in the rootfs
+// The second return value is the primary GID, which only passwd entries have
+// Numeric IDs don't need an entry, in that case the primary GID is 0 like in other runtimes
+func lookupID(rootfs, file, name string) (uint32, uint32, error) {
+	id, err := strconv.ParseUint(name, 10, 32)
+	numeric := err == nil
+
+	entries, err := readIDFile(rootfs, file)
+	if err != nil && !numeric {
+		return 0, 0, fmt.Errorf("failed to look up %s: %v", name, err)
+	}
+
+	for _, fields := range entries {
+		if (numeric && fields[2] != name) || (!numeric && fields[0] != name) {
+			continue
+		}
+		entryID, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		gid, _ := strconv.ParseUint(fields[3], 10, 32)
+		return uint32(entryID), uint32(gid), nil
+	}
+
+	if numeric {
+		return uint32(id), 0, nil
+	}
+	return 0, 0, fmt.Errorf("%s not found in %s", name, file)
+}
+
+// readIDFile returns the colon separated fields of all entries in a passwd or group file of the rootfs
+func readIDFile(rootfs, file string) ([][]string, error) {
+	path, err := secureJoin(rootfs, file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries [][]string
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Split(line, ":"); len(fields) >= 4 {
+			entries = append(entries, fields)
+		}
+	}
+	return entries, nil
+}
+
+// memberGroups returns the GIDs of all groups in the rootfs listing the user with the given UID as member
+// Missing passwd or group files mean the image defines no memberships
+func memberGroups(rootfs string, uid uint32) ([]uint32, error) {
+	users, err := readIDFile(rootfs, "/etc/passwd")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var name string
+	for _, fields := range users {
+		if fields[2] == strconv.FormatUint(uint64(uid), 10) {
+			name = fields[0]
+			break
+		}
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	groups, err := readIDFile(rootfs, "/etc/group")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var gids []uint32
+	for _, fields := range groups {
+		for _, member := range strings.Split(fields[3], ",") {
+			if member != name {
+				continue
+			}
+			if gid, err := strconv.ParseUint(fields[2], 10, 32); err == nil {
+				gids = append(gids, uint32(gid))
+			}
+			break
+		}
+	}
+	return gids, nil
+}
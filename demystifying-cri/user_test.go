@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeIDFiles writes /etc/passwd and /etc/group into a new rootfs
+func writeIDFiles(t *testing.T, passwd, group string) string {
+	t.Helper()
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return rootfs
+}
+
+func TestResolveUser(t *testing.T) {
+	rootfs := writeIDFiles(t,
+		"root:x:0:0:root:/root:/bin/sh\nnginx:x:101:102:nginx:/var/cache/nginx:/sbin/nologin\n",
+		"root:x:0:\nnginx:x:102:\nwww:x:33:nginx\n")
+	tests := []struct {
+		user     string
+		uid, gid uint32
+		valid    bool
+	}{
+		{"", 0, 0, true},
+		{"nginx", 101, 102, true},
+		{"101", 101, 102, true},
+		{"1000", 1000, 0, true},
+		{"nginx:www", 101, 33, true},
+		{"nginx:33", 101, 33, true},
+		{"1000:2000", 1000, 2000, true},
+		{"root", 0, 0, true},
+		{"unknown", 0, 0, false},
+		{"nginx:unknown", 0, 0, false},
+	}
+	for _, test := range tests {
+		uid, gid, err := resolveUser(rootfs, test.user)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("resolveUser(%q) = %d, %d, want an error", test.user, uid, gid)
+			}
+			continue
+		}
+		if err != nil || uid != test.uid || gid != test.gid {
+			t.Errorf("resolveUser(%q) = %d, %d, %v, want %d, %d", test.user, uid, gid, err, test.uid, test.gid)
+		}
+	}
+}
+
+func TestResolveUserWithoutPasswd(t *testing.T) {
+	rootfs := t.TempDir()
+	if uid, gid, err := resolveUser(rootfs, "1000:1000"); err != nil || uid != 1000 || gid != 1000 {
+		t.Errorf("resolveUser(1000:1000) = %d, %d, %v, want 1000, 1000", uid, gid, err)
+	}
+	if _, _, err := resolveUser(rootfs, "nginx"); err == nil {
+		t.Errorf("resolveUser(nginx) without /etc/passwd succeeded, want an error")
+	}
+}